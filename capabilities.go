@@ -0,0 +1,79 @@
+package hugot
+
+import (
+	"runtime/debug"
+)
+
+const modulePath = "github.com/knights-analytics/hugot"
+
+// BuildCapabilities describes the build of hugot an application runs against, so that it can adapt to it.
+type BuildCapabilities struct {
+	// Version is the version of the hugot module, e.g. v0.1.2, or (devel) when hugot is the main module.
+	Version string
+	// GoVersion is the version of go the application was built with.
+	GoVersion string
+	// Pipelines are the pipeline types that can be created with NewPipeline, named as in the cli.
+	Pipelines []string
+	// ExecutionProviders are the onnxruntime execution providers that can be selected with the session options. An
+	// execution provider is only usable if the onnxruntime library was built with it.
+	ExecutionProviders []string
+	// Features reports the optional features of the build.
+	Features map[string]bool
+}
+
+// Capabilities reports the version, pipeline types, execution providers and optional features of the hugot build.
+func Capabilities() BuildCapabilities {
+	capabilities := BuildCapabilities{
+		Version: "unknown",
+		Pipelines: []string{
+			"featureExtraction",
+			"textClassification",
+			"tokenClassification",
+			"promptInjection",
+			"intentSlotFilling",
+			"textGeneration",
+			"translation",
+			"text2textGeneration",
+			"reranking",
+			"gliner",
+			"setFit",
+			"zeroShotImageClassification",
+			"imageToText",
+			"imageSegmentation",
+			"maskGeneration",
+			"automaticSpeechRecognition",
+			"audioClassification",
+			"documentQuestionAnswering",
+		},
+		ExecutionProviders: []string{"cpu", "cuda", "coreml", "directml", "openvino", "tensorrt"},
+		Features: map[string]bool{
+			// models can be downloaded from the huggingface hub, unless built with the NODOWNLOAD tag
+			"modelDownload": downloadEnabled,
+			// sessions with an execution provider can fall back to CPU, see WithFallbackToCPU
+			"cpuFallback": true,
+			// outputs report the inputs truncated to the maximum length of the model
+			"truncationReporting": true,
+			// token classification can split long inputs into overlapping windows, see pipelines.WithStride
+			"tokenClassificationStride": true,
+			// feature extraction can embed long inputs in overlapping chunks, see pipelines.WithChunking
+			"featureExtractionChunking": true,
+			// token classification can decode nested entities, see pipelines.WithOverlappingEntities
+			"overlappingEntities": true,
+		},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		capabilities.GoVersion = info.GoVersion
+		if info.Main.Path == modulePath {
+			capabilities.Version = info.Main.Version
+		}
+		for _, dependency := range info.Deps {
+			if dependency.Path == modulePath {
+				capabilities.Version = dependency.Version
+				if dependency.Replace != nil && dependency.Replace.Version != "" {
+					capabilities.Version = dependency.Replace.Version
+				}
+			}
+		}
+	}
+	return capabilities
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+var modelAPath string
+var modelBPath string
+var minCosine float64
+
+var diffCommand = &cli.Command{
+	Name:  "diff",
+	Usage: "Compare the outputs of two models on the same inputs",
+	Description: `Diff runs two models of the same pipeline type on a .jsonl input file and reports the inputs on which they disagree, to support model upgrade decisions.
+				Each disagreement is written to stdout as a json line, followed by a summary line. Disagreements are label flips for textClassification, entities found by only one of the models for tokenClassification, and embeddings with a cosine similarity below --minCosine for featureExtraction.
+				`,
+	ArgsUsage: `
+				--modelA, --modelB: model names or paths to the models to compare, resolved as in hugot run.
+				--input: path to a .jsonl file with lines of the format {"input": "input string"}.
+				--type: pipeline type, one of featureExtraction, tokenClassification and textClassification.
+				--minCosine: embeddings with a lower cosine similarity are reported as disagreements (featureExtraction only).
+				`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "modelA",
+			Usage:       "Path to the first model",
+			Destination: &modelAPath,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "modelB",
+			Usage:       "Path to the second model",
+			Destination: &modelBPath,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "input",
+			Usage:       "Path to the input data",
+			Aliases:     []string{"i"},
+			Destination: &inputPath,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "type",
+			Usage:       "Pipeline type",
+			Aliases:     []string{"t"},
+			Destination: &pipelineType,
+			Required:    true,
+		},
+		&cli.Float64Flag{
+			Name:        "minCosine",
+			Usage:       "Minimum cosine similarity of embeddings considered in agreement",
+			Destination: &minCosine,
+			Value:       0.99,
+		},
+		&cli.IntFlag{
+			Name:        "batchSize",
+			Usage:       "Number of inputs to process in a batch",
+			Aliases:     []string{"b"},
+			Destination: &batchSize,
+			Value:       20,
+		},
+		&cli.StringFlag{
+			Name:        "onnxruntimeSharedLibrary",
+			Usage:       "Path to onnxruntime.so",
+			Aliases:     []string{"s"},
+			Destination: &sharedLibraryPath,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "modelFolder",
+			Usage:       "Folder where to store downloaded models. Falls back to $HOME/hugot/models if not specified",
+			Aliases:     []string{"f"},
+			Destination: &modelsDir,
+			Required:    false,
+			Value:       "",
+		},
+	},
+	Action: func(ctx *cli.Context) (err error) {
+		inputs, err := readDiffInputs(inputPath)
+		if err != nil {
+			return err
+		}
+
+		session, err := newSession(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, session.Destroy())
+		}()
+
+		var pipes [2]pipelines.Pipeline
+		for i, model := range []string{modelAPath, modelBPath} {
+			path, resolveErr := resolveModelPath(ctx, session, model)
+			if resolveErr != nil {
+				return resolveErr
+			}
+			name := fmt.Sprintf("cliPipeline%c", 'A'+i)
+			switch pipelineType {
+			case "textClassification":
+				pipes[i], err = hugot.NewPipeline(session, hugot.TextClassificationConfig{ModelPath: path, Name: name})
+			case "tokenClassification":
+				pipes[i], err = hugot.NewPipeline(session, hugot.TokenClassificationConfig{ModelPath: path, Name: name})
+			case "featureExtraction":
+				pipes[i], err = hugot.NewPipeline(session, hugot.FeatureExtractionConfig{ModelPath: path, Name: name})
+			default:
+				return fmt.Errorf("pipeline type %s is not supported by diff", pipelineType)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		summary := diffSummary{}
+		for start := 0; start < len(inputs); start += batchSize {
+			end := start + batchSize
+			if end > len(inputs) {
+				end = len(inputs)
+			}
+			batch := inputs[start:end]
+			var outputs [2]pipelines.PipelineBatchOutput
+			for i, pipe := range pipes {
+				if outputs[i], err = pipe.Run(batch); err != nil {
+					return err
+				}
+			}
+			disagreements, diffErr := diffOutputs(batch, outputs[0], outputs[1])
+			if diffErr != nil {
+				return diffErr
+			}
+			for _, disagreement := range disagreements {
+				if err = encoder.Encode(disagreement); err != nil {
+					return err
+				}
+			}
+			summary.Inputs += len(batch)
+			summary.Disagreements += len(disagreements)
+		}
+		return encoder.Encode(summary)
+	},
+}
+
+// diffResult is an input on which the two models disagree.
+type diffResult struct {
+	Input string `json:"input"`
+	// textClassification
+	LabelA     string  `json:"labelA,omitempty"`
+	LabelB     string  `json:"labelB,omitempty"`
+	ScoreDelta float32 `json:"scoreDelta,omitempty"`
+	// tokenClassification
+	OnlyA []pipelines.Entity `json:"onlyA,omitempty"`
+	OnlyB []pipelines.Entity `json:"onlyB,omitempty"`
+	// featureExtraction
+	Cosine *float32 `json:"cosine,omitempty"`
+}
+
+type diffSummary struct {
+	Inputs        int `json:"inputs"`
+	Disagreements int `json:"disagreements"`
+}
+
+// diffOutputs compares the outputs of the two models on a batch.
+func diffOutputs(inputs []string, outputA pipelines.PipelineBatchOutput, outputB pipelines.PipelineBatchOutput) ([]diffResult, error) {
+	var disagreements []diffResult
+	switch a := outputA.(type) {
+	case *pipelines.TextClassificationOutput:
+		b := outputB.(*pipelines.TextClassificationOutput)
+		for i, input := range inputs {
+			if len(a.ClassificationOutputs[i]) == 0 || len(b.ClassificationOutputs[i]) == 0 {
+				continue
+			}
+			topA, topB := a.ClassificationOutputs[i][0], b.ClassificationOutputs[i][0]
+			if topA.Label != topB.Label {
+				disagreements = append(disagreements, diffResult{Input: input, LabelA: topA.Label, LabelB: topB.Label, ScoreDelta: topB.Score - topA.Score})
+			}
+		}
+	case *pipelines.TokenClassificationOutput:
+		b := outputB.(*pipelines.TokenClassificationOutput)
+		for i, input := range inputs {
+			onlyA, onlyB := diffEntities(a.Entities[i], b.Entities[i]), diffEntities(b.Entities[i], a.Entities[i])
+			if len(onlyA) > 0 || len(onlyB) > 0 {
+				disagreements = append(disagreements, diffResult{Input: input, OnlyA: onlyA, OnlyB: onlyB})
+			}
+		}
+	case *pipelines.FeatureExtractionOutput:
+		b := outputB.(*pipelines.FeatureExtractionOutput)
+		for i, input := range inputs {
+			if len(a.Embeddings[i]) != len(b.Embeddings[i]) {
+				return nil, fmt.Errorf("the models produce embeddings of different dimensions (%d and %d), they cannot be compared", len(a.Embeddings[i]), len(b.Embeddings[i]))
+			}
+			cosine := util.CosineSimilarity(a.Embeddings[i], b.Embeddings[i])
+			if float64(cosine) < minCosine || math.IsNaN(float64(cosine)) {
+				disagreements = append(disagreements, diffResult{Input: input, Cosine: &cosine})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("outputs of type %T cannot be compared", outputA)
+	}
+	return disagreements, nil
+}
+
+// diffEntities returns the entities of a that are not in b, with the same label and span.
+func diffEntities(a []pipelines.Entity, b []pipelines.Entity) []pipelines.Entity {
+	var missing []pipelines.Entity
+	for _, entityA := range a {
+		found := false
+		for _, entityB := range b {
+			if entityA.Entity == entityB.Entity && entityA.Start == entityB.Start && entityA.End == entityB.End {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, entityA)
+		}
+	}
+	return missing
+}
+
+// readDiffInputs reads the input strings of a .jsonl file.
+func readDiffInputs(path string) ([]string, error) {
+	data, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	source, err := hugot.NewJSONLSource(bytes.NewReader(data), 1000)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []string
+	for {
+		batch, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			return inputs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, batch.Inputs()...)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -17,6 +16,7 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/parquet"
 	"github.com/knights-analytics/hugot/pipelines"
 	util "github.com/knights-analytics/hugot/utils"
 )
@@ -28,18 +28,36 @@ var pipelineType string
 var sharedLibraryPath string
 var batchSize int
 var modelsDir string
+var sourceLanguage string
+var targetLanguage string
+var outputFormat string
+var statsPath string
+var suppressedLabels cli.StringSlice
+var intraOpThreads int
+var interOpThreads int
+var chunkSize int
+var chunkOverlap int
+var chunkMerge string
 
 var runCommand = &cli.Command{
 	Name:  "run",
 	Usage: "Run a huggingface pipeline on input data",
 	Description: `Run expects a path to a file with input in .jsonl format. Each json line in the file must be of the format {"input": "input string"} to be processed.
+				Folders can also hold .csv files with an "input" column, and .txt files with one input per line.
 				`,
 	ArgsUsage: `
-				--input: path to a .jsonl file or a folder with .jsonl files to process. If omitted, the input will be read from stdin.
+				--input: path to a .jsonl, .csv or .txt file, or a folder with such files to process. If omitted, the input will be read from stdin.
 				--output: path to a folder where to write the output. If omitted, the output will be sent to stdout.
+				--stats: path to a json file where to write the statistics of the pipeline at the end of the run: tokenizer and inference timings, histogram of the batch sizes and tokens processed.
+				--format: format of the output, jsonl (default) or parquet. The other fields of the input records are written alongside the input and output.
 				--model: model name or path to the .onnx model to load. The hugot cli looks for models with this chain: first use the provided path. If the path does not exist, look for a model
 				with this name at $HOME/hugot/models. Finally, try to download the model from Huggingface and use it.
-				--type: pipeline type. Currently implemented types are: featureExtraction, tokenClassification, and textClassification (only single label)
+				--type: pipeline type. Currently implemented types are: featureExtraction, tokenClassification, textClassification (only single label) and translation
+				--suppressLabels: label never returned by the text and token classification pipelines, e.g. NEUTRAL. The flag can be repeated.
+				--srcLang, --tgtLang: source and target languages of the translation pipeline, e.g. eng_Latn and fra_Latn for NLLB models. MarianMT models translating a single language pair need neither.
+				--chunkSize, --chunkOverlap: split the inputs longer than the model into chunks of chunkSize tokens (the maximum length of the model by default) sharing chunkOverlap tokens, rather than truncating them, for featureExtraction, textClassification and tokenClassification. Entities are returned with their offsets in the input. tokenClassification needs an overlap greater than zero.
+				--chunkMerge: how the chunks of an input are merged: MEAN (default) or TOKENS to weight them by their number of tokens for featureExtraction, and also MAX for textClassification.
+				--intraOpThreads, --interOpThreads: number of threads onnxruntime uses within and across graph nodes, to bound the cores used by the run. If omitted, onnxruntime uses all the physical cores.
 				--onnxruntimeSharedLibrary: path to the onnxruntime.so library. If not provided, the cli will try to load it from $HOME/lib/hugot/onnxruntime.so, and from /usr/lib/onnxruntime.so in the last instance.
 				`,
 	Flags: []cli.Flag{
@@ -62,6 +80,22 @@ var runCommand = &cli.Command{
 			Aliases:     []string{"o"},
 			Destination: &outputPath,
 		},
+		&cli.StringFlag{
+			Name:        "format",
+			Usage:       "Format of the output, jsonl or parquet",
+			Value:       "jsonl",
+			Destination: &outputFormat,
+		},
+		&cli.StringFlag{
+			Name:        "stats",
+			Usage:       "Path to a json file where to write the pipeline statistics at the end of the run",
+			Destination: &statsPath,
+		},
+		&cli.StringSliceFlag{
+			Name:        "suppressLabels",
+			Usage:       "Label never returned by the classification pipelines, e.g. NEUTRAL, can be repeated",
+			Destination: &suppressedLabels,
+		},
 		&cli.StringFlag{
 			Name:        "type",
 			Usage:       "Pipeline type",
@@ -84,6 +118,36 @@ var runCommand = &cli.Command{
 			Required:    false,
 			Value:       20,
 		},
+		&cli.IntFlag{
+			Name:        "chunkSize",
+			Usage:       "Length in tokens of the chunks of long inputs, the maximum length of the model if not specified",
+			Destination: &chunkSize,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "chunkOverlap",
+			Usage:       "Number of tokens shared by consecutive chunks of long inputs",
+			Destination: &chunkOverlap,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "chunkMerge",
+			Usage:       "How the chunks of long inputs are merged: MEAN, TOKENS or MAX",
+			Destination: &chunkMerge,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "intraOpThreads",
+			Usage:       "Number of threads used by onnxruntime within graph nodes, all the physical cores if not specified",
+			Destination: &intraOpThreads,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "interOpThreads",
+			Usage:       "Number of threads used by onnxruntime across graph nodes, all the physical cores if not specified",
+			Destination: &interOpThreads,
+			Required:    false,
+		},
 		&cli.StringFlag{
 			Name:        "modelFolder",
 			Usage:       "Folder where to store downloaded models. Falls back to $HOME/hugot/models if not specified",
@@ -92,30 +156,21 @@ var runCommand = &cli.Command{
 			Required:    false,
 			Value:       "",
 		},
+		&cli.StringFlag{
+			Name:        "srcLang",
+			Usage:       "Source language of the translation pipeline",
+			Destination: &sourceLanguage,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "tgtLang",
+			Usage:       "Target language of the translation pipeline",
+			Destination: &targetLanguage,
+			Required:    false,
+		},
 	},
 	Action: func(ctx *cli.Context) error {
-		var opts []hugot.WithOption
-
-		if modelsDir == "" {
-			userDir, err := os.UserHomeDir()
-			if err != nil {
-				return err
-			}
-			modelsDir = util.PathJoinSafe(userDir, "hugot", "models")
-		}
-
-		if sharedLibraryPath != "" {
-			opts = append(opts, hugot.WithOnnxLibraryPath(sharedLibraryPath))
-		} else {
-			homeDir, err := os.UserHomeDir()
-			if err != nil {
-				if exists, err := util.FileSystem.Exists(ctx.Context, path.Join(homeDir, "lib", "hugot", "onnxruntime.so")); err != nil && exists {
-					opts = append(opts, hugot.WithOnnxLibraryPath(path.Join(homeDir, "lib", "hugot", "onnxruntime.so")))
-				}
-			}
-		}
-
-		session, err := hugot.NewSession(opts...)
+		session, err := newSession(ctx)
 		if err != nil {
 			return err
 		}
@@ -129,35 +184,10 @@ var runCommand = &cli.Command{
 
 		var pipe pipelines.Pipeline
 
-		// is the model a full path to a model
-		ok, err := util.FileSystem.Exists(ctx.Context, modelPath)
+		modelPath, err = resolveModelPath(ctx, session, modelPath)
 		if err != nil {
 			return err
 		}
-		if !ok {
-			// is the model the name of a model previously downloaded
-			downloadedModelName := strings.Replace(modelPath, "/", "_", -1)
-			ok, err = util.FileSystem.Exists(ctx.Context, util.PathJoinSafe(modelsDir, downloadedModelName))
-			if err != nil {
-				return err
-			}
-			if ok {
-				modelPath = util.PathJoinSafe(modelsDir, downloadedModelName)
-			} else {
-				// is the model the name of a model to download
-				if strings.Contains(modelPath, ":") {
-					return fmt.Errorf("filters with : are currently not supported")
-				}
-				err = util.FileSystem.Create(context.Background(), modelsDir, os.ModePerm, true)
-				if err != nil {
-					return err
-				}
-				modelPath, err = session.DownloadModel(modelPath, modelsDir, hugot.NewDownloadOptions())
-				if err != nil {
-					return err
-				}
-			}
-		}
 
 		switch pipelineType {
 		case "tokenClassification":
@@ -165,6 +195,22 @@ var runCommand = &cli.Command{
 				ModelPath: modelPath,
 				Name:      "cliPipeline",
 			}
+			if labels := suppressedLabels.Value(); len(labels) > 0 {
+				// the outside label stays ignored
+				config.Options = append(config.Options, pipelines.WithIgnoreLabels(append([]string{"O"}, labels...)))
+			}
+			if chunking() {
+				if chunkOverlap <= 0 {
+					setupErrs = append(setupErrs, errors.New("tokenClassification needs a --chunkOverlap greater than zero to split long inputs"))
+				}
+				if chunkMerge != "" {
+					setupErrs = append(setupErrs, errors.New("--chunkMerge does not apply to tokenClassification, whose entities are merged by their offsets"))
+				}
+				config.Options = append(config.Options,
+					pipelines.WithStride(chunkOverlap),
+					pipelines.WithChunkSize[*pipelines.TokenClassificationPipeline](chunkSize),
+				)
+			}
 			pipe, err = hugot.NewPipeline(session, config)
 			setupErrs = append(setupErrs, err)
 		case "textClassification":
@@ -172,6 +218,18 @@ var runCommand = &cli.Command{
 				ModelPath: modelPath,
 				Name:      "cliPipeline",
 			}
+			if labels := suppressedLabels.Value(); len(labels) > 0 {
+				config.Options = append(config.Options, pipelines.WithSuppressedLabels(labels))
+			}
+			if chunking() {
+				config.Options = append(config.Options,
+					pipelines.WithChunkedClassification(chunkOverlap),
+					pipelines.WithChunkSize[*pipelines.TextClassificationPipeline](chunkSize),
+				)
+				if chunkMerge != "" {
+					config.Options = append(config.Options, pipelines.WithChunkMerge(chunkMerge))
+				}
+			}
 			pipe, err = hugot.NewPipeline(session, config)
 			setupErrs = append(setupErrs, err)
 		case "featureExtraction":
@@ -179,17 +237,42 @@ var runCommand = &cli.Command{
 				ModelPath: modelPath,
 				Name:      "cliPipeline",
 			}
+			if chunking() {
+				config.Options = append(config.Options,
+					pipelines.WithChunking(chunkOverlap),
+					pipelines.WithChunkSize[*pipelines.FeatureExtractionPipeline](chunkSize),
+				)
+				if chunkMerge != "" {
+					config.Options = append(config.Options, pipelines.WithChunkAggregation(chunkMerge))
+				}
+			}
+			pipe, err = hugot.NewPipeline(session, config)
+			setupErrs = append(setupErrs, err)
+		case "translation":
+			config := hugot.TranslationConfig{
+				ModelPath: modelPath,
+				Name:      "cliPipeline",
+			}
+			if sourceLanguage != "" {
+				config.Options = append(config.Options, pipelines.WithSourceLanguage(sourceLanguage))
+			}
+			if targetLanguage != "" {
+				config.Options = append(config.Options, pipelines.WithTargetLanguage(targetLanguage))
+			}
 			pipe, err = hugot.NewPipeline(session, config)
 			setupErrs = append(setupErrs, err)
 		default:
 			setupErrs = append(setupErrs, fmt.Errorf("pipeline type %s not implemented", pipelineType))
 		}
+		if outputFormat != "jsonl" && outputFormat != "parquet" {
+			setupErrs = append(setupErrs, fmt.Errorf("output format %s not implemented", outputFormat))
+		}
 		if e := errors.Join(setupErrs...); e != nil {
 			return e
 		}
 
-		inputChannel := make(chan []input, 1000)
-		processedChannel := make(chan []byte, 1000)
+		inputChannel := make(chan hugot.RecordBatch, 1000)
+		processedChannel := make(chan []hugot.Result, 1000)
 		errorsChannel := make(chan error, 1000)
 		nWriteWorkers := 1
 		nProcessWorkers := 1
@@ -209,7 +292,7 @@ var runCommand = &cli.Command{
 			var writer io.WriteCloser
 
 			if outputPath != "" {
-				dest := util.PathJoinSafe(outputPath, fmt.Sprintf("result-%d.jsonl", i))
+				dest := util.PathJoinSafe(outputPath, fmt.Sprintf("result-%d.%s", i, outputFormat))
 				writer, err = util.FileSystem.NewWriter(ctx.Context, dest, os.ModePerm)
 				if err != nil {
 					return err
@@ -225,8 +308,17 @@ var runCommand = &cli.Command{
 				Writer: writer,
 				Type:   "stdout",
 			})
+			var sink hugot.Sink
+			if outputFormat == "parquet" {
+				sink, err = parquet.NewSink(writer)
+				if err != nil {
+					return err
+				}
+			} else {
+				sink = hugot.NewJSONLSink(writer)
+			}
 			writeWg.Add(1)
-			go writeOutputs(&writeWg, processedChannel, errorsChannel, writer)
+			go writeOutputs(&writeWg, processedChannel, errorsChannel, sink)
 		}
 
 		defer func() {
@@ -247,12 +339,23 @@ var runCommand = &cli.Command{
 
 		if exists {
 			fileWalker := func(_ context.Context, _ string, _ string, info os.FileInfo, reader io.Reader) (toContinue bool, err error) {
-				extension := filepath.Ext(info.Name())
-				if extension == ".jsonl" {
-					err := readInputs(reader, inputChannel)
-					if err != nil {
-						return false, err
-					}
+				var source hugot.Source
+				var sourceErr error
+				switch filepath.Ext(info.Name()) {
+				case ".jsonl":
+					source, sourceErr = hugot.NewJSONLSource(reader, batchSize)
+				case ".csv":
+					source, sourceErr = hugot.NewCSVSource(reader, batchSize)
+				case ".txt":
+					source, sourceErr = hugot.NewTextSource(reader, batchSize)
+				default:
+					return true, nil
+				}
+				if sourceErr != nil {
+					return false, sourceErr
+				}
+				if err := readInputs(source, inputChannel); err != nil {
+					return false, fmt.Errorf("%s: %w", info.Name(), err)
 				}
 				return true, nil
 			}
@@ -268,10 +371,13 @@ var runCommand = &cli.Command{
 
 			if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
 				// there is something to process on stdin
-				err := readInputs(os.Stdin, inputChannel)
+				source, err := hugot.NewJSONLSource(os.Stdin, batchSize)
 				if err != nil {
 					return err
 				}
+				if err = readInputs(source, inputChannel); err != nil {
+					return err
+				}
 			}
 		}
 
@@ -280,35 +386,126 @@ var runCommand = &cli.Command{
 		close(processedChannel)
 		close(errorsChannel)
 		writeWg.Wait()
+		if statsPath != "" {
+			return writeStats(ctx, session)
+		}
 		return err
 	},
 }
 
+// chunking reports whether the chunking flags of the run command are set.
+func chunking() bool {
+	return chunkSize > 0 || chunkOverlap > 0 || chunkMerge != ""
+}
+
+// writeStats writes the statistics of the pipelines of the session as json to the stats path.
+func writeStats(ctx *cli.Context, session *hugot.Session) (err error) {
+	statsBytes, err := json.MarshalIndent(session.GetStatistics(), "", "  ")
+	if err != nil {
+		return err
+	}
+	writer, err := util.FileSystem.NewWriter(ctx.Context, statsPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, writer.Close())
+	}()
+	_, err = writer.Write(statsBytes)
+	return err
+}
+
 func main() {
 	app := &cli.App{
 		Name:     "hugot",
 		Usage:    "Huggingface transformers from the command line - alpha",
-		Commands: []*cli.Command{runCommand},
+		Commands: []*cli.Command{runCommand, searchCommand, prefetchCommand, providersCommand, diffCommand, schemaCommand},
 	}
 	if err := app.Run(os.Args); err != nil {
 		panic(err)
 	}
 }
 
-func writeOutputs(wg *sync.WaitGroup, processedChannel chan []byte, errorChannel chan error, writeTarget io.WriteCloser) {
+// newSession creates the hugot session for a cli command, looking for the onnxruntime library in the
+// hugot install location if it is not provided.
+func newSession(ctx *cli.Context) (*hugot.Session, error) {
+	var opts []hugot.WithOption
+
+	if modelsDir == "" {
+		userDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		modelsDir = util.PathJoinSafe(userDir, "hugot", "models")
+	}
+
+	if sharedLibraryPath != "" {
+		opts = append(opts, hugot.WithOnnxLibraryPath(sharedLibraryPath))
+	} else {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			if exists, err := util.FileSystem.Exists(ctx.Context, path.Join(homeDir, "lib", "hugot", "onnxruntime.so")); err != nil && exists {
+				opts = append(opts, hugot.WithOnnxLibraryPath(path.Join(homeDir, "lib", "hugot", "onnxruntime.so")))
+			}
+		}
+	}
+
+	if intraOpThreads < 0 || interOpThreads < 0 {
+		return nil, fmt.Errorf("--intraOpThreads and --interOpThreads must not be negative, got %d and %d", intraOpThreads, interOpThreads)
+	}
+	if intraOpThreads > 0 {
+		opts = append(opts, hugot.WithIntraOpNumThreads(intraOpThreads))
+	}
+	if interOpThreads > 0 {
+		opts = append(opts, hugot.WithInterOpNumThreads(interOpThreads))
+	}
+
+	return hugot.NewSession(opts...)
+}
+
+// resolveModelPath returns the path of the model to load. The model can be a full path to a model, the name of
+// a model previously downloaded to the models folder, or the name of a huggingface model to download.
+func resolveModelPath(ctx *cli.Context, session *hugot.Session, model string) (string, error) {
+	// is the model a full path to a model
+	ok, err := util.FileSystem.Exists(ctx.Context, model)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return model, nil
+	}
+
+	// is the model the name of a model previously downloaded
+	downloadedModelName := strings.Replace(model, "/", "_", -1)
+	ok, err = util.FileSystem.Exists(ctx.Context, util.PathJoinSafe(modelsDir, downloadedModelName))
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return util.PathJoinSafe(modelsDir, downloadedModelName), nil
+	}
+
+	// is the model the name of a model to download
+	if strings.Contains(model, ":") {
+		return "", fmt.Errorf("filters with : are currently not supported")
+	}
+	err = util.FileSystem.Create(context.Background(), modelsDir, os.ModePerm, true)
+	if err != nil {
+		return "", err
+	}
+	return session.DownloadModel(model, modelsDir, hugot.NewDownloadOptions())
+}
+
+func writeOutputs(wg *sync.WaitGroup, processedChannel chan []hugot.Result, errorChannel chan error, sink hugot.Sink) {
 
 	for processedChannel != nil || errorChannel != nil {
 		select {
-		case output, ok := <-processedChannel:
+		case results, ok := <-processedChannel:
 			if !ok {
 				processedChannel = nil
+				continue
 			}
-			_, err := writeTarget.Write(output)
-			if err != nil {
-				panic(err)
-			}
-			_, err = writeTarget.Write([]byte("\n"))
-			if err != nil {
+			if err := sink.Write(results); err != nil {
 				panic(err)
 			}
 		case err, ok := <-errorChannel:
@@ -323,59 +520,38 @@ func writeOutputs(wg *sync.WaitGroup, processedChannel chan []byte, errorChannel
 			}
 		}
 	}
+	if err := sink.Close(); err != nil {
+		panic(err)
+	}
 	wg.Done()
 }
 
-func processWithPipeline(wg *sync.WaitGroup, inputChannel chan []input, processedChannel chan []byte, errorsChannel chan error, p pipelines.Pipeline) {
-	for inputBatch := range inputChannel {
-		inputStrings := make([]string, len(inputBatch))
-		for i := 0; i < len(inputBatch); i++ {
-			inputStrings[i] = inputBatch[i].Input
+func processWithPipeline(wg *sync.WaitGroup, inputChannel chan hugot.RecordBatch, processedChannel chan []hugot.Result, errorsChannel chan error, p pipelines.Pipeline) {
+	for batch := range inputChannel {
+		output, err := p.Run(batch.Inputs())
+		if err != nil {
+			errorsChannel <- err
+			continue
 		}
-		output, err := p.Run(inputStrings)
+		results, err := hugot.NewResults(batch, output)
 		if err != nil {
 			errorsChannel <- err
-		} else {
-			batchOutputs := output.GetOutput()
-			for i, batchOutput := range batchOutputs {
-				out := inputBatch[i]
-				out.Output = batchOutput
-				outputBytes, marshallErr := json.Marshal(out)
-				if marshallErr != nil {
-					errorsChannel <- marshallErr
-				} else {
-					processedChannel <- outputBytes
-				}
-			}
+			continue
 		}
+		processedChannel <- results
 	}
 	wg.Done()
 }
 
-func readInputs(inputSource io.Reader, inputChannel chan []input) error {
-	inputBatch := make([]input, 0, 20)
-
-	scanner := bufio.NewScanner(inputSource)
-	for scanner.Scan() {
-		var line input
-		err := json.Unmarshal(scanner.Bytes(), &line)
+func readInputs(source hugot.Source, inputChannel chan hugot.RecordBatch) error {
+	for {
+		batch, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		inputBatch = append(inputBatch, line)
-		if len(inputBatch) == batchSize {
-			inputChannel <- inputBatch
-			inputBatch = []input{}
-		}
-	}
-	// flush
-	if len(inputBatch) > 0 {
-		inputChannel <- inputBatch
+		inputChannel <- batch
 	}
-	return nil
-}
-
-type input struct {
-	Input  string `json:"input"`
-	Output any    `json:"output"`
 }
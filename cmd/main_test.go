@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/knights-analytics/hugot/pipelines"
 	util "github.com/knights-analytics/hugot/utils"
 )
 
@@ -109,6 +112,195 @@ func TestFeatureExtractionCli(t *testing.T) {
 	fmt.Println(string(result))
 }
 
+func TestChunkingCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	// a single input several times longer than a chunk, with entities at its end
+	longInput := strings.Repeat("The weather was mild and the streets were quiet. ", 6) + "Rome is a city in Italy."
+	longData, err := json.Marshal(map[string]string{"input": longInput})
+	check(t, err)
+	err = os.WriteFile(path.Join(testDataDir, "test-chunking.jsonl"), longData, os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+	input := fmt.Sprintf("--input=%s", path.Join(testDataDir, "test-chunking.jsonl"))
+
+	for pipelineType, model := range map[string]string{
+		"featureExtraction":   "KnightsAnalytics_all-MiniLM-L6-v2",
+		"tokenClassification": "KnightsAnalytics_distilbert-NER",
+	} {
+		args := append(baseArgs, "run", input, fmt.Sprintf("--model=%s", path.Join("../models", model)),
+			fmt.Sprintf("--type=%s", pipelineType), fmt.Sprintf("--output=%s", testDataDir), "--chunkSize=16", "--chunkOverlap=4")
+		check(t, app.Run(args))
+
+		result, err := os.ReadFile(path.Join(testDataDir, "result-0.jsonl"))
+		check(t, err)
+		lines := strings.Split(strings.TrimSpace(string(result)), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("%s: expected one result for the long input, got %d", pipelineType, len(lines))
+		}
+		switch pipelineType {
+		case "featureExtraction":
+			// the chunk embeddings are merged into a single embedding
+			var line struct{ Output []float32 }
+			check(t, json.Unmarshal([]byte(lines[0]), &line))
+			if len(line.Output) != 384 {
+				t.Fatalf("expected one embedding of dimension 384, got %d values", len(line.Output))
+			}
+		case "tokenClassification":
+			// the entities of the later chunks are found, with offsets in the full input
+			var line struct{ Output []pipelines.Entity }
+			check(t, json.Unmarshal([]byte(lines[0]), &line))
+			found := false
+			for _, entity := range line.Output {
+				if int(entity.Start) >= strings.Index(longInput, "Rome") && int(entity.End) <= len(longInput) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("expected entities beyond the first chunk, got %+v", line.Output)
+			}
+		}
+	}
+
+	// the overlap of token classification windows must be positive, and its entities are not merged by score
+	args := append(baseArgs, "run", input, fmt.Sprintf("--model=%s", path.Join("../models", "KnightsAnalytics_distilbert-NER")),
+		"--type=tokenClassification", fmt.Sprintf("--output=%s", testDataDir), "--chunkSize=16", "--chunkMerge=MEAN")
+	if err := app.Run(args); err == nil {
+		t.Fatal("expected an error for token classification chunks without overlap")
+	}
+}
+
+func TestThreadsCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	err = os.WriteFile(path.Join(testDataDir, "test-threads.jsonl"), textClassificationData, os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+	input := fmt.Sprintf("--input=%s", path.Join(testDataDir, "test-threads.jsonl"))
+
+	args := append(baseArgs, "run", input, fmt.Sprintf("--model=%s", testModel), "--type=textClassification",
+		fmt.Sprintf("--output=%s", testDataDir), "--intraOpThreads=1", "--interOpThreads=1")
+	check(t, app.Run(args))
+	result, err := os.ReadFile(path.Join(testDataDir, "result-0.jsonl"))
+	check(t, err)
+	if lines := strings.Split(strings.TrimSpace(string(result)), "\n"); len(lines) != 2 {
+		t.Fatalf("expected two results, got %d", len(lines))
+	}
+
+	// negative thread counts are rejected
+	for _, flag := range []string{"--intraOpThreads=-1", "--interOpThreads=-1"} {
+		args := append(baseArgs, "run", input, fmt.Sprintf("--model=%s", testModel), "--type=textClassification",
+			fmt.Sprintf("--output=%s", testDataDir), flag)
+		if err := app.Run(args); err == nil {
+			t.Fatalf("expected an error for %s", flag)
+		}
+	}
+}
+
+func TestSearchCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand, searchCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_all-MiniLM-L6-v2")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	err = os.WriteFile(path.Join(testDataDir, "test-search.jsonl"), textClassificationData, os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+
+	// precompute the embeddings, then search them
+	args := append(baseArgs, "run", fmt.Sprintf("--input=%s", path.Join(testDataDir, "test-search.jsonl")),
+		fmt.Sprintf("--model=%s", testModel), "--type=featureExtraction", fmt.Sprintf("--output=%s", testDataDir))
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+	args = append(baseArgs, "search", fmt.Sprintf("--embeddings=%s", path.Join(testDataDir, "result-0.jsonl")),
+		fmt.Sprintf("--model=%s", testModel), "--query=a great film", "--k=2")
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+}
+
+func TestPrefetchCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{prefetchCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_all-MiniLM-L6-v2")
+	args := append(baseArgs, "prefetch", fmt.Sprintf("--model=%s", testModel))
+	check(t, app.Run(args))
+
+	// a folder without a model fails validation
+	emptyDir := path.Join(os.TempDir(), "hugoEmptyModel")
+	check(t, os.MkdirAll(emptyDir, os.ModePerm))
+	defer func() {
+		check(t, os.RemoveAll(emptyDir))
+	}()
+	args = append(baseArgs, "prefetch", fmt.Sprintf("--model=%s", testModel), fmt.Sprintf("--model=%s", emptyDir))
+	if err := app.Run(args); err == nil {
+		t.Fatal("expected prefetch of an empty folder to fail")
+	}
+}
+
+func TestDiffCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{diffCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testDataDir := path.Join(os.TempDir(), "hugoDiffData")
+	check(t, os.MkdirAll(testDataDir, os.ModePerm))
+	defer func() {
+		check(t, os.RemoveAll(testDataDir))
+	}()
+	inputFile := path.Join(testDataDir, "test-0.jsonl")
+	check(t, os.WriteFile(inputFile, textClassificationData, os.ModePerm))
+
+	// a model compared with itself has no disagreements
+	testModel := path.Join("../models", "KnightsAnalytics_all-MiniLM-L6-v2")
+	args := append(baseArgs, "diff", fmt.Sprintf("--modelA=%s", testModel), fmt.Sprintf("--modelB=%s", testModel),
+		"--type=featureExtraction", fmt.Sprintf("--input=%s", inputFile))
+	check(t, app.Run(args))
+}
+
 func TestModelChain(t *testing.T) {
 	app := &cli.App{
 		Name:     "hugot",
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+var prefetchModels cli.StringSlice
+
+var prefetchCommand = &cli.Command{
+	Name:  "prefetch",
+	Usage: "Download and validate models ahead of time",
+	Description: `Prefetch resolves each model as hugot run does, downloading it to the models folder if needed, checks that it has a tokenizer.json and an .onnx file, and exits.
+				It is meant to run before the models are used, e.g. as an init container, so that the first run does not pay for the download. The command fails if any model cannot be fetched.
+				`,
+	ArgsUsage: `
+				--model: model name or path to the model. Can be repeated to prefetch several models.
+				--modelFolder: folder where to store downloaded models. Falls back to $HOME/hugot/models if not specified.
+				--onnxruntimeSharedLibrary: path to the onnxruntime.so library.
+				`,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "model",
+			Usage:       "Model name or path, can be repeated",
+			Aliases:     []string{"p"},
+			Destination: &prefetchModels,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "onnxruntimeSharedLibrary",
+			Usage:       "Path to onnxruntime.so",
+			Aliases:     []string{"s"},
+			Destination: &sharedLibraryPath,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "modelFolder",
+			Usage:       "Folder where to store downloaded models. Falls back to $HOME/hugot/models if not specified",
+			Aliases:     []string{"f"},
+			Destination: &modelsDir,
+			Required:    false,
+			Value:       "",
+		},
+	},
+	Action: func(ctx *cli.Context) (err error) {
+		session, err := newSession(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, session.Destroy())
+		}()
+
+		var prefetchErrs []error
+		for _, model := range prefetchModels.Value() {
+			path, resolveErr := resolveModelPath(ctx, session, model)
+			if resolveErr == nil {
+				resolveErr = validateModelFolder(ctx.Context, path)
+			}
+			if resolveErr != nil {
+				prefetchErrs = append(prefetchErrs, fmt.Errorf("could not prefetch %s: %w", model, resolveErr))
+				continue
+			}
+			fmt.Printf("%s: ready at %s\n", model, path)
+		}
+		return errors.Join(prefetchErrs...)
+	},
+}
+
+// validateModelFolder checks that a model folder has the files every pipeline needs.
+func validateModelFolder(ctx context.Context, modelPath string) error {
+	var errs []error
+	exists, err := util.FileSystem.Exists(ctx, util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		errs = append(errs, fmt.Errorf("model at %s has no tokenizer.json file", modelPath))
+	}
+
+	hasOnnx := false
+	walker := func(_ context.Context, _ string, _ string, info os.FileInfo, _ io.Reader) (bool, error) {
+		if strings.HasSuffix(info.Name(), ".onnx") {
+			hasOnnx = true
+			return false, nil
+		}
+		return true, nil
+	}
+	if err = util.FileSystem.Walk(ctx, modelPath, walker); err != nil {
+		return err
+	}
+	if !hasOnnx {
+		errs = append(errs, fmt.Errorf("model at %s has no .onnx file", modelPath))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/knights-analytics/hugot"
+)
+
+var providersCommand = &cli.Command{
+	Name:  "providers",
+	Usage: "List the execution providers supported by the onnxruntime library",
+	Description: `Providers loads the onnxruntime library and prints, one per line, the execution providers it supports among CPU, CUDA, TensorRT, CoreML, DirectML and OpenVINO.
+				`,
+	ArgsUsage: `
+				--onnxruntimeSharedLibrary: path to the onnxruntime.so library.
+				`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "onnxruntimeSharedLibrary",
+			Usage:       "Path to onnxruntime.so",
+			Aliases:     []string{"s"},
+			Destination: &sharedLibraryPath,
+			Required:    false,
+		},
+	},
+	Action: func(ctx *cli.Context) (err error) {
+		session, err := newSession(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, session.Destroy())
+		}()
+
+		providers, err := hugot.AvailableProviders()
+		if err != nil {
+			return err
+		}
+		for _, provider := range providers {
+			fmt.Println(provider)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/knights-analytics/hugot"
+)
+
+var schemaCommand = &cli.Command{
+	Name:  "schema",
+	Usage: "Print the json schema of the output of a pipeline type",
+	Description: `Schema prints the json schema of the outputs of a pipeline type, so that the systems consuming them can validate them or generate code.
+				The output of each input in the results of hugot run is an item of the main array of the schema, e.g. ClassificationOutputs for textClassification.
+				The schemas are versioned: their $id holds the version, which changes on incompatible changes of the outputs.
+				`,
+	ArgsUsage: `
+				--type: pipeline type, e.g. textClassification. All the pipeline types of the hugot library have a schema, not only those of hugot run.
+				`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "type",
+			Usage:       "Pipeline type",
+			Aliases:     []string{"t"},
+			Destination: &pipelineType,
+			Required:    true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		schema, err := hugot.OutputSchema(pipelineType)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(schema))
+		return nil
+	},
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/knights-analytics/hugot"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+var embeddingsPath string
+var queries cli.StringSlice
+var topK int
+
+var searchCommand = &cli.Command{
+	Name:  "search",
+	Usage: "Search a file of precomputed embeddings by cosine similarity",
+	Description: `Search embeds the queries with a feature extraction model and returns the k most similar entries of a file of precomputed embeddings.
+				The embeddings file must be in the .jsonl format produced by hugot run --type=featureExtraction, i.e. each line is of the format {"input": "input string", "output": [0.1, 0.2, ...]}.
+				The same model that produced the embeddings must be used for the queries.
+				`,
+	ArgsUsage: `
+				--embeddings: path to the .jsonl file with the precomputed embeddings.
+				--model: model name or path to the feature extraction model to embed the queries with, resolved as in hugot run.
+				--query: query string. Can be repeated to run several queries.
+				--k: number of results to return per query.
+				--onnxruntimeSharedLibrary: path to the onnxruntime.so library.
+				`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "embeddings",
+			Usage:       "Path to the .jsonl file with the precomputed embeddings",
+			Aliases:     []string{"e"},
+			Destination: &embeddingsPath,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "model",
+			Usage:       "Path to the model",
+			Aliases:     []string{"p"},
+			Destination: &modelPath,
+			Required:    true,
+		},
+		&cli.StringSliceFlag{
+			Name:        "query",
+			Usage:       "Query string, can be repeated",
+			Aliases:     []string{"q"},
+			Destination: &queries,
+			Required:    true,
+		},
+		&cli.IntFlag{
+			Name:        "k",
+			Usage:       "Number of results to return per query",
+			Destination: &topK,
+			Value:       10,
+		},
+		&cli.StringFlag{
+			Name:        "onnxruntimeSharedLibrary",
+			Usage:       "Path to onnxruntime.so",
+			Aliases:     []string{"s"},
+			Destination: &sharedLibraryPath,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "modelFolder",
+			Usage:       "Folder where to store downloaded models. Falls back to $HOME/hugot/models if not specified",
+			Aliases:     []string{"f"},
+			Destination: &modelsDir,
+			Required:    false,
+			Value:       "",
+		},
+	},
+	Action: func(ctx *cli.Context) (err error) {
+		if extension := filepath.Ext(embeddingsPath); extension != ".jsonl" {
+			return fmt.Errorf("embeddings file format %s is not supported, only .jsonl files can be searched", extension)
+		}
+		inputs, embeddings, err := readEmbeddings(embeddingsPath)
+		if err != nil {
+			return err
+		}
+
+		session, err := newSession(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, session.Destroy())
+		}()
+
+		modelPath, err = resolveModelPath(ctx, session, modelPath)
+		if err != nil {
+			return err
+		}
+		pipe, err := hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+			ModelPath: modelPath,
+			Name:      "cliPipeline",
+		})
+		if err != nil {
+			return err
+		}
+
+		queryEmbeddings, err := pipe.RunPipeline(queries.Value())
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(inputs))
+		for i := range inputs {
+			ids[i] = strconv.Itoa(i)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for i, query := range queries.Value() {
+			ranking, rankErr := util.DenseRanking(queryEmbeddings.Embeddings[i], ids, embeddings, topK)
+			if rankErr != nil {
+				return rankErr
+			}
+			results := make([]searchResult, len(ranking))
+			for j, r := range ranking {
+				index, _ := strconv.Atoi(r.ID)
+				results[j] = searchResult{Input: inputs[index], Score: r.Score}
+			}
+			if err = encoder.Encode(searchOutput{Query: query, Results: results}); err != nil {
+				return err
+			}
+		}
+		return err
+	},
+}
+
+type embeddingLine struct {
+	Input  string    `json:"input"`
+	Output []float32 `json:"output"`
+}
+
+type searchResult struct {
+	Input string  `json:"input"`
+	Score float32 `json:"score"`
+}
+
+type searchOutput struct {
+	Query   string         `json:"query"`
+	Results []searchResult `json:"results"`
+}
+
+func readEmbeddings(filename string) (inputs []string, embeddings [][]float32, err error) {
+	file, err := util.FileSystem.OpenURL(context.Background(), filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func(file io.Closer) {
+		err = errors.Join(err, util.CloseFile(file))
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+	// embedding lines are long
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var line embeddingLine
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, nil, err
+		}
+		inputs = append(inputs, line.Input)
+		embeddings = append(embeddings, line.Output)
+	}
+	return inputs, embeddings, scanner.Err()
+}
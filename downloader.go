@@ -18,6 +18,9 @@ import (
 	util "github.com/knights-analytics/hugot/utils"
 )
 
+// downloadEnabled reports whether models can be downloaded, i.e. whether the NODOWNLOAD build tag is not set.
+const downloadEnabled = true
+
 // DownloadOptions is a struct of options that can be passed to DownloadModel
 type DownloadOptions struct {
 	AuthToken             string
@@ -41,7 +44,8 @@ func NewDownloadOptions() DownloadOptions {
 }
 
 // DownloadModel can be used to download a model directly from huggingface. Before the model is downloaded,
-// validation occurs to ensure there is an .onnx and tokenizers.json file. Hugot only works with onnx models.
+// validation occurs to ensure there is an .onnx and a tokenizers.json file, or a preprocessor_config.json file for
+// models without text inputs (e.g. image segmentation). Hugot only works with onnx models.
 func (s *Session) DownloadModel(modelName string, destination string, options DownloadOptions) (string, error) {
 	// make sure it's an onnx model with tokenizer
 	err := validateDownloadHfModel(modelName, options.Branch, options.AuthToken)
@@ -91,7 +95,7 @@ func validateDownloadHfModel(modelPath string, branch string, authToken string)
 		errs = append(errs, fmt.Errorf("model does not have a model.onnx file, Hugot only works with onnx models"))
 	}
 	if !hasTokenizer {
-		errs = append(errs, fmt.Errorf("model does not have a tokenizer.json file"))
+		errs = append(errs, fmt.Errorf("model does not have a tokenizer.json or preprocessor_config.json file"))
 	}
 	return errors.Join(errs...)
 }
@@ -122,7 +126,8 @@ func checkURL(client *http.Client, url string, authToken string) (bool, bool, er
 
 	var dirs []hfFile
 	for _, f := range filesList {
-		if f.Path == "tokenizer.json" {
+		if f.Path == "tokenizer.json" || f.Path == "preprocessor_config.json" {
+			// vision and audio models without text inputs only have a preprocessor config
 			tokenizerFound = true
 		}
 		if filepath.Ext(f.Path) == ".onnx" {
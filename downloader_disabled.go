@@ -0,0 +1,6 @@
+//go:build NODOWNLOAD
+
+package hugot
+
+// downloadEnabled reports whether models can be downloaded, i.e. whether the NODOWNLOAD build tag is not set.
+const downloadEnabled = false
@@ -0,0 +1,198 @@
+// Command embeddingBackfill is an example batch job computing the embeddings of a .jsonl file of
+// {"id": "...", "text": "..."} records. The embeddings are appended as {"id": "...", "embedding": [...]} lines to the
+// output file, and the records already present in the output are skipped, so an interrupted job resumes where it
+// stopped. With -utilization below 1 the model is throttled, so that the job can run on a host serving other
+// workloads. Only the public hugot APIs are used.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+type record struct {
+	Id   string `json:"id"`
+	Text string `json:"text"`
+}
+
+type embeddingRecord struct {
+	Id        string    `json:"id"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// backfillStats counts the work done by a run of the job.
+type backfillStats struct {
+	Embedded    int
+	Skipped     int
+	InputTokens uint64
+	Duration    time.Duration
+}
+
+// embeddedIds returns the ids already in the output file, if it exists.
+func embeddedIds(outputPath string) (map[string]bool, error) {
+	ids := map[string]bool{}
+	file, err := os.Open(outputPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var r embeddingRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// a line cut by an interrupted run is embedded again
+			continue
+		}
+		ids[r.Id] = true
+	}
+	return ids, scanner.Err()
+}
+
+// backfill embeds the records of the input file missing from the output file, in batches.
+func backfill(pipeline *pipelines.FeatureExtractionPipeline, inputPath, outputPath string, batchSize int) (stats backfillStats, err error) {
+	start := time.Now()
+	defer func() {
+		stats.Duration = time.Since(start)
+	}()
+
+	done, err := embeddedIds(outputPath)
+	if err != nil {
+		return stats, err
+	}
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return stats, err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		err = errors.Join(err, output.Close())
+	}()
+	writer := bufio.NewWriter(output)
+	defer func() {
+		err = errors.Join(err, writer.Flush())
+	}()
+	encoder := json.NewEncoder(writer)
+
+	var batch []record
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		texts := make([]string, len(batch))
+		for i, r := range batch {
+			texts[i] = r.Text
+		}
+		embeddings, err := pipeline.RunPipeline(texts)
+		if err != nil {
+			return err
+		}
+		for i, r := range batch {
+			if err = encoder.Encode(embeddingRecord{Id: r.Id, Embedding: embeddings.Embeddings[i]}); err != nil {
+				return err
+			}
+			done[r.Id] = true
+		}
+		// flush each batch, so that an interrupted job loses at most one batch
+		if err = writer.Flush(); err != nil {
+			return err
+		}
+		stats.Embedded += len(batch)
+		stats.InputTokens += embeddings.InputTokens
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r record
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return stats, fmt.Errorf("line %d: %w", line, err)
+		}
+		if done[r.Id] {
+			stats.Skipped++
+			continue
+		}
+		batch = append(batch, r)
+		if len(batch) == batchSize {
+			if err = flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+func main() {
+	modelPath := flag.String("model", "", "path to a sentence embedding model, e.g. KnightsAnalytics/all-MiniLM-L6-v2")
+	inputPath := flag.String("input", "", "path to the .jsonl records to embed")
+	outputPath := flag.String("output", "", "path to the .jsonl embeddings file, created or appended to")
+	onnxLibraryPath := flag.String("onnxruntime", "", "path to onnxruntime.so")
+	batchSize := flag.Int("batch", 64, "number of records embedded per batch")
+	utilization := flag.Float64("utilization", 1, "share of the time the model runs, to leave cpu to the other workloads of the host")
+	flag.Parse()
+
+	if err := run(*modelPath, *inputPath, *outputPath, *onnxLibraryPath, *batchSize, *utilization); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(modelPath, inputPath, outputPath, onnxLibraryPath string, batchSize int, utilization float64) (err error) {
+	if modelPath == "" || inputPath == "" || outputPath == "" {
+		return errors.New("the model, input and output paths are required")
+	}
+	var options []hugot.WithOption
+	if onnxLibraryPath != "" {
+		options = append(options, hugot.WithOnnxLibraryPath(onnxLibraryPath))
+	}
+	session, err := hugot.NewSession(options...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, session.Destroy())
+	}()
+
+	pipeline, err := hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "embeddingBackfill",
+		Options: []hugot.FeatureExtractionOption{
+			pipelines.WithNormalization(),
+			pipelines.WithCPUThrottle[*pipelines.FeatureExtractionPipeline](utilization),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	stats, err := backfill(pipeline, inputPath, outputPath, batchSize)
+	log.Printf("embedded=%d skipped=%d tokens=%d duration=%s", stats.Embedded, stats.Skipped, stats.InputTokens, stats.Duration)
+	for _, line := range session.GetStats() {
+		log.Print(line)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot"
+)
+
+const onnxRuntimeSharedLibrary = "/usr/lib64/onnxruntime.so"
+
+func TestEmbeddingBackfill(t *testing.T) {
+	session, err := hugot.NewSession(hugot.WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *hugot.Session) {
+		check(t, session.Destroy())
+	}(session)
+
+	pipeline, err := hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+		ModelPath: path.Join("../../models", "KnightsAnalytics_all-MiniLM-L6-v2"),
+		Name:      "testBackfill",
+	})
+	check(t, err)
+
+	dir := t.TempDir()
+	inputPath := path.Join(dir, "records.jsonl")
+	outputPath := path.Join(dir, "embeddings.jsonl")
+	check(t, os.WriteFile(inputPath, []byte(`{"id": "1", "text": "first record"}
+{"id": "2", "text": "second record"}
+{"id": "3", "text": "third record"}
+`), 0o644))
+
+	stats, err := backfill(pipeline, inputPath, outputPath, 2)
+	check(t, err)
+	assert.Equal(t, 3, stats.Embedded)
+	assert.Equal(t, 0, stats.Skipped)
+	assert.Greater(t, stats.InputTokens, uint64(0))
+	ids, err := embeddedIds(outputPath)
+	check(t, err)
+	assert.Equal(t, map[string]bool{"1": true, "2": true, "3": true}, ids)
+
+	// a new run only embeds the new records
+	file, err := os.OpenFile(inputPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	check(t, err)
+	_, err = file.WriteString(`{"id": "4", "text": "fourth record"}` + "\n")
+	check(t, err)
+	check(t, file.Close())
+	stats, err = backfill(pipeline, inputPath, outputPath, 2)
+	check(t, err)
+	assert.Equal(t, 1, stats.Embedded)
+	assert.Equal(t, 3, stats.Skipped)
+	ids, err = embeddedIds(outputPath)
+	check(t, err)
+	assert.Len(t, ids, 4)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
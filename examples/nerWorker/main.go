@@ -0,0 +1,155 @@
+// Command nerWorker is an example enrichment worker. It reads {"id": "...", "text": "..."} records as .jsonl from
+// stdin, adds the named entities found in the text, and writes the enriched records as .jsonl to stdout. Statistics
+// are logged to stderr when the input is exhausted. Only the public hugot APIs are used.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// record is an input record. Fields other than id and text are not preserved.
+type record struct {
+	Id   string `json:"id"`
+	Text string `json:"text"`
+}
+
+type entity struct {
+	Type  string  `json:"type"`
+	Text  string  `json:"text"`
+	Start uint    `json:"start"`
+	End   uint    `json:"end"`
+	Score float32 `json:"score"`
+}
+
+type enrichedRecord struct {
+	record
+	Entities []entity `json:"entities"`
+	// Warnings are the non-fatal issues met while processing the record, e.g. truncation.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// workerStats counts the work done by the worker.
+type workerStats struct {
+	Records  int
+	Entities int
+	Batches  int
+	Warnings int
+}
+
+// enrich processes the records of reader in batches and writes the enriched records to writer.
+func enrich(pipeline *pipelines.TokenClassificationPipeline, reader io.Reader, writer io.Writer, batchSize int) (workerStats, error) {
+	var stats workerStats
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	encoder := json.NewEncoder(writer)
+
+	var batch []record
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		texts := make([]string, len(batch))
+		for i, r := range batch {
+			texts[i] = r.Text
+		}
+		output, err := pipeline.RunPipeline(texts)
+		if err != nil {
+			return err
+		}
+		warnings := make([][]string, len(batch))
+		for _, warning := range output.Warnings {
+			warnings[warning.Input] = append(warnings[warning.Input], warning.Message)
+			stats.Warnings++
+		}
+		for i, r := range batch {
+			enriched := enrichedRecord{record: r, Entities: []entity{}, Warnings: warnings[i]}
+			for _, e := range output.Entities[i] {
+				enriched.Entities = append(enriched.Entities, entity{Type: e.Entity, Text: strings.TrimSpace(e.Word), Start: e.Start, End: e.End, Score: e.Score})
+			}
+			stats.Entities += len(enriched.Entities)
+			if err = encoder.Encode(enriched); err != nil {
+				return err
+			}
+		}
+		stats.Records += len(batch)
+		stats.Batches++
+		batch = batch[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return stats, fmt.Errorf("record %d: %w", stats.Records+len(batch)+1, err)
+		}
+		batch = append(batch, r)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+func main() {
+	modelPath := flag.String("model", "", "path to a token classification model, e.g. KnightsAnalytics/distilbert-NER")
+	onnxLibraryPath := flag.String("onnxruntime", "", "path to onnxruntime.so")
+	batchSize := flag.Int("batch", 16, "number of records processed per batch")
+	flag.Parse()
+
+	if err := run(*modelPath, *onnxLibraryPath, *batchSize); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(modelPath, onnxLibraryPath string, batchSize int) (err error) {
+	if modelPath == "" {
+		return errors.New("the model path is required")
+	}
+	var options []hugot.WithOption
+	if onnxLibraryPath != "" {
+		options = append(options, hugot.WithOnnxLibraryPath(onnxLibraryPath))
+	}
+	session, err := hugot.NewSession(options...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, session.Destroy())
+	}()
+
+	pipeline, err := hugot.NewPipeline(session, hugot.TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "nerWorker",
+		Options:   []hugot.TokenClassificationOption{pipelines.WithSimpleAggregation()},
+	})
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	stats, err := enrich(pipeline, os.Stdin, writer, batchSize)
+	err = errors.Join(err, writer.Flush())
+	log.Printf("records=%d entities=%d batches=%d warnings=%d", stats.Records, stats.Entities, stats.Batches, stats.Warnings)
+	for _, line := range session.GetStats() {
+		log.Print(line)
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot"
+)
+
+const onnxRuntimeSharedLibrary = "/usr/lib64/onnxruntime.so"
+
+const records = `{"id": "1", "text": "Angela Merkel met Emmanuel Macron in Paris."}
+{"id": "2", "text": "nothing to see here"}
+
+{"id": "3", "text": "Apple opened a new office in London."}
+`
+
+func TestNERWorker(t *testing.T) {
+	session, err := hugot.NewSession(hugot.WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *hugot.Session) {
+		check(t, session.Destroy())
+	}(session)
+
+	pipeline, err := hugot.NewPipeline(session, hugot.TokenClassificationConfig{
+		ModelPath: path.Join("../../models", "KnightsAnalytics_distilbert-NER"),
+		Name:      "testNERWorker",
+	})
+	check(t, err)
+
+	var output bytes.Buffer
+	stats, err := enrich(pipeline, strings.NewReader(records), &output, 2)
+	check(t, err)
+	assert.Equal(t, 3, stats.Records)
+	assert.Equal(t, 2, stats.Batches)
+
+	var enriched []enrichedRecord
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		var r enrichedRecord
+		check(t, json.Unmarshal(scanner.Bytes(), &r))
+		enriched = append(enriched, r)
+	}
+	assert.Len(t, enriched, 3)
+	assert.Equal(t, "1", enriched[0].Id)
+	assert.Equal(t, "Angela Merkel", enriched[0].Entities[0].Text)
+	assert.Equal(t, "PER", enriched[0].Entities[0].Type)
+	assert.Empty(t, enriched[1].Entities)
+	assert.Equal(t, stats.Entities, len(enriched[0].Entities)+len(enriched[2].Entities))
+
+	_, err = enrich(pipeline, strings.NewReader("not json\n"), &output, 2)
+	assert.Error(t, err)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
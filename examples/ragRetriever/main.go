@@ -0,0 +1,217 @@
+// Command ragRetriever is an example retrieval service for retrieval-augmented generation. It embeds a corpus of
+// documents at startup and serves the documents most similar to a query over http:
+//
+//	POST /search {"query": "...", "k": 3} returns the top k documents and their similarity
+//	GET /stats returns the statistics of the hugot session
+//
+// The corpus is a .jsonl file of {"id": "...", "text": "..."} documents. Only the public hugot APIs are used.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// document is a line of the corpus file.
+type document struct {
+	Id   string `json:"id"`
+	Text string `json:"text"`
+}
+
+type searchRequest struct {
+	Query string `json:"query"`
+	K     int    `json:"k"`
+}
+
+type searchResult struct {
+	Id    string  `json:"id"`
+	Text  string  `json:"text"`
+	Score float32 `json:"score"`
+}
+
+// retriever holds the corpus and its embeddings in memory.
+type retriever struct {
+	session    *hugot.Session
+	embedder   *pipelines.FeatureExtractionPipeline
+	documents  []document
+	embeddings [][]float32
+	numQueries uint64
+	queryNS    uint64
+}
+
+// newRetriever creates the embedding pipeline and embeds the corpus in batches.
+func newRetriever(session *hugot.Session, modelPath string, documents []document, batchSize int) (*retriever, error) {
+	embedder, err := hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "retriever",
+		Options:   []hugot.FeatureExtractionOption{pipelines.WithNormalization()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &retriever{session: session, embedder: embedder, documents: documents}
+	for start := 0; start < len(documents); start += batchSize {
+		end := start + batchSize
+		if end > len(documents) {
+			end = len(documents)
+		}
+		texts := make([]string, 0, end-start)
+		for _, d := range documents[start:end] {
+			texts = append(texts, d.Text)
+		}
+		output, err := embedder.RunDocuments(texts)
+		if err != nil {
+			return nil, err
+		}
+		r.embeddings = append(r.embeddings, output.Embeddings...)
+	}
+	return r, nil
+}
+
+// search returns the k documents most similar to the query. The embeddings are normalized, so the dot product is
+// the cosine similarity.
+func (r *retriever) search(query string, k int) ([]searchResult, error) {
+	start := time.Now()
+	defer func() {
+		atomic.AddUint64(&r.numQueries, 1)
+		atomic.AddUint64(&r.queryNS, uint64(time.Since(start)))
+	}()
+
+	output, err := r.embedder.RunQueries([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]searchResult, len(r.documents))
+	for i, d := range r.documents {
+		results[i] = searchResult{Id: d.Id, Text: d.Text, Score: util.Dot(output.Embeddings[0], r.embeddings[i])}
+	}
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].Score > results[b].Score
+	})
+	if k > 0 && k < len(results) {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// stats returns the statistics of the session and of the queries served.
+func (r *retriever) stats() []string {
+	return append(r.session.GetStats(),
+		fmt.Sprintf("Retriever: Documents=%d, Queries=%d, Query time (ms)=%d",
+			len(r.documents), atomic.LoadUint64(&r.numQueries), atomic.LoadUint64(&r.queryNS)/1e6))
+}
+
+// handler serves the search and stats endpoints.
+func (r *retriever) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "search expects a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		var request searchRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Query == "" {
+			http.Error(w, "search expects a json body with a query", http.StatusBadRequest)
+			return
+		}
+		if request.K <= 0 {
+			request.K = 3
+		}
+		results, err := r.search(request.Query, request.K)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, results)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, r.stats())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("could not write response: %s", err)
+	}
+}
+
+// readDocuments reads a .jsonl corpus.
+func readDocuments(reader io.Reader) ([]document, error) {
+	var documents []document
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var d document
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("line %d: %w", len(documents)+1, err)
+		}
+		documents = append(documents, d)
+	}
+	return documents, scanner.Err()
+}
+
+func main() {
+	modelPath := flag.String("model", "", "path to a sentence embedding model, e.g. KnightsAnalytics/all-MiniLM-L6-v2")
+	corpusPath := flag.String("corpus", "", "path to the .jsonl corpus")
+	onnxLibraryPath := flag.String("onnxruntime", "", "path to onnxruntime.so")
+	address := flag.String("address", ":8080", "address to listen on")
+	batchSize := flag.Int("batch", 32, "batch size to embed the corpus")
+	flag.Parse()
+
+	if err := run(*modelPath, *corpusPath, *onnxLibraryPath, *address, *batchSize); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(modelPath, corpusPath, onnxLibraryPath, address string, batchSize int) (err error) {
+	if modelPath == "" || corpusPath == "" {
+		return errors.New("the model and corpus paths are required")
+	}
+	corpus, err := os.Open(corpusPath)
+	if err != nil {
+		return err
+	}
+	documents, err := readDocuments(corpus)
+	err = errors.Join(err, corpus.Close())
+	if err != nil {
+		return err
+	}
+
+	var options []hugot.WithOption
+	if onnxLibraryPath != "" {
+		options = append(options, hugot.WithOnnxLibraryPath(onnxLibraryPath))
+	}
+	session, err := hugot.NewSession(options...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, session.Destroy())
+	}()
+
+	r, err := newRetriever(session, modelPath, documents, batchSize)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving %d documents on %s", len(documents), address)
+	return http.ListenAndServe(address, r.handler())
+}
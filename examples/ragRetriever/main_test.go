@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot"
+)
+
+const onnxRuntimeSharedLibrary = "/usr/lib64/onnxruntime.so"
+
+const corpus = `{"id": "1", "text": "Berlin is the capital and largest city of Germany."}
+{"id": "2", "text": "The Eiffel Tower is a landmark of Paris."}
+{"id": "3", "text": "Photosynthesis converts light into chemical energy in plants."}
+`
+
+func TestRetrieverService(t *testing.T) {
+	session, err := hugot.NewSession(hugot.WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *hugot.Session) {
+		check(t, session.Destroy())
+	}(session)
+
+	documents, err := readDocuments(strings.NewReader(corpus))
+	check(t, err)
+	r, err := newRetriever(session, path.Join("../../models", "KnightsAnalytics_all-MiniLM-L6-v2"), documents, 2)
+	check(t, err)
+	server := httptest.NewServer(r.handler())
+	defer server.Close()
+
+	body, err := json.Marshal(searchRequest{Query: "What is the capital of Germany?", K: 2})
+	check(t, err)
+	response, err := http.Post(server.URL+"/search", "application/json", bytes.NewReader(body))
+	check(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var results []searchResult
+	check(t, json.NewDecoder(response.Body).Decode(&results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, "1", results[0].Id)
+	assert.Greater(t, results[0].Score, results[1].Score)
+
+	invalid, err := http.Post(server.URL+"/search", "application/json", strings.NewReader("{}"))
+	check(t, err)
+	defer invalid.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, invalid.StatusCode)
+
+	stats, err := http.Get(server.URL + "/stats")
+	check(t, err)
+	defer stats.Body.Close()
+	var lines []string
+	check(t, json.NewDecoder(stats.Body).Decode(&lines))
+	assert.Contains(t, lines[len(lines)-1], "Documents=3, Queries=1")
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 
 	util "github.com/knights-analytics/hugot/utils"
 
@@ -14,10 +16,38 @@ import (
 
 // Session allows for the creation of new pipelines and holds the pipeline already created.
 type Session struct {
-	featureExtractionPipelines   pipelineMap[*pipelines.FeatureExtractionPipeline]
-	tokenClassificationPipelines pipelineMap[*pipelines.TokenClassificationPipeline]
-	textClassificationPipelines  pipelineMap[*pipelines.TextClassificationPipeline]
-	ortOptions                   *ort.SessionOptions
+	featureExtractionPipelines           pipelineMap[*pipelines.FeatureExtractionPipeline]
+	tokenClassificationPipelines         pipelineMap[*pipelines.TokenClassificationPipeline]
+	textClassificationPipelines          pipelineMap[*pipelines.TextClassificationPipeline]
+	promptInjectionPipelines             pipelineMap[*pipelines.PromptInjectionPipeline]
+	intentSlotFillingPipelines           pipelineMap[*pipelines.IntentSlotFillingPipeline]
+	textGenerationPipelines              pipelineMap[*pipelines.TextGenerationPipeline]
+	translationPipelines                 pipelineMap[*pipelines.TranslationPipeline]
+	rerankingPipelines                   pipelineMap[*pipelines.RerankingPipeline]
+	zeroShotImageClassificationPipelines pipelineMap[*pipelines.ZeroShotImageClassificationPipeline]
+	automaticSpeechRecognitionPipelines  pipelineMap[*pipelines.AutomaticSpeechRecognitionPipeline]
+	documentQuestionAnsweringPipelines   pipelineMap[*pipelines.DocumentQuestionAnsweringPipeline]
+	imageToTextPipelines                 pipelineMap[*pipelines.ImageToTextPipeline]
+	imageSegmentationPipelines           pipelineMap[*pipelines.ImageSegmentationPipeline]
+	audioClassificationPipelines         pipelineMap[*pipelines.AudioClassificationPipeline]
+	maskGenerationPipelines              pipelineMap[*pipelines.MaskGenerationPipeline]
+	text2TextGenerationPipelines         pipelineMap[*pipelines.Text2TextGenerationPipeline]
+	glinerPipelines                      pipelineMap[*pipelines.GLiNERPipeline]
+	setFitPipelines                      pipelineMap[*pipelines.SetFitPipeline]
+	ortOptions                           *ort.SessionOptions
+	fallbackOptions                      *ortOptions
+	cpuFallback                          bool
+	cpuFallbackCause                     error
+	// pipelineDefaults are the default options of the pipelines, set with WithPipelineDefaults.
+	pipelineDefaults []any
+	// stateHandles are the state handles of the streams of stateful models, see GetStateHandle.
+	stateHandles *stateHandles
+}
+
+// stateHandles are the state handles of a session by stream id.
+type stateHandles struct {
+	mutex   sync.Mutex
+	handles map[string]*pipelines.StateHandle
 }
 
 type pipelineMap[T pipelines.Pipeline] map[string]T
@@ -38,6 +68,28 @@ func (m pipelineMap[T]) GetStats() []string {
 	return stats
 }
 
+func (m pipelineMap[T]) GetStatistics() []pipelines.PipelineStatistics {
+	var statistics []pipelines.PipelineStatistics
+	for _, p := range m {
+		if s, ok := any(p).(interface {
+			GetStatistics() pipelines.PipelineStatistics
+		}); ok {
+			statistics = append(statistics, s.GetStatistics())
+		}
+	}
+	return statistics
+}
+
+func (m pipelineMap[T]) GetTotalUsage() pipelines.Usage {
+	var usage pipelines.Usage
+	for _, p := range m {
+		if u, ok := any(p).(interface{ GetTotalUsage() pipelines.Usage }); ok {
+			usage = usage.Add(u.GetTotalUsage())
+		}
+	}
+	return usage
+}
+
 // TokenClassificationConfig is the configuration for a token classification pipeline
 type TokenClassificationConfig = pipelines.PipelineConfig[*pipelines.TokenClassificationPipeline]
 
@@ -47,6 +99,51 @@ type TextClassificationConfig = pipelines.PipelineConfig[*pipelines.TextClassifi
 // FeatureExtractionConfig is the configuration for a feature extraction pipeline
 type FeatureExtractionConfig = pipelines.PipelineConfig[*pipelines.FeatureExtractionPipeline]
 
+// PromptInjectionConfig is the configuration for a prompt injection detection pipeline
+type PromptInjectionConfig = pipelines.PipelineConfig[*pipelines.PromptInjectionPipeline]
+
+// IntentSlotFillingConfig is the configuration for a joint intent classification and slot filling pipeline
+type IntentSlotFillingConfig = pipelines.PipelineConfig[*pipelines.IntentSlotFillingPipeline]
+
+// TextGenerationConfig is the configuration for a text generation pipeline
+type TextGenerationConfig = pipelines.PipelineConfig[*pipelines.TextGenerationPipeline]
+
+// TranslationConfig is the configuration for a translation pipeline
+type TranslationConfig = pipelines.PipelineConfig[*pipelines.TranslationPipeline]
+
+// RerankingConfig is the configuration for a reranking pipeline
+type RerankingConfig = pipelines.PipelineConfig[*pipelines.RerankingPipeline]
+
+// ZeroShotImageClassificationConfig is the configuration for a zero-shot image classification pipeline
+type ZeroShotImageClassificationConfig = pipelines.PipelineConfig[*pipelines.ZeroShotImageClassificationPipeline]
+
+// AutomaticSpeechRecognitionConfig is the configuration for a speech recognition pipeline
+type AutomaticSpeechRecognitionConfig = pipelines.PipelineConfig[*pipelines.AutomaticSpeechRecognitionPipeline]
+
+// DocumentQuestionAnsweringConfig is the configuration for a document question answering pipeline
+type DocumentQuestionAnsweringConfig = pipelines.PipelineConfig[*pipelines.DocumentQuestionAnsweringPipeline]
+
+// ImageToTextConfig is the configuration for a image to text pipeline
+type ImageToTextConfig = pipelines.PipelineConfig[*pipelines.ImageToTextPipeline]
+
+// ImageSegmentationConfig is the configuration for a image segmentation pipeline
+type ImageSegmentationConfig = pipelines.PipelineConfig[*pipelines.ImageSegmentationPipeline]
+
+// AudioClassificationConfig is the configuration for a audio classification pipeline
+type AudioClassificationConfig = pipelines.PipelineConfig[*pipelines.AudioClassificationPipeline]
+
+// MaskGenerationConfig is the configuration for a mask generation pipeline
+type MaskGenerationConfig = pipelines.PipelineConfig[*pipelines.MaskGenerationPipeline]
+
+// Text2TextGenerationConfig is the configuration for a text2text generation pipeline
+type Text2TextGenerationConfig = pipelines.PipelineConfig[*pipelines.Text2TextGenerationPipeline]
+
+// GLiNERConfig is the configuration for a GLiNER open vocabulary NER pipeline
+type GLiNERConfig = pipelines.PipelineConfig[*pipelines.GLiNERPipeline]
+
+// SetFitConfig is the configuration for a SetFit classification pipeline
+type SetFitConfig = pipelines.PipelineConfig[*pipelines.SetFitPipeline]
+
 // TokenClassificationOption is an option for a token classification pipeline
 type TokenClassificationOption = pipelines.PipelineOption[*pipelines.TokenClassificationPipeline]
 
@@ -56,6 +153,51 @@ type TextClassificationOption = pipelines.PipelineOption[*pipelines.TextClassifi
 // FeatureExtractionOption is an option for a feature extraction pipeline
 type FeatureExtractionOption = pipelines.PipelineOption[*pipelines.FeatureExtractionPipeline]
 
+// PromptInjectionOption is an option for a prompt injection detection pipeline
+type PromptInjectionOption = pipelines.PipelineOption[*pipelines.PromptInjectionPipeline]
+
+// IntentSlotFillingOption is an option for a joint intent classification and slot filling pipeline
+type IntentSlotFillingOption = pipelines.PipelineOption[*pipelines.IntentSlotFillingPipeline]
+
+// TextGenerationOption is an option for a text generation pipeline
+type TextGenerationOption = pipelines.PipelineOption[*pipelines.TextGenerationPipeline]
+
+// TranslationOption is an option for a translation pipeline
+type TranslationOption = pipelines.PipelineOption[*pipelines.TranslationPipeline]
+
+// RerankingOption is an option for a reranking pipeline
+type RerankingOption = pipelines.PipelineOption[*pipelines.RerankingPipeline]
+
+// ZeroShotImageClassificationOption is an option for a zero-shot image classification pipeline
+type ZeroShotImageClassificationOption = pipelines.PipelineOption[*pipelines.ZeroShotImageClassificationPipeline]
+
+// AutomaticSpeechRecognitionOption is an option for a speech recognition pipeline
+type AutomaticSpeechRecognitionOption = pipelines.PipelineOption[*pipelines.AutomaticSpeechRecognitionPipeline]
+
+// DocumentQuestionAnsweringOption is an option for a document question answering pipeline
+type DocumentQuestionAnsweringOption = pipelines.PipelineOption[*pipelines.DocumentQuestionAnsweringPipeline]
+
+// ImageToTextOption is an option for a image to text pipeline
+type ImageToTextOption = pipelines.PipelineOption[*pipelines.ImageToTextPipeline]
+
+// ImageSegmentationOption is an option for a image segmentation pipeline
+type ImageSegmentationOption = pipelines.PipelineOption[*pipelines.ImageSegmentationPipeline]
+
+// AudioClassificationOption is an option for a audio classification pipeline
+type AudioClassificationOption = pipelines.PipelineOption[*pipelines.AudioClassificationPipeline]
+
+// MaskGenerationOption is an option for a mask generation pipeline
+type MaskGenerationOption = pipelines.PipelineOption[*pipelines.MaskGenerationPipeline]
+
+// Text2TextGenerationOption is an option for a text2text generation pipeline
+type Text2TextGenerationOption = pipelines.PipelineOption[*pipelines.Text2TextGenerationPipeline]
+
+// GLiNEROption is an option for a GLiNER open vocabulary NER pipeline
+type GLiNEROption = pipelines.PipelineOption[*pipelines.GLiNERPipeline]
+
+// SetFitOption is an option for a SetFit classification pipeline
+type SetFitOption = pipelines.PipelineOption[*pipelines.SetFitPipeline]
+
 // NewSession is the main entrypoint to hugot and is used to create a new hugot session object.
 // ortLibraryPath should be the path to onnxruntime.so. If it's the empty string, hugot will try
 // to load the library from the default location (/usr/lib/onnxruntime.so).
@@ -69,9 +211,25 @@ func NewSession(options ...WithOption) (*Session, error) {
 	}
 
 	session := &Session{
-		featureExtractionPipelines:   map[string]*pipelines.FeatureExtractionPipeline{},
-		tokenClassificationPipelines: map[string]*pipelines.TokenClassificationPipeline{},
-		textClassificationPipelines:  map[string]*pipelines.TextClassificationPipeline{},
+		featureExtractionPipelines:           map[string]*pipelines.FeatureExtractionPipeline{},
+		tokenClassificationPipelines:         map[string]*pipelines.TokenClassificationPipeline{},
+		textClassificationPipelines:          map[string]*pipelines.TextClassificationPipeline{},
+		promptInjectionPipelines:             map[string]*pipelines.PromptInjectionPipeline{},
+		intentSlotFillingPipelines:           map[string]*pipelines.IntentSlotFillingPipeline{},
+		textGenerationPipelines:              map[string]*pipelines.TextGenerationPipeline{},
+		translationPipelines:                 map[string]*pipelines.TranslationPipeline{},
+		rerankingPipelines:                   map[string]*pipelines.RerankingPipeline{},
+		zeroShotImageClassificationPipelines: map[string]*pipelines.ZeroShotImageClassificationPipeline{},
+		automaticSpeechRecognitionPipelines:  map[string]*pipelines.AutomaticSpeechRecognitionPipeline{},
+		documentQuestionAnsweringPipelines:   map[string]*pipelines.DocumentQuestionAnsweringPipeline{},
+		imageToTextPipelines:                 map[string]*pipelines.ImageToTextPipeline{},
+		imageSegmentationPipelines:           map[string]*pipelines.ImageSegmentationPipeline{},
+		audioClassificationPipelines:         map[string]*pipelines.AudioClassificationPipeline{},
+		maskGenerationPipelines:              map[string]*pipelines.MaskGenerationPipeline{},
+		text2TextGenerationPipelines:         map[string]*pipelines.Text2TextGenerationPipeline{},
+		glinerPipelines:                      map[string]*pipelines.GLiNERPipeline{},
+		setFitPipelines:                      map[string]*pipelines.SetFitPipeline{},
+		stateHandles:                         &stateHandles{handles: map[string]*pipelines.StateHandle{}},
 	}
 
 	// set session options and initialise
@@ -94,6 +252,10 @@ func (s *Session) initialiseORT(options ...WithOption) (bool, error) {
 		option(o)
 	}
 
+	if o.mixedPrecision && !o.tensorRTOptionsSet {
+		return false, errors.New("mixed precision requires the TensorRT execution provider, see WithTensorRT")
+	}
+
 	// Set pre-initialisation options
 	if o.libraryPath != "" {
 		ortPathExists, err := util.FileSystem.Exists(context.Background(), o.libraryPath)
@@ -121,80 +283,176 @@ func (s *Session) initialiseORT(options ...WithOption) (bool, error) {
 		}
 	}
 
+	s.pipelineDefaults = o.pipelineDefaults
+
 	// Create session options for use in all pipelines
-	sessionOptions, optionsError := ort.NewSessionOptions()
-	if optionsError != nil {
-		return true, optionsError
+	sessionOptions, err := newSessionOptions(o)
+	if err != nil {
+		return true, err
 	}
 	s.ortOptions = sessionOptions
 
+	if err = appendExecutionProviders(sessionOptions, o); err != nil {
+		if !o.fallbackToCPU {
+			return true, err
+		}
+		s.fallbackOptions = o
+		cpuOptions, optionsErr := newSessionOptions(o)
+		if optionsErr != nil {
+			return true, errors.Join(err, optionsErr)
+		}
+		if fallbackErr := s.fallBackToCPU(err, cpuOptions); fallbackErr != nil {
+			return true, errors.Join(err, fallbackErr)
+		}
+	} else if o.fallbackToCPU && o.hasExecutionProvider() {
+		// execution providers can also fail when the first onnx session is created, e.g. if the device is busy
+		s.fallbackOptions = o
+	}
+
+	return true, nil
+}
+
+// newSessionOptions creates onnxruntime session options with the cpu settings and no execution provider.
+func newSessionOptions(o *ortOptions) (*ort.SessionOptions, error) {
+	sessionOptions, err := ort.NewSessionOptions()
+	if err != nil {
+		return nil, err
+	}
 	if o.intraOpNumThreads != 0 {
 		if err := sessionOptions.SetIntraOpNumThreads(o.intraOpNumThreads); err != nil {
-			return true, err
+			return nil, errors.Join(err, sessionOptions.Destroy())
 		}
 	}
 	if o.interOpNumThreads != 0 {
 		if err := sessionOptions.SetInterOpNumThreads(o.interOpNumThreads); err != nil {
-			return true, err
+			return nil, errors.Join(err, sessionOptions.Destroy())
 		}
 	}
 	if o.cpuMemArenaSet {
 		if err := sessionOptions.SetCpuMemArena(o.cpuMemArena); err != nil {
-			return true, err
+			return nil, errors.Join(err, sessionOptions.Destroy())
 		}
 	}
 	if o.memPatternSet {
 		if err := sessionOptions.SetMemPattern(o.memPattern); err != nil {
-			return true, err
+			return nil, errors.Join(err, sessionOptions.Destroy())
 		}
 	}
+	return sessionOptions, nil
+}
+
+// appendExecutionProviders adds the configured execution providers to the session options.
+func appendExecutionProviders(sessionOptions *ort.SessionOptions, o *ortOptions) error {
 	if o.cudaOptionsSet {
 		cudaOptions, optErr := ort.NewCUDAProviderOptions()
 		if optErr != nil {
-			return true, optErr
+			return optErr
 		}
 		if len(o.cudaOptions) > 0 {
 			optErr = cudaOptions.Update(o.cudaOptions)
 			if optErr != nil {
-				return true, optErr
+				return optErr
 			}
 		}
 		if err := sessionOptions.AppendExecutionProviderCUDA(cudaOptions); err != nil {
-			return true, err
+			return err
 		}
 	}
 	if o.coreMLOptionsSet {
 		if err := sessionOptions.AppendExecutionProviderCoreML(o.coreMLOptions); err != nil {
-			return true, err
+			return err
 		}
 	}
 	if o.directMLOptionsSet {
 		if err := sessionOptions.AppendExecutionProviderDirectML(o.directMLOptions); err != nil {
-			return true, err
+			return err
 		}
 	}
 	if o.openVINOOptionsSet {
 		if err := sessionOptions.AppendExecutionProviderOpenVINO(o.openVINOOptions); err != nil {
-			return true, err
+			return err
 		}
 	}
 	if o.tensorRTOptionsSet {
 		tensorRTOptions, optErr := ort.NewTensorRTProviderOptions()
 		if optErr != nil {
-			return true, optErr
+			return optErr
 		}
-		if len(o.cudaOptions) > 0 {
-			optErr = tensorRTOptions.Update(o.tensorRTOptions)
+		providerOptions := map[string]string{}
+		for key, value := range o.tensorRTOptions {
+			providerOptions[key] = value
+		}
+		if o.mixedPrecision {
+			providerOptions["trt_fp16_enable"] = "1"
+		}
+		if len(providerOptions) > 0 {
+			optErr = tensorRTOptions.Update(providerOptions)
 			if optErr != nil {
-				return true, optErr
+				return optErr
 			}
 		}
 		if err := sessionOptions.AppendExecutionProviderTensorRT(tensorRTOptions); err != nil {
-			return true, err
+			return err
 		}
 	}
 
-	return true, nil
+	return nil
+}
+
+// fallBackToCPU replaces the session options with cpuOptions, which have no execution providers, after the
+// configured providers failed with cause, kept for CPUFallbackCause. Pipelines created from then on run on CPU.
+func (s *Session) fallBackToCPU(cause error, cpuOptions *ort.SessionOptions) error {
+	previousOptions := s.ortOptions
+	s.ortOptions = cpuOptions
+	s.cpuFallback = true
+	s.cpuFallbackCause = cause
+	return previousOptions.Destroy()
+}
+
+// AvailableProviders returns the execution providers supported by the loaded onnxruntime library, among CPU, CUDA,
+// TensorRT, CoreML, DirectML and OpenVINO. A provider is supported if it can be added to session options, which does
+// not guarantee that a device is present: use WithFallbackToCPU to handle devices failing at runtime. A session must
+// have been created so that the onnxruntime library is loaded.
+func AvailableProviders() ([]string, error) {
+	if !ort.IsInitialized() {
+		return nil, errors.New("the onnxruntime library is not loaded, create a session before probing providers")
+	}
+	probes := []struct {
+		name    string
+		options ortOptions
+	}{
+		{name: "CUDA", options: ortOptions{cudaOptionsSet: true}},
+		{name: "TensorRT", options: ortOptions{tensorRTOptionsSet: true}},
+		{name: "CoreML", options: ortOptions{coreMLOptionsSet: true}},
+		{name: "DirectML", options: ortOptions{directMLOptionsSet: true}},
+		{name: "OpenVINO", options: ortOptions{openVINOOptionsSet: true}},
+	}
+	providers := []string{"CPU"}
+	for _, probe := range probes {
+		sessionOptions, err := ort.NewSessionOptions()
+		if err != nil {
+			return nil, err
+		}
+		if appendExecutionProviders(sessionOptions, &probe.options) == nil {
+			providers = append(providers, probe.name)
+		}
+		if err = sessionOptions.Destroy(); err != nil {
+			return nil, err
+		}
+	}
+	return providers, nil
+}
+
+// UsesCPUFallback reports whether the session fell back to CPU because the configured execution providers failed
+// to initialise. See WithFallbackToCPU.
+func (s *Session) UsesCPUFallback() bool {
+	return s.cpuFallback
+}
+
+// CPUFallbackCause returns the error of the execution providers that made the session fall back to CPU, nil if it
+// did not, so that callers can log or alert on it.
+func (s *Session) CPUFallbackCause() error {
+	return s.cpuFallbackCause
 }
 
 type pipelineNotFoundError struct {
@@ -223,6 +481,47 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		return pipeline, getError
 	}
 
+	pipelineConfig.Options = withPipelineDefaults(s, pipelineConfig.Options)
+	pipeline, err = newPipeline(s, pipelineConfig)
+	if err != nil && s.fallbackOptions != nil && !s.cpuFallback {
+		// the execution provider may have failed to create the onnx session, retry on CPU
+		gpuOptions := s.ortOptions
+		cpuOptions, optionsErr := newSessionOptions(s.fallbackOptions)
+		if optionsErr != nil {
+			return pipeline, errors.Join(err, optionsErr)
+		}
+		s.ortOptions = cpuOptions
+		cpuPipeline, cpuErr := newPipeline(s, pipelineConfig)
+		if cpuErr != nil {
+			// the pipeline fails on CPU too, so the error is not due to the execution provider
+			s.ortOptions = gpuOptions
+			return pipeline, errors.Join(err, cpuOptions.Destroy())
+		}
+		s.ortOptions = gpuOptions
+		return cpuPipeline, s.fallBackToCPU(err, cpuOptions)
+	}
+	return pipeline, err
+}
+
+// withPipelineDefaults returns the default options of the session for the pipelines of type T followed by options,
+// so that options override the defaults.
+func withPipelineDefaults[T pipelines.Pipeline](s *Session, options []pipelines.PipelineOption[T]) []pipelines.PipelineOption[T] {
+	var withDefaults []pipelines.PipelineOption[T]
+	for _, option := range s.pipelineDefaults {
+		if defaultOption, ok := option.(pipelines.PipelineOption[T]); ok {
+			withDefaults = append(withDefaults, defaultOption)
+		}
+	}
+	if len(withDefaults) == 0 {
+		return options
+	}
+	return append(withDefaults, options...)
+}
+
+// newPipeline initialises a pipeline with the session options and stores it in the session.
+func newPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.PipelineConfig[T]) (T, error) {
+	var pipeline T
+	var err error
 	switch any(pipeline).(type) {
 	case *pipelines.TokenClassificationPipeline:
 		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TokenClassificationPipeline])
@@ -248,6 +547,126 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		}
 		s.featureExtractionPipelines[config.Name] = pipelineInitialised
 		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.PromptInjectionPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.PromptInjectionPipeline])
+		pipelineInitialised, err := pipelines.NewPromptInjectionPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.promptInjectionPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.IntentSlotFillingPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.IntentSlotFillingPipeline])
+		pipelineInitialised, err := pipelines.NewIntentSlotFillingPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.intentSlotFillingPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.TextGenerationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TextGenerationPipeline])
+		pipelineInitialised, err := pipelines.NewTextGenerationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.textGenerationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.TranslationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TranslationPipeline])
+		pipelineInitialised, err := pipelines.NewTranslationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.translationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.RerankingPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.RerankingPipeline])
+		pipelineInitialised, err := pipelines.NewRerankingPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.rerankingPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ZeroShotImageClassificationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ZeroShotImageClassificationPipeline])
+		pipelineInitialised, err := pipelines.NewZeroShotImageClassificationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.zeroShotImageClassificationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.AutomaticSpeechRecognitionPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.AutomaticSpeechRecognitionPipeline])
+		pipelineInitialised, err := pipelines.NewAutomaticSpeechRecognitionPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.automaticSpeechRecognitionPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.DocumentQuestionAnsweringPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.DocumentQuestionAnsweringPipeline])
+		pipelineInitialised, err := pipelines.NewDocumentQuestionAnsweringPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.documentQuestionAnsweringPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ImageToTextPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ImageToTextPipeline])
+		pipelineInitialised, err := pipelines.NewImageToTextPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.imageToTextPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ImageSegmentationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ImageSegmentationPipeline])
+		pipelineInitialised, err := pipelines.NewImageSegmentationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.imageSegmentationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.AudioClassificationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.AudioClassificationPipeline])
+		pipelineInitialised, err := pipelines.NewAudioClassificationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.audioClassificationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.MaskGenerationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.MaskGenerationPipeline])
+		pipelineInitialised, err := pipelines.NewMaskGenerationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.maskGenerationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.Text2TextGenerationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.Text2TextGenerationPipeline])
+		pipelineInitialised, err := pipelines.NewText2TextGenerationPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.text2TextGenerationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.GLiNERPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.GLiNERPipeline])
+		pipelineInitialised, err := pipelines.NewGLiNERPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.glinerPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.SetFitPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.SetFitPipeline])
+		pipelineInitialised, err := pipelines.NewSetFitPipeline(config, s.ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.setFitPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
 	default:
 		return pipeline, fmt.Errorf("not implemented")
 	}
@@ -276,6 +695,96 @@ func GetPipeline[T pipelines.Pipeline](s *Session, name string) (T, error) {
 			return pipeline, &pipelineNotFoundError{pipelineName: name}
 		}
 		return any(p).(T), nil
+	case *pipelines.PromptInjectionPipeline:
+		p, ok := s.promptInjectionPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.IntentSlotFillingPipeline:
+		p, ok := s.intentSlotFillingPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.TextGenerationPipeline:
+		p, ok := s.textGenerationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.TranslationPipeline:
+		p, ok := s.translationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.RerankingPipeline:
+		p, ok := s.rerankingPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ZeroShotImageClassificationPipeline:
+		p, ok := s.zeroShotImageClassificationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.AutomaticSpeechRecognitionPipeline:
+		p, ok := s.automaticSpeechRecognitionPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.DocumentQuestionAnsweringPipeline:
+		p, ok := s.documentQuestionAnsweringPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ImageToTextPipeline:
+		p, ok := s.imageToTextPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ImageSegmentationPipeline:
+		p, ok := s.imageSegmentationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.AudioClassificationPipeline:
+		p, ok := s.audioClassificationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.MaskGenerationPipeline:
+		p, ok := s.maskGenerationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.Text2TextGenerationPipeline:
+		p, ok := s.text2TextGenerationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.GLiNERPipeline:
+		p, ok := s.glinerPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.SetFitPipeline:
+		p, ok := s.setFitPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
 	default:
 		return pipeline, errors.New("pipeline type not supported")
 	}
@@ -284,15 +793,54 @@ func GetPipeline[T pipelines.Pipeline](s *Session, name string) (T, error) {
 // Destroy deletes the hugot session and onnxruntime environment and all initialized pipelines, freeing memory.
 // A hugot session should be destroyed when not neeeded anymore, preferably with a defer() call.
 func (s *Session) Destroy() error {
+	s.stateHandles.mutex.Lock()
+	s.stateHandles.handles = map[string]*pipelines.StateHandle{}
+	s.stateHandles.mutex.Unlock()
 	return errors.Join(
 		s.featureExtractionPipelines.Destroy(),
 		s.tokenClassificationPipelines.Destroy(),
 		s.textClassificationPipelines.Destroy(),
+		s.promptInjectionPipelines.Destroy(),
+		s.intentSlotFillingPipelines.Destroy(),
+		s.textGenerationPipelines.Destroy(),
+		s.translationPipelines.Destroy(),
+		s.rerankingPipelines.Destroy(),
+		s.zeroShotImageClassificationPipelines.Destroy(),
+		s.automaticSpeechRecognitionPipelines.Destroy(),
+		s.documentQuestionAnsweringPipelines.Destroy(),
+		s.imageToTextPipelines.Destroy(),
+		s.imageSegmentationPipelines.Destroy(),
+		s.audioClassificationPipelines.Destroy(),
+		s.maskGenerationPipelines.Destroy(),
+		s.text2TextGenerationPipelines.Destroy(),
+		s.glinerPipelines.Destroy(),
+		s.setFitPipelines.Destroy(),
 		s.ortOptions.Destroy(),
 		ort.DestroyEnvironment(),
 	)
 }
 
+// GetStateHandle returns the state handle of a stream of a stateful model, e.g. a connection or a document id,
+// creating it on first use. It is passed to the RunWithState method of the pipelines, and kept by the session until
+// ReleaseStateHandle or Destroy.
+func (s *Session) GetStateHandle(id string) *pipelines.StateHandle {
+	s.stateHandles.mutex.Lock()
+	defer s.stateHandles.mutex.Unlock()
+	handle, ok := s.stateHandles.handles[id]
+	if !ok {
+		handle = pipelines.NewStateHandle()
+		s.stateHandles.handles[id] = handle
+	}
+	return handle
+}
+
+// ReleaseStateHandle forgets the state handle of a stream, e.g. when it ends.
+func (s *Session) ReleaseStateHandle(id string) {
+	s.stateHandles.mutex.Lock()
+	defer s.stateHandles.mutex.Unlock()
+	delete(s.stateHandles.handles, id)
+}
+
 // GetStats returns runtime statistics for all initialized pipelines for profiling purposes. We currently record for each pipeline:
 // the total runtime of the tokenization step
 // the number of batch calls to the tokenization step
@@ -302,10 +850,102 @@ func (s *Session) Destroy() error {
 // the average time per onnxruntime inference batch call
 func (s *Session) GetStats() []string {
 	// slices.Concat() is not implemented in experimental x/exp/slices package
-	return append(append(s.tokenClassificationPipelines.GetStats(),
-		s.textClassificationPipelines.GetStats()...),
-		s.featureExtractionPipelines.GetStats()...,
-	)
+	var stats []string
+	for _, pipelineStats := range [][]string{
+		s.tokenClassificationPipelines.GetStats(),
+		s.textClassificationPipelines.GetStats(),
+		s.featureExtractionPipelines.GetStats(),
+		s.promptInjectionPipelines.GetStats(),
+		s.intentSlotFillingPipelines.GetStats(),
+		s.textGenerationPipelines.GetStats(),
+		s.translationPipelines.GetStats(),
+		s.rerankingPipelines.GetStats(),
+		s.zeroShotImageClassificationPipelines.GetStats(),
+		s.automaticSpeechRecognitionPipelines.GetStats(),
+		s.documentQuestionAnsweringPipelines.GetStats(),
+		s.imageToTextPipelines.GetStats(),
+		s.imageSegmentationPipelines.GetStats(),
+		s.audioClassificationPipelines.GetStats(),
+		s.maskGenerationPipelines.GetStats(),
+		s.text2TextGenerationPipelines.GetStats(),
+		s.glinerPipelines.GetStats(),
+		s.setFitPipelines.GetStats(),
+	} {
+		stats = append(stats, pipelineStats...)
+	}
+	usage := s.GetTotalUsage()
+	stats = append(stats, fmt.Sprintf("Session tokens: Input=%d, Generated=%d", usage.InputTokens, usage.GeneratedTokens))
+	return stats
+}
+
+// SessionStatistics is a snapshot of the statistics of the pipelines of a session, the structured counterpart of
+// GetStats, e.g. to be written as json at the end of a batch job.
+type SessionStatistics struct {
+	// Pipelines are the statistics of each pipeline, sorted by name.
+	Pipelines []pipelines.PipelineStatistics
+	// Usage is the number of tokens processed by all the pipelines.
+	Usage pipelines.Usage
+}
+
+// GetStatistics returns a snapshot of the statistics of the pipelines of the session. The pipelines should not be
+// running for the snapshot to be consistent.
+func (s *Session) GetStatistics() SessionStatistics {
+	var statistics SessionStatistics
+	for _, pipelineStatistics := range [][]pipelines.PipelineStatistics{
+		s.tokenClassificationPipelines.GetStatistics(),
+		s.textClassificationPipelines.GetStatistics(),
+		s.featureExtractionPipelines.GetStatistics(),
+		s.promptInjectionPipelines.GetStatistics(),
+		s.intentSlotFillingPipelines.GetStatistics(),
+		s.textGenerationPipelines.GetStatistics(),
+		s.translationPipelines.GetStatistics(),
+		s.rerankingPipelines.GetStatistics(),
+		s.zeroShotImageClassificationPipelines.GetStatistics(),
+		s.automaticSpeechRecognitionPipelines.GetStatistics(),
+		s.documentQuestionAnsweringPipelines.GetStatistics(),
+		s.imageToTextPipelines.GetStatistics(),
+		s.imageSegmentationPipelines.GetStatistics(),
+		s.audioClassificationPipelines.GetStatistics(),
+		s.maskGenerationPipelines.GetStatistics(),
+		s.text2TextGenerationPipelines.GetStatistics(),
+		s.glinerPipelines.GetStatistics(),
+		s.setFitPipelines.GetStatistics(),
+	} {
+		statistics.Pipelines = append(statistics.Pipelines, pipelineStatistics...)
+	}
+	sort.Slice(statistics.Pipelines, func(i, j int) bool {
+		return statistics.Pipelines[i].Name < statistics.Pipelines[j].Name
+	})
+	statistics.Usage = s.GetTotalUsage()
+	return statistics
+}
+
+// GetTotalUsage returns the tokens processed by all the pipelines of the session.
+func (s *Session) GetTotalUsage() pipelines.Usage {
+	var usage pipelines.Usage
+	for _, pipelineUsage := range []pipelines.Usage{
+		s.tokenClassificationPipelines.GetTotalUsage(),
+		s.textClassificationPipelines.GetTotalUsage(),
+		s.featureExtractionPipelines.GetTotalUsage(),
+		s.promptInjectionPipelines.GetTotalUsage(),
+		s.intentSlotFillingPipelines.GetTotalUsage(),
+		s.textGenerationPipelines.GetTotalUsage(),
+		s.translationPipelines.GetTotalUsage(),
+		s.rerankingPipelines.GetTotalUsage(),
+		s.zeroShotImageClassificationPipelines.GetTotalUsage(),
+		s.automaticSpeechRecognitionPipelines.GetTotalUsage(),
+		s.documentQuestionAnsweringPipelines.GetTotalUsage(),
+		s.imageToTextPipelines.GetTotalUsage(),
+		s.imageSegmentationPipelines.GetTotalUsage(),
+		s.audioClassificationPipelines.GetTotalUsage(),
+		s.maskGenerationPipelines.GetTotalUsage(),
+		s.text2TextGenerationPipelines.GetTotalUsage(),
+		s.glinerPipelines.GetTotalUsage(),
+		s.setFitPipelines.GetTotalUsage(),
+	} {
+		usage = usage.Add(pipelineUsage)
+	}
+	return usage
 }
 
 // deprecated methods
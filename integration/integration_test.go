@@ -0,0 +1,252 @@
+//go:build INTEGRATION
+
+// Package integration holds the end-to-end tests of the hugot pipelines. Unlike the unit tests, they do not depend on
+// a models folder layout: the small models they use are downloaded at the revision of their fixture into a cache
+// folder, and each pipeline is run on every execution provider selected. Run them with
+//
+//	go test -tags INTEGRATION ./integration/...
+//
+// or in docker with make run-integration-tests. They are configured with the following environment variables:
+//   - HUGOT_ONNXRUNTIME: path to onnxruntime.so, /usr/lib64/onnxruntime.so by default.
+//   - HUGOT_INTEGRATION_MODELS: folder the models are downloaded to, hugot-integration-models in the temp folder by
+//     default. Models are cached in a subfolder per revision and are not downloaded again, so a fixture following a
+//     branch such as main keeps the snapshot of its first download until the folder is cleared, while changing the
+//     revision of a fixture downloads it afresh.
+//   - HUGOT_INTEGRATION_EPS: comma separated execution providers to run the pipelines on, among cpu, cuda, openvino
+//     and tensorrt, cpu by default. The tests of an execution provider that is not available are skipped.
+package integration
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	util "github.com/knights-analytics/hugot/utils"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// fixture is a model and the checks run on the pipeline it is loaded in.
+type fixture struct {
+	name  string
+	model string
+	// revision is the branch, tag or commit the model is downloaded at. A commit makes the results reproducible
+	// across caches.
+	revision string
+	run      func(t *testing.T, session *hugot.Session, modelPath string)
+}
+
+var fixtures = []fixture{
+	{
+		name:     "featureExtraction",
+		model:    "KnightsAnalytics/all-MiniLM-L6-v2",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+				ModelPath: modelPath,
+				Name:      "integrationFeatureExtraction",
+				Options:   []hugot.FeatureExtractionOption{pipelines.WithNormalization()},
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"first sentence", "a second, longer sentence"})
+			check(t, err)
+			assert.Len(t, output.Embeddings, 2)
+			for _, embedding := range output.Embeddings {
+				assert.Len(t, embedding, 384)
+			}
+		},
+	},
+	{
+		name:     "textClassification",
+		model:    "KnightsAnalytics/distilbert-base-uncased-finetuned-sst-2-english",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.TextClassificationConfig{
+				ModelPath: modelPath,
+				Name:      "integrationTextClassification",
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"This movie is great!", "This movie is terrible."})
+			check(t, err)
+			assert.Len(t, output.ClassificationOutputs, 2)
+			assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+			assert.Equal(t, "NEGATIVE", output.ClassificationOutputs[1][0].Label)
+		},
+	},
+	{
+		name:     "tokenClassification",
+		model:    "KnightsAnalytics/distilbert-NER",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.TokenClassificationConfig{
+				ModelPath: modelPath,
+				Name:      "integrationTokenClassification",
+				Options:   []hugot.TokenClassificationOption{pipelines.WithSimpleAggregation()},
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"Angela Merkel met Emmanuel Macron in Paris."})
+			check(t, err)
+			assert.Len(t, output.Entities, 1)
+			assert.NotEmpty(t, output.Entities[0])
+		},
+	},
+	{
+		name:     "reranking",
+		model:    "cross-encoder/ms-marco-MiniLM-L-6-v2",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.RerankingConfig{
+				ModelPath:    modelPath,
+				Name:         "integrationReranking",
+				OnnxFilename: "model.onnx",
+			})
+			check(t, err)
+			documents := []string{"Paris is known for the Eiffel Tower.", "Berlin is the capital of Germany."}
+			output, err := pipeline.RunPipeline("What is the capital of Germany?", documents)
+			check(t, err)
+			assert.Len(t, output.Results, 2)
+			assert.Equal(t, 1, output.Results[0].Index)
+		},
+	},
+	{
+		name:     "gliner",
+		model:    "onnx-community/gliner_small-v2.1",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.GLiNERConfig{
+				ModelPath:    modelPath,
+				Name:         "integrationGLiNER",
+				OnnxFilename: "model.onnx",
+				Options:      []hugot.GLiNEROption{pipelines.WithEntityLabels([]string{"person", "city"})},
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"Angela Merkel visited Paris."}, []string{"person", "city"})
+			check(t, err)
+			assert.Len(t, output.Entities, 1)
+			assert.NotEmpty(t, output.Entities[0])
+		},
+	},
+	{
+		name:     "textGeneration",
+		model:    "Xenova/distilgpt2",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.TextGenerationConfig{
+				ModelPath:    modelPath,
+				Name:         "integrationTextGeneration",
+				OnnxFilename: "decoder_model_merged.onnx",
+				Options: []hugot.TextGenerationOption{
+					pipelines.WithMaxNewTokens[*pipelines.TextGenerationPipeline](5),
+				},
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"The capital of France is"})
+			check(t, err)
+			assert.Len(t, output.GeneratedTexts, 1)
+			assert.NotEmpty(t, output.GeneratedTexts[0])
+		},
+	},
+	{
+		name:     "translation",
+		model:    "Xenova/opus-mt-en-fr",
+		revision: "main",
+		run: func(t *testing.T, session *hugot.Session, modelPath string) {
+			pipeline, err := hugot.NewPipeline(session, hugot.TranslationConfig{
+				ModelPath: modelPath,
+				Name:      "integrationTranslation",
+				Options: []hugot.TranslationOption{
+					pipelines.WithMaxNewTokens[*pipelines.TranslationPipeline](10),
+				},
+			})
+			check(t, err)
+			output, err := pipeline.RunPipeline([]string{"Hello, how are you?"})
+			check(t, err)
+			assert.Len(t, output.TranslationTexts, 1)
+			assert.NotEmpty(t, output.TranslationTexts[0])
+		},
+	},
+}
+
+// executionProviders maps the names accepted in HUGOT_INTEGRATION_EPS to the session options selecting them.
+var executionProviders = map[string][]hugot.WithOption{
+	"cpu":      nil,
+	"cuda":     {hugot.WithCuda(map[string]string{"device_id": "0"})},
+	"openvino": {hugot.WithOpenVINO(map[string]string{"device_type": "CPU"})},
+	"tensorrt": {hugot.WithTensorRT(map[string]string{"device_id": "0"})},
+}
+
+func TestPipelines(t *testing.T) {
+	modelsDir := getenv("HUGOT_INTEGRATION_MODELS", path.Join(os.TempDir(), "hugot-integration-models"))
+	check(t, os.MkdirAll(modelsDir, 0o755))
+	modelPaths := downloadFixtures(t, modelsDir)
+
+	for _, ep := range strings.Split(getenv("HUGOT_INTEGRATION_EPS", "cpu"), ",") {
+		ep = strings.TrimSpace(ep)
+		t.Run(ep, func(t *testing.T) {
+			epOptions, ok := executionProviders[ep]
+			if !ok {
+				t.Fatalf("unknown execution provider %s", ep)
+			}
+			options := append([]hugot.WithOption{hugot.WithOnnxLibraryPath(getenv("HUGOT_ONNXRUNTIME", "/usr/lib64/onnxruntime.so"))}, epOptions...)
+			for _, f := range fixtures {
+				t.Run(f.name, func(t *testing.T) {
+					session, err := hugot.NewSession(options...)
+					if err != nil {
+						t.Skipf("execution provider %s is not available: %s", ep, err.Error())
+					}
+					defer func(session *hugot.Session) {
+						check(t, session.Destroy())
+					}(session)
+					f.run(t, session, modelPaths[f.name])
+				})
+			}
+		})
+	}
+}
+
+// downloadFixtures downloads the models of the fixtures missing from modelsDir at their revision, and returns the path of each model by
+// fixture name. The session is only used for downloading.
+func downloadFixtures(t *testing.T, modelsDir string) map[string]string {
+	t.Helper()
+	session, err := hugot.NewSession(hugot.WithOnnxLibraryPath(getenv("HUGOT_ONNXRUNTIME", "/usr/lib64/onnxruntime.so")))
+	check(t, err)
+	defer func(session *hugot.Session) {
+		check(t, session.Destroy())
+	}(session)
+
+	modelPaths := map[string]string{}
+	for _, f := range fixtures {
+		// the revision is part of the cache path, so that changing it does not reuse the model of another revision
+		revisionDir := path.Join(modelsDir, strings.Replace(f.revision, "/", "_", -1))
+		check(t, os.MkdirAll(revisionDir, 0o755))
+		modelPath := path.Join(revisionDir, strings.Replace(f.model, "/", "_", -1))
+		exists, err := util.FileSystem.Exists(context.Background(), modelPath)
+		check(t, err)
+		if !exists {
+			options := hugot.NewDownloadOptions()
+			options.Branch = f.revision
+			modelPath, err = session.DownloadModel(f.model, revisionDir, options)
+			check(t, err)
+		}
+		modelPaths[f.name] = modelPath
+	}
+	return modelPaths
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// sessionOptions are the options of hugot_init, as a json object.
+type sessionOptions struct {
+	OnnxLibraryPath   string `json:"onnx_library_path"`
+	IntraOpNumThreads int    `json:"intra_op_num_threads"`
+	InterOpNumThreads int    `json:"inter_op_num_threads"`
+}
+
+// bindings holds the session of the library and its pipelines by name. Hugot sessions are singletons, so a process
+// loading the library has a single session.
+type bindings struct {
+	mutex     sync.RWMutex
+	session   *hugot.Session
+	pipelines map[string]pipelines.Pipeline
+}
+
+var library = &bindings{}
+
+// init creates the session from the json options.
+func (b *bindings) init(optionsJSON string) error {
+	var options sessionOptions
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+			return fmt.Errorf("could not read the session options: %w", err)
+		}
+	}
+	var withOptions []hugot.WithOption
+	if options.OnnxLibraryPath != "" {
+		withOptions = append(withOptions, hugot.WithOnnxLibraryPath(options.OnnxLibraryPath))
+	}
+	if options.IntraOpNumThreads > 0 {
+		withOptions = append(withOptions, hugot.WithIntraOpNumThreads(options.IntraOpNumThreads))
+	}
+	if options.InterOpNumThreads > 0 {
+		withOptions = append(withOptions, hugot.WithInterOpNumThreads(options.InterOpNumThreads))
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.session != nil {
+		return errors.New("the session is already initialised")
+	}
+	session, err := hugot.NewSession(withOptions...)
+	if err != nil {
+		return err
+	}
+	b.session = session
+	b.pipelines = map[string]pipelines.Pipeline{}
+	return nil
+}
+
+// newPipeline creates a pipeline of one of the types of the command line application.
+func (b *bindings) newPipeline(pipelineType string, name string, modelPath string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.session == nil {
+		return errors.New("the session is not initialised")
+	}
+	var pipeline pipelines.Pipeline
+	var err error
+	switch pipelineType {
+	case "tokenClassification":
+		pipeline, err = hugot.NewPipeline(b.session, hugot.TokenClassificationConfig{ModelPath: modelPath, Name: name})
+	case "textClassification":
+		pipeline, err = hugot.NewPipeline(b.session, hugot.TextClassificationConfig{ModelPath: modelPath, Name: name})
+	case "featureExtraction":
+		pipeline, err = hugot.NewPipeline(b.session, hugot.FeatureExtractionConfig{ModelPath: modelPath, Name: name})
+	case "translation":
+		pipeline, err = hugot.NewPipeline(b.session, hugot.TranslationConfig{ModelPath: modelPath, Name: name})
+	default:
+		return fmt.Errorf("pipeline type %s not implemented", pipelineType)
+	}
+	if err != nil {
+		return err
+	}
+	b.pipelines[name] = pipeline
+	return nil
+}
+
+// run runs a pipeline on a json array of strings and returns its output as json. The read lock is held while the
+// pipeline runs, so that destroy waits for the running pipelines rather than freeing their sessions under them.
+func (b *bindings) run(name string, inputsJSON string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	pipeline, ok := b.pipelines[name]
+	if !ok {
+		return nil, fmt.Errorf("pipeline %s not found", name)
+	}
+	var inputs []string
+	if err := json.Unmarshal([]byte(inputsJSON), &inputs); err != nil {
+		return nil, fmt.Errorf("the inputs must be a json array of strings: %w", err)
+	}
+	output, err := pipeline.Run(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(output)
+}
+
+// destroy destroys the session and its pipelines.
+func (b *bindings) destroy() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.session == nil {
+		return nil
+	}
+	err := b.session.Destroy()
+	b.session = nil
+	b.pipelines = nil
+	return err
+}
@@ -0,0 +1,71 @@
+// Command libhugot builds hugot as a shared library with a C ABI, so that services written in other languages (e.g.
+// Python with ctypes, Rust or Node) run the exact pipelines of hugot:
+//
+//	go build -buildmode=c-shared -o libhugot.so ./libhugot
+//
+// The build also writes libhugot.h. Inputs and outputs are json strings: pipelines take a json array of strings and
+// return the json of their output. Functions report failures through their last argument, set to an error message
+// that the caller frees with hugot_free, and left NULL on success.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import "unsafe"
+
+// setError sets the error argument of a function to the message of err, if any, and returns -1, or 0 without error.
+func setError(err error, errorMessage **C.char) C.int {
+	if err == nil {
+		return 0
+	}
+	if errorMessage != nil {
+		*errorMessage = C.CString(err.Error())
+	}
+	return -1
+}
+
+// hugot_init creates the hugot session of the process from json options, e.g. {"onnx_library_path":
+// "/usr/lib64/onnxruntime.so", "intra_op_num_threads": 1}. It returns 0 on success and -1 on failure.
+//
+//export hugot_init
+func hugot_init(optionsJSON *C.char, errorMessage **C.char) C.int {
+	return setError(library.init(C.GoString(optionsJSON)), errorMessage)
+}
+
+// hugot_new_pipeline creates a pipeline of a type (tokenClassification, textClassification, featureExtraction or
+// translation) from a model folder. The pipeline is run by its name. It returns 0 on success and -1 on failure.
+//
+//export hugot_new_pipeline
+func hugot_new_pipeline(pipelineType *C.char, name *C.char, modelPath *C.char, errorMessage **C.char) C.int {
+	return setError(library.newPipeline(C.GoString(pipelineType), C.GoString(name), C.GoString(modelPath)), errorMessage)
+}
+
+// hugot_run runs a pipeline on a json array of strings. It returns the json output, which the caller frees with
+// hugot_free, or NULL on failure.
+//
+//export hugot_run
+func hugot_run(name *C.char, inputsJSON *C.char, errorMessage **C.char) *C.char {
+	output, err := library.run(C.GoString(name), C.GoString(inputsJSON))
+	if setError(err, errorMessage) != 0 {
+		return nil
+	}
+	return C.CString(string(output))
+}
+
+// hugot_destroy destroys the session and its pipelines. It returns 0 on success and -1 on failure.
+//
+//export hugot_destroy
+func hugot_destroy(errorMessage **C.char) C.int {
+	return setError(library.destroy(), errorMessage)
+}
+
+// hugot_free frees a string returned by the library.
+//
+//export hugot_free
+func hugot_free(value *C.char) {
+	C.free(unsafe.Pointer(value))
+}
+
+func main() {}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const onnxRuntimeSharedLibrary = "/usr/lib64/onnxruntime.so"
+
+func TestBindings(t *testing.T) {
+	b := &bindings{}
+	_, err := b.run("classifier", `["a"]`)
+	assert.Error(t, err)
+	assert.Error(t, b.newPipeline("textClassification", "classifier", "model"))
+
+	check(t, b.init(`{"onnx_library_path": "`+onnxRuntimeSharedLibrary+`"}`))
+	defer func() {
+		check(t, b.destroy())
+	}()
+	assert.Error(t, b.init(""))
+
+	modelPath := path.Join("../models", "KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+	check(t, b.newPipeline("textClassification", "classifier", modelPath))
+	assert.Error(t, b.newPipeline("objectDetection", "detector", modelPath))
+
+	output, err := b.run("classifier", `["This movie is disgustingly good !", "The director tried too much"]`)
+	check(t, err)
+	var classifications struct {
+		ClassificationOutputs [][]struct {
+			Label string
+			Score float32
+		}
+	}
+	check(t, json.Unmarshal(output, &classifications))
+	assert.Len(t, classifications.ClassificationOutputs, 2)
+	assert.Equal(t, "POSITIVE", classifications.ClassificationOutputs[0][0].Label)
+	assert.Equal(t, "NEGATIVE", classifications.ClassificationOutputs[1][0].Label)
+
+	_, err = b.run("classifier", `"not an array"`)
+	assert.Error(t, err)
+}
+
+func TestBindingsDestroyWhileRunning(t *testing.T) {
+	b := &bindings{}
+	check(t, b.init(`{"onnx_library_path": "`+onnxRuntimeSharedLibrary+`"}`))
+	modelPath := path.Join("../models", "KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+	check(t, b.newPipeline("textClassification", "classifier", modelPath))
+
+	// the runs started before destroy complete, the later ones find no pipeline
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output, err := b.run("classifier", `["This movie is disgustingly good !"]`)
+			if err != nil {
+				assert.EqualError(t, err, "pipeline classifier not found")
+			} else {
+				assert.NotEmpty(t, output)
+			}
+		}()
+	}
+	check(t, b.destroy())
+	wg.Wait()
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
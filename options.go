@@ -1,5 +1,7 @@
 package hugot
 
+import "github.com/knights-analytics/hugot/pipelines"
+
 type ortOptions struct {
 	libraryPath        string
 	telemetry          bool
@@ -19,6 +21,14 @@ type ortOptions struct {
 	openVINOOptionsSet bool
 	tensorRTOptions    map[string]string
 	tensorRTOptionsSet bool
+	mixedPrecision     bool
+	fallbackToCPU      bool
+	pipelineDefaults   []any
+}
+
+// hasExecutionProvider reports whether an execution provider other than the default CPU one is configured.
+func (o *ortOptions) hasExecutionProvider() bool {
+	return o.cudaOptionsSet || o.coreMLOptionsSet || o.directMLOptionsSet || o.openVINOOptionsSet || o.tensorRTOptionsSet
 }
 
 // WithOption is the interface for all option functions
@@ -133,3 +143,34 @@ func WithTensorRT(options map[string]string) WithOption {
 		o.tensorRTOptionsSet = true
 	}
 }
+
+// WithMixedPrecision runs fp32 models in float16 on supported GPUs, without re-exporting them: the TensorRT provider
+// builds its engines with float16 kernels (trt_fp16_enable), keeping float32 inputs and outputs. Onnxruntime only
+// converts models to float16 at load time with TensorRT, so the option requires WithTensorRT; models for the CUDA
+// provider must be exported in float16.
+func WithMixedPrecision() WithOption {
+	return func(o *ortOptions) {
+		o.mixedPrecision = true
+	}
+}
+
+// WithFallbackToCPU Falls back to CPU inference when the configured execution providers (e.g. CUDA) fail to
+// initialise, for instance because of a missing driver or a busy device. Without this option session and pipeline
+// creation fail instead. Session.UsesCPUFallback reports whether the fallback happened, and Session.CPUFallbackCause
+// the error of the providers.
+func WithFallbackToCPU() WithOption {
+	return func(o *ortOptions) {
+		o.fallbackToCPU = true
+	}
+}
+
+// WithPipelineDefaults sets default options for all the pipelines of type T created in the session, e.g.
+// WithPipelineDefaults(pipelines.WithNormalization()) to normalise the embeddings of all feature extraction pipelines.
+// The defaults are applied before the options of the pipeline configuration, which can override them.
+func WithPipelineDefaults[T pipelines.Pipeline](options ...pipelines.PipelineOption[T]) WithOption {
+	return func(o *ortOptions) {
+		for _, option := range options {
+			o.pipelineDefaults = append(o.pipelineDefaults, option)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Package parquet provides a hugot.Sink writing the results of pipelines as a parquet file. It is a separate package
+// so that only the applications writing parquet depend on the parquet libraries.
+package parquet
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/knights-analytics/hugot"
+)
+
+// row is a result as written to the parquet file. The output and the fields are json encoded, as their types depend
+// on the pipeline and on the source.
+type row struct {
+	Input  string  `parquet:"name=input, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Output string  `parquet:"name=output, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Fields *string `parquet:"name=fields, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Line   int64   `parquet:"name=line, type=INT64"`
+}
+
+type sink struct {
+	writer *writer.ParquetWriter
+}
+
+// NewSink returns a sink writing the results to w as a snappy compressed parquet file, with the columns input,
+// output (json), fields (json, null for text sources) and line. The file is only complete once the sink is closed.
+func NewSink(w io.Writer) (hugot.Sink, error) {
+	parquetWriter, err := writer.NewParquetWriterFromWriter(w, new(row), 1)
+	if err != nil {
+		return nil, err
+	}
+	return &sink{writer: parquetWriter}, nil
+}
+
+func (s *sink) Write(results []hugot.Result) error {
+	for _, result := range results {
+		output, err := json.Marshal(result.Output)
+		if err != nil {
+			return err
+		}
+		r := row{Input: result.Input, Output: string(output), Line: int64(result.Line)}
+		if result.Fields != nil {
+			fields, err := json.Marshal(result.Fields)
+			if err != nil {
+				return err
+			}
+			fieldsString := string(fields)
+			r.Fields = &fieldsString
+		}
+		if err = s.writer.Write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sink) Close() error {
+	return s.writer.WriteStop()
+}
@@ -0,0 +1,165 @@
+package pipelines
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// tokenDistributionsMagic starts the binary files of token distributions, followed by the format version.
+const (
+	tokenDistributionsMagic   = "HGTD"
+	tokenDistributionsVersion = 1
+)
+
+// TokenDistributionWriter writes the token distributions of token classification outputs in a compact binary format,
+// batch after batch, e.g. to select the inputs to annotate offline. The file starts with the magic bytes HGTD, the
+// format version as a byte and the number of labels as a little endian uint32. Each input follows as its number of
+// tokens as a little endian uint32, then the probabilities of the labels of each token as little endian uint16
+// values, the probability times 65535 rounded, so that an input takes two bytes per token and label.
+type TokenDistributionWriter struct {
+	writer        *bufio.Writer
+	labels        int
+	headerWritten bool
+}
+
+// NewTokenDistributionWriter returns a writer to w of token distributions over labels labels, the output dimension of
+// the token classification pipeline. The header is written with the first batch.
+func NewTokenDistributionWriter(w io.Writer, labels int) *TokenDistributionWriter {
+	return &TokenDistributionWriter{writer: bufio.NewWriter(w), labels: labels}
+}
+
+// Write writes the token distributions of a batch of inputs, as returned in the Distributions of a token
+// classification output.
+func (w *TokenDistributionWriter) Write(distributions [][][]float32) error {
+	for _, input := range distributions {
+		for _, token := range input {
+			if len(token) != w.labels {
+				return fmt.Errorf("token distribution has %d labels, expected %d", len(token), w.labels)
+			}
+		}
+	}
+	if !w.headerWritten {
+		header := append([]byte(tokenDistributionsMagic), tokenDistributionsVersion, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(header[len(tokenDistributionsMagic)+1:], uint32(w.labels))
+		if _, err := w.writer.Write(header); err != nil {
+			return err
+		}
+		w.headerWritten = true
+	}
+	buffer := make([]byte, 4)
+	for _, input := range distributions {
+		binary.LittleEndian.PutUint32(buffer, uint32(len(input)))
+		if _, err := w.writer.Write(buffer); err != nil {
+			return err
+		}
+		for _, token := range input {
+			for _, p := range token {
+				binary.LittleEndian.PutUint16(buffer, uint16(math.Round(math.Max(0, math.Min(1, float64(p)))*math.MaxUint16)))
+				if _, err := w.writer.Write(buffer[:2]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return w.writer.Flush()
+}
+
+// ReadTokenDistributions reads the token distributions written by a TokenDistributionWriter, one per input.
+func ReadTokenDistributions(r io.Reader) ([][][]float32, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(tokenDistributionsMagic)+5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			// nothing was written
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read the token distributions header: %w", err)
+	}
+	if string(header[:len(tokenDistributionsMagic)]) != tokenDistributionsMagic {
+		return nil, errors.New("not a token distributions file")
+	}
+	if version := header[len(tokenDistributionsMagic)]; version != tokenDistributionsVersion {
+		return nil, fmt.Errorf("token distributions format version %d is not supported", version)
+	}
+	labels := int(binary.LittleEndian.Uint32(header[len(tokenDistributionsMagic)+1:]))
+
+	// the counts are read from the file, so the memory is only allocated as the values are actually read, rather than
+	// trusting the counts of a truncated or corrupt file
+	var distributions [][][]float32
+	buffer := make([]byte, 4)
+	var values bytes.Buffer
+	for {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			if errors.Is(err, io.EOF) {
+				return distributions, nil
+			}
+			return nil, err
+		}
+		tokens := binary.LittleEndian.Uint32(buffer)
+		input := [][]float32{}
+		for j := uint32(0); j < tokens; j++ {
+			values.Reset()
+			if _, err := io.CopyN(&values, reader, 2*int64(labels)); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, fmt.Errorf("could not read the distributions of input %d: %w", len(distributions), err)
+			}
+			token := make([]float32, labels)
+			for k := range token {
+				token[k] = float32(binary.LittleEndian.Uint16(values.Bytes()[2*k:])) / math.MaxUint16
+			}
+			input = append(input, token)
+		}
+		distributions = append(distributions, input)
+	}
+}
+
+// SelectForAnnotation returns the indices of the k inputs the model is the least certain about, most uncertain
+// first, to be annotated in an active learning loop. The uncertainty of an input is that of its least certain token:
+// with the ENTROPY strategy the highest entropy of the label distribution of a token, with the MARGIN strategy the
+// smallest difference between the two most likely labels of a token. All the inputs are returned if k is greater than
+// their number, none if k is zero.
+func SelectForAnnotation(distributions [][][]float32, k int, strategy string) ([]int, error) {
+	var tokenUncertainty func([]float32) float64
+	switch strategy {
+	case "ENTROPY":
+		tokenUncertainty = util.Entropy
+	case "MARGIN":
+		tokenUncertainty = func(distribution []float32) float64 {
+			return 1 - float64(util.Margin(distribution))
+		}
+	default:
+		return nil, fmt.Errorf("sampling strategy must be ENTROPY or MARGIN, got %s", strategy)
+	}
+	if k < 0 {
+		return nil, fmt.Errorf("number of inputs to select cannot be negative, got %d", k)
+	}
+	if k == 0 {
+		return []int{}, nil
+	}
+
+	uncertainties := make([]float64, len(distributions))
+	indices := make([]int, len(distributions))
+	for i, input := range distributions {
+		indices[i] = i
+		for _, token := range input {
+			uncertainties[i] = math.Max(uncertainties[i], tokenUncertainty(token))
+		}
+	}
+	sort.SliceStable(indices, func(a, b int) bool {
+		return uncertainties[indices[a]] > uncertainties[indices[b]]
+	})
+	if k < len(indices) {
+		indices = indices[:k]
+	}
+	return indices, nil
+}
@@ -0,0 +1,315 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// AudioClassificationPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/audio_classification.py
+// for wav2vec2-style models, which take the normalized raw waveform, and audio spectrogram transformers (AST),
+// which take kaldi log mel filter banks. The feature extraction is chosen from the preprocessor config of the model.
+
+// types
+
+type AudioClassificationPipeline struct {
+	BasePipeline
+	IdLabelMap  map[int]string
+	AudioConfig AudioProcessorConfig
+	// TopK is the number of labels returned for each input, all labels if zero or negative. The default is 5.
+	TopK int
+}
+
+type AudioClassificationOutput struct {
+	Usage
+	Diagnostics
+	// ClassificationOutputs holds the labels of each input, sorted by decreasing score.
+	ClassificationOutputs [][]ClassificationOutput
+}
+
+func (t *AudioClassificationOutput) GetOutput() []any {
+	out := make([]any, len(t.ClassificationOutputs))
+	for i, classificationOutput := range t.ClassificationOutputs {
+		out[i] = any(classificationOutput)
+	}
+	return out
+}
+
+// options
+
+// WithTopLabels sets the number of labels returned for each input, all labels if k is zero or negative.
+func WithTopLabels(k int) PipelineOption[*AudioClassificationPipeline] {
+	return func(pipeline *AudioClassificationPipeline) {
+		pipeline.TopK = k
+	}
+}
+
+// NewAudioClassificationPipeline initializes an audio classification pipeline.
+func NewAudioClassificationPipeline(config PipelineConfig[*AudioClassificationPipeline], ortOptions *ort.SessionOptions) (*AudioClassificationPipeline, error) {
+	pipeline := &AudioClassificationPipeline{TopK: 5}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var modelConfig struct {
+		IdLabelMap map[int]string `json:"id2label"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &modelConfig); err != nil {
+		return nil, err
+	}
+	pipeline.IdLabelMap = modelConfig.IdLabelMap
+
+	audioConfig, err := loadAudioProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.AudioConfig = audioConfig
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx model, audio classification models have no tokenizer
+	err = pipeline.loadModelWithoutTokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, output := range pipeline.OutputsMeta {
+		if output.Name == "logits" && len(output.Dimensions) == 2 {
+			pipeline.OutputDim = int(output.Dimensions[1])
+		}
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+// filterBanks reports whether the model takes filter bank features rather than the raw waveform.
+func (p *AudioClassificationPipeline) filterBanks() bool {
+	return p.AudioConfig.NumMelBins > 0 || strings.HasPrefix(p.AudioConfig.FeatureExtractorType, "AST")
+}
+
+func (p *AudioClassificationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.IdLabelMap) == 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model config has no id2label map"))
+	}
+	if p.OutputDim <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model must have a logits output of shape [batch, labels]"))
+	} else if len(p.IdLabelMap) != p.OutputDim {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: length of id2label map does not match model output dimension"))
+	}
+	for _, input := range p.InputsMeta {
+		if input.Name != "input_values" && (input.Name != "attention_mask" || p.filterBanks()) {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported model input %s", input.Name))
+		}
+	}
+	if p.filterBanks() && (p.AudioConfig.NumMelBins <= 0 || p.AudioConfig.MaxLength <= 0) {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the feature extractor config must define num_mel_bins and max_length"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess extracts the input features of each audio input. Waveforms are normalized if the feature extractor
+// requires it and zero padded to the longest input, with an attention mask. Filter banks are padded or truncated to
+// the max length of the feature extractor. It returns the features, their shape, the attention mask and a warning
+// for each truncated input.
+func (p *AudioClassificationPipeline) Preprocess(audio [][]float32) ([]float32, ort.Shape, []int64, []Warning) {
+	start := time.Now()
+	defer func() {
+		// the feature extraction is accounted as the tokenization step of the pipeline
+		atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+		atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	}()
+
+	if p.filterBanks() {
+		melBins, maxLength := p.AudioConfig.NumMelBins, p.AudioConfig.MaxLength
+		size := melBins * maxLength
+		features := make([]float32, len(audio)*size)
+		var warnings []Warning
+		for i, samples := range audio {
+			banks, frames := kaldiFilterBanks(samples, p.AudioConfig.SamplingRate, melBins)
+			if frames > maxLength {
+				warnings = append(warnings, Warning{
+					Input:   i,
+					Type:    WarningTruncated,
+					Message: fmt.Sprintf("audio of %d frames was truncated to the maximum length of %d frames", frames, maxLength),
+				})
+				frames = maxLength
+			}
+			copy(features[i*size:], banks[:frames*melBins])
+		}
+		if p.AudioConfig.DoNormalize {
+			// padding frames are normalized too, as in the AST feature extractor
+			for i, v := range features {
+				features[i] = (v - p.AudioConfig.Mean) / (p.AudioConfig.Std * 2)
+			}
+		}
+		return features, ort.NewShape(int64(len(audio)), int64(maxLength), int64(melBins)), nil, warnings
+	}
+
+	longest := 0
+	for _, samples := range audio {
+		if len(samples) > longest {
+			longest = len(samples)
+		}
+	}
+	features := make([]float32, len(audio)*longest)
+	attentionMask := make([]int64, len(audio)*longest)
+	for i, samples := range audio {
+		if p.AudioConfig.DoNormalize {
+			samples = normalizeWaveform(samples)
+		}
+		copy(features[i*longest:], samples)
+		for j := range samples {
+			attentionMask[i*longest+j] = 1
+		}
+	}
+	return features, ort.NewShape(int64(len(audio)), int64(longest)), attentionMask, nil
+}
+
+// Forward runs the model on the input features and returns the [batch, labels] logits.
+func (p *AudioClassificationPipeline) Forward(features []float32, shape ort.Shape, attentionMask []int64) (logits []float32, err error) {
+	return p.forward(features, shape, attentionMask, nil)
+}
+
+// forward runs the model, feeding the states of a stateful model from the state handle if not nil.
+func (p *AudioClassificationPipeline) forward(features []float32, shape ort.Shape, attentionMask []int64, state *StateHandle) (logits []float32, err error) {
+	start := time.Now()
+
+	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
+	defer func() {
+		for _, tensor := range inputTensors {
+			if tensor != nil {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+	for i, input := range p.InputsMeta {
+		switch input.Name {
+		case "input_values":
+			tensor, tensorErr := ort.NewTensor(shape, features)
+			if tensorErr != nil {
+				return nil, tensorErr
+			}
+			inputTensors[i] = tensor
+		case "attention_mask":
+			tensor, tensorErr := ort.NewTensor(shape, attentionMask)
+			if tensorErr != nil {
+				return nil, tensorErr
+			}
+			inputTensors[i] = tensor
+		default:
+			if _, isState := p.stateOutput(input.Name); isState {
+				if state == nil {
+					state = NewStateHandle()
+				}
+				tensor, tensorErr := state.stateTensor(input, shape[0])
+				if tensorErr != nil {
+					return nil, tensorErr
+				}
+				inputTensors[i] = tensor
+			}
+		}
+	}
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+	for i, output := range p.OutputsMeta {
+		if output.Name == "logits" {
+			logitsTensor, ok := outputTensors[i].(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, errors.New("logits output must be float32"))
+			} else {
+				logits = append([]float32(nil), logitsTensor.GetData()...)
+			}
+		}
+	}
+	err = errors.Join(err, p.updateState(state, outputTensors, nil))
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, err
+}
+
+// Postprocess converts the logits of each input to label probabilities and keeps the top labels.
+func (p *AudioClassificationPipeline) Postprocess(logits []float32, inputsCount int) (*AudioClassificationOutput, error) {
+	if len(logits) != inputsCount*p.OutputDim {
+		return nil, fmt.Errorf("unexpected logits size %d for %d inputs and %d labels", len(logits), inputsCount, p.OutputDim)
+	}
+	output := &AudioClassificationOutput{ClassificationOutputs: make([][]ClassificationOutput, inputsCount)}
+	for i := range output.ClassificationOutputs {
+		scores := util.SoftMax(logits[i*p.OutputDim : (i+1)*p.OutputDim])
+		classifications := make([]ClassificationOutput, len(scores))
+		for id, score := range scores {
+			classifications[id] = ClassificationOutput{Label: p.IdLabelMap[id], Score: score}
+		}
+		sort.SliceStable(classifications, func(a, b int) bool {
+			return classifications[a].Score > classifications[b].Score
+		})
+		if p.TopK > 0 && p.TopK < len(classifications) {
+			classifications = classifications[:p.TopK]
+		}
+		output.ClassificationOutputs[i] = classifications
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of paths to WAV files.
+func (p *AudioClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	audio, err := p.AudioConfig.readAudio(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(audio)
+}
+
+// RunPipeline classifies each audio input, given as mono samples in [-1, 1] at the sampling rate of the model.
+func (p *AudioClassificationPipeline) RunPipeline(audio [][]float32) (*AudioClassificationOutput, error) {
+	return p.RunWithState(audio, nil)
+}
+
+// RunWithState classifies the next chunk of each audio stream with a stateful model, e.g. a streaming classifier
+// carrying a hidden state: the states output by the model are fed back to it on the next call with the same handle.
+// A stateful model starts from a zero state if the handle is nil.
+// The inputs of a batch are the ith streams of the handle, so their number must not change between calls.
+func (p *AudioClassificationPipeline) RunWithState(audio [][]float32, state *StateHandle) (*AudioClassificationOutput, error) {
+	if len(audio) == 0 {
+		return &AudioClassificationOutput{}, nil
+	}
+	features, shape, attentionMask, warnings := p.Preprocess(audio)
+	logits, err := p.forward(features, shape, attentionMask, state)
+	if err != nil {
+		return nil, err
+	}
+	output, err := p.Postprocess(logits, len(audio))
+	if err != nil {
+		return nil, err
+	}
+	output.Warnings = warnings
+	return output, nil
+}
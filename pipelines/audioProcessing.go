@@ -0,0 +1,420 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// Audio preprocessing shared by the speech pipelines: WAV decoding, resampling, the log-mel spectrogram of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/models/whisper/feature_extraction_whisper.py
+// the kaldi filter banks of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/models/audio_spectrogram_transformer/feature_extraction_audio_spectrogram_transformer.py
+// and the waveform normalization of wav2vec2 models.
+
+// AudioProcessorConfig holds the feature extraction parameters read from the preprocessor_config.json file of the
+// model.
+type AudioProcessorConfig struct {
+	SamplingRate int
+	FeatureSize  int // number of mel filters
+	NFFT         int
+	HopLength    int
+	ChunkLength  int // length in seconds of the audio windows the model is run on
+	// FeatureExtractorType is the feature extractor class of the model, e.g. Wav2Vec2FeatureExtractor.
+	FeatureExtractorType string
+	DoNormalize          bool
+	ReturnAttentionMask  bool
+	// NumMelBins, MaxLength, Mean and Std are the filter bank parameters of audio spectrogram transformers: the
+	// number of filter banks, the number of frames the features are padded or truncated to, and the mean and
+	// standard deviation the features are normalized with.
+	NumMelBins int
+	MaxLength  int
+	Mean       float32
+	Std        float32
+}
+
+// loadAudioProcessorConfig reads preprocessor_config.json, with the whisper defaults for missing values.
+func loadAudioProcessorConfig(modelPath string) (AudioProcessorConfig, error) {
+	config := AudioProcessorConfig{SamplingRate: 16000, FeatureSize: 80, NFFT: 400, HopLength: 160, ChunkLength: 30}
+
+	path := util.PathJoinSafe(modelPath, "preprocessor_config.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return config, err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return config, err
+	}
+	var values map[string]any
+	if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+		return config, fmt.Errorf("could not read preprocessor_config.json: %w", err)
+	}
+	for key, field := range map[string]*int{
+		"sampling_rate": &config.SamplingRate,
+		"feature_size":  &config.FeatureSize,
+		"n_fft":         &config.NFFT,
+		"hop_length":    &config.HopLength,
+		"chunk_length":  &config.ChunkLength,
+		"num_mel_bins":  &config.NumMelBins,
+		"max_length":    &config.MaxLength,
+	} {
+		if v, ok := values[key].(float64); ok && v > 0 {
+			*field = int(v)
+		}
+	}
+	config.FeatureExtractorType, _ = values["feature_extractor_type"].(string)
+	config.DoNormalize, _ = values["do_normalize"].(bool)
+	config.ReturnAttentionMask, _ = values["return_attention_mask"].(bool)
+	if v, ok := values["mean"].(float64); ok {
+		config.Mean = float32(v)
+	}
+	if v, ok := values["std"].(float64); ok {
+		config.Std = float32(v)
+	}
+	return config, nil
+}
+
+// chunkSamples is the number of samples of an audio window.
+func (c AudioProcessorConfig) chunkSamples() int {
+	return c.ChunkLength * c.SamplingRate
+}
+
+// chunkFrames is the number of spectrogram frames of an audio window.
+func (c AudioProcessorConfig) chunkFrames() int {
+	return c.chunkSamples() / c.HopLength
+}
+
+// decodeWAV decodes a RIFF WAV file of 8, 16, 24 or 32 bit PCM or 32 bit float samples. Channels are averaged into
+// a mono signal with values between -1 and 1. It returns the samples and the sampling rate.
+func decodeWAV(data []byte) ([]float32, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a RIFF WAVE file")
+	}
+	var format, channels, bitsPerSample uint16
+	var sampleRate uint32
+	var samples []byte
+	formatFound := false
+	for offset := 12; offset+8 <= len(data); {
+		chunkID := string(data[offset : offset+4])
+		chunkSize := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := offset + 8
+		if body+chunkSize > len(data) {
+			// truncated files (e.g. streamed recordings) often declare a larger data chunk
+			chunkSize = len(data) - body
+		}
+		switch chunkID {
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, 0, errors.New("invalid WAV fmt chunk")
+			}
+			format = binary.LittleEndian.Uint16(data[body : body+2])
+			channels = binary.LittleEndian.Uint16(data[body+2 : body+4])
+			sampleRate = binary.LittleEndian.Uint32(data[body+4 : body+8])
+			bitsPerSample = binary.LittleEndian.Uint16(data[body+14 : body+16])
+			if format == 0xFFFE && chunkSize >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE, the format is the first two bytes of the sub format guid
+				format = binary.LittleEndian.Uint16(data[body+24 : body+26])
+			}
+			formatFound = true
+		case "data":
+			samples = data[body : body+chunkSize]
+		}
+		// chunks are padded to an even size
+		offset = body + chunkSize + chunkSize%2
+	}
+	if !formatFound || samples == nil {
+		return nil, 0, errors.New("WAV file has no fmt or data chunk")
+	}
+	if channels == 0 {
+		return nil, 0, errors.New("WAV file has no channels")
+	}
+
+	bytesPerSample := int(bitsPerSample / 8)
+	var decode func([]byte) float32
+	switch {
+	case format == 1 && bitsPerSample == 8:
+		decode = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case format == 1 && bitsPerSample == 16:
+		decode = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	case format == 1 && bitsPerSample == 24:
+		decode = func(b []byte) float32 {
+			return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / 8388608
+		}
+	case format == 1 && bitsPerSample == 32:
+		decode = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / 2147483648 }
+	case format == 3 && bitsPerSample == 32:
+		decode = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+	default:
+		return nil, 0, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bitsPerSample)
+	}
+
+	frameSize := bytesPerSample * int(channels)
+	mono := make([]float32, len(samples)/frameSize)
+	for i := range mono {
+		var sum float32
+		for c := 0; c < int(channels); c++ {
+			start := i*frameSize + c*bytesPerSample
+			sum += decode(samples[start : start+bytesPerSample])
+		}
+		mono[i] = sum / float32(channels)
+	}
+	return mono, int(sampleRate), nil
+}
+
+// resampleAudio converts a signal to the target sampling rate by linear interpolation.
+func resampleAudio(samples []float32, rate int, targetRate int) []float32 {
+	if rate == targetRate || len(samples) == 0 {
+		return samples
+	}
+	ratio := float64(rate) / float64(targetRate)
+	resampled := make([]float32, int(float64(len(samples))/ratio))
+	for i := range resampled {
+		position := float64(i) * ratio
+		index := int(position)
+		if index+1 >= len(samples) {
+			resampled[i] = samples[len(samples)-1]
+			continue
+		}
+		fraction := float32(position - float64(index))
+		resampled[i] = samples[index]*(1-fraction) + samples[index+1]*fraction
+	}
+	return resampled
+}
+
+// readAudio reads WAV files and resamples them to the sampling rate of the model.
+func (c AudioProcessorConfig) readAudio(paths []string) ([][]float32, error) {
+	audio := make([][]float32, len(paths))
+	for i, path := range paths {
+		data, err := util.ReadFileBytes(path)
+		if err != nil {
+			return nil, err
+		}
+		samples, rate, err := decodeWAV(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode audio file %s: %w", path, err)
+		}
+		audio[i] = resampleAudio(samples, rate, c.SamplingRate)
+	}
+	return audio, nil
+}
+
+// melFilterBank computes the triangular mel filters with the slaney mel scale and normalization (librosa's
+// defaults, used by whisper), as a [melFilters][frequencyBins] matrix.
+func melFilterBank(frequencyBins int, melFilters int, samplingRate int) [][]float64 {
+	hzToMel := func(hz float64) float64 {
+		if hz < 1000 {
+			return 3 * hz / 200
+		}
+		return 15 + 27/math.Log(6.4)*math.Log(hz/1000)
+	}
+	melToHz := func(mel float64) float64 {
+		if mel < 15 {
+			return 200 * mel / 3
+		}
+		return 1000 * math.Exp(math.Log(6.4)/27*(mel-15))
+	}
+
+	maxMel := hzToMel(float64(samplingRate) / 2)
+	filterFrequencies := make([]float64, melFilters+2)
+	for i := range filterFrequencies {
+		filterFrequencies[i] = melToHz(maxMel * float64(i) / float64(melFilters+1))
+	}
+	filters := make([][]float64, melFilters)
+	for m := range filters {
+		filters[m] = make([]float64, frequencyBins)
+		lower, center, upper := filterFrequencies[m], filterFrequencies[m+1], filterFrequencies[m+2]
+		norm := 2 / (upper - lower)
+		for k := range filters[m] {
+			frequency := float64(k) * float64(samplingRate) / 2 / float64(frequencyBins-1)
+			weight := math.Min((frequency-lower)/(center-lower), (upper-frequency)/(upper-center))
+			filters[m][k] = math.Max(weight, 0) * norm
+		}
+	}
+	return filters
+}
+
+// logMelSpectrogram computes the whisper input features of a window of audio, padded or truncated to
+// ChunkLength seconds: the log10 mel spectrogram, clamped to 8 below its maximum and scaled to about [-1, 1]. The
+// features are returned as a flattened [FeatureSize, chunkFrames] matrix.
+func (c AudioProcessorConfig) logMelSpectrogram(samples []float32, filters [][]float64) []float32 {
+	padded := make([]float64, c.chunkSamples())
+	for i := 0; i < len(padded) && i < len(samples); i++ {
+		padded[i] = float64(samples[i])
+	}
+
+	// the signal is centered on the frames by reflecting n_fft/2 samples at each end
+	half := c.NFFT / 2
+	signal := make([]float64, len(padded)+2*half)
+	copy(signal[half:], padded)
+	for i := 0; i < half; i++ {
+		signal[half-1-i] = padded[i+1]
+		signal[half+len(padded)+i] = padded[len(padded)-2-i]
+	}
+
+	window := make([]float64, c.NFFT)
+	for i := range window {
+		// periodic hann window
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(c.NFFT))
+	}
+	frequencyBins := c.NFFT/2 + 1
+	cosTable := make([]float64, c.NFFT)
+	sinTable := make([]float64, c.NFFT)
+	for i := range cosTable {
+		cosTable[i] = math.Cos(2 * math.Pi * float64(i) / float64(c.NFFT))
+		sinTable[i] = math.Sin(2 * math.Pi * float64(i) / float64(c.NFFT))
+	}
+
+	frames := c.chunkFrames()
+	melSpectrogram := make([]float64, c.FeatureSize*frames)
+	frame := make([]float64, c.NFFT)
+	power := make([]float64, frequencyBins)
+	maxValue := math.Inf(-1)
+	for t := 0; t < frames; t++ {
+		start := t * c.HopLength
+		for i := range frame {
+			frame[i] = signal[start+i] * window[i]
+		}
+		// the discrete fourier transform, n_fft (400 for whisper) is not a power of 2
+		for k := 0; k < frequencyBins; k++ {
+			var re, im float64
+			for n, v := range frame {
+				index := (k * n) % c.NFFT
+				re += v * cosTable[index]
+				im -= v * sinTable[index]
+			}
+			power[k] = re*re + im*im
+		}
+		for m, filter := range filters {
+			var energy float64
+			for k, weight := range filter {
+				energy += weight * power[k]
+			}
+			value := math.Log10(math.Max(energy, 1e-10))
+			melSpectrogram[m*frames+t] = value
+			maxValue = math.Max(maxValue, value)
+		}
+	}
+
+	features := make([]float32, len(melSpectrogram))
+	for i, value := range melSpectrogram {
+		features[i] = float32((math.Max(value, maxValue-8) + 4) / 4)
+	}
+	return features
+}
+
+// normalizeWaveform normalizes a waveform to zero mean and unit variance, as wav2vec2 feature extractors do.
+func normalizeWaveform(samples []float32) []float32 {
+	if len(samples) == 0 {
+		return samples
+	}
+	var mean, variance float64
+	for _, v := range samples {
+		mean += float64(v)
+	}
+	mean /= float64(len(samples))
+	for _, v := range samples {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	variance /= float64(len(samples))
+	normalized := make([]float32, len(samples))
+	for i, v := range samples {
+		normalized[i] = float32((float64(v) - mean) / math.Sqrt(variance+1e-7))
+	}
+	return normalized
+}
+
+// kaldiFilterBanks computes the log mel filter bank features of kaldi (as torchaudio.compliance.kaldi.fbank, with
+// a hanning window and no dithering) over frames of 25ms shifted by 10ms, as a flattened [frames, numMelBins]
+// matrix. It returns the features and the number of frames.
+func kaldiFilterBanks(samples []float32, samplingRate int, numMelBins int) ([]float32, int) {
+	frameLength := samplingRate * 25 / 1000
+	frameShift := samplingRate * 10 / 1000
+	if len(samples) < frameLength {
+		return nil, 0
+	}
+	frames := 1 + (len(samples)-frameLength)/frameShift
+	paddedLength := 1
+	for paddedLength < frameLength {
+		paddedLength *= 2
+	}
+	frequencyBins := paddedLength/2 + 1
+
+	window := make([]float64, frameLength)
+	for i := range window {
+		// symmetric hann window
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameLength-1))
+	}
+	cosTable := make([]float64, paddedLength)
+	sinTable := make([]float64, paddedLength)
+	for i := range cosTable {
+		cosTable[i] = math.Cos(2 * math.Pi * float64(i) / float64(paddedLength))
+		sinTable[i] = math.Sin(2 * math.Pi * float64(i) / float64(paddedLength))
+	}
+
+	// triangular filters, equally spaced on the kaldi mel scale between 20Hz and the nyquist frequency
+	mel := func(hz float64) float64 { return 1127 * math.Log(1+hz/700) }
+	melLow, melHigh := mel(20), mel(float64(samplingRate)/2)
+	melDelta := (melHigh - melLow) / float64(numMelBins+1)
+	binWidth := float64(samplingRate) / float64(paddedLength)
+	filters := make([][]float64, numMelBins)
+	for m := range filters {
+		filters[m] = make([]float64, frequencyBins)
+		left := melLow + float64(m)*melDelta
+		center, right := left+melDelta, left+2*melDelta
+		// the nyquist bin has no weight
+		for k := 0; k < frequencyBins-1; k++ {
+			frequencyMel := mel(binWidth * float64(k))
+			up := (frequencyMel - left) / (center - left)
+			down := (right - frequencyMel) / (right - center)
+			filters[m][k] = math.Max(0, math.Min(up, down))
+		}
+	}
+
+	features := make([]float32, frames*numMelBins)
+	frame := make([]float64, frameLength)
+	power := make([]float64, frequencyBins)
+	for t := 0; t < frames; t++ {
+		var mean float64
+		for i := range frame {
+			frame[i] = float64(samples[t*frameShift+i])
+			mean += frame[i]
+		}
+		mean /= float64(frameLength)
+		for i := range frame {
+			frame[i] -= mean
+		}
+		// pre-emphasis, in place from the end
+		for i := frameLength - 1; i > 0; i-- {
+			frame[i] -= 0.97 * frame[i-1]
+		}
+		frame[0] -= 0.97 * frame[0]
+		for i := range frame {
+			frame[i] *= window[i]
+		}
+		// the frame is zero padded to paddedLength
+		for k := 0; k < frequencyBins; k++ {
+			var re, im float64
+			for n, v := range frame {
+				index := (k * n) % paddedLength
+				re += v * cosTable[index]
+				im -= v * sinTable[index]
+			}
+			power[k] = re*re + im*im
+		}
+		for m, filter := range filters {
+			var energy float64
+			for k, weight := range filter {
+				energy += weight * power[k]
+			}
+			features[t*numMelBins+m] = float32(math.Log(math.Max(energy, 1.1920929e-07)))
+		}
+	}
+	return features, frames
+}
@@ -0,0 +1,352 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// AutomaticSpeechRecognitionPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/automatic_speech_recognition.py
+// for whisper models exported to onnx as an encoder and a decoder. Audio longer than the model window (30 seconds)
+// is split in consecutive windows which are transcribed independently. Text is decoded greedily.
+
+// types
+
+type AutomaticSpeechRecognitionPipeline struct {
+	BaseSeq2SeqPipeline
+	// Language is the spoken language, e.g. "en" or "fr", for multilingual models. If empty the model detects it.
+	Language string
+	// Task is "transcribe" (the default) or "translate" (to english), for multilingual models.
+	Task             string
+	ReturnTimestamps bool
+	AudioConfig      AudioProcessorConfig
+	whisperConfig    whisperGenerationConfig
+	melFilters       [][]float64
+}
+
+// TranscriptionChunk is a segment of a transcription, with its start and end time in seconds.
+type TranscriptionChunk struct {
+	Text  string
+	Start float32
+	End   float32
+}
+
+type AutomaticSpeechRecognitionOutput struct {
+	Usage
+	Transcriptions []string
+	// Chunks holds the timestamped segments of each transcription, if timestamps are requested.
+	Chunks [][]TranscriptionChunk
+}
+
+func (t *AutomaticSpeechRecognitionOutput) GetOutput() []any {
+	out := make([]any, len(t.Transcriptions))
+	for i, transcription := range t.Transcriptions {
+		out[i] = any(transcription)
+	}
+	return out
+}
+
+// whisperGenerationConfig holds the whisper specific special tokens of generation_config.json.
+type whisperGenerationConfig struct {
+	LangToId            map[string]int64 `json:"lang_to_id"`
+	TaskToId            map[string]int64 `json:"task_to_id"`
+	NoTimestampsTokenId int64            `json:"no_timestamps_token_id"`
+	IsMultilingual      bool             `json:"is_multilingual"`
+}
+
+// whisperMaxNewTokens is the number of tokens whisper can generate in a window: its decoder takes at most 448
+// positions, four of which are used by the prefix tokens.
+const whisperMaxNewTokens = 444
+
+// timestampPrecision is the duration in seconds between two consecutive timestamp tokens.
+const timestampPrecision = 0.02
+
+// options
+
+// WithSpokenLanguage sets the language of the audio, e.g. "en", for multilingual whisper models.
+func WithSpokenLanguage(language string) PipelineOption[*AutomaticSpeechRecognitionPipeline] {
+	return func(pipeline *AutomaticSpeechRecognitionPipeline) {
+		pipeline.Language = language
+	}
+}
+
+// WithSpeechTranslation translates the speech to english instead of transcribing it, for multilingual models.
+func WithSpeechTranslation() PipelineOption[*AutomaticSpeechRecognitionPipeline] {
+	return func(pipeline *AutomaticSpeechRecognitionPipeline) {
+		pipeline.Task = "translate"
+	}
+}
+
+// WithTimestamps returns the timestamped segments of the transcriptions.
+func WithTimestamps() PipelineOption[*AutomaticSpeechRecognitionPipeline] {
+	return func(pipeline *AutomaticSpeechRecognitionPipeline) {
+		pipeline.ReturnTimestamps = true
+	}
+}
+
+// NewAutomaticSpeechRecognitionPipeline initializes a speech recognition pipeline.
+func NewAutomaticSpeechRecognitionPipeline(config PipelineConfig[*AutomaticSpeechRecognitionPipeline], ortOptions *ort.SessionOptions) (*AutomaticSpeechRecognitionPipeline, error) {
+	pipeline := &AutomaticSpeechRecognitionPipeline{Task: "transcribe"}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	generationConfig, err := loadGenerationConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	generationConfig.MaxNewTokens = whisperMaxNewTokens
+	pipeline.GenerationConfig = generationConfig
+
+	whisperConfigBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "generation_config.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err = jsoniter.Unmarshal(whisperConfigBytes, &pipeline.whisperConfig); err != nil {
+		return nil, fmt.Errorf("could not read generation_config.json: %w", err)
+	}
+
+	audioConfig, err := loadAudioProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.AudioConfig = audioConfig
+	pipeline.melFilters = melFilterBank(audioConfig.NFFT/2+1, audioConfig.FeatureSize, audioConfig.SamplingRate)
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx models
+	err = pipeline.loadSeq2SeqModel()
+	if err != nil {
+		return nil, err
+	}
+	if pipeline.whisperConfig.NoTimestampsTokenId == 0 {
+		if id, ok := pipeline.Vocabulary.TokenToId("<|notimestamps|>"); ok {
+			pipeline.whisperConfig.NoTimestampsTokenId = int64(id)
+		}
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *AutomaticSpeechRecognitionPipeline) Validate() error {
+	validationErrors := p.validateSeq2Seq()
+
+	if !hasInputOutput(p.InputsMeta, "input_features") {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the encoder has no input_features input"))
+	}
+	if p.whisperConfig.NoTimestampsTokenId <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model has no <|notimestamps|> token"))
+	}
+	if p.whisperConfig.IsMultilingual {
+		if _, err := p.languageTokenId(); err != nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: %w", err))
+		}
+		if _, ok := p.whisperConfig.TaskToId[p.Task]; !ok {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: task %s is not supported by the model", p.Task))
+		}
+	} else if p.Language != "" && p.Language != "en" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model is english only, language %s is not supported", p.Language))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// languageTokenId returns the id of the language token, or -1 if the language is to be detected by the model.
+func (p *AutomaticSpeechRecognitionPipeline) languageTokenId() (int64, error) {
+	if p.Language == "" {
+		return -1, nil
+	}
+	token := p.Language
+	if !strings.HasPrefix(token, "<|") {
+		token = "<|" + token + "|>"
+	}
+	id, ok := p.whisperConfig.LangToId[token]
+	if !ok {
+		return 0, fmt.Errorf("language %s is not supported by the model", p.Language)
+	}
+	return id, nil
+}
+
+// prefix returns the tokens the transcriptions start with: <|startoftranscript|>, then for multilingual models the
+// language and task tokens, and <|notimestamps|> unless timestamps are requested.
+func (p *AutomaticSpeechRecognitionPipeline) prefix() ([]int64, error) {
+	prefix := []int64{p.GenerationConfig.DecoderStartTokenId}
+	if p.whisperConfig.IsMultilingual {
+		languageId, err := p.languageTokenId()
+		if err != nil {
+			return nil, err
+		}
+		if languageId < 0 {
+			// the model generates the language token, followed by the task and timestamp tokens
+			return prefix, nil
+		}
+		prefix = append(prefix, languageId, p.whisperConfig.TaskToId[p.Task])
+	}
+	if !p.ReturnTimestamps {
+		prefix = append(prefix, p.whisperConfig.NoTimestampsTokenId)
+	}
+	return prefix, nil
+}
+
+// audioWindow is a window of audio of one of the inputs, starting at offset seconds.
+type audioWindow struct {
+	input  int
+	offset float32
+}
+
+// Preprocess splits the audio inputs into windows and computes their log-mel spectrograms, returned as a flattened
+// [windows, FeatureSize, frames] tensor.
+func (p *AutomaticSpeechRecognitionPipeline) Preprocess(audio [][]float32) ([]float32, []audioWindow) {
+	start := time.Now()
+
+	var features []float32
+	var windows []audioWindow
+	windowSamples := p.AudioConfig.chunkSamples()
+	for i, samples := range audio {
+		for offset := 0; offset == 0 || offset < len(samples); offset += windowSamples {
+			end := offset + windowSamples
+			if end > len(samples) {
+				end = len(samples)
+			}
+			features = append(features, p.AudioConfig.logMelSpectrogram(samples[offset:end], p.melFilters)...)
+			windows = append(windows, audioWindow{input: i, offset: float32(offset) / float32(p.AudioConfig.SamplingRate)})
+		}
+	}
+
+	// the feature extraction is accounted as the tokenization step of the pipeline
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return features, windows
+}
+
+// Forward encodes the windows and decodes their transcriptions, returning the generated token ids of each window.
+func (p *AutomaticSpeechRecognitionPipeline) Forward(features []float32, windowsCount int) (generated [][]int64, err error) {
+	prefix, err := p.prefix()
+	if err != nil {
+		return nil, err
+	}
+
+	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
+	for i, input := range p.InputsMeta {
+		if input.Name != "input_features" {
+			return nil, fmt.Errorf("unsupported encoder input %s", input.Name)
+		}
+		shape := ort.NewShape(int64(windowsCount), int64(p.AudioConfig.FeatureSize), int64(p.AudioConfig.chunkFrames()))
+		if inputTensors[i], err = ort.NewTensor(shape, features); err != nil {
+			return nil, err
+		}
+	}
+	hiddenStates, err := p.runEncoder(inputTensors)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, hiddenStates.Destroy())
+	}()
+	return p.generate(hiddenStates, nil, prefix)
+}
+
+// Postprocess decodes the generated tokens of the windows and joins the windows of each input.
+func (p *AutomaticSpeechRecognitionPipeline) Postprocess(generated [][]int64, windows []audioWindow, inputsCount int) (*AutomaticSpeechRecognitionOutput, error) {
+	usage := Usage{}
+	for _, tokens := range generated {
+		usage.GeneratedTokens += uint64(len(tokens))
+	}
+	output := &AutomaticSpeechRecognitionOutput{
+		Usage:          p.recordUsage(usage),
+		Transcriptions: make([]string, inputsCount),
+	}
+	if p.ReturnTimestamps {
+		output.Chunks = make([][]TranscriptionChunk, inputsCount)
+	}
+
+	texts := make([][]string, inputsCount)
+	timestampBegin := p.whisperConfig.NoTimestampsTokenId + 1
+	windowLength := float32(p.AudioConfig.ChunkLength)
+	for w, tokens := range generated {
+		window := windows[w]
+		var textTokens []int64
+		var segmentTokens []int64
+		segmentStart := float32(-1)
+		for _, token := range tokens {
+			if token < timestampBegin {
+				textTokens = append(textTokens, token)
+				segmentTokens = append(segmentTokens, token)
+				continue
+			}
+			timestamp := float32(token-timestampBegin) * timestampPrecision
+			if segmentStart < 0 {
+				segmentStart = timestamp
+				continue
+			}
+			if text := p.decodeTokens(segmentTokens); text != "" && p.ReturnTimestamps {
+				output.Chunks[window.input] = append(output.Chunks[window.input], TranscriptionChunk{Text: text, Start: window.offset + segmentStart, End: window.offset + timestamp})
+			}
+			segmentTokens = nil
+			segmentStart = -1
+		}
+		if text := p.decodeTokens(segmentTokens); text != "" && p.ReturnTimestamps {
+			// the last segment was not closed, it ends with the window
+			if segmentStart < 0 {
+				segmentStart = 0
+			}
+			output.Chunks[window.input] = append(output.Chunks[window.input], TranscriptionChunk{Text: text, Start: window.offset + segmentStart, End: window.offset + windowLength})
+		}
+		if text := p.decodeTokens(textTokens); text != "" {
+			texts[window.input] = append(texts[window.input], text)
+		}
+	}
+	for i := range texts {
+		output.Transcriptions[i] = strings.Join(texts[i], " ")
+	}
+	return output, nil
+}
+
+// decodeTokens decodes text tokens, skipping the special tokens.
+func (p *AutomaticSpeechRecognitionPipeline) decodeTokens(tokens []int64) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	return p.decodeGenerated([][]int64{tokens})[0]
+}
+
+// Run the pipeline on a batch of paths to WAV files.
+func (p *AutomaticSpeechRecognitionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	audio, err := p.AudioConfig.readAudio(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(audio)
+}
+
+// RunPipeline transcribes each input, given as mono samples between -1 and 1 at the sampling rate of the model
+// (AudioConfig.SamplingRate, 16kHz for whisper).
+func (p *AutomaticSpeechRecognitionPipeline) RunPipeline(audio [][]float32) (*AutomaticSpeechRecognitionOutput, error) {
+	if len(audio) == 0 {
+		return &AutomaticSpeechRecognitionOutput{}, nil
+	}
+	features, windows := p.Preprocess(audio)
+	generated, err := p.Forward(features, len(windows))
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(generated, windows, len(audio))
+}
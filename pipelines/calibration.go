@@ -0,0 +1,81 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// Calibration adjusts the scores of a classification model to the data of a deployment, so that precision and
+// recall can be tuned without retraining or code changes. It is read from a json file of the format
+//
+//	{"temperature": 1.5, "platt": {"POSITIVE": {"a": 1.2, "b": -0.3}}, "thresholds": {"POSITIVE": 0.8}}
+//
+// where all the fields are optional. The logit z of each label is replaced by (a*z + b) / temperature before the
+// softmax or sigmoid: with a sigmoid this is Platt scaling, and a temperature alone is temperature scaling. The
+// labels without Platt parameters keep a=1 and b=0.
+type Calibration struct {
+	Temperature float32                 `json:"temperature"`
+	Platt       map[string]PlattScaling `json:"platt"`
+	// Thresholds are the minimum scores of the labels to be returned, see WithLabelThresholds.
+	Thresholds map[string]float32 `json:"thresholds"`
+}
+
+// PlattScaling holds the Platt scaling parameters of a label.
+type PlattScaling struct {
+	A float32 `json:"a"`
+	B float32 `json:"b"`
+}
+
+// loadCalibration reads a calibration file. Relative paths are resolved against the model folder.
+func loadCalibration(modelPath string, filename string) (*Calibration, error) {
+	calibrationPath := filename
+	if !filepath.IsAbs(calibrationPath) && util.GetPathType(calibrationPath) != "S3" {
+		calibrationPath = util.PathJoinSafe(modelPath, calibrationPath)
+	}
+	calibrationBytes, err := util.ReadFileBytes(calibrationPath)
+	if err != nil {
+		return nil, err
+	}
+	calibration := &Calibration{}
+	if err = jsoniter.Unmarshal(calibrationBytes, calibration); err != nil {
+		return nil, fmt.Errorf("could not read calibration %s: %w", filename, err)
+	}
+	return calibration, nil
+}
+
+// validate checks the calibration against the labels of the model.
+func (c *Calibration) validate(idLabelMap map[int]string) error {
+	var validationErrors []error
+	if c.Temperature < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: calibration temperature must be greater than zero, got %f", c.Temperature))
+	}
+	labels := map[string]bool{}
+	for _, label := range idLabelMap {
+		labels[label] = true
+	}
+	for label := range c.Platt {
+		if !labels[label] {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: calibration label %s is not a label of the model", label))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// apply calibrates the logits of an input, in place. The index of a logit is the id of its label.
+func (c *Calibration) apply(logits []float32, idLabelMap map[int]string) {
+	temperature := c.Temperature
+	if temperature == 0 {
+		temperature = 1
+	}
+	for i, logit := range logits {
+		if platt, ok := c.Platt[idLabelMap[i]]; ok {
+			logit = platt.A*logit + platt.B
+		}
+		logits[i] = logit / temperature
+	}
+}
@@ -0,0 +1,278 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// CascadePipeline runs the inputs on a chain of pipelines of increasing cost (e.g. a small distilled model, then a
+// large one), each input being escalated to the next stage only when the confidence of the current stage in its
+// output is below the stage threshold. Most inputs are then served by the cheap model, and the cost of the larger
+// model is only paid for the hard ones.
+type CascadePipeline struct {
+	PipelineName string
+	Stages       []CascadeStage
+	// MaxEscalationRate caps the fraction of the inputs reaching a stage that can be escalated to the next one, to
+	// bound the cost and latency of a batch. The inputs with the lowest confidence are escalated first.
+	MaxEscalationRate float64
+	// Confidence returns the confidence of a stage in its output for a single input, between 0 and 1.
+	Confidence   func(output any) (float32, error)
+	CascadeStats []CascadeStats
+}
+
+// CascadeStage is a pipeline of a cascade, with the minimum confidence for its outputs to be accepted. The threshold
+// of the last stage is ignored, as its outputs are always accepted.
+type CascadeStage struct {
+	Name      string
+	Pipeline  Pipeline
+	Threshold float32
+}
+
+// CascadeStats holds the metrics of a stage of a CascadePipeline.
+type CascadeStats struct {
+	NumInputs    uint64
+	NumEscalated uint64
+	TotalNS      uint64
+}
+
+// CascadedOutput is the output for a single input, with the name of the stage that produced it and its confidence.
+type CascadedOutput struct {
+	Stage      string
+	Confidence float32
+	Output     any
+}
+
+type CascadeOutput struct {
+	Usage
+	Diagnostics
+	Outputs []CascadedOutput
+}
+
+func (t *CascadeOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, cascadedOutput := range t.Outputs {
+		out[i] = any(cascadedOutput)
+	}
+	return out
+}
+
+// options
+
+// WithMaxEscalationRate sets the maximum fraction (between 0 and 1) of the inputs reaching a stage that can be
+// escalated to the next one. By default all the inputs below the threshold of a stage are escalated.
+func WithMaxEscalationRate(rate float64) PipelineOption[*CascadePipeline] {
+	return func(p *CascadePipeline) {
+		p.MaxEscalationRate = rate
+	}
+}
+
+// WithConfidenceFunction sets the function returning the confidence of a stage in its output for a single input, one
+// of the elements of the GetOutput method of its batch output. By default this is the top score of classification
+// outputs, see ClassificationConfidence.
+func WithConfidenceFunction(confidence func(output any) (float32, error)) PipelineOption[*CascadePipeline] {
+	return func(p *CascadePipeline) {
+		p.Confidence = confidence
+	}
+}
+
+// ClassificationConfidence returns the top score of the output of a classification pipeline.
+func ClassificationConfidence(output any) (float32, error) {
+	classifications, ok := output.([]ClassificationOutput)
+	if !ok {
+		return 0, fmt.Errorf("no confidence for output of type %T, use WithConfidenceFunction", output)
+	}
+	var topScore float32
+	for _, classification := range classifications {
+		if classification.Score > topScore {
+			topScore = classification.Score
+		}
+	}
+	return topScore, nil
+}
+
+// NewCascadePipeline creates a pipeline running the inputs on the stages in order, from the cheapest to the most
+// expensive. The wrapped pipelines are not owned by the cascade and must be destroyed separately, e.g. by the
+// session that created them.
+func NewCascadePipeline(name string, stages []CascadeStage, opts ...PipelineOption[*CascadePipeline]) (*CascadePipeline, error) {
+	pipeline := &CascadePipeline{
+		PipelineName:      name,
+		Stages:            stages,
+		MaxEscalationRate: 1,
+		Confidence:        ClassificationConfidence,
+		CascadeStats:      make([]CascadeStats, len(stages)),
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *CascadePipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.Stages) < 2 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least two stages are required"))
+	}
+	names := map[string]bool{}
+	for _, stage := range p.Stages {
+		if stage.Pipeline == nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: stage %s has no pipeline", stage.Name))
+		}
+		if stage.Threshold < 0 || stage.Threshold > 1 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: threshold of stage %s must be between 0 and 1, got %f", stage.Name, stage.Threshold))
+		}
+		if names[stage.Name] {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: stage name %s is not unique", stage.Name))
+		}
+		names[stage.Name] = true
+	}
+	if p.MaxEscalationRate < 0 || p.MaxEscalationRate > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: max escalation rate must be between 0 and 1, got %f", p.MaxEscalationRate))
+	}
+	if p.Confidence == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a confidence function is required"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy is a no-op: the pipelines of the stages are not owned by the cascade.
+func (p *CascadePipeline) Destroy() error {
+	return nil
+}
+
+// GetOutputDim returns the output dimension of the first stage.
+func (p *CascadePipeline) GetOutputDim() int {
+	return p.Stages[0].Pipeline.GetOutputDim()
+}
+
+func (p *CascadePipeline) GetStats() []string {
+	stats := []string{fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName)}
+	for i, stage := range p.Stages {
+		inputs := atomic.LoadUint64(&p.CascadeStats[i].NumInputs)
+		escalated := atomic.LoadUint64(&p.CascadeStats[i].NumEscalated)
+		escalationRate := 0.0
+		if inputs > 0 {
+			escalationRate = float64(escalated) / float64(inputs)
+		}
+		stats = append(stats, fmt.Sprintf("Stage: Name=%s, Inputs=%d, Escalated=%d, Escalation rate=%.4f, Total time=%s",
+			stage.Name,
+			inputs,
+			escalated,
+			escalationRate,
+			time.Duration(atomic.LoadUint64(&p.CascadeStats[i].TotalNS))))
+	}
+	return stats
+}
+
+// Run the pipeline on a string batch.
+func (p *CascadePipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline runs the first stage on all the inputs, then each following stage on the inputs escalated by the
+// previous one.
+func (p *CascadePipeline) RunPipeline(inputs []string) (*CascadeOutput, error) {
+	outputs := make([]CascadedOutput, len(inputs))
+	var usage Usage
+	var diagnostics Diagnostics
+
+	// positions are the indices in inputs of the inputs run on the current stage
+	positions := make([]int, len(inputs))
+	for i := range positions {
+		positions[i] = i
+	}
+	for s, stage := range p.Stages {
+		if len(positions) == 0 {
+			break
+		}
+		stageInputs := make([]string, len(positions))
+		for i, position := range positions {
+			stageInputs[i] = inputs[position]
+		}
+		start := time.Now()
+		stageOutput, err := stage.Pipeline.Run(stageInputs)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		atomic.AddUint64(&p.CascadeStats[s].TotalNS, uint64(time.Since(start)))
+		atomic.AddUint64(&p.CascadeStats[s].NumInputs, uint64(len(positions)))
+		results := stageOutput.GetOutput()
+		if len(results) != len(positions) {
+			return nil, fmt.Errorf("stage %s returned %d outputs for %d inputs", stage.Name, len(results), len(positions))
+		}
+
+		confidences := make([]float32, len(results))
+		for i, result := range results {
+			if confidences[i], err = p.Confidence(result); err != nil {
+				return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+			}
+			outputs[positions[i]] = CascadedOutput{Stage: stage.Name, Confidence: confidences[i], Output: result}
+		}
+		escalated := p.escalate(s, confidences)
+
+		// the diagnostics of the escalated inputs are those of the stage that serves them
+		usage = usage.Add(usageOf(stageOutput))
+		isEscalated := make([]bool, len(positions))
+		for _, i := range escalated {
+			isEscalated[i] = true
+		}
+		for _, warning := range warningsOf(stageOutput, nil) {
+			if warning.Input >= 0 && warning.Input < len(positions) {
+				if isEscalated[warning.Input] {
+					continue
+				}
+				warning.Input = positions[warning.Input]
+			}
+			diagnostics.Warnings = append(diagnostics.Warnings, warning)
+		}
+		for _, truncation := range truncationsOf(stageOutput, nil) {
+			if truncation.Input >= 0 && truncation.Input < len(positions) {
+				if isEscalated[truncation.Input] {
+					continue
+				}
+				truncation.Input = positions[truncation.Input]
+			}
+			diagnostics.Truncations = append(diagnostics.Truncations, truncation)
+		}
+
+		nextPositions := make([]int, len(escalated))
+		for i, index := range escalated {
+			nextPositions[i] = positions[index]
+		}
+		atomic.AddUint64(&p.CascadeStats[s].NumEscalated, uint64(len(escalated)))
+		positions = nextPositions
+	}
+
+	return &CascadeOutput{Outputs: outputs, Usage: usage, Diagnostics: diagnostics}, nil
+}
+
+// escalate returns the indices of the outputs of stage s to run on the next stage: those with a confidence below the
+// stage threshold, at most MaxEscalationRate of the outputs, the least confident first. The last stage escalates
+// nothing.
+func (p *CascadePipeline) escalate(s int, confidences []float32) []int {
+	if s == len(p.Stages)-1 {
+		return nil
+	}
+	var escalated []int
+	for i, confidence := range confidences {
+		if confidence < p.Stages[s].Threshold {
+			escalated = append(escalated, i)
+		}
+	}
+	maxEscalated := int(math.Floor(p.MaxEscalationRate * float64(len(confidences))))
+	if len(escalated) > maxEscalated {
+		sort.SliceStable(escalated, func(i, j int) bool {
+			return confidences[escalated[i]] < confidences[escalated[j]]
+		})
+		escalated = escalated[:maxEscalated]
+		sort.Ints(escalated)
+	}
+	return escalated
+}
@@ -0,0 +1,435 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/tokenizers"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// DocumentQuestionAnsweringPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/document_question_answering.py
+// for LayoutLM-style extractive models (e.g. impira/layoutlm-document-qa). The question and the words of the document
+// are encoded as a sequence pair, each document token carrying the bounding box of its word, and the answer is the
+// span of words with the best start and end logits. Models with a pixel_values input (e.g. LayoutLMv3) also receive
+// the page image. Documents longer than the model maximum length are truncated.
+
+// types
+
+// OCRFunc extracts the words of a page image with their bounding boxes [x0, y0, x1, y1] in pixels, so that the
+// pipeline can be run on images alone.
+type OCRFunc func(img image.Image) (words []string, boxes [][4]int, err error)
+
+// DocumentInput is a page of a document. Words and Boxes are the OCR output of the page, with boxes [x0, y0, x1, y1]
+// normalized to a 0-1000 scale. If Words is empty the pipeline OCR function is run on the Image.
+type DocumentInput struct {
+	Image image.Image
+	Words []string
+	Boxes [][4]int
+}
+
+type DocumentQuestionAnsweringPipeline struct {
+	BasePipeline
+	OCR             OCRFunc
+	TopK            int
+	MaxAnswerLength int // maximum number of tokens of an answer
+	ImageConfig     ImageProcessorConfig
+	hasPixelValues  bool
+}
+
+// DocumentAnswer is an answer span. StartWord and EndWord are the indices of its first and last word in the
+// document words and Box is the union of their boxes, on the 0-1000 scale.
+type DocumentAnswer struct {
+	Answer    string
+	Score     float32
+	StartWord int
+	EndWord   int
+	Box       [4]int
+}
+
+type DocumentQuestionAnsweringOutput struct {
+	Usage
+	// Answers holds the answers to each question, sorted by decreasing score.
+	Answers [][]DocumentAnswer
+}
+
+func (t *DocumentQuestionAnsweringOutput) GetOutput() []any {
+	out := make([]any, len(t.Answers))
+	for i, answers := range t.Answers {
+		out[i] = any(answers)
+	}
+	return out
+}
+
+// the maximum length of LayoutLM models, for tokenizers that do not truncate
+const defaultDocumentMaxLength = 512
+
+// options
+
+// WithOCR sets the function used to extract the words of document images.
+func WithOCR(ocr OCRFunc) PipelineOption[*DocumentQuestionAnsweringPipeline] {
+	return func(pipeline *DocumentQuestionAnsweringPipeline) {
+		pipeline.OCR = ocr
+	}
+}
+
+// WithTopAnswers sets the number of answers returned for each question. The default is 1.
+func WithTopAnswers(topK int) PipelineOption[*DocumentQuestionAnsweringPipeline] {
+	return func(pipeline *DocumentQuestionAnsweringPipeline) {
+		pipeline.TopK = topK
+	}
+}
+
+// WithMaxAnswerLength sets the maximum number of tokens of an answer. The default is 15.
+func WithMaxAnswerLength(maxLength int) PipelineOption[*DocumentQuestionAnsweringPipeline] {
+	return func(pipeline *DocumentQuestionAnsweringPipeline) {
+		pipeline.MaxAnswerLength = maxLength
+	}
+}
+
+// NewDocumentQuestionAnsweringPipeline initializes a document question answering pipeline.
+func NewDocumentQuestionAnsweringPipeline(config PipelineConfig[*DocumentQuestionAnsweringPipeline], ortOptions *ort.SessionOptions) (*DocumentQuestionAnsweringPipeline, error) {
+	pipeline := &DocumentQuestionAnsweringPipeline{TopK: 1, MaxAnswerLength: 15}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	imageConfig, err := loadImageProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ImageConfig = imageConfig
+
+	// load onnx model
+	err = pipeline.loadModel()
+	if err != nil {
+		return nil, err
+	}
+	pipeline.hasPixelValues = hasInputOutput(pipeline.InputsMeta, "pixel_values")
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *DocumentQuestionAnsweringPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.TopK < 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: top answers must be at least 1, got %d", p.TopK))
+	}
+	if p.MaxAnswerLength < 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: max answer length must be at least 1, got %d", p.MaxAnswerLength))
+	}
+	for _, name := range []string{"start_logits", "end_logits"} {
+		if !hasInputOutput(p.OutputsMeta, name) {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model has no %s output, an extractive question answering model is required", name))
+		}
+	}
+	if height, width := p.ImageConfig.outputSize(); p.hasPixelValues && (height <= 0 || width <= 0) {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the image processor config must define a fixed output size"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// documentWords runs the OCR function on the image of a document without words, and normalizes its boxes.
+func (p *DocumentQuestionAnsweringPipeline) documentWords(document DocumentInput) ([]string, [][4]int, error) {
+	if len(document.Words) > 0 || document.Image == nil {
+		if len(document.Words) != len(document.Boxes) {
+			return nil, nil, fmt.Errorf("the document has %d words and %d boxes", len(document.Words), len(document.Boxes))
+		}
+		return document.Words, document.Boxes, nil
+	}
+	if p.OCR == nil {
+		return nil, nil, errors.New("the document has no words and the pipeline has no OCR function, see WithOCR")
+	}
+	words, boxes, err := p.OCR(document.Image)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCR failed: %w", err)
+	}
+	if len(words) != len(boxes) {
+		return nil, nil, fmt.Errorf("OCR returned %d words and %d boxes", len(words), len(boxes))
+	}
+	bounds := document.Image.Bounds()
+	normalize := func(v int, origin int, size int) int {
+		scaled := 1000 * (v - origin) / size
+		if scaled < 0 {
+			return 0
+		}
+		if scaled > 1000 {
+			return 1000
+		}
+		return scaled
+	}
+	normalized := make([][4]int, len(boxes))
+	for i, box := range boxes {
+		normalized[i] = [4]int{
+			normalize(box[0], bounds.Min.X, bounds.Dx()),
+			normalize(box[1], bounds.Min.Y, bounds.Dy()),
+			normalize(box[2], bounds.Min.X, bounds.Dx()),
+			normalize(box[3], bounds.Min.Y, bounds.Dy()),
+		}
+	}
+	return words, normalized, nil
+}
+
+// Preprocess encodes each question with the document words. It returns the batch and, for each question, the index
+// of the word of each token, or -1 for the question and special tokens.
+func (p *DocumentQuestionAnsweringPipeline) Preprocess(document DocumentInput, words []string, boxes [][4]int, questions []string) (PipelineBatch, [][]int, error) {
+	start := time.Now()
+
+	// the words are encoded as a single text so that they are tokenized as in context, and the tokens are mapped
+	// back to their word with the offsets
+	wordStarts := make([]int, len(words))
+	offset := 0
+	for i, word := range words {
+		wordStarts[i] = offset
+		offset += len(word) + 1
+	}
+	options := []tokenizers.EncodeOption{tokenizers.WithReturnTokens(), tokenizers.WithReturnTypeIDs(), tokenizers.WithReturnOffsets()}
+	wordsEncoding := p.Tokenizer.EncodeWithOptions(strings.Join(words, " "), false, options...)
+	tokenWords := make([]int, len(wordsEncoding.IDs))
+	for j, tokenOffset := range wordsEncoding.Offsets {
+		tokenWords[j] = sort.Search(len(wordStarts), func(k int) bool { return wordStarts[k] > int(tokenOffset[0]) }) - 1
+	}
+
+	sepId, sepErr := p.Vocabulary.SpecialTokenId("sep_token")
+	maxLength := p.pairTemplate.maxLength
+	if maxLength <= 0 {
+		maxLength = defaultDocumentMaxLength
+	}
+
+	inputs := make([]TokenizedInput, len(questions))
+	questionsWords := make([][]int, len(questions))
+	maxSequence := 0
+	for i, question := range questions {
+		questionEncoding := p.Tokenizer.EncodeWithOptions(question, false, options...)
+		// only the document is truncated
+		available := maxLength - p.pairTemplate.specialLength() - len(questionEncoding.IDs)
+		if available <= 0 {
+			return PipelineBatch{}, nil, fmt.Errorf("question %d is longer than the maximum length of %d tokens", i, maxLength)
+		}
+		truncated := wordsEncoding
+		if len(truncated.IDs) > available {
+			truncated.IDs = truncated.IDs[:available]
+			truncated.Tokens = truncated.Tokens[:available]
+		}
+
+		input, sequenceIds := p.pairTemplate.join(question, [2]tokenizers.Encoding{questionEncoding, truncated})
+		input.Bboxes = make([][4]int64, len(input.TokenIds))
+		questionsWords[i] = make([]int, len(input.TokenIds))
+		documentToken := 0
+		for j, sequence := range sequenceIds {
+			questionsWords[i][j] = -1
+			switch {
+			case sequence == 1:
+				word := tokenWords[documentToken]
+				documentToken++
+				if word < 0 {
+					continue
+				}
+				questionsWords[i][j] = word
+				box := boxes[word]
+				input.Bboxes[j] = [4]int64{int64(box[0]), int64(box[1]), int64(box[2]), int64(box[3])}
+			case sequence == -1 && sepErr == nil && input.TokenIds[j] == sepId:
+				input.Bboxes[j] = [4]int64{1000, 1000, 1000, 1000}
+			}
+		}
+		inputs[i] = input
+		if len(input.TokenIds) > maxSequence {
+			maxSequence = len(input.TokenIds)
+		}
+	}
+
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	batch := p.convertInputToTensors(inputs, maxSequence)
+
+	if p.hasPixelValues {
+		if document.Image == nil {
+			return PipelineBatch{}, nil, errors.New("the model requires the image of the document")
+		}
+		pixelValues, height, width, err := p.ImageConfig.preprocessImages([]image.Image{document.Image})
+		if err != nil {
+			return PipelineBatch{}, nil, err
+		}
+		// the page image is repeated for each question
+		for range questions {
+			batch.PixelValues = append(batch.PixelValues, pixelValues...)
+		}
+		batch.ImageHeight, batch.ImageWidth = height, width
+	}
+	return batch, questionsWords, nil
+}
+
+// Forward runs the model and returns the start and end logits of the tokens of each question.
+func (p *DocumentQuestionAnsweringPipeline) Forward(batch PipelineBatch) (startLogits []float32, endLogits []float32, err error) {
+	start := time.Now()
+
+	inputTensors, err := p.getInputTensors(batch, int64(len(batch.Input)), int64(batch.MaxSequence))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		for _, tensor := range inputTensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}()
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, nil, err
+	}
+	for i, output := range p.OutputsMeta {
+		if output.Name == "start_logits" || output.Name == "end_logits" {
+			logitsTensor, ok := outputTensors[i].(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, fmt.Errorf("%s output must be float32", output.Name))
+			} else if output.Name == "start_logits" {
+				startLogits = append([]float32(nil), logitsTensor.GetData()...)
+			} else {
+				endLogits = append([]float32(nil), logitsTensor.GetData()...)
+			}
+		}
+		err = errors.Join(err, outputTensors[i].Destroy())
+	}
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return startLogits, endLogits, err
+}
+
+// Postprocess scores the spans of document tokens of up to MaxAnswerLength tokens by the product of their start and
+// end probabilities, the softmax of the logits over the document tokens, and returns the TopK word spans.
+func (p *DocumentQuestionAnsweringPipeline) Postprocess(batch PipelineBatch, questionsWords [][]int, startLogits []float32, endLogits []float32, words []string, boxes [][4]int) (*DocumentQuestionAnsweringOutput, error) {
+	expected := len(batch.Input) * batch.MaxSequence
+	if len(startLogits) != expected || len(endLogits) != expected {
+		return nil, fmt.Errorf("expected %d start and end logits, got %d and %d", expected, len(startLogits), len(endLogits))
+	}
+	output := &DocumentQuestionAnsweringOutput{
+		Usage:   p.recordUsage(batchUsage(batch)),
+		Answers: make([][]DocumentAnswer, len(batch.Input)),
+	}
+	for i, tokenWords := range questionsWords {
+		var documentTokens []int
+		for j, word := range tokenWords {
+			if word >= 0 {
+				documentTokens = append(documentTokens, j)
+			}
+		}
+		if len(documentTokens) == 0 {
+			output.Answers[i] = []DocumentAnswer{}
+			continue
+		}
+		offset := i * batch.MaxSequence
+		documentStart := make([]float32, len(documentTokens))
+		documentEnd := make([]float32, len(documentTokens))
+		for k, j := range documentTokens {
+			documentStart[k] = startLogits[offset+j]
+			documentEnd[k] = endLogits[offset+j]
+		}
+		startScores, endScores := util.SoftMax(documentStart), util.SoftMax(documentEnd)
+
+		// the best score of each word span
+		spans := map[[2]int]float32{}
+		for s := range documentTokens {
+			for e := s; e < len(documentTokens) && e < s+p.MaxAnswerLength; e++ {
+				span := [2]int{tokenWords[documentTokens[s]], tokenWords[documentTokens[e]]}
+				if score := startScores[s] * endScores[e]; score > spans[span] {
+					spans[span] = score
+				}
+			}
+		}
+		answers := make([]DocumentAnswer, 0, len(spans))
+		for span, score := range spans {
+			box := boxes[span[0]]
+			for _, wordBox := range boxes[span[0]+1 : span[1]+1] {
+				box = unionBox(box, wordBox)
+			}
+			answers = append(answers, DocumentAnswer{
+				Answer:    strings.Join(words[span[0]:span[1]+1], " "),
+				Score:     score,
+				StartWord: span[0],
+				EndWord:   span[1],
+				Box:       box,
+			})
+		}
+		sort.Slice(answers, func(a, b int) bool {
+			if answers[a].Score != answers[b].Score {
+				return answers[a].Score > answers[b].Score
+			}
+			return answers[a].StartWord < answers[b].StartWord
+		})
+		if len(answers) > p.TopK {
+			answers = answers[:p.TopK]
+		}
+		output.Answers[i] = answers
+	}
+	return output, nil
+}
+
+// unionBox returns the smallest box containing both boxes.
+func unionBox(a [4]int, b [4]int) [4]int {
+	union := a
+	for i := 0; i < 2; i++ {
+		if b[i] < union[i] {
+			union[i] = b[i]
+		}
+		if b[i+2] > union[i+2] {
+			union[i+2] = b[i+2]
+		}
+	}
+	return union
+}
+
+// Run the pipeline on a string batch. The first input is the path to a page image (jpeg, png or gif), read with the
+// OCR function of the pipeline, and the following ones the questions.
+func (p *DocumentQuestionAnsweringPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("document question answering requires an image path followed by the questions")
+	}
+	images, err := readImages(inputs[:1])
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(DocumentInput{Image: images[0]}, inputs[1:])
+}
+
+// RunPipeline answers each question on the document.
+func (p *DocumentQuestionAnsweringPipeline) RunPipeline(document DocumentInput, questions []string) (*DocumentQuestionAnsweringOutput, error) {
+	if len(questions) == 0 {
+		return &DocumentQuestionAnsweringOutput{}, nil
+	}
+	words, boxes, err := p.documentWords(document)
+	if err != nil {
+		return nil, err
+	}
+	batch, questionsWords, err := p.Preprocess(document, words, boxes, questions)
+	if err != nil {
+		return nil, err
+	}
+	startLogits, endLogits, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, questionsWords, startLogits, endLogits, words, boxes)
+}
@@ -0,0 +1,188 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unicode"
+)
+
+// ExplanationPipeline explains the predictions of any classification pipeline, i.e. any pipeline whose outputs are
+// []ClassificationOutput, by occlusion: each word of an input is masked in turn and the input is classified again.
+// The importance of a word is the drop in the score of the predicted label when it is masked, a leave-one-out
+// approximation of its SHAP value that needs no access to the model internals.
+type ExplanationPipeline struct {
+	PipelineName string
+	Classifier   Pipeline
+	// MaskToken replaces the occluded words, e.g. "[MASK]" for bert models. If empty the words are removed.
+	MaskToken string
+	NumCalls  uint64
+}
+
+// Explanation is the predicted label of an input with the importance of each of its words.
+type Explanation struct {
+	Label string
+	Score float32
+	Words []TokenContribution
+}
+
+type ExplanationOutput struct {
+	Usage
+	Explanations []Explanation
+}
+
+func (t *ExplanationOutput) GetOutput() []any {
+	out := make([]any, len(t.Explanations))
+	for i, explanation := range t.Explanations {
+		out[i] = any(explanation)
+	}
+	return out
+}
+
+// NewExplanationPipeline creates a pipeline explaining the outputs of classifier, occluding the words with
+// maskToken. The classifier is not owned by the explanation pipeline and must be destroyed separately, e.g. by the
+// session that created it.
+func NewExplanationPipeline(name string, classifier Pipeline, maskToken string) (*ExplanationPipeline, error) {
+	pipeline := &ExplanationPipeline{
+		PipelineName: name,
+		Classifier:   classifier,
+		MaskToken:    maskToken,
+	}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *ExplanationPipeline) Validate() error {
+	if p.Classifier == nil {
+		return errors.New("pipeline configuration invalid: a classification pipeline is required")
+	}
+	return nil
+}
+
+// Destroy does nothing, the classifier is not destroyed.
+func (p *ExplanationPipeline) Destroy() error {
+	return nil
+}
+
+func (p *ExplanationPipeline) GetOutputDim() int {
+	return p.Classifier.GetOutputDim()
+}
+
+func (p *ExplanationPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Explanation: Explained inputs=%d", atomic.LoadUint64(&p.NumCalls)),
+	}
+}
+
+// Run the pipeline on a string batch.
+func (p *ExplanationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline classifies each input and computes the importance of its words. The classifier is run once on the
+// batch and once per input on its occluded copies.
+func (p *ExplanationPipeline) RunPipeline(inputs []string) (*ExplanationOutput, error) {
+	output := &ExplanationOutput{Explanations: make([]Explanation, len(inputs))}
+	if len(inputs) == 0 {
+		return output, nil
+	}
+	classified, err := p.Classifier.Run(inputs)
+	if err != nil {
+		return nil, err
+	}
+	output.Usage = output.Usage.Add(usageOf(classified))
+	predictions, err := classifications(classified, len(inputs))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, input := range inputs {
+		if len(predictions[i]) == 0 {
+			continue
+		}
+		top := predictions[i][0]
+		for _, prediction := range predictions[i] {
+			if prediction.Score > top.Score {
+				top = prediction
+			}
+		}
+		output.Explanations[i] = Explanation{Label: top.Label, Score: top.Score}
+
+		words := wordSpans(input)
+		if len(words) == 0 {
+			continue
+		}
+		occluded := make([]string, len(words))
+		for j, word := range words {
+			occluded[j] = input[:word[0]] + p.MaskToken + input[word[1]:]
+		}
+		occludedOutput, err := p.Classifier.Run(occluded)
+		if err != nil {
+			return nil, err
+		}
+		output.Usage = output.Usage.Add(usageOf(occludedOutput))
+		occludedPredictions, err := classifications(occludedOutput, len(occluded))
+		if err != nil {
+			return nil, err
+		}
+		output.Explanations[i].Words = make([]TokenContribution, len(words))
+		for j, word := range words {
+			// classifiers returning only their top label give no score for the original label if the occlusion
+			// changes the prediction, it is then counted as zero
+			var score float32
+			for _, prediction := range occludedPredictions[j] {
+				if prediction.Label == top.Label {
+					score = prediction.Score
+				}
+			}
+			output.Explanations[i].Words[j] = TokenContribution{
+				Token:        input[word[0]:word[1]],
+				Start:        uint(word[0]),
+				End:          uint(word[1]),
+				Contribution: top.Score - score,
+			}
+		}
+	}
+	atomic.AddUint64(&p.NumCalls, uint64(len(inputs)))
+	return output, nil
+}
+
+// classifications reads the classification outputs of a batch.
+func classifications(output PipelineBatchOutput, inputsCount int) ([][]ClassificationOutput, error) {
+	results := output.GetOutput()
+	if len(results) != inputsCount {
+		return nil, fmt.Errorf("the classifier returned %d outputs for %d inputs", len(results), inputsCount)
+	}
+	predictions := make([][]ClassificationOutput, len(results))
+	for i, result := range results {
+		prediction, ok := result.([]ClassificationOutput)
+		if !ok {
+			return nil, fmt.Errorf("explanations require a classification pipeline, got outputs of type %T", result)
+		}
+		predictions[i] = prediction
+	}
+	return predictions, nil
+}
+
+// wordSpans returns the byte offsets of the whitespace separated words of a text.
+func wordSpans(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
@@ -1,8 +1,13 @@
 package pipelines
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 
+	jsoniter "github.com/json-iterator/go"
 	ort "github.com/yalue/onnxruntime_go"
 
 	util "github.com/knights-analytics/hugot/utils"
@@ -16,7 +21,36 @@ import (
 
 type FeatureExtractionPipeline struct {
 	BasePipeline
-	Normalization bool
+	Normalization         bool
+	Projection            *util.PCA
+	ProjectionFile        string
+	ReturnTokenEmbeddings bool
+	MultiVector           bool
+	// PoolSpecialTokens includes the special tokens (e.g. CLS and SEP) in mean pooling. It is true by default, like
+	// the mean pooling of sentence-transformers, which averages all the attended tokens.
+	PoolSpecialTokens bool
+	// TruncatedDimension is the number of leading dimensions the embeddings are truncated to, if greater than zero.
+	TruncatedDimension int
+	Int8Quantization   bool
+	BinaryQuantization bool
+	// Chunking splits the inputs longer than the maximum length of the model into chunks sharing ChunkStride tokens,
+	// whose embeddings are aggregated with ChunkAggregation: MEAN or TOKENS.
+	Chunking         bool
+	ChunkStride      int
+	ChunkAggregation string
+	// QueryPrefix and DocumentPrefix are prepended to the inputs of RunQueries and RunDocuments, for instruction tuned
+	// models such as E5 or BGE. Unless set with options, they are read from the prompts of the sentence-transformers
+	// config of the model. The token offsets of prefixed inputs include the prefix.
+	QueryPrefix    string
+	DocumentPrefix string
+	// Modules applies the Dense and Normalize modules of sentence-transformers models listed in their modules.json,
+	// which are not part of the exported onnx graph.
+	Modules bool
+	// Dense are the dense layers applied in order to the pooled embeddings, read from the Dense modules of the model.
+	Dense []*util.Dense
+	// defaultPrefix is the prompt of the sentence-transformers config named as default, prepended to the inputs of
+	// RunPipeline.
+	defaultPrefix string
 }
 
 type FeatureExtractionPipelineConfig struct {
@@ -24,7 +58,24 @@ type FeatureExtractionPipelineConfig struct {
 }
 
 type FeatureExtractionOutput struct {
+	Usage
+	Diagnostics
 	Embeddings [][]float32
+	// TokenEmbeddings, TokenOffsets and WordIds are only set with WithTokenEmbeddings. They hold, for each input, the
+	// embedding, the [start, end) byte offsets in the input and the word index (-1 for special tokens) of each token.
+	TokenEmbeddings [][][]float32
+	TokenOffsets    [][]tokenizers.Offset
+	WordIds         [][]int
+	// MultiVectorEmbeddings is only set with WithMultiVectorEmbeddings. It holds, for each input, the normalized
+	// embedding of each of its tokens.
+	MultiVectorEmbeddings [][][]float32
+	// QuantizedEmbeddings and Scales are only set with WithInt8Quantization. They hold, for each input, the int8
+	// embedding and its scale: the embedding is approximately the quantized embedding times the scale.
+	QuantizedEmbeddings [][]int8
+	Scales              []float32
+	// BinaryEmbeddings is only set with WithBinaryQuantization. It holds, for each input, the sign bits of the
+	// embedding packed in bytes, see util.QuantizeBinary.
+	BinaryEmbeddings [][]byte
 }
 
 func (t *FeatureExtractionOutput) GetOutput() []any {
@@ -37,15 +88,129 @@ func (t *FeatureExtractionOutput) GetOutput() []any {
 
 // options
 
+// WithNormalization scales the embeddings to unit L2 norm in postprocessing, after any projection, as
+// normalize_embeddings=True in sentence-transformers, so that the cosine similarity of two embeddings is their dot
+// product.
 func WithNormalization() PipelineOption[*FeatureExtractionPipeline] {
 	return func(pipeline *FeatureExtractionPipeline) {
 		pipeline.Normalization = true
 	}
 }
 
+// WithProjection applies a PCA/whitening projection to the embeddings in postprocessing, to reduce their
+// dimensionality before indexing. See util.FitPCA to fit the projection from a sample corpus.
+func WithProjection(projection *util.PCA) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Projection = projection
+	}
+}
+
+// WithProjectionFile loads the PCA/whitening projection from a json file. Relative paths are resolved
+// against the model folder.
+func WithProjectionFile(filename string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.ProjectionFile = filename
+	}
+}
+
+// WithTokenEmbeddings also returns the embedding of each token, with the token offsets and word ids, so that the
+// vectors can be mapped back to spans of the input. Token embeddings are not projected nor normalized.
+func WithTokenEmbeddings() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.ReturnTokenEmbeddings = true
+	}
+}
+
+// WithSpecialTokensInPooling sets whether the special tokens (e.g. CLS and SEP) are included in mean pooling. They
+// are included by default, as in sentence-transformers; models trained to pool the content tokens only need false.
+func WithSpecialTokensInPooling(include bool) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.PoolSpecialTokens = include
+	}
+}
+
+// WithMultiVectorEmbeddings also returns the L2 normalized embedding of each token (padding excluded), for ColBERT
+// style late interaction retrieval. Queries and documents are scored with util.MaxSim.
+func WithMultiVectorEmbeddings() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.MultiVector = true
+	}
+}
+
+// WithTruncatedDimension truncates the embeddings to their first dimension values and L2 normalizes them again, so
+// that models trained with a Matryoshka loss can be used at a reduced dimensionality, e.g. 256 of 768, to save vector
+// store space. Truncation applies after any projection.
+func WithTruncatedDimension(dimension int) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.TruncatedDimension = dimension
+	}
+}
+
+// WithInt8Quantization also returns the embeddings quantized to int8 values, with the scale of each embedding, so
+// that they can be written directly to scalar quantized vector indexes. Quantization applies to the final embeddings,
+// after projection, truncation and normalization.
+func WithInt8Quantization() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Int8Quantization = true
+	}
+}
+
+// WithBinaryQuantization also returns the embeddings quantized to their sign bits, packed in bytes, for binary
+// vector indexes compared with the hamming distance. Quantization applies to the final embeddings, after projection,
+// truncation and normalization.
+func WithBinaryQuantization() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.BinaryQuantization = true
+	}
+}
+
+// WithChunking splits the inputs longer than the maximum length of the model into overlapping chunks rather than
+// truncating them, consecutive chunks sharing stride tokens. The embeddings of the chunks of an input are aggregated
+// into its embedding before projection and normalization, see WithChunkAggregation. Chunking is not supported with
+// token or multi vector embeddings.
+func WithChunking(stride int) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Chunking = true
+		pipeline.ChunkStride = stride
+	}
+}
+
+// WithChunkAggregation sets how the embeddings of the chunks of an input are aggregated with WithChunking: MEAN (the
+// default) averages them, TOKENS weights them by their number of tokens, so that a short last chunk counts less.
+func WithChunkAggregation(aggregation string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.ChunkAggregation = aggregation
+	}
+}
+
+// WithQueryPrefix sets the instruction prepended to the inputs of RunQueries, e.g. "query: " for E5 models. It takes
+// precedence over the query prompt of the sentence-transformers config of the model.
+func WithQueryPrefix(prefix string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.QueryPrefix = prefix
+	}
+}
+
+// WithDocumentPrefix sets the instruction prepended to the inputs of RunDocuments, e.g. "passage: " for E5 models. It
+// takes precedence over the document prompt of the sentence-transformers config of the model.
+func WithDocumentPrefix(prefix string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.DocumentPrefix = prefix
+	}
+}
+
+// WithSentenceTransformersModules applies the Dense and Normalize modules of a sentence-transformers model, listed in
+// its modules.json, to the pooled embeddings so that they match the ones of the python library. The weights of the
+// Dense modules are read from the model.safetensors file of their folder.
+func WithSentenceTransformersModules() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Modules = true
+	}
+}
+
 // NewFeatureExtractionPipeline Initialize a feature extraction pipeline
 func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeline], ortOptions *ort.SessionOptions) (*FeatureExtractionPipeline, error) {
-	pipeline := &FeatureExtractionPipeline{}
+	pipeline := &FeatureExtractionPipeline{PoolSpecialTokens: true}
 	pipeline.ModelPath = config.ModelPath
 	pipeline.PipelineName = config.Name
 	pipeline.OrtOptions = ortOptions
@@ -57,10 +222,50 @@ func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeli
 
 	// tokenizer
 	pipeline.TokenizerOptions = []tokenizers.EncodeOption{tokenizers.WithReturnTypeIDs(), tokenizers.WithReturnAttentionMask()}
+	if pipeline.ReturnTokenEmbeddings {
+		pipeline.TokenizerOptions = append(pipeline.TokenizerOptions,
+			tokenizers.WithReturnTokens(),
+			tokenizers.WithReturnSpecialTokensMask(),
+			tokenizers.WithReturnOffsets(),
+		)
+	} else if !pipeline.PoolSpecialTokens || pipeline.Chunking {
+		// the chunks keep the special tokens of their input
+		pipeline.TokenizerOptions = append(pipeline.TokenizerOptions, tokenizers.WithReturnSpecialTokensMask())
+	}
+	if pipeline.Chunking && pipeline.ChunkAggregation == "" {
+		pipeline.ChunkAggregation = "MEAN"
+	}
+	// long inputs are split into chunks rather than truncated by the tokenizer
+	pipeline.untruncated = pipeline.Chunking
 
 	pipeline.PipelineTimings = &Timings{}
 	pipeline.TokenizerTimings = &Timings{}
 
+	if pipeline.ProjectionFile != "" {
+		projectionPath := pipeline.ProjectionFile
+		if !filepath.IsAbs(projectionPath) && util.GetPathType(projectionPath) != "S3" {
+			projectionPath = util.PathJoinSafe(pipeline.ModelPath, projectionPath)
+		}
+		projectionBytes, err := util.ReadFileBytes(projectionPath)
+		if err != nil {
+			return nil, err
+		}
+		projection := &util.PCA{}
+		if err = jsoniter.Unmarshal(projectionBytes, projection); err != nil {
+			return nil, err
+		}
+		pipeline.Projection = projection
+	}
+
+	if err := pipeline.loadPrompts(); err != nil {
+		return nil, err
+	}
+	if pipeline.Modules {
+		if err := pipeline.loadModules(); err != nil {
+			return nil, err
+		}
+	}
+
 	// load onnx model
 	err := pipeline.loadModel()
 	if err != nil {
@@ -78,22 +283,222 @@ func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeli
 	return pipeline, nil
 }
 
+// loadPrompts reads the query, document and default prompts of config_sentence_transformers.json, if present. The
+// prefixes set with options are kept.
+func (p *FeatureExtractionPipeline) loadPrompts() error {
+	path := util.PathJoinSafe(p.ModelPath, "config_sentence_transformers.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return err
+	}
+	var values struct {
+		Prompts           map[string]string `json:"prompts"`
+		DefaultPromptName string            `json:"default_prompt_name"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+		return fmt.Errorf("could not read config_sentence_transformers.json: %w", err)
+	}
+	if p.QueryPrefix == "" {
+		p.QueryPrefix = values.Prompts["query"]
+	}
+	if p.DocumentPrefix == "" {
+		// sentence-transformers models name their document prompt differently
+		for _, name := range []string{"document", "passage", "corpus"} {
+			if prompt, ok := values.Prompts[name]; ok {
+				p.DocumentPrefix = prompt
+				break
+			}
+		}
+	}
+	if values.DefaultPromptName != "" {
+		prompt, ok := values.Prompts[values.DefaultPromptName]
+		if !ok {
+			return fmt.Errorf("default prompt %s is not in the prompts of config_sentence_transformers.json", values.DefaultPromptName)
+		}
+		p.defaultPrefix = prompt
+	}
+	return nil
+}
+
+// loadModules reads the Dense and Normalize modules of modules.json, if present. The Dense weights are read from the
+// model.safetensors file of the module folder.
+func (p *FeatureExtractionPipeline) loadModules() error {
+	path := util.PathJoinSafe(p.ModelPath, "modules.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return err
+	}
+	modulesBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return err
+	}
+	var modules []struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+	}
+	if err = jsoniter.Unmarshal(modulesBytes, &modules); err != nil {
+		return fmt.Errorf("could not read modules.json: %w", err)
+	}
+	for _, module := range modules {
+		switch module.Type[strings.LastIndex(module.Type, ".")+1:] {
+		case "Dense":
+			dense, err := loadDenseModule(util.PathJoinSafe(p.ModelPath, module.Path))
+			if err != nil {
+				return fmt.Errorf("could not load the dense module %s: %w", module.Path, err)
+			}
+			p.Dense = append(p.Dense, dense)
+		case "Normalize":
+			p.Normalization = true
+		}
+	}
+	return nil
+}
+
+// loadDenseModule reads the configuration and weights of a sentence-transformers Dense module folder.
+func loadDenseModule(modulePath string) (*util.Dense, error) {
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(modulePath, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		InFeatures         int    `json:"in_features"`
+		OutFeatures        int    `json:"out_features"`
+		Bias               bool   `json:"bias"`
+		ActivationFunction string `json:"activation_function"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &config); err != nil {
+		return nil, err
+	}
+	weightsBytes, err := util.ReadFileBytes(util.PathJoinSafe(modulePath, "model.safetensors"))
+	if err != nil {
+		return nil, fmt.Errorf("the weights are only read from model.safetensors: %w", err)
+	}
+	tensors, err := util.ReadSafetensors(weightsBytes)
+	if err != nil {
+		return nil, err
+	}
+	weight, ok := tensors["linear.weight"]
+	if !ok || len(weight.Shape) != 2 || weight.Shape[0] != config.OutFeatures || weight.Shape[1] != config.InFeatures {
+		return nil, fmt.Errorf("model.safetensors has no linear.weight tensor of shape [%d %d]", config.OutFeatures, config.InFeatures)
+	}
+	dense := &util.Dense{Activation: config.ActivationFunction}
+	for i := 0; i < config.OutFeatures; i++ {
+		dense.Weight = append(dense.Weight, weight.Values[i*config.InFeatures:(i+1)*config.InFeatures])
+	}
+	if config.Bias {
+		bias, ok := tensors["linear.bias"]
+		if !ok || len(bias.Values) != config.OutFeatures {
+			return nil, fmt.Errorf("model.safetensors has no linear.bias tensor of %d values", config.OutFeatures)
+		}
+		dense.Bias = bias.Values
+	}
+	return dense, dense.Validate()
+}
+
 func (p *FeatureExtractionPipeline) Validate() error {
 	var validationErrors []error
 
 	if p.OutputDim <= 0 {
 		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: outputDim parameter must be greater than zero"))
 	}
+	dim := p.OutputDim
+	for _, dense := range p.Dense {
+		if dense.InputDim() != dim {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: dense input dimension %d does not match embedding dimension %d", dense.InputDim(), dim))
+		}
+		dim = dense.OutputDim()
+	}
+	if p.Projection != nil {
+		if err := p.Projection.Validate(); err != nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: %w", err))
+		} else if p.Projection.InputDim() != p.pooledDim() {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: projection input dimension %d does not match model output dimension %d", p.Projection.InputDim(), p.pooledDim()))
+		}
+	}
+	if p.Chunking {
+		if p.ChunkStride < 0 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk stride must not be negative, got %d", p.ChunkStride))
+		} else if p.ChunkStride >= p.windowLength()-p.pairTemplate.specialLength() {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk stride %d must be smaller than the chunk of %d tokens", p.ChunkStride, p.windowLength()-p.pairTemplate.specialLength()))
+		}
+		if p.ChunkAggregation != "MEAN" && p.ChunkAggregation != "TOKENS" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk aggregation must be MEAN or TOKENS, got %s", p.ChunkAggregation))
+		}
+		if p.ReturnTokenEmbeddings || p.MultiVector {
+			validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: chunking is not supported with token or multi vector embeddings"))
+		}
+	}
+	if p.TruncatedDimension < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: truncated dimension must not be negative, got %d", p.TruncatedDimension))
+	} else if p.TruncatedDimension > p.untruncatedDim() {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: truncated dimension %d is greater than the embedding dimension %d", p.TruncatedDimension, p.untruncatedDim()))
+	}
 	return errors.Join(validationErrors...)
 }
 
+// GetOutputDim returns the dimension of the embeddings returned by the pipeline, after any projection and truncation.
+func (p *FeatureExtractionPipeline) GetOutputDim() int {
+	if p.TruncatedDimension > 0 {
+		return p.TruncatedDimension
+	}
+	return p.untruncatedDim()
+}
+
+// untruncatedDim returns the dimension of the embeddings after any projection, before truncation.
+func (p *FeatureExtractionPipeline) untruncatedDim() int {
+	if p.Projection != nil {
+		return p.Projection.OutputDim()
+	}
+	return p.pooledDim()
+}
+
+// pooledDim returns the dimension of the pooled embeddings after any dense layers.
+func (p *FeatureExtractionPipeline) pooledDim() int {
+	if len(p.Dense) > 0 {
+		return p.Dense[len(p.Dense)-1].OutputDim()
+	}
+	return p.OutputDim
+}
+
 // Postprocess Parse the results of the forward pass into the output. Token embeddings are mean pooled.
 func (p *FeatureExtractionPipeline) Postprocess(batch PipelineBatch) (*FeatureExtractionOutput, error) {
+	outputs, tokenOutputs, multiVectorOutputs := p.pool(batch)
+	output := p.embeddingsOutput(outputs)
+	output.Usage = p.recordUsage(batchUsage(batch))
+	output.Diagnostics = batchDiagnostics(batch)
+	output.MultiVectorEmbeddings = multiVectorOutputs
+	if p.ReturnTokenEmbeddings {
+		output.TokenEmbeddings = tokenOutputs
+		output.TokenOffsets = make([][]tokenizers.Offset, len(batch.Input))
+		output.WordIds = make([][]int, len(batch.Input))
+		for i, input := range batch.Input {
+			output.TokenOffsets[i] = input.Offsets
+			output.WordIds[i] = input.WordIds
+		}
+	}
+	return output, nil
+}
+
+// pool mean pools the token embeddings of each input of a batch. It also returns the token embeddings and the multi
+// vector embeddings of the inputs, if asked.
+func (p *FeatureExtractionPipeline) pool(batch PipelineBatch) ([][]float32, [][][]float32, [][][]float32) {
 	maxSequence := batch.MaxSequence
 	vectorCounter := 0
 	tokenCounter := 0
 	inputCounter := 0
 	outputs := make([][]float32, len(batch.Input))
+	var tokenOutputs [][][]float32
+	if p.ReturnTokenEmbeddings {
+		tokenOutputs = make([][][]float32, len(batch.Input))
+	}
+	var multiVectorOutputs [][][]float32
+	if p.MultiVector {
+		multiVectorOutputs = make([][][]float32, len(batch.Input))
+	}
 	tokens := make([][]float32, maxSequence)
 	vectors := make([]float32, p.OutputDim)
 
@@ -104,7 +509,13 @@ func (p *FeatureExtractionPipeline) Postprocess(batch PipelineBatch) (*FeatureEx
 			vectorCounter = 0
 			vectors = make([]float32, p.OutputDim)
 			if tokenCounter == maxSequence-1 {
-				outputs[inputCounter] = meanPooling(tokens, batch.Input[inputCounter], maxSequence, p.OutputDim)
+				outputs[inputCounter] = meanPooling(tokens, batch.Input[inputCounter], maxSequence, p.OutputDim, p.PoolSpecialTokens)
+				if p.ReturnTokenEmbeddings {
+					tokenOutputs[inputCounter] = tokens[:len(batch.Input[inputCounter].TokenIds)]
+				}
+				if p.MultiVector {
+					multiVectorOutputs[inputCounter] = multiVectors(tokens, batch.Input[inputCounter])
+				}
 				tokenCounter = 0
 				tokens = make([][]float32, maxSequence)
 				inputCounter++
@@ -115,30 +526,80 @@ func (p *FeatureExtractionPipeline) Postprocess(batch PipelineBatch) (*FeatureEx
 			vectorCounter++
 		}
 	}
+	return outputs, tokenOutputs, multiVectorOutputs
+}
+
+// embeddingsOutput applies the dense layers, and projects, truncates, normalizes and quantizes the pooled embeddings,
+// as asked.
+func (p *FeatureExtractionPipeline) embeddingsOutput(outputs [][]float32) *FeatureExtractionOutput {
+	// Apply the Dense modules of sentence-transformers models
+	for _, dense := range p.Dense {
+		for i, output := range outputs {
+			outputs[i] = dense.Transform(output)
+		}
+	}
+
+	// Reduce dimensionality (if asked)
+	if p.Projection != nil {
+		for i, output := range outputs {
+			outputs[i] = p.Projection.Transform(output)
+		}
+	}
+
+	// Truncate Matryoshka embeddings (if asked), which are normalized again
+	if p.TruncatedDimension > 0 {
+		for i, output := range outputs {
+			outputs[i] = util.Normalize(output[:p.TruncatedDimension:p.TruncatedDimension], 2)
+		}
+	}
 
 	// Normalize embeddings (if asked), like in https://huggingface.co/sentence-transformers/all-mpnet-base-v2
-	if p.Normalization {
+	if p.Normalization && p.TruncatedDimension == 0 {
 		for i, output := range outputs {
 			outputs[i] = util.Normalize(output, 2)
 		}
 	}
 
-	return &FeatureExtractionOutput{Embeddings: outputs}, nil
+	output := &FeatureExtractionOutput{Embeddings: outputs}
+	if p.Int8Quantization {
+		output.QuantizedEmbeddings = make([][]int8, len(outputs))
+		output.Scales = make([]float32, len(outputs))
+		for i, embedding := range outputs {
+			output.QuantizedEmbeddings[i], output.Scales[i] = util.QuantizeInt8(embedding)
+		}
+	}
+	if p.BinaryQuantization {
+		output.BinaryEmbeddings = make([][]byte, len(outputs))
+		for i, embedding := range outputs {
+			output.BinaryEmbeddings[i] = util.QuantizeBinary(embedding)
+		}
+	}
+	return output
 }
 
-func meanPooling(tokens [][]float32, input TokenizedInput, maxSequence int, dimensions int) []float32 {
+// meanPooling averages the embeddings of the attended tokens, skipping the special tokens unless poolSpecialTokens.
+func meanPooling(tokens [][]float32, input TokenizedInput, maxSequence int, dimensions int, poolSpecialTokens bool) []float32 {
 
 	length := len(input.AttentionMask)
 	vector := make([]float32, dimensions)
+	skipped := 0
 	for j := 0; j < maxSequence; j++ {
 		if j+1 <= length && input.AttentionMask[j] != 0 {
+			if !poolSpecialTokens && j < len(input.SpecialTokensMask) && input.SpecialTokensMask[j] != 0 {
+				skipped++
+				continue
+			}
 			for k, vectorValue := range tokens[j] {
 				vector[k] = vector[k] + vectorValue
 			}
 		}
 	}
 
-	numAttentionTokens := float32(input.MaxAttentionIndex + 1)
+	numAttentionTokens := float32(input.MaxAttentionIndex + 1 - skipped)
+	if numAttentionTokens == 0 {
+		// inputs made of special tokens only
+		return vector
+	}
 	for v, vectorValue := range vector {
 		vector[v] = vectorValue / numAttentionTokens
 	}
@@ -146,16 +607,123 @@ func meanPooling(tokens [][]float32, input TokenizedInput, maxSequence int, dime
 	return vector
 }
 
+// multiVectors returns the normalized embeddings of the attended tokens of an input.
+func multiVectors(tokens [][]float32, input TokenizedInput) [][]float32 {
+	var vectors [][]float32
+	for j, mask := range input.AttentionMask {
+		if mask != 0 && j < len(tokens) {
+			vectors = append(vectors, util.Normalize(append([]float32(nil), tokens[j]...), 2))
+		}
+	}
+	return vectors
+}
+
 // Run the pipeline on a string batch
 func (p *FeatureExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
 	return p.RunPipeline(inputs)
 }
 
+// RunPipeline runs the pipeline on a string batch, prepending the default prompt of the sentence-transformers config of
+// the model to the inputs, if any.
 func (p *FeatureExtractionPipeline) RunPipeline(inputs []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(inputs, p.defaultPrefix)
+}
+
+// RunQueries runs the pipeline on search queries, prepending QueryPrefix to the inputs.
+func (p *FeatureExtractionPipeline) RunQueries(inputs []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(inputs, p.QueryPrefix)
+}
+
+// RunDocuments runs the pipeline on documents to be searched, prepending DocumentPrefix to the inputs.
+func (p *FeatureExtractionPipeline) RunDocuments(inputs []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(inputs, p.DocumentPrefix)
+}
+
+func (p *FeatureExtractionPipeline) runWithPrefix(inputs []string, prefix string) (*FeatureExtractionOutput, error) {
+	if prefix != "" {
+		prefixed := make([]string, len(inputs))
+		for i, input := range inputs {
+			prefixed[i] = prefix + input
+		}
+		inputs = prefixed
+	}
 	batch := p.Preprocess(inputs)
+	if p.Chunking {
+		return p.runChunks(batch)
+	}
 	batch, forwardError := p.Forward(batch)
 	if forwardError != nil {
 		return nil, forwardError
 	}
 	return p.Postprocess(batch)
 }
+
+// RunTokenized runs the pipeline on inputs already tokenized with the tokenizer of the model, for callers tokenizing
+// once for several models sharing a tokenizer. Each input is the token ids of a text, special tokens included, as
+// encoded by the tokenizer; see PreprocessTokenized. Inputs longer than the maximum length of the model are only
+// accepted with chunking.
+func (p *FeatureExtractionPipeline) RunTokenized(inputs [][]uint32) (*FeatureExtractionOutput, error) {
+	batch, err := p.PreprocessTokenized(inputs, p.Chunking)
+	if err != nil {
+		return nil, err
+	}
+	if p.Chunking {
+		return p.runChunks(batch)
+	}
+	batch, err = p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch)
+}
+
+// runChunks splits the inputs of a batch longer than the maximum length of the model into overlapping chunks, runs
+// the model on all the chunks at once and aggregates the embeddings of the chunks of each input.
+func (p *FeatureExtractionPipeline) runChunks(batch PipelineBatch) (*FeatureExtractionOutput, error) {
+	var chunks []TokenizedInput
+	var owners []int
+	maxSequence := 0
+	for i, input := range batch.Input {
+		inputChunks, _ := p.splitWindows(input, p.ChunkStride)
+		for _, chunk := range inputChunks {
+			chunks = append(chunks, chunk)
+			owners = append(owners, i)
+			if len(chunk.TokenIds) > maxSequence {
+				maxSequence = len(chunk.TokenIds)
+			}
+		}
+	}
+	chunkBatch := p.convertInputToTensors(chunks, maxSequence)
+	chunkBatch, err := p.Forward(chunkBatch)
+	if err != nil {
+		return nil, err
+	}
+	chunkEmbeddings, _, _ := p.pool(chunkBatch)
+
+	embeddings := make([][]float32, len(batch.Input))
+	weights := make([]float32, len(batch.Input))
+	for c, embedding := range chunkEmbeddings {
+		weight := float32(1)
+		if p.ChunkAggregation == "TOKENS" {
+			weight = float32(len(chunks[c].TokenIds))
+		}
+		owner := owners[c]
+		if embeddings[owner] == nil {
+			embeddings[owner] = make([]float32, len(embedding))
+		}
+		for k, value := range embedding {
+			embeddings[owner][k] += weight * value
+		}
+		weights[owner] += weight
+	}
+	for i, embedding := range embeddings {
+		for k := range embedding {
+			embedding[k] /= weights[i]
+		}
+	}
+
+	output := p.embeddingsOutput(embeddings)
+	output.Usage = p.recordUsage(batchUsage(chunkBatch))
+	output.Diagnostics = batchDiagnostics(batch)
+	return output, nil
+}
@@ -0,0 +1,341 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/exp/slices"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// Autoregressive decoding shared by the generation pipelines. Unlike the other pipelines, which run a single forward
+// pass per batch, generation pipelines call the model once per generated token, feeding back the past key/values
+// returned by the previous call so that each step only processes the new token.
+
+// GenerationConfig holds the limits and special token ids used to decode, read from the generation_config.json
+// and config.json files of the model.
+type GenerationConfig struct {
+	MaxNewTokens        int
+	EosTokenIds         []int64
+	PadTokenId          int64
+	DecoderStartTokenId int64
+	// SuppressTokens are never generated, BeginSuppressTokens are not generated as the first new token.
+	SuppressTokens      []int64
+	BeginSuppressTokens []int64
+}
+
+// generationPipeline is implemented by the pipelines that generate text, so that generation options can be shared.
+type generationPipeline interface {
+	getGenerationConfig() *GenerationConfig
+}
+
+// WithMaxNewTokens sets the maximum number of tokens generated for each input.
+// Example: pipelines.WithMaxNewTokens[*pipelines.TextGenerationPipeline](20).
+func WithMaxNewTokens[T Pipeline](maxNewTokens int) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(generationPipeline); ok {
+			p.getGenerationConfig().MaxNewTokens = maxNewTokens
+		}
+	}
+}
+
+const defaultMaxNewTokens = 50
+
+// loadGenerationConfig reads the generation parameters of the model. Values in generation_config.json take
+// precedence over the ones in config.json.
+func loadGenerationConfig(modelPath string) (GenerationConfig, error) {
+	config := GenerationConfig{MaxNewTokens: defaultMaxNewTokens, PadTokenId: -1, DecoderStartTokenId: -1}
+	for _, filename := range []string{"config.json", "generation_config.json"} {
+		path := util.PathJoinSafe(modelPath, filename)
+		exists, err := util.FileSystem.Exists(context.Background(), path)
+		if err != nil {
+			return config, err
+		}
+		if !exists {
+			continue
+		}
+		configBytes, err := util.ReadFileBytes(path)
+		if err != nil {
+			return config, err
+		}
+		var values map[string]any
+		if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+			return config, fmt.Errorf("could not read %s: %w", filename, err)
+		}
+		sources := []map[string]any{values}
+		if decoderValues, ok := values["decoder"].(map[string]any); ok {
+			// composite models (e.g. vision-encoder-decoder) define the decoder tokens in a sub config, which the top
+			// level values override
+			sources = []map[string]any{decoderValues, values}
+		}
+		for _, values := range sources {
+			if ids := tokenIdList(values["eos_token_id"]); len(ids) > 0 {
+				config.EosTokenIds = ids
+			}
+			if ids := tokenIdList(values["pad_token_id"]); len(ids) > 0 {
+				config.PadTokenId = ids[0]
+			}
+			if ids := tokenIdList(values["decoder_start_token_id"]); len(ids) > 0 {
+				config.DecoderStartTokenId = ids[0]
+			}
+			if ids := tokenIdList(values["suppress_tokens"]); len(ids) > 0 {
+				config.SuppressTokens = ids
+			}
+			if ids := tokenIdList(values["begin_suppress_tokens"]); len(ids) > 0 {
+				config.BeginSuppressTokens = ids
+			}
+			if maxNewTokens, ok := values["max_new_tokens"].(float64); ok && maxNewTokens > 0 {
+				config.MaxNewTokens = int(maxNewTokens)
+			}
+		}
+	}
+	if config.PadTokenId < 0 && len(config.EosTokenIds) > 0 {
+		// models without a pad token (e.g. gpt2) pad finished sequences with the eos token
+		config.PadTokenId = config.EosTokenIds[0]
+	}
+	if config.PadTokenId < 0 {
+		config.PadTokenId = 0
+	}
+	return config, nil
+}
+
+// tokenIdList reads a token id field of a model config, which can be a single id or a list of ids.
+func tokenIdList(value any) []int64 {
+	switch v := value.(type) {
+	case float64:
+		return []int64{int64(v)}
+	case []any:
+		var ids []int64
+		for _, id := range v {
+			if f, ok := id.(float64); ok {
+				ids = append(ids, int64(f))
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+// greedySearch runs greedy decoding for a batch of sequences. step runs the model on the tokens selected at the
+// previous step (nil at the first step, where the model is run on the prompts) and returns the logits of the next
+// token for each sequence. Finished sequences are fed the pad token until all sequences are finished or
+// MaxNewTokens tokens have been generated. The generated tokens are returned without the eos token.
+// The suppressed tokens of the config are excluded from the selection.
+func greedySearch(config GenerationConfig, batchSize int, step func(nextTokens []int64) ([][]float32, error)) ([][]int64, error) {
+	generated := make([][]int64, batchSize)
+	finished := make([]bool, batchSize)
+	var nextTokens []int64
+	for i := 0; i < config.MaxNewTokens; i++ {
+		logits, err := step(nextTokens)
+		if err != nil {
+			return nil, err
+		}
+		if len(logits) != batchSize {
+			return nil, fmt.Errorf("expected next token logits for %d sequences, got %d", batchSize, len(logits))
+		}
+		nextTokens = make([]int64, batchSize)
+		allFinished := true
+		for j, sequenceLogits := range logits {
+			if finished[j] {
+				nextTokens[j] = config.PadTokenId
+				continue
+			}
+			suppressTokens(sequenceLogits, config.SuppressTokens)
+			if i == 0 {
+				suppressTokens(sequenceLogits, config.BeginSuppressTokens)
+			}
+			tokenId, _, argMaxErr := util.ArgMax(sequenceLogits)
+			if argMaxErr != nil {
+				return nil, argMaxErr
+			}
+			nextTokens[j] = int64(tokenId)
+			if slices.Contains(config.EosTokenIds, nextTokens[j]) {
+				finished[j] = true
+				continue
+			}
+			generated[j] = append(generated[j], nextTokens[j])
+			allFinished = false
+		}
+		if allFinished {
+			break
+		}
+	}
+	return generated, nil
+}
+
+// suppressTokens sets the logits of the given tokens to -inf.
+func suppressTokens(logits []float32, tokens []int64) {
+	for _, token := range tokens {
+		if token >= 0 && int(token) < len(logits) {
+			logits[token] = float32(math.Inf(-1))
+		}
+	}
+}
+
+// lastTokenLogits extracts the logits of the last position of each sequence from a [batch, sequence, vocab]
+// logits tensor.
+func lastTokenLogits(logits *ort.Tensor[float32]) ([][]float32, error) {
+	shape := logits.GetShape()
+	if len(shape) != 3 {
+		return nil, fmt.Errorf("expected logits of shape [batch, sequence, vocabulary], got %s", shape)
+	}
+	batchSize, sequenceLength, vocabSize := int(shape[0]), int(shape[1]), int(shape[2])
+	data := logits.GetData()
+	result := make([][]float32, batchSize)
+	for i := range result {
+		offset := (i*sequenceLength + sequenceLength - 1) * vocabSize
+		// copy, as the tensor memory is released after the step
+		result[i] = append([]float32(nil), data[offset:offset+vocabSize]...)
+	}
+	return result, nil
+}
+
+const pastKeyValuesPrefix = "past_key_values"
+
+// kvCache holds the past key/value tensors of a decoder between decoding steps. Models exported with past
+// key/values take inputs named past_key_values.<layer>.<...> and return the updated values as outputs named
+// present.<layer>.<...>.
+type kvCache struct {
+	inputNames []string
+	shapes     map[string]ort.Shape
+	tensors    map[string]ort.ArbitraryTensor
+}
+
+// newKVCache finds the past key/value inputs of the model. The returned cache holds no tensors, it is used to
+// allocate the cache of each run.
+func newKVCache(inputsMeta []ort.InputOutputInfo, modelConfig map[string]any) (*kvCache, error) {
+	cache := &kvCache{shapes: map[string]ort.Shape{}, tensors: map[string]ort.ArbitraryTensor{}}
+	for _, input := range inputsMeta {
+		if !strings.HasPrefix(input.Name, pastKeyValuesPrefix) {
+			continue
+		}
+		if input.DataType != ort.TensorElementDataTypeFloat {
+			return nil, fmt.Errorf("past key/values input %s has type %s, only float32 is supported", input.Name, input.DataType)
+		}
+		if len(input.Dimensions) != 4 {
+			return nil, fmt.Errorf("past key/values input %s has shape %s, expected [batch, heads, sequence, head dimension]", input.Name, input.Dimensions)
+		}
+		shape := input.Dimensions.Clone()
+		if shape[1] <= 0 || shape[3] <= 0 {
+			// dynamic head dimensions, derive them from the model config
+			heads, headDim := attentionDims(modelConfig)
+			if heads <= 0 || headDim <= 0 {
+				return nil, fmt.Errorf("could not determine the number of heads and head dimension of past key/values input %s", input.Name)
+			}
+			shape[1], shape[3] = heads, headDim
+		}
+		cache.inputNames = append(cache.inputNames, input.Name)
+		cache.shapes[input.Name] = shape
+	}
+	if len(cache.inputNames) == 0 {
+		return nil, errors.New("the model has no past_key_values inputs, it must be exported with past key/values (e.g. optimum-cli export onnx --task text-generation-with-past)")
+	}
+	return cache, nil
+}
+
+// attentionDims reads the number of key/value heads and the head dimension from the model config.
+func attentionDims(modelConfig map[string]any) (int64, int64) {
+	number := func(keys ...string) int64 {
+		for _, key := range keys {
+			if v, ok := modelConfig[key].(float64); ok && v > 0 {
+				return int64(v)
+			}
+		}
+		return 0
+	}
+	heads := number("num_attention_heads", "n_head", "num_heads", "decoder_attention_heads")
+	kvHeads := number("num_key_value_heads")
+	if kvHeads == 0 {
+		kvHeads = heads
+	}
+	headDim := number("head_dim", "d_kv")
+	if headDim == 0 && heads > 0 {
+		headDim = number("hidden_size", "n_embd", "d_model") / heads
+	}
+	return kvHeads, headDim
+}
+
+// allocate returns a new cache for a batch, filled with a single zero position per sequence. Tensors cannot have a
+// zero dimension, so the first step is run against this dummy past position, which callers must mask out with a 0
+// in the attention mask. Each run allocates its own cache so that pipelines can be run concurrently.
+func (c *kvCache) allocate(batchSize int) (*kvCache, error) {
+	cache := &kvCache{inputNames: c.inputNames, shapes: c.shapes, tensors: map[string]ort.ArbitraryTensor{}}
+	for _, name := range c.inputNames {
+		shape := c.shapes[name].Clone()
+		shape[0], shape[2] = int64(batchSize), 1
+		tensor, err := ort.NewEmptyTensor[float32](shape)
+		if err != nil {
+			return nil, errors.Join(err, cache.destroy())
+		}
+		cache.tensors[name] = tensor
+	}
+	return cache, nil
+}
+
+// isPresent reports whether a model output is the present key/values for one of the cache inputs, and returns
+// the name of that input.
+func (c *kvCache) isPresent(outputName string) (string, bool) {
+	if !strings.HasPrefix(outputName, "present") {
+		return "", false
+	}
+	inputName := pastKeyValuesPrefix + strings.TrimPrefix(outputName, "present")
+	_, ok := c.shapes[inputName]
+	return inputName, ok
+}
+
+// isCrossAttention reports whether a cache input holds the cross-attention key/values of an encoder-decoder
+// model, which are computed from the encoder output at the first step and constant afterwards.
+func (c *kvCache) isCrossAttention(inputName string) bool {
+	return strings.Contains(inputName, ".encoder.")
+}
+
+// update replaces the past key/value tensor of an input with the present tensor returned by the model.
+func (c *kvCache) update(inputName string, tensor ort.ArbitraryTensor) error {
+	var err error
+	if previous, ok := c.tensors[inputName]; ok {
+		err = previous.Destroy()
+	}
+	c.tensors[inputName] = tensor
+	return err
+}
+
+func (c *kvCache) destroy() error {
+	var err error
+	for name, tensor := range c.tensors {
+		err = errors.Join(err, tensor.Destroy())
+		delete(c.tensors, name)
+	}
+	return err
+}
+
+// newUseCacheBranchTensor creates the boolean use_cache_branch input of merged decoders, which selects the
+// graph branch that consumes past key/values.
+func newUseCacheBranchTensor(useCache bool) (ort.ArbitraryTensor, error) {
+	value := byte(0)
+	if useCache {
+		value = 1
+	}
+	return ort.NewCustomDataTensor(ort.NewShape(1), []byte{value}, ort.TensorElementDataTypeBool)
+}
+
+// loadModelConfig reads config.json as a generic map, or returns an empty map if the model has none.
+func loadModelConfig(modelPath string) (map[string]any, error) {
+	modelConfig := map[string]any{}
+	path := util.PathJoinSafe(modelPath, "config.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return modelConfig, err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	err = jsoniter.Unmarshal(configBytes, &modelConfig)
+	return modelConfig, err
+}
@@ -0,0 +1,438 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// GLiNERPipeline is a go version of the inference of GLiNER (https://github.com/urchade/GLiNER) models exported
+// to onnx, for open vocabulary named entity recognition: the entity types are text labels given at inference time,
+// which the model matches against every span of up to MaxWidth words of the input. The labels are prepended to the
+// words of the input as a prompt, <<ENT>> label <<ENT>> label ... <<SEP>> words.
+
+// types
+
+type GLiNERPipeline struct {
+	BasePipeline
+	// Labels are the entity types searched for by Run.
+	Labels []string
+	// Threshold is the minimum probability of a span to be returned as an entity. The default is 0.5.
+	Threshold float32
+	// NestedEntities returns entities nested in other entities; by default overlapping entities are resolved
+	// greedily by score.
+	NestedEntities bool
+	MaxWidth       int
+	MaxWords       int
+	entityToken    string
+	sepToken       string
+}
+
+type GLiNEROutput struct {
+	Usage
+	Diagnostics
+	Entities [][]Entity
+}
+
+func (t *GLiNEROutput) GetOutput() []any {
+	out := make([]any, len(t.Entities))
+	for i, entities := range t.Entities {
+		out[i] = any(entities)
+	}
+	return out
+}
+
+// glinerWordPattern splits the inputs in words as the GLiNER whitespace token splitter.
+var glinerWordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+(?:[-_][\p{L}\p{N}_]+)*|\S`)
+
+// options
+
+// WithEntityLabels sets the entity types searched for by Run.
+func WithEntityLabels(labels []string) PipelineOption[*GLiNERPipeline] {
+	return func(pipeline *GLiNERPipeline) {
+		pipeline.Labels = labels
+	}
+}
+
+// WithEntityThreshold sets the minimum probability of a span to be returned as an entity.
+func WithEntityThreshold(threshold float32) PipelineOption[*GLiNERPipeline] {
+	return func(pipeline *GLiNERPipeline) {
+		pipeline.Threshold = threshold
+	}
+}
+
+// WithNestedEntities returns entities nested in other entities, e.g. "Paris" in "University of Paris". Partially
+// overlapping entities are still resolved by score.
+func WithNestedEntities() PipelineOption[*GLiNERPipeline] {
+	return func(pipeline *GLiNERPipeline) {
+		pipeline.NestedEntities = true
+	}
+}
+
+// NewGLiNERPipeline initializes a GLiNER pipeline.
+func NewGLiNERPipeline(config PipelineConfig[*GLiNERPipeline], ortOptions *ort.SessionOptions) (*GLiNERPipeline, error) {
+	pipeline := &GLiNERPipeline{
+		Threshold:   0.5,
+		MaxWidth:    12,
+		MaxWords:    384,
+		entityToken: "<<ENT>>",
+		sepToken:    "<<SEP>>",
+	}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if err := pipeline.loadGLiNERConfig(); err != nil {
+		return nil, err
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx model
+	err := pipeline.loadModel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+// loadGLiNERConfig reads the span width, maximum length and prompt tokens of gliner_config.json, if present.
+func (p *GLiNERPipeline) loadGLiNERConfig() error {
+	path := util.PathJoinSafe(p.ModelPath, "gliner_config.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return err
+	}
+	var values struct {
+		MaxWidth int    `json:"max_width"`
+		MaxLen   int    `json:"max_len"`
+		EntToken string `json:"ent_token"`
+		SepToken string `json:"sep_token"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+		return fmt.Errorf("could not read gliner_config.json: %w", err)
+	}
+	if values.MaxWidth > 0 {
+		p.MaxWidth = values.MaxWidth
+	}
+	if values.MaxLen > 0 {
+		p.MaxWords = values.MaxLen
+	}
+	if values.EntToken != "" {
+		p.entityToken = values.EntToken
+	}
+	if values.SepToken != "" {
+		p.sepToken = values.SepToken
+	}
+	return nil
+}
+
+func (p *GLiNERPipeline) Validate() error {
+	var validationErrors []error
+
+	for _, input := range p.InputsMeta {
+		switch input.Name {
+		case "input_ids", "attention_mask", "words_mask", "text_lengths", "span_idx", "span_mask":
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported model input %s", input.Name))
+		}
+	}
+	if len(p.OutputsMeta) != 1 || len(p.OutputsMeta[0].Dimensions) != 4 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model must have a single logits output of shape [batch, words, width, labels]"))
+	}
+	if p.Threshold < 0 || p.Threshold > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: threshold must be between 0 and 1, got %f", p.Threshold))
+	}
+	if p.MaxWidth <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: max width must be greater than zero"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// glinerBatch holds the model inputs of a batch besides the tokens, and the word spans of each input.
+type glinerBatch struct {
+	PipelineBatch
+	wordsMask   []int64
+	textLengths []int64
+	spanIdx     []int64
+	spanMask    []byte
+	maxWords    int
+	words       [][][2]int
+}
+
+// Preprocess splits the inputs in words and encodes them with the labels prompt, word by word.
+func (p *GLiNERPipeline) Preprocess(inputs []string, labels []string) glinerBatch {
+	start := time.Now()
+
+	// the special tokens around a sequence, e.g. [CLS] and [SEP]
+	specials := p.Tokenizer.EncodeWithOptions("", true).IDs
+	var prefixIds, suffixIds []uint32
+	if len(specials) > 0 {
+		prefixIds, suffixIds = specials[:1], specials[1:]
+	}
+	encodeWord := func(word string) []uint32 {
+		return p.Tokenizer.EncodeWithOptions(word, false).IDs
+	}
+
+	var promptIds []uint32
+	for _, label := range labels {
+		promptIds = append(promptIds, encodeWord(p.entityToken)...)
+		promptIds = append(promptIds, encodeWord(label)...)
+	}
+	promptIds = append(promptIds, encodeWord(p.sepToken)...)
+
+	batch := glinerBatch{words: make([][][2]int, len(inputs))}
+	tokenized := make([]TokenizedInput, len(inputs))
+	var wordMasks [][]int64
+	maxSequence := 0
+	for i, input := range inputs {
+		words := glinerWordPattern.FindAllStringIndex(input, -1)
+		if len(words) > p.MaxWords {
+			batch.Warnings = append(batch.Warnings, Warning{
+				Input:   i,
+				Type:    WarningTruncated,
+				Message: fmt.Sprintf("input of %d words was truncated to the maximum length of %d words", len(words), p.MaxWords),
+			})
+			words = words[:p.MaxWords]
+		}
+		batch.words[i] = make([][2]int, len(words))
+		ids := append(append([]uint32(nil), prefixIds...), promptIds...)
+		wordMask := make([]int64, len(ids))
+		for j, word := range words {
+			batch.words[i][j] = [2]int{word[0], word[1]}
+			wordIds := encodeWord(input[word[0]:word[1]])
+			for k := range wordIds {
+				if k == 0 {
+					// the first token of each word carries its 1-based index
+					wordMask = append(wordMask, int64(j+1))
+				} else {
+					wordMask = append(wordMask, 0)
+				}
+			}
+			ids = append(ids, wordIds...)
+		}
+		ids = append(ids, suffixIds...)
+		wordMask = append(wordMask, make([]int64, len(suffixIds))...)
+
+		attentionMask := make([]uint32, len(ids))
+		for j := range attentionMask {
+			attentionMask[j] = 1
+		}
+		tokenized[i] = TokenizedInput{Raw: input, TokenIds: ids, AttentionMask: attentionMask, MaxAttentionIndex: len(ids) - 1}
+		wordMasks = append(wordMasks, wordMask)
+		if len(ids) > maxSequence {
+			maxSequence = len(ids)
+		}
+		if len(words) > batch.maxWords {
+			batch.maxWords = len(words)
+		}
+	}
+	warnings := batch.Warnings
+	batch.PipelineBatch = p.convertInputToTensors(tokenized, maxSequence)
+	batch.Warnings = warnings
+
+	// word masks padded to the longest sequence, and every span of up to MaxWidth words from each word
+	batch.wordsMask = make([]int64, len(inputs)*maxSequence)
+	batch.textLengths = make([]int64, len(inputs))
+	spans := batch.maxWords * p.MaxWidth
+	batch.spanIdx = make([]int64, len(inputs)*spans*2)
+	batch.spanMask = make([]byte, len(inputs)*spans)
+	for i := range inputs {
+		copy(batch.wordsMask[i*maxSequence:], wordMasks[i])
+		numWords := len(batch.words[i])
+		batch.textLengths[i] = int64(numWords)
+		for startWord := 0; startWord < batch.maxWords; startWord++ {
+			for width := 0; width < p.MaxWidth; width++ {
+				span := i*spans + startWord*p.MaxWidth + width
+				batch.spanIdx[2*span] = int64(startWord)
+				batch.spanIdx[2*span+1] = int64(startWord + width)
+				if startWord+width < numWords {
+					batch.spanMask[span] = 1
+				}
+			}
+		}
+	}
+
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return batch
+}
+
+// Forward runs the model and returns the [batch, words, width, labels] span logits.
+func (p *GLiNERPipeline) Forward(batch glinerBatch) (logits []float32, shape ort.Shape, err error) {
+	start := time.Now()
+
+	batchSize := int64(len(batch.Input))
+	spans := int64(batch.maxWords * p.MaxWidth)
+	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
+	defer func() {
+		for _, tensor := range inputTensors {
+			if tensor != nil {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+	for i, input := range p.InputsMeta {
+		var tensor ort.ArbitraryTensor
+		var tensorErr error
+		switch input.Name {
+		case "input_ids":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(batchSize, int64(batch.MaxSequence)), batch.IdsTensor)
+		case "attention_mask":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(batchSize, int64(batch.MaxSequence)), batch.AttentionMasksTensor)
+		case "words_mask":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(batchSize, int64(batch.MaxSequence)), batch.wordsMask)
+		case "text_lengths":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(batchSize, 1), batch.textLengths)
+		case "span_idx":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(batchSize, spans, 2), batch.spanIdx)
+		case "span_mask":
+			// the span mask is boolean, which has no go tensor type
+			var maskTensor *ort.CustomDataTensor
+			maskTensor, tensorErr = ort.NewCustomDataTensor(ort.NewShape(batchSize, spans), batch.spanMask, ort.TensorElementDataTypeBool)
+			if tensorErr == nil {
+				tensor = maskTensor
+			}
+		}
+		if tensorErr != nil {
+			return nil, nil, tensorErr
+		}
+		inputTensors[i] = tensor
+	}
+
+	outputTensors := []ort.ArbitraryTensor{nil}
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, nil, err
+	}
+	logitsTensor, ok := outputTensors[0].(*ort.Tensor[float32])
+	if !ok {
+		err = errors.New("logits output must be float32")
+	} else {
+		logits = append([]float32(nil), logitsTensor.GetData()...)
+		shape = logitsTensor.GetShape().Clone()
+	}
+	err = errors.Join(err, outputTensors[0].Destroy())
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, shape, err
+}
+
+// Postprocess returns the spans whose probability exceeds the threshold, resolving overlapping spans greedily by
+// score.
+func (p *GLiNERPipeline) Postprocess(batch glinerBatch, logits []float32, shape ort.Shape, labels []string) (*GLiNEROutput, error) {
+	if len(shape) != 4 || int(shape[0]) != len(batch.Input) || int(shape[3]) != len(labels) || int(shape[2]) != p.MaxWidth {
+		return nil, fmt.Errorf("unexpected logits shape %s for %d inputs, %d labels and a max width of %d", shape, len(batch.Input), len(labels), p.MaxWidth)
+	}
+	words, width, classes := int(shape[1]), int(shape[2]), int(shape[3])
+
+	output := &GLiNEROutput{
+		Usage:       p.recordUsage(batchUsage(batch.PipelineBatch)),
+		Diagnostics: batchDiagnostics(batch.PipelineBatch),
+		Entities:    make([][]Entity, len(batch.Input)),
+	}
+	for i, input := range batch.Input {
+		type span struct {
+			start, end, label int
+			score             float32
+		}
+		var candidates []span
+		inputWords := batch.words[i]
+		for startWord := 0; startWord < len(inputWords) && startWord < words; startWord++ {
+			for w := 0; w < width && startWord+w < len(inputWords); w++ {
+				for label := 0; label < classes; label++ {
+					logit := logits[((i*words+startWord)*width+w)*classes+label]
+					score := float32(1 / (1 + math.Exp(-float64(logit))))
+					if score > p.Threshold {
+						candidates = append(candidates, span{start: startWord, end: startWord + w, label: label, score: score})
+					}
+				}
+			}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return candidates[a].score > candidates[b].score
+		})
+		var selected []span
+		for _, candidate := range candidates {
+			keep := true
+			for _, s := range selected {
+				disjoint := candidate.start > s.end || s.start > candidate.end
+				nested := (candidate.start >= s.start && candidate.end <= s.end) || (s.start >= candidate.start && s.end <= candidate.end)
+				sameSpan := candidate.start == s.start && candidate.end == s.end
+				if !disjoint && (!p.NestedEntities || !nested || sameSpan) {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				selected = append(selected, candidate)
+			}
+		}
+		sort.SliceStable(selected, func(a, b int) bool {
+			return selected[a].start < selected[b].start
+		})
+		entities := make([]Entity, len(selected))
+		for j, s := range selected {
+			startOffset, endOffset := inputWords[s.start][0], inputWords[s.end][1]
+			entities[j] = Entity{
+				Entity: labels[s.label],
+				Score:  s.score,
+				Index:  s.start,
+				Word:   input.Raw[startOffset:endOffset],
+				Start:  uint(startOffset),
+				End:    uint(endOffset),
+			}
+		}
+		output.Entities[i] = entities
+	}
+	return output, nil
+}
+
+// Run the pipeline on a string batch, with the labels of the pipeline.
+func (p *GLiNERPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs, p.Labels)
+}
+
+// RunPipeline finds the entities of the given types in each input.
+func (p *GLiNERPipeline) RunPipeline(inputs []string, labels []string) (*GLiNEROutput, error) {
+	if len(labels) == 0 {
+		return nil, errors.New("at least one entity label is required")
+	}
+	if len(inputs) == 0 {
+		return &GLiNEROutput{}, nil
+	}
+	batch := p.Preprocess(inputs, labels)
+	if batch.maxWords == 0 {
+		return &GLiNEROutput{Entities: make([][]Entity, len(inputs))}, nil
+	}
+	logits, shape, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, logits, shape, labels)
+}
@@ -0,0 +1,346 @@
+package pipelines
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the gif decoder
+	_ "image/jpeg" // register the jpeg decoder
+	_ "image/png"  // register the png decoder
+	"math"
+
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// Image preprocessing shared by the vision pipelines, a go version of the transformers image processors
+// (https://github.com/huggingface/transformers/blob/main/src/transformers/image_processing_utils.py): images are
+// resized, center cropped, rescaled and normalized, then laid out as [batch, channels, height, width] pixel values.
+
+// ImageProcessorConfig holds the preprocessing parameters read from the preprocessor_config.json file of the model.
+type ImageProcessorConfig struct {
+	DoResize bool
+	// ShortestEdge is the size the shortest edge of the image is resized to, keeping the aspect ratio. If zero, the
+	// image is resized to Height x Width.
+	ShortestEdge  int
+	Height        int
+	Width         int
+	DoCenterCrop  bool
+	CropHeight    int
+	CropWidth     int
+	DoRescale     bool
+	RescaleFactor float32
+	DoNormalize   bool
+	ImageMean     []float32
+	ImageStd      []float32
+}
+
+type imageProcessorConfigJSON struct {
+	DoResize      *bool     `json:"do_resize"`
+	Size          any       `json:"size"`
+	DoCenterCrop  *bool     `json:"do_center_crop"`
+	CropSize      any       `json:"crop_size"`
+	DoRescale     *bool     `json:"do_rescale"`
+	RescaleFactor *float32  `json:"rescale_factor"`
+	DoNormalize   *bool     `json:"do_normalize"`
+	ImageMean     []float32 `json:"image_mean"`
+	ImageStd      []float32 `json:"image_std"`
+}
+
+// loadImageProcessorConfig reads preprocessor_config.json. Missing values take the defaults of the transformers
+// image processors: resize to 224x224, rescale by 1/255 and normalize with the ImageNet mean and standard deviation.
+func loadImageProcessorConfig(modelPath string) (ImageProcessorConfig, error) {
+	config := ImageProcessorConfig{
+		DoResize:      true,
+		Height:        224,
+		Width:         224,
+		DoRescale:     true,
+		RescaleFactor: 1.0 / 255,
+		DoNormalize:   true,
+		ImageMean:     []float32{0.485, 0.456, 0.406},
+		ImageStd:      []float32{0.229, 0.224, 0.225},
+	}
+
+	path := util.PathJoinSafe(modelPath, "preprocessor_config.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return config, err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return config, err
+	}
+	var values imageProcessorConfigJSON
+	if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+		return config, fmt.Errorf("could not read preprocessor_config.json: %w", err)
+	}
+
+	if values.DoResize != nil {
+		config.DoResize = *values.DoResize
+	}
+	if values.Size != nil {
+		shortestEdge, height, width := imageSize(values.Size)
+		config.ShortestEdge, config.Height, config.Width = shortestEdge, height, width
+	}
+	if values.DoCenterCrop != nil {
+		config.DoCenterCrop = *values.DoCenterCrop
+	}
+	if values.CropSize != nil {
+		shortestEdge, height, width := imageSize(values.CropSize)
+		if shortestEdge > 0 {
+			height, width = shortestEdge, shortestEdge
+		}
+		config.CropHeight, config.CropWidth = height, width
+	}
+	if values.DoRescale != nil {
+		config.DoRescale = *values.DoRescale
+	}
+	if values.RescaleFactor != nil {
+		config.RescaleFactor = *values.RescaleFactor
+	}
+	if values.DoNormalize != nil {
+		config.DoNormalize = *values.DoNormalize
+	}
+	if len(values.ImageMean) == 3 {
+		config.ImageMean = values.ImageMean
+	}
+	if len(values.ImageStd) == 3 {
+		config.ImageStd = values.ImageStd
+	}
+	if _, isNumber := values.Size.(float64); isNumber && !config.DoCenterCrop {
+		// a single size is the shortest edge for processors that crop (e.g. CLIP) and a square size otherwise (e.g. ViT)
+		config.Height, config.Width, config.ShortestEdge = config.ShortestEdge, config.ShortestEdge, 0
+	}
+	return config, nil
+}
+
+// imageSize reads a size field of preprocessor_config.json, which is either a single number (the shortest edge, as
+// in older configs), {"shortest_edge": n} or {"height": h, "width": w}.
+func imageSize(value any) (shortestEdge int, height int, width int) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), 0, 0
+	case map[string]any:
+		if s, ok := v["shortest_edge"].(float64); ok {
+			return int(s), 0, 0
+		}
+		h, _ := v["height"].(float64)
+		w, _ := v["width"].(float64)
+		return 0, int(h), int(w)
+	}
+	return 0, 0, 0
+}
+
+// outputSize returns the height and width of the preprocessed images.
+func (c ImageProcessorConfig) outputSize() (int, int) {
+	if c.DoCenterCrop && c.CropHeight > 0 && c.CropWidth > 0 {
+		return c.CropHeight, c.CropWidth
+	}
+	if c.DoResize && c.ShortestEdge == 0 {
+		return c.Height, c.Width
+	}
+	return 0, 0
+}
+
+// decodeImage decodes a jpeg, png or gif image.
+func decodeImage(imageBytes []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageBytes))
+	return img, err
+}
+
+// readImages reads and decodes the images at the given paths.
+func readImages(paths []string) ([]image.Image, error) {
+	images := make([]image.Image, len(paths))
+	for i, path := range paths {
+		imageBytes, err := util.ReadFileBytes(path)
+		if err != nil {
+			return nil, err
+		}
+		if images[i], err = decodeImage(imageBytes); err != nil {
+			return nil, fmt.Errorf("could not decode image %s: %w", path, err)
+		}
+	}
+	return images, nil
+}
+
+// imagePlanes holds an rgb image as three planes of height x width values between 0 and 255.
+type imagePlanes struct {
+	height int
+	width  int
+	planes [3][]float32
+}
+
+func newImagePlanes(img image.Image) imagePlanes {
+	bounds := img.Bounds()
+	p := imagePlanes{height: bounds.Dy(), width: bounds.Dx()}
+	for c := range p.planes {
+		p.planes[c] = make([]float32, p.height*p.width)
+	}
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			// RGBA returns 16 bit alpha premultiplied values, images are converted to rgb on a black background
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			i := y*p.width + x
+			p.planes[0][i] = float32(r >> 8)
+			p.planes[1][i] = float32(g >> 8)
+			p.planes[2][i] = float32(b >> 8)
+		}
+	}
+	return p
+}
+
+// resize resamples the image with a bicubic filter, antialiased when downscaling, like PIL's Image.resize.
+func (p imagePlanes) resize(height int, width int) imagePlanes {
+	if height == p.height && width == p.width {
+		return p
+	}
+	horizontal := resampleWeights(p.width, width)
+	vertical := resampleWeights(p.height, height)
+	resized := imagePlanes{height: height, width: width}
+	for c, plane := range p.planes {
+		// resample the rows, then the columns
+		rows := make([]float32, p.height*width)
+		for y := 0; y < p.height; y++ {
+			for x, w := range horizontal {
+				var sum float32
+				for k, weight := range w.weights {
+					sum += weight * plane[y*p.width+w.start+k]
+				}
+				rows[y*width+x] = clampPixel(sum)
+			}
+		}
+		out := make([]float32, height*width)
+		for y, w := range vertical {
+			for x := 0; x < width; x++ {
+				var sum float32
+				for k, weight := range w.weights {
+					sum += weight * rows[(w.start+k)*width+x]
+				}
+				out[y*width+x] = clampPixel(sum)
+			}
+		}
+		resized.planes[c] = out
+	}
+	return resized
+}
+
+// resizeShortestEdge resizes the image so that its shortest edge is size, keeping the aspect ratio.
+func (p imagePlanes) resizeShortestEdge(size int) imagePlanes {
+	if p.height <= p.width {
+		return p.resize(size, int(float64(size)*float64(p.width)/float64(p.height)))
+	}
+	return p.resize(int(float64(size)*float64(p.height)/float64(p.width)), size)
+}
+
+// centerCrop crops the center of the image, padding it with zeros if it is smaller than the crop.
+func (p imagePlanes) centerCrop(height int, width int) imagePlanes {
+	top := (p.height - height) / 2
+	left := (p.width - width) / 2
+	cropped := imagePlanes{height: height, width: width}
+	for c, plane := range p.planes {
+		out := make([]float32, height*width)
+		for y := 0; y < height; y++ {
+			sourceY := top + y
+			if sourceY < 0 || sourceY >= p.height {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				sourceX := left + x
+				if sourceX >= 0 && sourceX < p.width {
+					out[y*width+x] = plane[sourceY*p.width+sourceX]
+				}
+			}
+		}
+		cropped.planes[c] = out
+	}
+	return cropped
+}
+
+type resampleWindow struct {
+	start   int
+	weights []float32
+}
+
+// resampleWeights computes the bicubic filter weights of each output position.
+func resampleWeights(inSize int, outSize int) []resampleWindow {
+	scale := float64(inSize) / float64(outSize)
+	filterScale := math.Max(scale, 1)
+	support := 2 * filterScale
+	windows := make([]resampleWindow, outSize)
+	for i := range windows {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Max(math.Floor(center-support+0.5), 0))
+		end := int(math.Min(math.Floor(center+support+0.5), float64(inSize)))
+		weights := make([]float32, end-start)
+		var total float64
+		raw := make([]float64, end-start)
+		for j := range raw {
+			raw[j] = bicubic((float64(start+j) - center + 0.5) / filterScale)
+			total += raw[j]
+		}
+		for j := range raw {
+			if total != 0 {
+				weights[j] = float32(raw[j] / total)
+			}
+		}
+		windows[i] = resampleWindow{start: start, weights: weights}
+	}
+	return windows
+}
+
+// bicubic is the cubic convolution kernel with a = -0.5, as used by PIL.
+func bicubic(x float64) float64 {
+	const a = -0.5
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return ((a+2)*x-(a+3))*x*x + 1
+	case x < 2:
+		return (((x-5)*x+8)*x - 4) * a
+	}
+	return 0
+}
+
+func clampPixel(v float32) float32 {
+	return float32(math.Min(math.Max(math.Round(float64(v)), 0), 255))
+}
+
+// preprocessImages converts images to the pixel values expected by the model, returning the flattened
+// [batch, 3, height, width] values and the height and width of the images.
+func (c ImageProcessorConfig) preprocessImages(images []image.Image) ([]float32, int, int, error) {
+	var pixelValues []float32
+	height, width := c.outputSize()
+	for i, img := range images {
+		planes := newImagePlanes(img)
+		if c.DoResize {
+			if c.ShortestEdge > 0 {
+				planes = planes.resizeShortestEdge(c.ShortestEdge)
+			} else {
+				planes = planes.resize(c.Height, c.Width)
+			}
+		}
+		if c.DoCenterCrop && c.CropHeight > 0 && c.CropWidth > 0 {
+			planes = planes.centerCrop(c.CropHeight, c.CropWidth)
+		}
+		if i == 0 && height == 0 {
+			height, width = planes.height, planes.width
+		}
+		if planes.height != height || planes.width != width {
+			return nil, 0, 0, fmt.Errorf("image %d has size %dx%d after preprocessing, expected %dx%d", i, planes.height, planes.width, height, width)
+		}
+		for channel, plane := range planes.planes {
+			for _, v := range plane {
+				if c.DoRescale {
+					v *= c.RescaleFactor
+				}
+				if c.DoNormalize {
+					v = (v - c.ImageMean[channel]) / c.ImageStd[channel]
+				}
+				pixelValues = append(pixelValues, v)
+			}
+		}
+	}
+	return pixelValues, height, width, nil
+}
@@ -0,0 +1,326 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ImageSegmentationPipeline is a go version of the semantic segmentation postprocessing of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/image_segmentation.py
+// for Segformer-style models, which return class logits at a lower resolution than the input. The logits are
+// resized to the size of each image with bilinear interpolation and each pixel is assigned its top class.
+
+// types
+
+type ImageSegmentationPipeline struct {
+	BasePipeline
+	IdLabelMap        map[int]string
+	ImageConfig       ImageProcessorConfig
+	RunLengthEncoding bool
+}
+
+// Segment is a class present in a segmented image. Fraction is the share of the pixels of the image assigned to
+// the class. With run-length encoding, RLE holds the mask of the class as the lengths of the alternating runs of
+// pixels outside and inside the mask, in row-major order, starting with a run outside the mask (possibly empty).
+type Segment struct {
+	Label    string
+	Fraction float32
+	RLE      []int `json:",omitempty"`
+}
+
+// Segmentation is the segmentation of an image. LabelIds is the row-major [Height, Width] matrix of the class id
+// of each pixel, nil with run-length encoding. Segments lists the classes present in the image, by class id.
+type Segmentation struct {
+	Height   int
+	Width    int
+	LabelIds []int `json:",omitempty"`
+	Segments []Segment
+}
+
+type ImageSegmentationOutput struct {
+	Usage
+	Segmentations []Segmentation
+}
+
+func (t *ImageSegmentationOutput) GetOutput() []any {
+	out := make([]any, len(t.Segmentations))
+	for i, segmentation := range t.Segmentations {
+		out[i] = any(segmentation)
+	}
+	return out
+}
+
+// options
+
+// WithRunLengthEncoding returns the masks of the segments as run-length encodings instead of the label matrix.
+func WithRunLengthEncoding() PipelineOption[*ImageSegmentationPipeline] {
+	return func(pipeline *ImageSegmentationPipeline) {
+		pipeline.RunLengthEncoding = true
+	}
+}
+
+// NewImageSegmentationPipeline initializes an image segmentation pipeline.
+func NewImageSegmentationPipeline(config PipelineConfig[*ImageSegmentationPipeline], ortOptions *ort.SessionOptions) (*ImageSegmentationPipeline, error) {
+	pipeline := &ImageSegmentationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var modelConfig struct {
+		IdLabelMap map[int]string `json:"id2label"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &modelConfig); err != nil {
+		return nil, err
+	}
+	pipeline.IdLabelMap = modelConfig.IdLabelMap
+
+	imageConfig, err := loadImageProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ImageConfig = imageConfig
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx model, segmentation models have no tokenizer
+	err = pipeline.loadModelWithoutTokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, output := range pipeline.OutputsMeta {
+		if output.Name == "logits" && len(output.Dimensions) == 4 {
+			pipeline.OutputDim = int(output.Dimensions[1])
+		}
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *ImageSegmentationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.IdLabelMap) == 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model config has no id2label map"))
+	}
+	if p.OutputDim <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model must have a logits output of shape [batch, labels, height, width]"))
+	} else if len(p.IdLabelMap) != p.OutputDim {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: length of id2label map does not match model output dimension"))
+	}
+	for _, input := range p.InputsMeta {
+		if input.Name != "pixel_values" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported model input %s", input.Name))
+		}
+	}
+	if height, width := p.ImageConfig.outputSize(); height <= 0 || width <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the image processor config must define a fixed output size"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess converts the images to the pixel values of the model.
+func (p *ImageSegmentationPipeline) Preprocess(images []image.Image) (PipelineBatch, error) {
+	start := time.Now()
+
+	pixelValues, height, width, err := p.ImageConfig.preprocessImages(images)
+	if err != nil {
+		return PipelineBatch{}, err
+	}
+
+	// the image preprocessing is accounted as the tokenization step of the pipeline
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return PipelineBatch{
+		Input:       make([]TokenizedInput, len(images)),
+		PixelValues: pixelValues,
+		ImageHeight: height,
+		ImageWidth:  width,
+	}, nil
+}
+
+// Forward runs the model and returns the logits with their [batch, labels, height, width] shape.
+func (p *ImageSegmentationPipeline) Forward(batch PipelineBatch) (logits []float32, shape ort.Shape, err error) {
+	start := time.Now()
+
+	inputTensors, err := p.getInputTensors(batch, int64(len(batch.Input)), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		for _, tensor := range inputTensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}()
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, nil, err
+	}
+	for i, output := range p.OutputsMeta {
+		if output.Name == "logits" {
+			logitsTensor, ok := outputTensors[i].(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, errors.New("logits output must be float32"))
+			} else {
+				logits = append([]float32(nil), logitsTensor.GetData()...)
+				shape = logitsTensor.GetShape().Clone()
+			}
+		}
+		err = errors.Join(err, outputTensors[i].Destroy())
+	}
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, shape, err
+}
+
+// Postprocess resizes the logits of each image to its size and assigns each pixel its top class.
+func (p *ImageSegmentationPipeline) Postprocess(logits []float32, shape ort.Shape, images []image.Image) (*ImageSegmentationOutput, error) {
+	if len(shape) != 4 || int(shape[0]) != len(images) || int(shape[1]) != p.OutputDim {
+		return nil, fmt.Errorf("unexpected logits shape %s for %d images and %d labels", shape, len(images), p.OutputDim)
+	}
+	labels, logitsHeight, logitsWidth := int(shape[1]), int(shape[2]), int(shape[3])
+	imageSize := labels * logitsHeight * logitsWidth
+
+	output := &ImageSegmentationOutput{Segmentations: make([]Segmentation, len(images))}
+	for i, img := range images {
+		height, width := img.Bounds().Dy(), img.Bounds().Dx()
+		labelIds := upsampleArgMax(logits[i*imageSize:(i+1)*imageSize], labels, logitsHeight, logitsWidth, height, width)
+
+		counts := make([]int, labels)
+		for _, id := range labelIds {
+			counts[id]++
+		}
+		segmentation := Segmentation{Height: height, Width: width}
+		for id, count := range counts {
+			if count == 0 {
+				continue
+			}
+			segment := Segment{Label: p.IdLabelMap[id], Fraction: float32(count) / float32(len(labelIds))}
+			if p.RunLengthEncoding {
+				segment.RLE = runLengthEncode(labelIds, id)
+			}
+			segmentation.Segments = append(segmentation.Segments, segment)
+		}
+		if !p.RunLengthEncoding {
+			segmentation.LabelIds = labelIds
+		}
+		output.Segmentations[i] = segmentation
+	}
+	return output, nil
+}
+
+// bilinearSample is the pair of input positions an output position of a bilinear resize is interpolated from.
+type bilinearSample struct {
+	low, high int
+	weight    float32 // weight of high
+}
+
+// bilinearSamples computes the input positions of each output position of a bilinear resize, as torch's interpolate
+// with align_corners=False.
+func bilinearSamples(in int, out int) []bilinearSample {
+	scale := float64(in) / float64(out)
+	positions := make([]bilinearSample, out)
+	for o := range positions {
+		source := math.Max((float64(o)+0.5)*scale-0.5, 0)
+		low := int(source)
+		if low > in-1 {
+			low = in - 1
+		}
+		high := low + 1
+		if high > in-1 {
+			high = in - 1
+		}
+		positions[o] = bilinearSample{low: low, high: high, weight: float32(source - float64(low))}
+	}
+	return positions
+}
+
+// upsampleArgMax resizes the [labels, height, width] logits of an image to the output size with bilinear
+// interpolation (as torch's interpolate with align_corners=False) and returns the top label of each output pixel.
+func upsampleArgMax(logits []float32, labels int, height int, width int, outHeight int, outWidth int) []int {
+	rows, columns := bilinearSamples(height, outHeight), bilinearSamples(width, outWidth)
+	plane := height * width
+
+	labelIds := make([]int, outHeight*outWidth)
+	for y, row := range rows {
+		for x, column := range columns {
+			best, bestValue := 0, float32(math.Inf(-1))
+			for label := 0; label < labels; label++ {
+				values := logits[label*plane:]
+				top := values[row.low*width+column.low]*(1-column.weight) + values[row.low*width+column.high]*column.weight
+				bottom := values[row.high*width+column.low]*(1-column.weight) + values[row.high*width+column.high]*column.weight
+				if value := top*(1-row.weight) + bottom*row.weight; value > bestValue {
+					best, bestValue = label, value
+				}
+			}
+			labelIds[y*outWidth+x] = best
+		}
+	}
+	return labelIds
+}
+
+// runLengthEncode returns the run-length encoding of the mask of a label in a label matrix.
+func runLengthEncode(labelIds []int, label int) []int {
+	var runs []int
+	inside := false
+	length := 0
+	for _, id := range labelIds {
+		if (id == label) != inside {
+			runs = append(runs, length)
+			inside = !inside
+			length = 0
+		}
+		length++
+	}
+	return append(runs, length)
+}
+
+// Run the pipeline on a batch of paths to image files (jpeg, png or gif).
+func (p *ImageSegmentationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	images, err := readImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(images)
+}
+
+// RunPipeline segments each image.
+func (p *ImageSegmentationPipeline) RunPipeline(images []image.Image) (*ImageSegmentationOutput, error) {
+	if len(images) == 0 {
+		return &ImageSegmentationOutput{}, nil
+	}
+	batch, err := p.Preprocess(images)
+	if err != nil {
+		return nil, err
+	}
+	logits, shape, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(logits, shape, images)
+}
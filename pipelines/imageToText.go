@@ -0,0 +1,159 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// ImageToTextPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/image_to_text.py
+// for vision-encoder-decoder models (e.g. ViT-GPT2) exported to onnx as an encoder and a decoder. The images are
+// encoded by the vision encoder and the captions are decoded greedily from its hidden states.
+
+// types
+
+type ImageToTextPipeline struct {
+	BaseSeq2SeqPipeline
+	ImageConfig ImageProcessorConfig
+}
+
+type ImageToTextOutput struct {
+	Usage
+	GeneratedTexts []string
+}
+
+func (t *ImageToTextOutput) GetOutput() []any {
+	out := make([]any, len(t.GeneratedTexts))
+	for i, text := range t.GeneratedTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+// NewImageToTextPipeline initializes an image to text pipeline.
+func NewImageToTextPipeline(config PipelineConfig[*ImageToTextPipeline], ortOptions *ort.SessionOptions) (*ImageToTextPipeline, error) {
+	pipeline := &ImageToTextPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	generationConfig, err := loadGenerationConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.GenerationConfig = generationConfig
+
+	imageConfig, err := loadImageProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ImageConfig = imageConfig
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx models
+	err = pipeline.loadSeq2SeqModel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *ImageToTextPipeline) Validate() error {
+	validationErrors := p.validateSeq2Seq()
+
+	for _, input := range p.InputsMeta {
+		if input.Name != "pixel_values" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported encoder input %s, a vision encoder is required", input.Name))
+		}
+	}
+	if height, width := p.ImageConfig.outputSize(); height <= 0 || width <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the image processor config must define a fixed output size"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess converts the images to the pixel values of the encoder.
+func (p *ImageToTextPipeline) Preprocess(images []image.Image) (PipelineBatch, error) {
+	start := time.Now()
+
+	pixelValues, height, width, err := p.ImageConfig.preprocessImages(images)
+	if err != nil {
+		return PipelineBatch{}, err
+	}
+
+	// the image preprocessing is accounted as the tokenization step of the pipeline
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return PipelineBatch{
+		Input:       make([]TokenizedInput, len(images)),
+		PixelValues: pixelValues,
+		ImageHeight: height,
+		ImageWidth:  width,
+	}, nil
+}
+
+// Forward encodes the images and decodes their captions, returning the generated token ids.
+func (p *ImageToTextPipeline) Forward(batch PipelineBatch) (generated [][]int64, err error) {
+	hiddenStates, err := p.encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, hiddenStates.Destroy())
+	}()
+	return p.generate(hiddenStates, nil, []int64{p.GenerationConfig.DecoderStartTokenId})
+}
+
+// Postprocess decodes the generated tokens.
+func (p *ImageToTextPipeline) Postprocess(generated [][]int64) (*ImageToTextOutput, error) {
+	usage := Usage{}
+	for _, tokens := range generated {
+		usage.GeneratedTokens += uint64(len(tokens))
+	}
+	return &ImageToTextOutput{
+		Usage:          p.recordUsage(usage),
+		GeneratedTexts: p.decodeGenerated(generated),
+	}, nil
+}
+
+// Run the pipeline on a batch of paths to image files (jpeg, png or gif).
+func (p *ImageToTextPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	images, err := readImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(images)
+}
+
+// RunPipeline generates a caption for each image.
+func (p *ImageToTextPipeline) RunPipeline(images []image.Image) (*ImageToTextOutput, error) {
+	if len(images) == 0 {
+		return &ImageToTextOutput{}, nil
+	}
+	batch, err := p.Preprocess(images)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(generated)
+}
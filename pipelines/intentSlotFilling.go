@@ -0,0 +1,332 @@
+package pipelines
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/knights-analytics/tokenizers"
+	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/exp/slices"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// IntentSlotFillingPipeline runs joint intent classification and slot filling models (e.g. JointBERT) which produce
+// an utterance-level intent and token-level slot tags from a single forward pass. The model must have two outputs:
+// the intent logits of shape (batch, intents) and the slot logits of shape (batch, sequence, slots), found by their
+// names (e.g. intent_logits and slot_logits) or else by their rank. The labels
+// are read from the intent_id2label and slot_id2label fields of config.json or, following the JointBERT
+// convention, from intent_label.txt and slot_label.txt in the model folder (one label per line).
+
+// types
+
+type IntentSlotFillingPipeline struct {
+	BasePipeline
+	IntentIdLabelMap map[int]string
+	SlotIdLabelMap   map[int]string
+	IgnoreSlotLabels []string
+	// SlotTaggingScheme is the tagging scheme of the slot labels, see WithTaggingScheme. Default is IOB2.
+	SlotTaggingScheme string
+	intentOutputIndex int
+	slotOutputIndex   int
+	IntentDim         int
+	slotDecoder       *TokenClassificationPipeline
+}
+
+type IntentSlotFillingPipelineConfig struct {
+	IntentIdLabelMap map[int]string `json:"intent_id2label"`
+	SlotIdLabelMap   map[int]string `json:"slot_id2label"`
+}
+
+type IntentSlotResult struct {
+	Intent ClassificationOutput
+	Slots  []Entity
+}
+
+type IntentSlotFillingOutput struct {
+	Usage
+	Results []IntentSlotResult
+}
+
+func (t *IntentSlotFillingOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// options
+
+// WithIgnoreSlotLabels sets the slot labels that are not returned. Default is O, PAD and UNK.
+func WithIgnoreSlotLabels(ignoreLabels []string) PipelineOption[*IntentSlotFillingPipeline] {
+	return func(pipeline *IntentSlotFillingPipeline) {
+		pipeline.IgnoreSlotLabels = ignoreLabels
+	}
+}
+
+// WithSlotTaggingScheme declares the tagging scheme of the slot labels: IOB2 (the default), BILOU or BIOES, see
+// WithTaggingScheme.
+func WithSlotTaggingScheme(scheme string) PipelineOption[*IntentSlotFillingPipeline] {
+	return func(pipeline *IntentSlotFillingPipeline) {
+		pipeline.SlotTaggingScheme = scheme
+	}
+}
+
+// readLabelFile reads a JointBERT style label file with one label per line.
+func readLabelFile(path string) (map[int]string, error) {
+	labelBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[int]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(labelBytes))
+	for scanner.Scan() {
+		label := strings.TrimSpace(scanner.Text())
+		if label != "" {
+			labels[len(labels)] = label
+		}
+	}
+	return labels, scanner.Err()
+}
+
+// NewIntentSlotFillingPipeline initializes a joint intent classification and slot filling pipeline
+func NewIntentSlotFillingPipeline(config PipelineConfig[*IntentSlotFillingPipeline], ortOptions *ort.SessionOptions) (*IntentSlotFillingPipeline, error) {
+	pipeline := &IntentSlotFillingPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	pipeline.TokenizerOptions = []tokenizers.EncodeOption{
+		tokenizers.WithReturnTokens(),
+		tokenizers.WithReturnTypeIDs(),
+		tokenizers.WithReturnAttentionMask(),
+		tokenizers.WithReturnSpecialTokensMask(),
+		tokenizers.WithReturnOffsets(),
+	}
+
+	// labels
+	configPath := util.PathJoinSafe(config.ModelPath, "config.json")
+	pipelineInputConfig := IntentSlotFillingPipelineConfig{}
+	mapBytes, err := util.ReadFileBytes(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = jsoniter.Unmarshal(mapBytes, &pipelineInputConfig); err != nil {
+		return nil, err
+	}
+	pipeline.IntentIdLabelMap = pipelineInputConfig.IntentIdLabelMap
+	pipeline.SlotIdLabelMap = pipelineInputConfig.SlotIdLabelMap
+	if len(pipeline.IntentIdLabelMap) == 0 {
+		if pipeline.IntentIdLabelMap, err = readLabelFile(util.PathJoinSafe(config.ModelPath, "intent_label.txt")); err != nil {
+			return nil, err
+		}
+	}
+	if len(pipeline.SlotIdLabelMap) == 0 {
+		if pipeline.SlotIdLabelMap, err = readLabelFile(util.PathJoinSafe(config.ModelPath, "slot_label.txt")); err != nil {
+			return nil, err
+		}
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// defaults
+	if pipeline.IgnoreSlotLabels == nil {
+		pipeline.IgnoreSlotLabels = []string{"O", "PAD", "UNK"}
+	}
+	if pipeline.SlotTaggingScheme == "" {
+		pipeline.SlotTaggingScheme = "IOB2"
+	}
+
+	// load onnx model
+	if err = pipeline.loadModel(); err != nil {
+		return nil, err
+	}
+
+	pipeline.intentOutputIndex, pipeline.slotOutputIndex = intentSlotOutputs(pipeline.OutputsMeta)
+	if pipeline.intentOutputIndex >= 0 && len(pipeline.OutputsMeta[pipeline.intentOutputIndex].Dimensions) == 2 {
+		pipeline.IntentDim = int(pipeline.OutputsMeta[pipeline.intentOutputIndex].Dimensions[1])
+	}
+	if pipeline.slotOutputIndex >= 0 && len(pipeline.OutputsMeta[pipeline.slotOutputIndex].Dimensions) == 3 {
+		pipeline.OutputDim = int(pipeline.OutputsMeta[pipeline.slotOutputIndex].Dimensions[2])
+	}
+
+	// slots are decoded like token classification entities, the slot labels being filtered by Postprocess
+	pipeline.slotDecoder = &TokenClassificationPipeline{
+		BasePipeline: BasePipeline{
+			PipelineName: pipeline.PipelineName,
+			Tokenizer:    pipeline.Tokenizer,
+			Vocabulary:   pipeline.Vocabulary,
+			OutputDim:    pipeline.OutputDim,
+		},
+		IdLabelMap:          pipeline.SlotIdLabelMap,
+		AggregationStrategy: "SIMPLE",
+		TaggingScheme:       pipeline.SlotTaggingScheme,
+		IgnoreLabels:        pipeline.IgnoreSlotLabels,
+	}
+
+	if err = pipeline.Validate(); err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+// intentSlotOutputs returns the indices of the intent and slot outputs of the model: the outputs whose names contain
+// intent and slot, or else the outputs of rank 2 and 3. An index is -1 if no output matches.
+func intentSlotOutputs(outputs []ort.InputOutputInfo) (int, int) {
+	intentIndex, slotIndex := -1, -1
+	for i, meta := range outputs {
+		name := strings.ToLower(meta.Name)
+		switch {
+		case strings.Contains(name, "intent"):
+			intentIndex = i
+		case strings.Contains(name, "slot"):
+			slotIndex = i
+		}
+	}
+	if intentIndex >= 0 && slotIndex >= 0 {
+		return intentIndex, slotIndex
+	}
+	intentIndex, slotIndex = -1, -1
+	for i, meta := range outputs {
+		switch len(meta.Dimensions) {
+		case 2:
+			intentIndex = i
+		case 3:
+			slotIndex = i
+		}
+	}
+	return intentIndex, slotIndex
+}
+
+func (p *IntentSlotFillingPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.OutputsMeta) != 2 || p.intentOutputIndex < 0 || p.slotOutputIndex < 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model must have an intent output and a slot output"))
+	} else if len(p.OutputsMeta[p.intentOutputIndex].Dimensions) != 2 || len(p.OutputsMeta[p.slotOutputIndex].Dimensions) != 3 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the intent output must have rank 2 and the slot output rank 3"))
+	}
+	if len(p.IntentIdLabelMap) == 0 || len(p.IntentIdLabelMap) != p.IntentDim {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: number of intent labels (%d) does not match model intent dimension (%d)", len(p.IntentIdLabelMap), p.IntentDim))
+	}
+	if len(p.SlotIdLabelMap) == 0 || len(p.SlotIdLabelMap) != p.OutputDim {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: number of slot labels (%d) does not match model slot dimension (%d)", len(p.SlotIdLabelMap), p.OutputDim))
+	} else if err := p.slotDecoder.Validate(); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Forward pass of the neural network, returning the slot logits in the batch output tensor and the intent logits.
+func (p *IntentSlotFillingPipeline) Forward(batch PipelineBatch) (PipelineBatch, []float32, error) {
+	start := time.Now()
+
+	actualBatchSize := int64(len(batch.Input))
+	maxSequence := int64(batch.MaxSequence)
+	inputTensors, err := p.getInputTensors(batch, actualBatchSize, maxSequence)
+	if err != nil {
+		return batch, nil, err
+	}
+	defer func(inputTensors []ort.ArbitraryTensor) {
+		for _, tensor := range inputTensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}(inputTensors)
+
+	intentTensor, err := ort.NewEmptyTensor[float32](ort.NewShape(actualBatchSize, int64(p.IntentDim)))
+	if err != nil {
+		return batch, nil, err
+	}
+	defer func(tensor *ort.Tensor[float32]) {
+		err = errors.Join(err, tensor.Destroy())
+	}(intentTensor)
+	slotTensor, err := ort.NewEmptyTensor[float32](ort.NewShape(actualBatchSize, maxSequence, int64(p.OutputDim)))
+	if err != nil {
+		return batch, nil, err
+	}
+	defer func(tensor *ort.Tensor[float32]) {
+		err = errors.Join(err, tensor.Destroy())
+	}(slotTensor)
+
+	outputTensors := make([]ort.ArbitraryTensor, 2)
+	outputTensors[p.intentOutputIndex] = intentTensor
+	outputTensors[p.slotOutputIndex] = slotTensor
+
+	// Run Onnx model
+	if errOnnx := p.runSession(p.OrtSession, inputTensors, outputTensors); errOnnx != nil {
+		return batch, nil, errOnnx
+	}
+	batch.OutputTensor = slotTensor.GetData()
+	intents := intentTensor.GetData()
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return batch, intents, err
+}
+
+// Postprocess converts the intent and slot logits to the predicted intent and slots of each input.
+func (p *IntentSlotFillingPipeline) Postprocess(batch PipelineBatch, intents []float32) (*IntentSlotFillingOutput, error) {
+	output := &IntentSlotFillingOutput{
+		Results: make([]IntentSlotResult, len(batch.Input)),
+		Usage:   p.recordUsage(batchUsage(batch)),
+	}
+	slotSize := batch.MaxSequence * p.OutputDim
+
+	for i, input := range batch.Input {
+		// intent
+		intentScores := util.SoftMax(intents[i*p.IntentDim : (i+1)*p.IntentDim])
+		intentIndex, intentScore, err := util.ArgMax(intentScores)
+		if err != nil {
+			return nil, err
+		}
+		intentLabel, ok := p.IntentIdLabelMap[intentIndex]
+		if !ok {
+			return nil, fmt.Errorf("intent with index number %d not found in intent label map", intentIndex)
+		}
+		output.Results[i].Intent = ClassificationOutput{Label: intentLabel, Score: intentScore}
+
+		// slots, skipping the padding tokens
+		tokenScores := make([][]float32, len(input.TokenIds))
+		for j := range input.TokenIds {
+			offset := i*slotSize + j*p.OutputDim
+			tokenScores[j] = util.SoftMax(batch.OutputTensor[offset : offset+p.OutputDim])
+		}
+		preEntities := p.slotDecoder.GatherPreEntities(input, tokenScores)
+		slots, err := p.slotDecoder.Aggregate(input, preEntities)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			if !slices.Contains(p.IgnoreSlotLabels, slot.Entity) && slot.Entity != "" {
+				output.Results[i].Slots = append(output.Results[i].Slots, slot)
+			}
+		}
+	}
+	return output, nil
+}
+
+// Run the pipeline on a string batch
+func (p *IntentSlotFillingPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+func (p *IntentSlotFillingPipeline) RunPipeline(inputs []string) (*IntentSlotFillingOutput, error) {
+	batch := p.Preprocess(inputs)
+	batch, intents, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, intents)
+}
@@ -0,0 +1,231 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// KNNClassificationPipeline labels inputs by nearest neighbour lookup of their embedding in a small set of labelled
+// examples, so that new categories only need a few examples rather than a trained classification head. The
+// embeddings come from a feature extraction pipeline, e.g. with sentence-transformers/all-MiniLM-L6-v2, and are
+// compared by cosine similarity.
+type KNNClassificationPipeline struct {
+	PipelineName string
+	Embedder     *FeatureExtractionPipeline
+	// K is the number of neighbours voting for the label of an input. The default is 5.
+	K int
+	// MinSimilarity ignores the neighbours less similar to the input, so that inputs unlike any example get no
+	// label. The default is -1, i.e. all neighbours vote.
+	MinSimilarity float32
+	NumInputs     uint64
+	mutex         sync.RWMutex
+	examples      [][]float32
+	labels        []string
+}
+
+type KNNClassificationOutput struct {
+	Usage
+	Diagnostics
+	// ClassificationOutputs holds the labels of the neighbours of each input, sorted by decreasing score. The score
+	// of a label is its share of the summed similarity of the voting neighbours.
+	ClassificationOutputs [][]ClassificationOutput
+}
+
+func (t *KNNClassificationOutput) GetOutput() []any {
+	out := make([]any, len(t.ClassificationOutputs))
+	for i, classificationOutput := range t.ClassificationOutputs {
+		out[i] = any(classificationOutput)
+	}
+	return out
+}
+
+// options
+
+// WithNeighbours sets the number of neighbours voting for the label of an input.
+func WithNeighbours(k int) PipelineOption[*KNNClassificationPipeline] {
+	return func(p *KNNClassificationPipeline) {
+		p.K = k
+	}
+}
+
+// WithMinSimilarity ignores the neighbours whose cosine similarity to the input is below minSimilarity.
+func WithMinSimilarity(minSimilarity float32) PipelineOption[*KNNClassificationPipeline] {
+	return func(p *KNNClassificationPipeline) {
+		p.MinSimilarity = minSimilarity
+	}
+}
+
+// NewKNNClassificationPipeline creates a classifier on top of the embeddings of embedder. It has no examples until
+// Fit is called. The embedder is not owned by the classifier and must be destroyed separately, e.g. by the session
+// that created it.
+func NewKNNClassificationPipeline(name string, embedder *FeatureExtractionPipeline, opts ...PipelineOption[*KNNClassificationPipeline]) (*KNNClassificationPipeline, error) {
+	pipeline := &KNNClassificationPipeline{
+		PipelineName:  name,
+		Embedder:      embedder,
+		K:             5,
+		MinSimilarity: -1,
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *KNNClassificationPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.Embedder == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a feature extraction pipeline is required"))
+	}
+	if p.K <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of neighbours must be greater than zero, got %d", p.K))
+	}
+	if p.MinSimilarity < -1 || p.MinSimilarity > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: minimum similarity must be between -1 and 1, got %f", p.MinSimilarity))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Fit embeds the labelled examples and replaces the examples of the classifier with them.
+func (p *KNNClassificationPipeline) Fit(inputs []string, labels []string) error {
+	if len(inputs) != len(labels) {
+		return fmt.Errorf("got %d labels for %d examples", len(labels), len(inputs))
+	}
+	output, err := p.Embedder.RunPipeline(inputs)
+	if err != nil {
+		return err
+	}
+	return p.FitEmbeddings(output.Embeddings, labels)
+}
+
+// FitEmbeddings replaces the examples of the classifier with precomputed embeddings, e.g. stored alongside the
+// labelled data. They must come from the same model as the embedder.
+func (p *KNNClassificationPipeline) FitEmbeddings(embeddings [][]float32, labels []string) error {
+	if len(embeddings) != len(labels) {
+		return fmt.Errorf("got %d labels for %d examples", len(labels), len(embeddings))
+	}
+	if len(embeddings) == 0 {
+		return errors.New("at least one example is required")
+	}
+	examples := make([][]float32, len(embeddings))
+	for i, embedding := range embeddings {
+		if len(embedding) != len(embeddings[0]) {
+			return fmt.Errorf("example %d has dimension %d, expected %d", i, len(embedding), len(embeddings[0]))
+		}
+		examples[i] = util.Normalize(append([]float32(nil), embedding...), 2)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.examples = examples
+	p.labels = append([]string(nil), labels...)
+	return nil
+}
+
+// Destroy is a no-op: the embedder is not owned by the classifier.
+func (p *KNNClassificationPipeline) Destroy() error {
+	return nil
+}
+
+// GetOutputDim returns the number of distinct labels of the examples.
+func (p *KNNClassificationPipeline) GetOutputDim() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	distinct := map[string]bool{}
+	for _, label := range p.labels {
+		distinct[label] = true
+	}
+	return len(distinct)
+}
+
+func (p *KNNClassificationPipeline) GetStats() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("kNN classification: Examples=%d, Inputs=%d", len(p.examples), atomic.LoadUint64(&p.NumInputs)),
+	}
+}
+
+// Run the pipeline on a string batch.
+func (p *KNNClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline embeds the inputs and labels each one by a similarity weighted vote of its K nearest examples.
+func (p *KNNClassificationPipeline) RunPipeline(inputs []string) (*KNNClassificationOutput, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.examples) == 0 {
+		return nil, errors.New("the classifier has no examples, call Fit first")
+	}
+	output := &KNNClassificationOutput{ClassificationOutputs: make([][]ClassificationOutput, len(inputs))}
+	if len(inputs) == 0 {
+		return output, nil
+	}
+	embedded, err := p.Embedder.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(embedded.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("the embedder returned %d embeddings for %d inputs", len(embedded.Embeddings), len(inputs))
+	}
+	output.Usage = embedded.Usage
+	output.Diagnostics = embedded.Diagnostics
+	atomic.AddUint64(&p.NumInputs, uint64(len(inputs)))
+
+	type neighbour struct {
+		index      int
+		similarity float32
+	}
+	for i, embedding := range embedded.Embeddings {
+		if len(embedding) != len(p.examples[0]) {
+			return nil, fmt.Errorf("embedding dimension %d does not match the examples dimension %d", len(embedding), len(p.examples[0]))
+		}
+		embedding = util.Normalize(append([]float32(nil), embedding...), 2)
+		neighbours := make([]neighbour, len(p.examples))
+		for j, example := range p.examples {
+			neighbours[j] = neighbour{index: j, similarity: util.Dot(embedding, example)}
+		}
+		sort.SliceStable(neighbours, func(a, b int) bool {
+			return neighbours[a].similarity > neighbours[b].similarity
+		})
+		if len(neighbours) > p.K {
+			neighbours = neighbours[:p.K]
+		}
+
+		// similarities are shifted to [0, 2] so that dissimilar neighbours still weigh positively
+		votes := map[string]float32{}
+		var total float32
+		for _, n := range neighbours {
+			if n.similarity < p.MinSimilarity {
+				continue
+			}
+			votes[p.labels[n.index]] += n.similarity + 1
+			total += n.similarity + 1
+		}
+		classifications := make([]ClassificationOutput, 0, len(votes))
+		for label, vote := range votes {
+			score := float32(1)
+			if total > 0 {
+				score = vote / total
+			}
+			classifications = append(classifications, ClassificationOutput{Label: label, Score: score})
+		}
+		sort.Slice(classifications, func(a, b int) bool {
+			if classifications[a].Score != classifications[b].Score {
+				return classifications[a].Score > classifications[b].Score
+			}
+			return classifications[a].Label < classifications[b].Label
+		})
+		output.ClassificationOutputs[i] = classifications
+	}
+	return output, nil
+}
@@ -0,0 +1,190 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// LanguageRouterPipeline dispatches each input to the pipeline of its language, e.g. to monolingual NER models.
+// The language of the inputs is the top label of a detector, any classification pipeline whose labels are language
+// codes (e.g. a text classification pipeline with papluca/xlm-roberta-base-language-detection). The outputs are
+// returned in input order, tagged with the detected language.
+type LanguageRouterPipeline struct {
+	PipelineName string
+	Detector     Pipeline
+	// Routes maps the languages returned by the detector to the pipelines serving them.
+	Routes map[string]Pipeline
+	// Fallback serves the inputs whose language has no route. If nil their output is empty.
+	Fallback    Pipeline
+	routeCounts map[string]*uint64
+}
+
+// LanguageRoutedOutput is the output for a single input, tagged with its detected language. Output is nil if the
+// language has no route and there is no fallback pipeline.
+type LanguageRoutedOutput struct {
+	Language string
+	Score    float32
+	Output   any
+}
+
+type LanguageRouterOutput struct {
+	Usage
+	Diagnostics
+	Outputs []LanguageRoutedOutput
+}
+
+func (t *LanguageRouterOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, routedOutput := range t.Outputs {
+		out[i] = any(routedOutput)
+	}
+	return out
+}
+
+// options
+
+// WithFallbackRoute serves the inputs in languages without a route with the given pipeline, e.g. a multilingual model.
+func WithFallbackRoute(pipeline Pipeline) PipelineOption[*LanguageRouterPipeline] {
+	return func(p *LanguageRouterPipeline) {
+		p.Fallback = pipeline
+	}
+}
+
+// NewLanguageRouterPipeline creates a pipeline routing inputs to the pipeline of the language detected by detector.
+// The detector and the routed pipelines are not owned by the router and must be destroyed separately, e.g. by the
+// session that created them.
+func NewLanguageRouterPipeline(name string, detector Pipeline, routes map[string]Pipeline, opts ...PipelineOption[*LanguageRouterPipeline]) (*LanguageRouterPipeline, error) {
+	pipeline := &LanguageRouterPipeline{
+		PipelineName: name,
+		Detector:     detector,
+		Routes:       routes,
+		routeCounts:  map[string]*uint64{},
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+	for language := range routes {
+		pipeline.routeCounts[language] = new(uint64)
+	}
+	pipeline.routeCounts[""] = new(uint64)
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *LanguageRouterPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.Detector == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a language detection pipeline is required"))
+	}
+	if len(p.Routes) == 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least one language route is required"))
+	}
+	for language, route := range p.Routes {
+		if route == nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: language %s has no pipeline", language))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy is a no-op: the detector and the routed pipelines are not owned by the router.
+func (p *LanguageRouterPipeline) Destroy() error {
+	return nil
+}
+
+// GetOutputDim returns the output dimension of the routed pipelines, which should all be of the same type.
+func (p *LanguageRouterPipeline) GetOutputDim() int {
+	for _, route := range p.Routes {
+		return route.GetOutputDim()
+	}
+	return 0
+}
+
+func (p *LanguageRouterPipeline) GetStats() []string {
+	languages := make([]string, 0, len(p.Routes))
+	for language := range p.Routes {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	stats := []string{fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName)}
+	for _, language := range languages {
+		stats = append(stats, fmt.Sprintf("Language route: Language=%s, Inputs served=%d", language, atomic.LoadUint64(p.routeCounts[language])))
+	}
+	return append(stats, fmt.Sprintf("Language route: Unrouted inputs=%d", atomic.LoadUint64(p.routeCounts[""])))
+}
+
+// Run the pipeline on a string batch.
+func (p *LanguageRouterPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline detects the language of each input and runs each route once on the inputs in its language.
+func (p *LanguageRouterPipeline) RunPipeline(inputs []string) (*LanguageRouterOutput, error) {
+	output := &LanguageRouterOutput{Outputs: make([]LanguageRoutedOutput, len(inputs))}
+	if len(inputs) == 0 {
+		return output, nil
+	}
+	detected, err := p.Detector.Run(inputs)
+	if err != nil {
+		return nil, fmt.Errorf("language detection: %w", err)
+	}
+	output.Usage = output.Usage.Add(usageOf(detected))
+	predictions, err := classifications(detected, len(inputs))
+	if err != nil {
+		return nil, err
+	}
+
+	// split the batch into one sub-batch per route, remembering the original positions. The fallback is keyed by
+	// the empty language.
+	routeInputs := map[string][]string{}
+	routePositions := map[string][]int{}
+	for i, input := range inputs {
+		for _, prediction := range predictions[i] {
+			if prediction.Score > output.Outputs[i].Score || output.Outputs[i].Language == "" {
+				output.Outputs[i].Language, output.Outputs[i].Score = prediction.Label, prediction.Score
+			}
+		}
+		route := output.Outputs[i].Language
+		if _, ok := p.Routes[route]; !ok {
+			route = ""
+			warning := Warning{Input: i, Type: WarningUnknownLabel, Message: fmt.Sprintf("language %s has no route, the input was not processed", output.Outputs[i].Language)}
+			if p.Fallback != nil {
+				warning = Warning{Input: i, Type: WarningFallback, Message: fmt.Sprintf("language %s has no route, the input was processed by the fallback pipeline", output.Outputs[i].Language)}
+			}
+			output.Warnings = append(output.Warnings, warning)
+		}
+		routeInputs[route] = append(routeInputs[route], input)
+		routePositions[route] = append(routePositions[route], i)
+	}
+
+	for language, batch := range routeInputs {
+		pipeline, ok := p.Routes[language]
+		if !ok {
+			pipeline = p.Fallback
+		}
+		atomic.AddUint64(p.routeCounts[language], uint64(len(batch)))
+		if pipeline == nil {
+			continue
+		}
+		routeOutput, err := pipeline.Run(batch)
+		if err != nil {
+			return nil, fmt.Errorf("language route %s: %w", language, err)
+		}
+		output.Usage = output.Usage.Add(usageOf(routeOutput))
+		output.Warnings = append(output.Warnings, warningsOf(routeOutput, routePositions[language])...)
+		output.Truncations = append(output.Truncations, truncationsOf(routeOutput, routePositions[language])...)
+		results := routeOutput.GetOutput()
+		if len(results) != len(batch) {
+			return nil, fmt.Errorf("language route %s returned %d outputs for %d inputs", language, len(results), len(batch))
+		}
+		for j, result := range results {
+			output.Outputs[routePositions[language][j]].Output = result
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,497 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// MaskGenerationPipeline is an interactive go version of the prompted segmentation of the transformers SamModel
+// (https://github.com/huggingface/transformers/blob/main/src/transformers/models/sam/modeling_sam.py) for Segment
+// Anything models exported to onnx as a vision encoder and a prompt encoder and mask decoder. An image is encoded
+// once, and each prompt (a set of points and/or a box) is decoded to segmentation masks from the image embeddings.
+// The embeddings can be kept with EncodeImage and decoded with new prompts at any time with DecodePrompts.
+
+// types
+
+type MaskGenerationPipeline struct {
+	BasePipeline
+	DecoderOnnxFilename string
+	DecoderSession      *ort.DynamicAdvancedSession
+	DecoderInputsMeta   []ort.InputOutputInfo
+	DecoderOutputsMeta  []ort.InputOutputInfo
+	ImageConfig         ImageProcessorConfig
+	// LongestEdge is the size the longest edge of the images is resized to, PadHeight and PadWidth the size they
+	// are then padded to.
+	LongestEdge int
+	PadHeight   int
+	PadWidth    int
+	// MultimaskOutput returns the three masks predicted for each prompt instead of the one with the best score.
+	MultimaskOutput bool
+}
+
+const (
+	defaultVisionEncoderOnnxFilename = "vision_encoder.onnx"
+	defaultMaskDecoderOnnxFilename   = "prompt_encoder_mask_decoder.onnx"
+)
+
+// MaskPrompt is a prompt of a mask generation pipeline: points, each labelled 1 (in the object) or 0 (outside the
+// object), and/or a box, as [x1, y1, x2, y2]. Coordinates are pixels of the original image.
+type MaskPrompt struct {
+	Points [][2]float32
+	Labels []int64
+	Box    *[4]float32 `json:",omitempty"`
+}
+
+// Mask is a predicted segmentation mask with its predicted IoU score. The mask is run-length encoded as in
+// Segment: the lengths of the alternating runs of pixels outside and inside the mask, in row-major order, starting
+// with a run outside the mask (possibly empty).
+type Mask struct {
+	Score  float32
+	Height int
+	Width  int
+	RLE    []int
+}
+
+type MaskGenerationOutput struct {
+	Usage
+	// Masks holds the masks of each prompt, sorted by decreasing score.
+	Masks [][]Mask
+}
+
+func (t *MaskGenerationOutput) GetOutput() []any {
+	out := make([]any, len(t.Masks))
+	for i, masks := range t.Masks {
+		out[i] = any(masks)
+	}
+	return out
+}
+
+// ImageEmbedding is the encoding of an image by the vision encoder, to be decoded with prompts.
+type ImageEmbedding struct {
+	embeddings      []float32
+	embeddingsShape ort.Shape
+	positional      []float32
+	positionalShape ort.Shape
+	height          int
+	width           int
+	resizedHeight   int
+	resizedWidth    int
+}
+
+// options
+
+// WithMultimaskOutput returns the three masks predicted for each prompt, which is useful for ambiguous prompts
+// (e.g. a single point), instead of the mask with the best score.
+func WithMultimaskOutput() PipelineOption[*MaskGenerationPipeline] {
+	return func(pipeline *MaskGenerationPipeline) {
+		pipeline.MultimaskOutput = true
+	}
+}
+
+// WithMaskDecoderOnnxFilename sets the onnx file of the prompt encoder and mask decoder, by default
+// prompt_encoder_mask_decoder.onnx. The vision encoder file is set with the OnnxFilename of the pipeline config and
+// defaults to vision_encoder.onnx.
+func WithMaskDecoderOnnxFilename(filename string) PipelineOption[*MaskGenerationPipeline] {
+	return func(pipeline *MaskGenerationPipeline) {
+		pipeline.DecoderOnnxFilename = filename
+	}
+}
+
+// NewMaskGenerationPipeline initializes a mask generation pipeline.
+func NewMaskGenerationPipeline(config PipelineConfig[*MaskGenerationPipeline], ortOptions *ort.SessionOptions) (*MaskGenerationPipeline, error) {
+	pipeline := &MaskGenerationPipeline{
+		DecoderOnnxFilename: defaultMaskDecoderOnnxFilename,
+		LongestEdge:         1024,
+		PadHeight:           1024,
+		PadWidth:            1024,
+	}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	if pipeline.OnnxFilename == "" {
+		pipeline.OnnxFilename = defaultVisionEncoderOnnxFilename
+	}
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	imageConfig, err := loadImageProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ImageConfig = imageConfig
+	if err = pipeline.loadSamSizes(); err != nil {
+		return nil, err
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx models, segment anything models have no tokenizer
+	err = pipeline.loadModelWithoutTokenizer()
+	if err != nil {
+		return nil, err
+	}
+	session, inputs, outputs, err := pipeline.loadSession(pipeline.DecoderOnnxFilename)
+	if err != nil {
+		return nil, errors.Join(err, pipeline.BasePipeline.Destroy())
+	}
+	pipeline.DecoderSession = session
+	pipeline.DecoderInputsMeta = inputs
+	pipeline.DecoderOutputsMeta = outputs
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+// loadSamSizes reads the longest edge and pad size of the SAM image processor from preprocessor_config.json.
+func (p *MaskGenerationPipeline) loadSamSizes() error {
+	path := util.PathJoinSafe(p.ModelPath, "preprocessor_config.json")
+	exists, err := util.FileSystem.Exists(context.Background(), path)
+	if err != nil || !exists {
+		return err
+	}
+	configBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return err
+	}
+	var values struct {
+		Size struct {
+			LongestEdge int `json:"longest_edge"`
+		} `json:"size"`
+		PadSize struct {
+			Height int `json:"height"`
+			Width  int `json:"width"`
+		} `json:"pad_size"`
+	}
+	if err = jsoniter.Unmarshal(configBytes, &values); err != nil {
+		return fmt.Errorf("could not read preprocessor_config.json: %w", err)
+	}
+	if values.Size.LongestEdge > 0 {
+		p.LongestEdge = values.Size.LongestEdge
+	}
+	if values.PadSize.Height > 0 && values.PadSize.Width > 0 {
+		p.PadHeight, p.PadWidth = values.PadSize.Height, values.PadSize.Width
+	}
+	return nil
+}
+
+func (p *MaskGenerationPipeline) Validate() error {
+	var validationErrors []error
+
+	for _, input := range p.InputsMeta {
+		if input.Name != "pixel_values" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported vision encoder input %s", input.Name))
+		}
+	}
+	for _, input := range p.DecoderInputsMeta {
+		switch input.Name {
+		case "input_points", "input_labels", "image_embeddings", "image_positional_embeddings":
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported mask decoder input %s", input.Name))
+		}
+	}
+	if p.LongestEdge > p.PadHeight || p.LongestEdge > p.PadWidth {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the pad size must be at least the longest edge"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+func (p *MaskGenerationPipeline) Destroy() error {
+	err := p.BasePipeline.Destroy()
+	if p.DecoderSession != nil {
+		err = errors.Join(err, p.DecoderSession.Destroy())
+	}
+	return err
+}
+
+// preprocess resizes the image so that its longest edge is LongestEdge, rescales and normalizes it, and pads it to
+// the pad size. It returns the pixel values and the size of the resized image.
+func (p *MaskGenerationPipeline) preprocess(img image.Image) ([]float32, int, int) {
+	start := time.Now()
+
+	planes := newImagePlanes(img)
+	longest := planes.height
+	if planes.width > longest {
+		longest = planes.width
+	}
+	scale := float64(p.LongestEdge) / float64(longest)
+	resizedHeight, resizedWidth := int(float64(planes.height)*scale+0.5), int(float64(planes.width)*scale+0.5)
+	planes = planes.resize(resizedHeight, resizedWidth)
+
+	pixelValues := make([]float32, 3*p.PadHeight*p.PadWidth)
+	for channel, plane := range planes.planes {
+		offset := channel * p.PadHeight * p.PadWidth
+		for y := 0; y < resizedHeight; y++ {
+			for x := 0; x < resizedWidth; x++ {
+				v := plane[y*resizedWidth+x]
+				if p.ImageConfig.DoRescale {
+					v *= p.ImageConfig.RescaleFactor
+				}
+				if p.ImageConfig.DoNormalize {
+					v = (v - p.ImageConfig.ImageMean[channel]) / p.ImageConfig.ImageStd[channel]
+				}
+				pixelValues[offset+y*p.PadWidth+x] = v
+			}
+		}
+	}
+
+	// the image preprocessing is accounted as the tokenization step of the pipeline
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return pixelValues, resizedHeight, resizedWidth
+}
+
+// EncodeImage runs the vision encoder on an image. The returned embedding can be decoded with any number of prompts.
+func (p *MaskGenerationPipeline) EncodeImage(img image.Image) (embedding *ImageEmbedding, err error) {
+	pixelValues, resizedHeight, resizedWidth := p.preprocess(img)
+	start := time.Now()
+
+	pixelTensor, err := ort.NewTensor(ort.NewShape(1, 3, int64(p.PadHeight), int64(p.PadWidth)), pixelValues)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, pixelTensor.Destroy())
+	}()
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, []ort.ArbitraryTensor{pixelTensor}, outputTensors); err != nil {
+		return nil, err
+	}
+
+	embedding = &ImageEmbedding{
+		height:        img.Bounds().Dy(),
+		width:         img.Bounds().Dx(),
+		resizedHeight: resizedHeight,
+		resizedWidth:  resizedWidth,
+	}
+	for i, output := range p.OutputsMeta {
+		tensor, ok := outputTensors[i].(*ort.Tensor[float32])
+		switch {
+		case !ok:
+			err = errors.Join(err, fmt.Errorf("vision encoder output %s must be float32", output.Name))
+		case output.Name == "image_embeddings":
+			embedding.embeddings = append([]float32(nil), tensor.GetData()...)
+			embedding.embeddingsShape = tensor.GetShape().Clone()
+		case output.Name == "image_positional_embeddings":
+			embedding.positional = append([]float32(nil), tensor.GetData()...)
+			embedding.positionalShape = tensor.GetShape().Clone()
+		}
+		err = errors.Join(err, outputTensors[i].Destroy())
+	}
+	if err == nil && embedding.embeddings == nil {
+		err = errors.New("the vision encoder has no image_embeddings output")
+	}
+	if err == nil && embedding.positional == nil {
+		err = errors.New("the vision encoder has no image_positional_embeddings output")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return embedding, nil
+}
+
+// promptPoints converts a prompt to the points and labels of the decoder, in the coordinates of the resized image.
+// Boxes are encoded as their top left and bottom right corners, labelled 2 and 3 as in the original SAM.
+func promptPoints(prompt MaskPrompt, embedding *ImageEmbedding) ([]float32, []int64, error) {
+	if len(prompt.Points) != len(prompt.Labels) {
+		return nil, nil, fmt.Errorf("prompt has %d points and %d labels", len(prompt.Points), len(prompt.Labels))
+	}
+	if len(prompt.Points) == 0 && prompt.Box == nil {
+		return nil, nil, errors.New("prompt has no points and no box")
+	}
+	scaleX := float32(embedding.resizedWidth) / float32(embedding.width)
+	scaleY := float32(embedding.resizedHeight) / float32(embedding.height)
+	var points []float32
+	labels := append([]int64(nil), prompt.Labels...)
+	for _, point := range prompt.Points {
+		points = append(points, point[0]*scaleX, point[1]*scaleY)
+	}
+	if prompt.Box != nil {
+		box := *prompt.Box
+		points = append(points, box[0]*scaleX, box[1]*scaleY, box[2]*scaleX, box[3]*scaleY)
+		labels = append(labels, 2, 3)
+	}
+	return points, labels, nil
+}
+
+// DecodePrompts decodes the masks of each prompt from an image embedding, running the mask decoder once per prompt.
+func (p *MaskGenerationPipeline) DecodePrompts(embedding *ImageEmbedding, prompts []MaskPrompt) (*MaskGenerationOutput, error) {
+	output := &MaskGenerationOutput{Masks: make([][]Mask, len(prompts))}
+	for i, prompt := range prompts {
+		points, labels, err := promptPoints(prompt, embedding)
+		if err != nil {
+			return nil, fmt.Errorf("prompt %d: %w", i, err)
+		}
+		scores, masks, maskHeight, maskWidth, err := p.decode(embedding, points, labels)
+		if err != nil {
+			return nil, err
+		}
+		output.Masks[i] = p.postprocess(embedding, scores, masks, maskHeight, maskWidth)
+	}
+	return output, nil
+}
+
+// decode runs the mask decoder on a prompt and returns the predicted IoU scores and low resolution mask logits.
+func (p *MaskGenerationPipeline) decode(embedding *ImageEmbedding, points []float32, labels []int64) (scores []float32, masks []float32, maskHeight int, maskWidth int, err error) {
+	start := time.Now()
+
+	inputTensors := make([]ort.ArbitraryTensor, len(p.DecoderInputsMeta))
+	defer func() {
+		for _, tensor := range inputTensors {
+			if tensor != nil {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+	for i, input := range p.DecoderInputsMeta {
+		var tensor ort.ArbitraryTensor
+		var tensorErr error
+		switch input.Name {
+		case "input_points":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(1, 1, int64(len(labels)), 2), points)
+		case "input_labels":
+			tensor, tensorErr = newTensorOrNil(ort.NewShape(1, 1, int64(len(labels))), labels)
+		case "image_embeddings":
+			tensor, tensorErr = newTensorOrNil(embedding.embeddingsShape, embedding.embeddings)
+		case "image_positional_embeddings":
+			tensor, tensorErr = newTensorOrNil(embedding.positionalShape, embedding.positional)
+		}
+		if tensorErr != nil {
+			return nil, nil, 0, 0, tensorErr
+		}
+		inputTensors[i] = tensor
+	}
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.DecoderOutputsMeta))
+	if err = p.runSession(p.DecoderSession, inputTensors, outputTensors); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	for i, output := range p.DecoderOutputsMeta {
+		tensor, ok := outputTensors[i].(*ort.Tensor[float32])
+		switch {
+		case !ok:
+			err = errors.Join(err, fmt.Errorf("mask decoder output %s must be float32", output.Name))
+		case output.Name == "iou_scores":
+			scores = append([]float32(nil), tensor.GetData()...)
+		case output.Name == "pred_masks":
+			// [batch, point batch, masks, height, width]
+			shape := tensor.GetShape()
+			if len(shape) != 5 {
+				err = errors.Join(err, fmt.Errorf("unexpected pred_masks shape %s", shape))
+				break
+			}
+			masks = append([]float32(nil), tensor.GetData()...)
+			maskHeight, maskWidth = int(shape[3]), int(shape[4])
+		}
+		err = errors.Join(err, outputTensors[i].Destroy())
+	}
+	if err == nil && (scores == nil || masks == nil || len(masks) != len(scores)*maskHeight*maskWidth) {
+		err = errors.New("the mask decoder must return iou_scores and pred_masks outputs for the same masks")
+	}
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return scores, masks, maskHeight, maskWidth, err
+}
+
+// newTensorOrNil creates a tensor, returning a nil interface on error so that it is not destroyed.
+func newTensorOrNil[T ort.TensorData](shape ort.Shape, data []T) (ort.ArbitraryTensor, error) {
+	tensor, err := ort.NewTensor(shape, data)
+	if err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// postprocess resizes the low resolution masks to the padded image size, removes the padding, resizes them to the
+// original image size and binarizes them, as SamImageProcessor.post_process_masks.
+func (p *MaskGenerationPipeline) postprocess(embedding *ImageEmbedding, scores []float32, logits []float32, maskHeight int, maskWidth int) []Mask {
+	masks := make([]Mask, len(scores))
+	size := maskHeight * maskWidth
+	for i, score := range scores {
+		padded := resizeBilinear(logits[i*size:(i+1)*size], maskHeight, maskWidth, p.PadHeight, p.PadWidth)
+		cropped := make([]float32, embedding.resizedHeight*embedding.resizedWidth)
+		for y := 0; y < embedding.resizedHeight; y++ {
+			copy(cropped[y*embedding.resizedWidth:(y+1)*embedding.resizedWidth], padded[y*p.PadWidth:])
+		}
+		resized := resizeBilinear(cropped, embedding.resizedHeight, embedding.resizedWidth, embedding.height, embedding.width)
+		binary := make([]int, len(resized))
+		for j, v := range resized {
+			if v > 0 {
+				binary[j] = 1
+			}
+		}
+		masks[i] = Mask{Score: score, Height: embedding.height, Width: embedding.width, RLE: runLengthEncode(binary, 1)}
+	}
+	sort.SliceStable(masks, func(a, b int) bool {
+		return masks[a].Score > masks[b].Score
+	})
+	if !p.MultimaskOutput && len(masks) > 1 {
+		masks = masks[:1]
+	}
+	return masks
+}
+
+// resizeBilinear resizes a [height, width] matrix with bilinear interpolation (align_corners=False).
+func resizeBilinear(values []float32, height int, width int, outHeight int, outWidth int) []float32 {
+	rows, columns := bilinearSamples(height, outHeight), bilinearSamples(width, outWidth)
+	resized := make([]float32, outHeight*outWidth)
+	for y, row := range rows {
+		for x, column := range columns {
+			top := values[row.low*width+column.low]*(1-column.weight) + values[row.low*width+column.high]*column.weight
+			bottom := values[row.high*width+column.low]*(1-column.weight) + values[row.high*width+column.high]*column.weight
+			resized[y*outWidth+x] = top*(1-row.weight) + bottom*row.weight
+		}
+	}
+	return resized
+}
+
+// Run the pipeline on a path to an image file (jpeg, png or gif) followed by the prompts, as json encoded MaskPrompt
+// values, e.g. {"Points": [[450, 600]], "Labels": [1]}.
+func (p *MaskGenerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	if len(inputs) < 2 {
+		return nil, errors.New("mask generation requires an image path followed by at least one prompt")
+	}
+	images, err := readImages(inputs[:1])
+	if err != nil {
+		return nil, err
+	}
+	prompts := make([]MaskPrompt, len(inputs)-1)
+	for i, input := range inputs[1:] {
+		if err = jsoniter.Unmarshal([]byte(input), &prompts[i]); err != nil {
+			return nil, fmt.Errorf("could not read prompt %d: %w", i, err)
+		}
+	}
+	return p.RunPipeline(images[0], prompts)
+}
+
+// RunPipeline encodes the image once and decodes the masks of each prompt.
+func (p *MaskGenerationPipeline) RunPipeline(img image.Image, prompts []MaskPrompt) (*MaskGenerationOutput, error) {
+	if len(prompts) == 0 {
+		return &MaskGenerationOutput{}, nil
+	}
+	embedding, err := p.EncodeImage(img)
+	if err != nil {
+		return nil, err
+	}
+	return p.DecodePrompts(embedding, prompts)
+}
@@ -0,0 +1,135 @@
+package pipelines
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MemoryBudget bounds the device memory a single run of the model may need, so that a batch too large for a GPU is
+// split before it runs rather than failing with an out of memory error of the execution provider, which can leave the
+// onnxruntime session unusable. The memory of a run is estimated from the shape of the batch and the dimensions of the
+// model read from its config.json: the input and output tensors, and the hidden states, attention scores and feed
+// forward activations of one layer, since the layers run one after the other. The estimate is approximate: the budget
+// should be the memory available to the activations, e.g. the gpu_mem_limit of the CUDA provider less the size of the
+// model weights.
+type MemoryBudget struct {
+	Bytes int64
+	// SplitBatches is the number of batches split to fit in the budget.
+	SplitBatches     uint64
+	hiddenSize       int64
+	heads            int64
+	intermediateSize int64
+}
+
+// WithMemoryBudget splits the batches of the pipeline whose estimated memory is over bytes into smaller batches run
+// one after the other, see MemoryBudget. A batch is not split if a single input does not fit: the run fails before
+// the model is called. Batches carrying the state of a stateful model are never split.
+// Example: pipelines.WithMemoryBudget[*pipelines.FeatureExtractionPipeline](2 << 30).
+func WithMemoryBudget[T Pipeline](bytes int64) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().MemoryBudget = &MemoryBudget{Bytes: bytes}
+		}
+	}
+}
+
+// loadDimensions reads the hidden size, number of attention heads and intermediate size of the model from its
+// config.json, with the defaults of BERT base for the ones missing.
+func (b *MemoryBudget) loadDimensions(modelPath string) error {
+	modelConfig, err := loadModelConfig(modelPath)
+	if err != nil {
+		return err
+	}
+	number := func(keys ...string) int64 {
+		for _, key := range keys {
+			if v, ok := modelConfig[key].(float64); ok && v > 0 {
+				return int64(v)
+			}
+		}
+		return 0
+	}
+	b.hiddenSize = number("hidden_size", "d_model", "n_embd", "dim")
+	if b.hiddenSize == 0 {
+		b.hiddenSize = 768
+	}
+	b.heads = number("num_attention_heads", "n_head", "num_heads", "n_heads")
+	if b.heads == 0 {
+		b.heads = 12
+	}
+	b.intermediateSize = number("intermediate_size", "d_ff", "n_inner", "hidden_dim")
+	if b.intermediateSize == 0 {
+		b.intermediateSize = 4 * b.hiddenSize
+	}
+	return nil
+}
+
+// EstimateMemory returns the estimated memory in bytes of a run of the model on batchSize inputs padded to
+// maxSequence tokens, see MemoryBudget. It is zero for pipelines without a memory budget.
+func (p *BasePipeline) EstimateMemory(batchSize int, maxSequence int) int64 {
+	b := p.MemoryBudget
+	if b == nil {
+		return 0
+	}
+	sequence := int64(maxSequence)
+	// the three int64 input tensors
+	inputs := 3 * 8 * sequence
+	// float32 hidden states of a layer (input, query, key, value, context and output), attention scores and
+	// probabilities of all the heads, feed forward activations and model output
+	activations := 4 * (6*sequence*b.hiddenSize + 2*b.heads*sequence*sequence + sequence*b.intermediateSize + sequence*int64(p.OutputDim))
+	return int64(batchSize) * (inputs + activations)
+}
+
+// forwardWithinBudget runs forward on the batch, split into consecutive batches padded to the same sequence length
+// that fit in the memory budget of the pipeline, if any. The output tensors of the split batches are concatenated
+// in input order.
+func (p *BasePipeline) forwardWithinBudget(batch PipelineBatch, forward func(PipelineBatch) (PipelineBatch, error)) (PipelineBatch, error) {
+	if p.MemoryBudget == nil || len(batch.Input) == 0 {
+		return forward(batch)
+	}
+	perInput := p.EstimateMemory(1, batch.MaxSequence)
+	if perInput > p.MemoryBudget.Bytes {
+		return batch, fmt.Errorf("an input of %d tokens needs an estimated %d bytes, over the memory budget of %d bytes", batch.MaxSequence, perInput, p.MemoryBudget.Bytes)
+	}
+	size := int(p.MemoryBudget.Bytes / perInput)
+	if size >= len(batch.Input) {
+		return forward(batch)
+	}
+	if batch.State != nil {
+		return batch, fmt.Errorf("a stateful batch of %d inputs needs an estimated %d bytes, over the memory budget of %d bytes", len(batch.Input), p.EstimateMemory(len(batch.Input), batch.MaxSequence), p.MemoryBudget.Bytes)
+	}
+	atomic.AddUint64(&p.MemoryBudget.SplitBatches, 1)
+
+	var outputTensor []float32
+	for start := 0; start < len(batch.Input); start += size {
+		end := start + size
+		if end > len(batch.Input) {
+			end = len(batch.Input)
+		}
+		part, err := forward(batchPart(batch, start, end))
+		if err != nil {
+			return batch, err
+		}
+		outputTensor = append(outputTensor, part.OutputTensor...)
+	}
+	batch.OutputTensor = outputTensor
+	return batch, nil
+}
+
+// batchPart returns the inputs from start to end of a batch, with the same sequence length.
+func batchPart(batch PipelineBatch, start, end int) PipelineBatch {
+	part := batch
+	part.Input = batch.Input[start:end]
+	sequence := batch.MaxSequence
+	part.IdsTensor = batch.IdsTensor[start*sequence : end*sequence]
+	part.TypeIdsTensor = batch.TypeIdsTensor[start*sequence : end*sequence]
+	part.AttentionMasksTensor = batch.AttentionMasksTensor[start*sequence : end*sequence]
+	if len(batch.BboxTensor) > 0 {
+		part.BboxTensor = batch.BboxTensor[start*sequence*4 : end*sequence*4]
+	}
+	if len(batch.PixelValues) > 0 {
+		image := 3 * batch.ImageHeight * batch.ImageWidth
+		part.PixelValues = batch.PixelValues[start*image : end*image]
+	}
+	part.OutputTensor = nil
+	return part
+}
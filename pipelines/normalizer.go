@@ -0,0 +1,144 @@
+package pipelines
+
+import (
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/exp/slices"
+)
+
+// NormalizerOverrides overrides the text normalization declared in tokenizer.json, for models trained with a
+// preprocessing that differs from the shipped tokenizer configuration.
+type NormalizerOverrides struct {
+	Lowercase       bool
+	LowercaseSet    bool
+	StripAccents    bool
+	StripAccentsSet bool
+	// UnicodeForm is one of NFC, NFD, NFKC or NFKD, or empty to keep the tokenizer default.
+	UnicodeForm string
+}
+
+func (o NormalizerOverrides) isSet() bool {
+	return o.LowercaseSet || o.StripAccentsSet || o.UnicodeForm != ""
+}
+
+// WithLowercase forces lowercasing of the inputs on or off, overriding the tokenizer.json normalizer.
+// Example: pipelines.WithLowercase[*pipelines.FeatureExtractionPipeline](false).
+func WithLowercase[T Pipeline](enable bool) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().NormalizerOverrides.Lowercase = enable
+			p.getBase().NormalizerOverrides.LowercaseSet = true
+		}
+	}
+}
+
+// WithStripAccents forces the removal of accents from the inputs on or off, overriding the tokenizer.json normalizer.
+func WithStripAccents[T Pipeline](enable bool) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().NormalizerOverrides.StripAccents = enable
+			p.getBase().NormalizerOverrides.StripAccentsSet = true
+		}
+	}
+}
+
+// WithUnicodeNormalization applies the given unicode normalization form (NFC, NFD, NFKC or NFKD) to the inputs
+// before the rest of the tokenizer normalization, replacing any unicode normalization declared in tokenizer.json.
+func WithUnicodeNormalization[T Pipeline](form string) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().NormalizerOverrides.UnicodeForm = form
+		}
+	}
+}
+
+var unicodeForms = []string{"NFC", "NFD", "NFKC", "NFKD"}
+
+// overrideNormalizer rewrites the normalizer of tokenizer.json according to the overrides.
+func overrideNormalizer(tokenizerBytes []byte, overrides NormalizerOverrides) ([]byte, error) {
+	if overrides.UnicodeForm != "" && !slices.Contains(unicodeForms, overrides.UnicodeForm) {
+		return nil, fmt.Errorf("unicode normalization form %s is not supported, use one of %v", overrides.UnicodeForm, unicodeForms)
+	}
+
+	var tokenizerData map[string]jsoniter.RawMessage
+	if err := jsoniter.Unmarshal(tokenizerBytes, &tokenizerData); err != nil {
+		return nil, err
+	}
+	var normalizer map[string]any
+	if raw, ok := tokenizerData["normalizer"]; ok {
+		if err := jsoniter.Unmarshal(raw, &normalizer); err != nil {
+			return nil, err
+		}
+	}
+
+	// flatten the normalizer into a list of normalizers
+	var normalizers []map[string]any
+	switch {
+	case normalizer == nil:
+	case normalizer["type"] == "Sequence":
+		sequence, _ := normalizer["normalizers"].([]any)
+		for _, n := range sequence {
+			if m, ok := n.(map[string]any); ok {
+				normalizers = append(normalizers, m)
+			}
+		}
+	default:
+		normalizers = []map[string]any{normalizer}
+	}
+
+	hasLowercase := false
+	hasStripAccents := false
+	var result []any
+	if overrides.UnicodeForm != "" {
+		result = append(result, map[string]any{"type": overrides.UnicodeForm})
+	}
+	for _, n := range normalizers {
+		normalizerType, _ := n["type"].(string)
+		switch {
+		case normalizerType == "BertNormalizer":
+			// the bert normalizer has its own lowercase and strip_accents settings
+			if overrides.LowercaseSet {
+				n["lowercase"] = overrides.Lowercase
+			}
+			if overrides.StripAccentsSet {
+				n["strip_accents"] = overrides.StripAccents
+			}
+			lowercase, _ := n["lowercase"].(bool)
+			hasLowercase = hasLowercase || lowercase
+			stripAccents, isBool := n["strip_accents"].(bool)
+			// strip_accents defaults to the lowercase setting when it is null
+			hasStripAccents = hasStripAccents || stripAccents || (!isBool && lowercase)
+		case normalizerType == "Lowercase":
+			if overrides.LowercaseSet && !overrides.Lowercase {
+				continue
+			}
+			hasLowercase = true
+		case normalizerType == "StripAccents":
+			if overrides.StripAccentsSet && !overrides.StripAccents {
+				continue
+			}
+			hasStripAccents = true
+		case slices.Contains(unicodeForms, normalizerType):
+			if overrides.UnicodeForm != "" {
+				continue
+			}
+		}
+		result = append(result, n)
+	}
+	if overrides.LowercaseSet && overrides.Lowercase && !hasLowercase {
+		result = append(result, map[string]any{"type": "Lowercase"})
+	}
+	if overrides.StripAccentsSet && overrides.StripAccents && !hasStripAccents {
+		// accents can only be stripped from decomposed characters
+		result = append(result, map[string]any{"type": "NFD"}, map[string]any{"type": "StripAccents"})
+	}
+
+	var err error
+	if len(result) == 0 {
+		tokenizerData["normalizer"] = jsoniter.RawMessage("null")
+	} else if tokenizerData["normalizer"], err = jsoniter.Marshal(map[string]any{"type": "Sequence", "normalizers": result}); err != nil {
+		return nil, err
+	}
+	return jsoniter.Marshal(tokenizerData)
+}
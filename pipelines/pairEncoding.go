@@ -0,0 +1,215 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/knights-analytics/tokenizers"
+)
+
+// The tokenizer bindings only encode single sequences, so sequence pairs (e.g. a query and a document for cross
+// encoders) are encoded one sequence at a time and joined with the pair template of the tokenizer post processor.
+
+// pairTemplatePiece is either a special token or one of the two sequences of a pair.
+type pairTemplatePiece struct {
+	sequence int // 0 or 1 for the first and second sequence, -1 for special tokens
+	ids      []uint32
+	tokens   []string
+	typeId   uint32
+}
+
+// pairTemplate is the layout of an encoded pair, e.g. [CLS] A [SEP] B [SEP] for bert models.
+type pairTemplate struct {
+	pieces    []pairTemplatePiece
+	maxLength int
+}
+
+type templateSpecialToken struct {
+	Id     string   `json:"id"`
+	Ids    []uint32 `json:"ids"`
+	Tokens []string `json:"tokens"`
+}
+
+type postProcessorJSON struct {
+	Type          string                          `json:"type"`
+	Pair          []map[string]templateItemJSON   `json:"pair"`
+	SpecialTokens map[string]templateSpecialToken `json:"special_tokens"`
+	Sep           []any                           `json:"sep"`
+	Cls           []any                           `json:"cls"`
+	Processors    []jsoniter.RawMessage           `json:"processors"`
+}
+
+type templateItemJSON struct {
+	Id     string `json:"id"`
+	TypeId uint32 `json:"type_id"`
+}
+
+// newPairTemplate reads the pair template from the post_processor of tokenizer.json. Tokenizers without a post
+// processor join the two sequences without special tokens.
+func newPairTemplate(tokenizerBytes []byte) (*pairTemplate, error) {
+	var tokenizerData struct {
+		PostProcessor jsoniter.RawMessage `json:"post_processor"`
+		Truncation    *struct {
+			MaxLength int `json:"max_length"`
+		} `json:"truncation"`
+	}
+	if err := jsoniter.Unmarshal(tokenizerBytes, &tokenizerData); err != nil {
+		return nil, err
+	}
+	template, err := parsePostProcessor(tokenizerData.PostProcessor)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		template = &pairTemplate{pieces: []pairTemplatePiece{{sequence: 0}, {sequence: 1, typeId: 1}}}
+	}
+	if tokenizerData.Truncation != nil {
+		template.maxLength = tokenizerData.Truncation.MaxLength
+	}
+	return template, nil
+}
+
+// parsePostProcessor returns the pair template of a post processor, or nil if the processor adds no special tokens.
+func parsePostProcessor(raw jsoniter.RawMessage) (*pairTemplate, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var processor postProcessorJSON
+	if err := jsoniter.Unmarshal(raw, &processor); err != nil {
+		return nil, err
+	}
+
+	special := func(token []any) (pairTemplatePiece, error) {
+		if len(token) != 2 {
+			return pairTemplatePiece{}, fmt.Errorf("invalid special token %v in %s post processor", token, processor.Type)
+		}
+		content, okContent := token[0].(string)
+		id, okId := token[1].(float64)
+		if !okContent || !okId {
+			return pairTemplatePiece{}, fmt.Errorf("invalid special token %v in %s post processor", token, processor.Type)
+		}
+		return pairTemplatePiece{sequence: -1, ids: []uint32{uint32(id)}, tokens: []string{content}}, nil
+	}
+
+	switch processor.Type {
+	case "TemplateProcessing":
+		template := &pairTemplate{}
+		for _, item := range processor.Pair {
+			if sequence, ok := item["Sequence"]; ok {
+				piece := pairTemplatePiece{sequence: 0, typeId: sequence.TypeId}
+				if sequence.Id == "B" {
+					piece.sequence = 1
+				}
+				template.pieces = append(template.pieces, piece)
+			} else if specialToken, ok := item["SpecialToken"]; ok {
+				token, found := processor.SpecialTokens[specialToken.Id]
+				if !found {
+					return nil, fmt.Errorf("special token %s of the pair template is not defined", specialToken.Id)
+				}
+				template.pieces = append(template.pieces, pairTemplatePiece{sequence: -1, ids: token.Ids, tokens: token.Tokens, typeId: specialToken.TypeId})
+			}
+		}
+		return template, nil
+	case "BertProcessing", "RobertaProcessing":
+		cls, err := special(processor.Cls)
+		if err != nil {
+			return nil, err
+		}
+		sep, err := special(processor.Sep)
+		if err != nil {
+			return nil, err
+		}
+		if processor.Type == "BertProcessing" {
+			// [CLS] A [SEP] B [SEP]
+			secondSep := sep
+			secondSep.typeId = 1
+			return &pairTemplate{pieces: []pairTemplatePiece{cls, {sequence: 0}, sep, {sequence: 1, typeId: 1}, secondSep}}, nil
+		}
+		// <s> A </s></s> B </s>
+		return &pairTemplate{pieces: []pairTemplatePiece{cls, {sequence: 0}, sep, sep, {sequence: 1}, sep}}, nil
+	case "Sequence":
+		for _, p := range processor.Processors {
+			template, err := parsePostProcessor(p)
+			if err != nil || template != nil {
+				return template, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// encodePair tokenizes a pair of sequences as the tokenizer would with its pair template. If the tokenizer
+// truncates its inputs, the longest sequence is truncated first until the pair fits.
+func (p *BasePipeline) encodePair(first string, second string) (TokenizedInput, error) {
+	inputs, err := p.encodePairs(first, []string{second})
+	if err != nil {
+		return TokenizedInput{}, err
+	}
+	return inputs[0], nil
+}
+
+// encodePairs tokenizes the pairs of a sequence with each of the second sequences, e.g. a query and the documents
+// to rerank. The first sequence is tokenized once for all the pairs.
+func (p *BasePipeline) encodePairs(first string, seconds []string) ([]TokenizedInput, error) {
+	if p.pairTemplate == nil {
+		return nil, errors.New("the tokenizer has no template to encode sequence pairs")
+	}
+	options := []tokenizers.EncodeOption{tokenizers.WithReturnTokens(), tokenizers.WithReturnTypeIDs()}
+	firstEncoding := p.Tokenizer.EncodeWithOptions(first, false, options...)
+
+	inputs := make([]TokenizedInput, len(seconds))
+	for i, second := range seconds {
+		// truncation reslices the encodings, the encoding of the first sequence is not modified
+		sequences := [2]tokenizers.Encoding{firstEncoding, p.Tokenizer.EncodeWithOptions(second, false, options...)}
+		if p.pairTemplate.maxLength > 0 {
+			specialLength := p.pairTemplate.specialLength()
+			for len(sequences[0].IDs)+len(sequences[1].IDs)+specialLength > p.pairTemplate.maxLength {
+				longest := 0
+				if len(sequences[1].IDs) > len(sequences[0].IDs) {
+					longest = 1
+				}
+				if len(sequences[longest].IDs) == 0 {
+					break
+				}
+				last := len(sequences[longest].IDs) - 1
+				sequences[longest].IDs = sequences[longest].IDs[:last]
+				sequences[longest].Tokens = sequences[longest].Tokens[:last]
+			}
+		}
+		inputs[i], _ = p.pairTemplate.join(first, sequences)
+	}
+	return inputs, nil
+}
+
+// specialLength is the number of special tokens the template adds to a pair.
+func (t *pairTemplate) specialLength() int {
+	length := 0
+	for _, piece := range t.pieces {
+		length += len(piece.ids)
+	}
+	return length
+}
+
+// join lays out two encoded sequences with the template. It also returns the sequence of each token: 0 or 1, or -1
+// for the special tokens.
+func (t *pairTemplate) join(raw string, sequences [2]tokenizers.Encoding) (TokenizedInput, []int) {
+	input := TokenizedInput{Raw: raw}
+	var sequenceIds []int
+	for _, piece := range t.pieces {
+		ids, tokens, special := piece.ids, piece.tokens, uint32(1)
+		if piece.sequence >= 0 {
+			ids, tokens, special = sequences[piece.sequence].IDs, sequences[piece.sequence].Tokens, 0
+		}
+		input.TokenIds = append(input.TokenIds, ids...)
+		input.Tokens = append(input.Tokens, tokens...)
+		for range ids {
+			input.TypeIds = append(input.TypeIds, piece.typeId)
+			input.AttentionMask = append(input.AttentionMask, 1)
+			input.SpecialTokensMask = append(input.SpecialTokensMask, special)
+			sequenceIds = append(sequenceIds, piece.sequence)
+		}
+	}
+	input.MaxAttentionIndex = len(input.TokenIds) - 1
+	return input, sequenceIds
+}
@@ -10,29 +10,58 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/knights-analytics/tokenizers"
 	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/exp/slices"
 
 	util "github.com/knights-analytics/hugot/utils"
 )
 
 // BasePipeline is a basic pipeline type used for struct composition in the other pipelines.
 type BasePipeline struct {
-	ModelPath        string
-	OnnxFilename     string
-	PipelineName     string
-	OrtSession       *ort.DynamicAdvancedSession
-	OrtOptions       *ort.SessionOptions
-	Tokenizer        *tokenizers.Tokenizer
-	TokenizerOptions []tokenizers.EncodeOption
-	InputsMeta       []ort.InputOutputInfo
-	OutputsMeta      []ort.InputOutputInfo
-	hasTokenTypeIds  bool
-	hasAttentionMask bool
+	ModelPath           string
+	OnnxFilename        string
+	PipelineName        string
+	OrtSession          *ort.DynamicAdvancedSession
+	OrtOptions          *ort.SessionOptions
+	Tokenizer           *tokenizers.Tokenizer
+	TokenizerOptions    []tokenizers.EncodeOption
+	Vocabulary          *Vocabulary
+	AddedTokens         []string
+	NormalizerOverrides NormalizerOverrides
+	InputsMeta          []ort.InputOutputInfo
+	OutputsMeta         []ort.InputOutputInfo
+	hasTokenTypeIds     bool
+	hasAttentionMask    bool
+	hasBbox             bool
+	pairTemplate        *pairTemplate
+	// specialSuffix is the number of special tokens the tokenizer appends to a sequence, e.g. 1 for [SEP].
+	specialSuffix int
+	// untruncated loads the tokenizer without its truncation, for the pipelines splitting long inputs themselves.
+	untruncated      bool
 	OutputDim        int
 	TokenizerTimings *Timings
 	PipelineTimings  *Timings
+	TokenUsage       Usage
+	// MaxInputTokens truncates the encoded inputs to a token budget lower than the maximum length of the model, if
+	// greater than zero.
+	MaxInputTokens int
+	// ChunkSize is the length in tokens of the chunks of the inputs split by the pipeline, special tokens included,
+	// if greater than zero and lower than the maximum length of the model.
+	ChunkSize int
+	// Throttle limits the share of the time the pipeline runs its model, if set.
+	Throttle *Throttle
+	// MemoryBudget splits the batches estimated to need more memory than the budget, if set.
+	MemoryBudget *MemoryBudget
+	// StateTensors maps the state inputs of a stateful model to the outputs they are fed back from, see StateHandle.
+	// The states are detected from the input and output names if nil.
+	StateTensors map[string]string
+	// batchSizes is the histogram of the batch sizes of the model runs, see GetStatistics.
+	batchSizes [batchSizeBuckets]uint64
 }
 
 type PipelineBatchOutput interface {
@@ -49,6 +78,74 @@ type Pipeline interface {
 
 type PipelineOption[T Pipeline] func(eo T)
 
+// basePipeline is implemented by all the pipelines embedding BasePipeline, so that options common to all
+// pipelines can be written once.
+type basePipeline interface {
+	getBase() *BasePipeline
+}
+
+func (p *BasePipeline) getBase() *BasePipeline {
+	return p
+}
+
+// WithAddedTokens adds custom tokens (e.g. domain terms) to the tokenizer vocabulary when the pipeline is
+// created, so that they are never split into subwords. Tokens already in the vocabulary are left as they are.
+// The model embedding matrix must cover the ids of the new tokens, i.e. the model must have been fine-tuned with
+// the extended tokenizer (its config.json vocab_size must include them), otherwise pipeline creation fails.
+// Example: pipelines.WithAddedTokens[*pipelines.TokenClassificationPipeline]([]string{"hugot"}).
+func WithAddedTokens[T Pipeline](tokens []string) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().AddedTokens = tokens
+		}
+	}
+}
+
+// WithMaxInputTokens truncates the inputs to at most maxTokens tokens, special tokens included, e.g. to bound the
+// latency of a pipeline below the maximum length of its model. The truncation is reported in the output Diagnostics.
+// It applies to the pipelines tokenizing single text inputs.
+// Example: pipelines.WithMaxInputTokens[*pipelines.FeatureExtractionPipeline](128).
+func WithMaxInputTokens[T Pipeline](maxTokens int) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().MaxInputTokens = maxTokens
+		}
+	}
+}
+
+// WithChunkSize splits long inputs into chunks of at most chunkSize tokens, special tokens included, rather than of
+// the maximum length of the model, e.g. to keep each chunk on a single topic. It applies to the pipelines splitting
+// long inputs: feature extraction and text classification with chunking, token classification with a stride. Chunk
+// sizes greater than the maximum length of the model are capped to it.
+// Example: pipelines.WithChunkSize[*pipelines.FeatureExtractionPipeline](256).
+func WithChunkSize[T Pipeline](chunkSize int) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().ChunkSize = chunkSize
+		}
+	}
+}
+
+// labelMappingPipeline is implemented by the pipelines returning labels that can be remapped.
+type labelMappingPipeline interface {
+	setLabelMapping(mapping map[string]string)
+}
+
+// WithLabelMapping maps the labels of the model to the labels of the application taxonomy in the pipeline
+// outputs, so that application code does not depend on model-specific label strings. Several model labels can be
+// mapped to the same label, their classification scores are then merged (summed for softmax scores, the maximum
+// for sigmoid scores). Labels without a mapping are returned unchanged. Supported by the text and token
+// classification pipelines, where token classification labels are mapped after aggregation (e.g. PER rather than
+// B-PER with simple aggregation). The label filters of both pipelines, e.g. thresholds, apply to the mapped labels.
+// Example: pipelines.WithLabelMapping[*pipelines.TextClassificationPipeline](map[string]string{"LABEL_0": "negative"}).
+func WithLabelMapping[T Pipeline](mapping map[string]string) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(labelMappingPipeline); ok {
+			p.setLabelMapping(mapping)
+		}
+	}
+}
+
 type PipelineConfig[T Pipeline] struct {
 	ModelPath    string
 	Name         string
@@ -61,6 +158,155 @@ type Timings struct {
 	TotalNS  uint64
 }
 
+// Usage counts the tokens processed by pipeline runs, so that usage and cost reporting can be built on top of
+// pipelines. InputTokens excludes padding; GeneratedTokens is only counted by generation pipelines.
+// Pipeline outputs embed the Usage of their run.
+type Usage struct {
+	InputTokens     uint64
+	GeneratedTokens uint64
+}
+
+// GetUsage returns the token usage of a pipeline output.
+func (u Usage) GetUsage() Usage {
+	return u
+}
+
+// Add returns the sum of two usages.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{InputTokens: u.InputTokens + other.InputTokens, GeneratedTokens: u.GeneratedTokens + other.GeneratedTokens}
+}
+
+// usageOf returns the token usage of a pipeline output, or zero if the output does not report it.
+func usageOf(output any) Usage {
+	if u, ok := output.(interface{ GetUsage() Usage }); ok {
+		return u.GetUsage()
+	}
+	return Usage{}
+}
+
+// Warning is a non-fatal issue met while processing an input (e.g. a truncated input or a fallback path taken), so
+// that silent data quality issues are visible to callers. Input is the index of the input in the batch of the run.
+type Warning struct {
+	Input   int
+	Type    string
+	Message string
+}
+
+// Warning types.
+const (
+	WarningTruncated    = "TRUNCATED"
+	WarningUnknownLabel = "UNKNOWN_LABEL"
+	WarningFallback     = "FALLBACK"
+)
+
+// Truncation reports an input cut to the maximum length of the model or to the token budget of the pipeline:
+// Tokens is the number of tokens kept and TruncatedTokens the number of tokens dropped. Tokens dropped by the
+// tokenizer are counted by encoding the dropped text on its own, so their count can differ by a token or two from
+// the encoding of the full input.
+type Truncation struct {
+	Input           int
+	Tokens          int
+	TruncatedTokens int
+}
+
+// Diagnostics holds the warnings and truncations of a pipeline run. Pipeline outputs that can report warnings embed
+// the Diagnostics of their run.
+type Diagnostics struct {
+	Warnings    []Warning    `json:",omitempty"`
+	Truncations []Truncation `json:",omitempty"`
+}
+
+// GetWarnings returns the warnings of a pipeline output.
+func (d Diagnostics) GetWarnings() []Warning {
+	return d.Warnings
+}
+
+// GetTruncations returns the truncated inputs of a pipeline output.
+func (d Diagnostics) GetTruncations() []Truncation {
+	return d.Truncations
+}
+
+// TruncatedTokens returns the number of tokens dropped from an input, zero if it was not truncated.
+func (d Diagnostics) TruncatedTokens(input int) int {
+	for _, truncation := range d.Truncations {
+		if truncation.Input == input {
+			return truncation.TruncatedTokens
+		}
+	}
+	return 0
+}
+
+// truncationsOf returns the truncations of a pipeline output, with their input indices mapped through positions as
+// in warningsOf, or nil if the output does not report truncations.
+func truncationsOf(output any, positions []int) []Truncation {
+	d, ok := output.(interface{ GetTruncations() []Truncation })
+	if !ok {
+		return nil
+	}
+	var truncations []Truncation
+	for _, truncation := range d.GetTruncations() {
+		if positions != nil && truncation.Input >= 0 && truncation.Input < len(positions) {
+			truncation.Input = positions[truncation.Input]
+		}
+		truncations = append(truncations, truncation)
+	}
+	return truncations
+}
+
+// warningsOf returns the warnings of a pipeline output, with their input indices mapped through positions (the
+// index in the caller batch of each input of the output), or nil if the output does not report warnings.
+func warningsOf(output any, positions []int) []Warning {
+	d, ok := output.(interface{ GetWarnings() []Warning })
+	if !ok {
+		return nil
+	}
+	var warnings []Warning
+	for _, warning := range d.GetWarnings() {
+		if positions != nil && warning.Input >= 0 && warning.Input < len(positions) {
+			warning.Input = positions[warning.Input]
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// batchDiagnostics returns the warnings and truncations raised while preprocessing a batch.
+func batchDiagnostics(batch PipelineBatch) Diagnostics {
+	return Diagnostics{Warnings: batch.Warnings, Truncations: batch.Truncations}
+}
+
+// batchUsage counts the input tokens of a batch.
+func batchUsage(batch PipelineBatch) Usage {
+	var usage Usage
+	for _, input := range batch.Input {
+		if len(input.AttentionMask) == 0 {
+			usage.InputTokens += uint64(len(input.TokenIds))
+			continue
+		}
+		for _, mask := range input.AttentionMask {
+			if mask != 0 {
+				usage.InputTokens++
+			}
+		}
+	}
+	return usage
+}
+
+// recordUsage adds the usage of a run to the pipeline totals and returns it.
+func (p *BasePipeline) recordUsage(usage Usage) Usage {
+	atomic.AddUint64(&p.TokenUsage.InputTokens, usage.InputTokens)
+	atomic.AddUint64(&p.TokenUsage.GeneratedTokens, usage.GeneratedTokens)
+	return usage
+}
+
+// GetTotalUsage returns the tokens processed by all the runs of the pipeline.
+func (p *BasePipeline) GetTotalUsage() Usage {
+	return Usage{
+		InputTokens:     atomic.LoadUint64(&p.TokenUsage.InputTokens),
+		GeneratedTokens: atomic.LoadUint64(&p.TokenUsage.GeneratedTokens),
+	}
+}
+
 type TokenizedInput struct {
 	Raw               string
 	Tokens            []string
@@ -70,6 +316,11 @@ type TokenizedInput struct {
 	SpecialTokensMask []uint32
 	MaxAttentionIndex int
 	Offsets           []tokenizers.Offset
+	// WordIds is the index of the word of each token, -1 for special tokens, for the pipelines requesting the tokens,
+	// offsets and special tokens mask from the tokenizer. See wordIds.
+	WordIds []int
+	// Bboxes is the bounding box of each token on a page, on a 0-1000 scale, for layout aware models.
+	Bboxes [][4]int64
 }
 
 type PipelineBatch struct {
@@ -77,8 +328,55 @@ type PipelineBatch struct {
 	IdsTensor            []int64
 	TypeIdsTensor        []int64
 	AttentionMasksTensor []int64
-	MaxSequence          int
-	OutputTensor         []float32
+	BboxTensor           []int64
+	// Warnings are the warnings raised while preprocessing the batch.
+	Warnings []Warning
+	// Truncations are the inputs truncated while preprocessing the batch.
+	Truncations []Truncation
+	// PixelValues are the preprocessed [batch, 3, ImageHeight, ImageWidth] images of multi-modal models.
+	PixelValues  []float32
+	ImageHeight  int
+	ImageWidth   int
+	MaxSequence  int
+	OutputTensor []float32
+	// State carries the state tensors of a stateful model between batches. A stateful model starts from a zero
+	// state for each batch if nil.
+	State *StateHandle
+}
+
+// wordIds returns the index of the word each token belongs to, or -1 for special and padding tokens. The tokenizer
+// bindings do not expose the word ids of the encoding, so they are reconstructed: for WordPiece tokenizers a token
+// continues the previous word if it starts with the continuing subword prefix (##); for other tokenizers if it starts
+// where the previous token ends, unless one of the two is punctuation. Tokens, offsets and the special tokens mask
+// must have been returned by the tokenizer.
+func wordIds(input TokenizedInput, continuingSubwordPrefix string) []int {
+	ids := make([]int, len(input.TokenIds))
+	word := -1
+	previousEnd := -1
+	for j := range input.TokenIds {
+		if input.SpecialTokensMask[j] > 0 || (len(input.AttentionMask) > j && input.AttentionMask[j] == 0) {
+			ids[j] = -1
+			previousEnd = -1
+			continue
+		}
+		start, end := int(input.Offsets[j][0]), int(input.Offsets[j][1])
+		continues := false
+		if previousEnd >= 0 {
+			if continuingSubwordPrefix != "" {
+				continues = strings.HasPrefix(input.Tokens[j], continuingSubwordPrefix)
+			} else if start == previousEnd && start > 0 && start < len(input.Raw) {
+				before, _ := utf8.DecodeLastRuneInString(input.Raw[:start])
+				after, _ := utf8.DecodeRuneInString(input.Raw[start:])
+				continues = unicode.IsPunct(before) == unicode.IsPunct(after)
+			}
+		}
+		if !continues {
+			word++
+		}
+		ids[j] = word
+		previousEnd = end
+	}
+	return ids
 }
 
 func (p *BasePipeline) GetOutputDim() int {
@@ -97,6 +395,16 @@ func getOnnxFiles(path string) ([][]string, error) {
 	return onnxFiles, err
 }
 
+// hasInputOutput reports whether one of the model inputs or outputs has the given name.
+func hasInputOutput(infos []ort.InputOutputInfo, name string) bool {
+	for _, info := range infos {
+		if info.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Load the ort model supporting the pipeline.
 func (p *BasePipeline) loadModel() error {
 	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(p.ModelPath, "tokenizer.json"))
@@ -104,33 +412,139 @@ func (p *BasePipeline) loadModel() error {
 		return err
 	}
 
+	if len(p.AddedTokens) > 0 {
+		if tokenizerBytes, err = p.addTokens(tokenizerBytes); err != nil {
+			return err
+		}
+	}
+	if p.NormalizerOverrides.isSet() {
+		if tokenizerBytes, err = overrideNormalizer(tokenizerBytes, p.NormalizerOverrides); err != nil {
+			return err
+		}
+	}
+
+	// the pair template keeps the maximum length of the tokenizer truncation, even if it is removed
+	pairTemplate, err := newPairTemplate(tokenizerBytes)
+	if err != nil {
+		return fmt.Errorf("could not read the tokenizer post processor: %w", err)
+	}
+	if p.untruncated {
+		if tokenizerBytes, err = withoutTruncation(tokenizerBytes); err != nil {
+			return err
+		}
+	}
+
 	tk, err := tokenizers.FromBytes(tokenizerBytes)
 	if err != nil {
 		return err
 	}
 
+	vocabulary, err := loadVocabulary(p.ModelPath, tokenizerBytes)
+	if err != nil {
+		return errors.Join(err, tk.Close())
+	}
+
+	session, inputs, outputs, err := p.loadSession(p.OnnxFilename)
+	if err != nil {
+		return errors.Join(err, tk.Close())
+	}
+
+	p.InputsMeta = inputs
+	p.OutputsMeta = outputs
+	for _, meta := range inputs {
+		switch meta.Name {
+		case "token_type_ids":
+			p.hasTokenTypeIds = true
+		case "attention_mask":
+			p.hasAttentionMask = true
+		case "bbox":
+			p.hasBbox = true
+		}
+	}
+
+	p.OrtSession = session
+	p.Tokenizer = tk
+	p.Vocabulary = vocabulary
+	p.pairTemplate = pairTemplate
+	p.specialSuffix = appendedSpecialTokens(tk)
+	return nil
+}
+
+// appendedSpecialTokens counts the special tokens the tokenizer appends to a sequence, found by encoding a word with
+// and without them.
+func appendedSpecialTokens(tk *tokenizers.Tokenizer) int {
+	withSpecials := tk.EncodeWithOptions("a", true).IDs
+	withoutSpecials := tk.EncodeWithOptions("a", false).IDs
+	for i := 0; i+len(withoutSpecials) <= len(withSpecials); i++ {
+		if slices.Equal(withSpecials[i:i+len(withoutSpecials)], withoutSpecials) {
+			return len(withSpecials) - i - len(withoutSpecials)
+		}
+	}
+	return 0
+}
+
+// withoutTruncation removes the truncation settings of tokenizer.json.
+func withoutTruncation(tokenizerBytes []byte) ([]byte, error) {
+	var tokenizerData map[string]jsoniter.RawMessage
+	if err := jsoniter.Unmarshal(tokenizerBytes, &tokenizerData); err != nil {
+		return nil, err
+	}
+	tokenizerData["truncation"] = jsoniter.RawMessage("null")
+	return jsoniter.Marshal(tokenizerData)
+}
+
+// loadModelWithoutTokenizer loads the ort model of the pipelines that take no text input (e.g. vision models), whose
+// model folders have no tokenizer.
+func (p *BasePipeline) loadModelWithoutTokenizer() error {
+	session, inputs, outputs, err := p.loadSession(p.OnnxFilename)
+	if err != nil {
+		return err
+	}
+	p.InputsMeta = inputs
+	p.OutputsMeta = outputs
+	p.OrtSession = session
+	return nil
+}
+
+// loadSession creates an onnx session for a model file of the pipeline folder. The filename can be omitted if the
+// folder contains a single .onnx file.
+func (p *BasePipeline) loadSession(onnxFilename string) (*ort.DynamicAdvancedSession, []ort.InputOutputInfo, []ort.InputOutputInfo, error) {
+	if p.Throttle != nil && (p.Throttle.TargetUtilization <= 0 || p.Throttle.TargetUtilization > 1) {
+		return nil, nil, nil, fmt.Errorf("pipeline configuration invalid: target utilization must be greater than 0 and at most 1, got %f", p.Throttle.TargetUtilization)
+	}
+	if p.ChunkSize < 0 {
+		return nil, nil, nil, fmt.Errorf("pipeline configuration invalid: chunk size must not be negative, got %d", p.ChunkSize)
+	}
+	if p.MemoryBudget != nil {
+		if p.MemoryBudget.Bytes <= 0 {
+			return nil, nil, nil, fmt.Errorf("pipeline configuration invalid: memory budget must be greater than zero, got %d", p.MemoryBudget.Bytes)
+		}
+		if err := p.MemoryBudget.loadDimensions(p.ModelPath); err != nil {
+			return nil, nil, nil, err
+		}
+	}
 	// we look for .onnx files.
 	var modelOnnxFile string
 	onnxFiles, err := getOnnxFiles(p.ModelPath)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 	if len(onnxFiles) == 0 {
-		return fmt.Errorf("no .onnx file detected at %s. There should be exactly .onnx file", p.ModelPath)
+		return nil, nil, nil, fmt.Errorf("no .onnx file detected at %s. There should be exactly .onnx file", p.ModelPath)
 	}
 	if len(onnxFiles) > 1 {
-		if p.OnnxFilename == "" {
-			return fmt.Errorf("multiple .onnx file detected at %s and no OnnxFilename specified", p.ModelPath)
+		if onnxFilename == "" {
+			return nil, nil, nil, fmt.Errorf("multiple .onnx file detected at %s and no OnnxFilename specified", p.ModelPath)
 		}
 		modelNameFound := false
 		for i := range onnxFiles {
-			if onnxFiles[i][1] == p.OnnxFilename {
+			if onnxFiles[i][1] == onnxFilename {
 				modelNameFound = true
 				modelOnnxFile = util.PathJoinSafe(onnxFiles[i]...)
 			}
 		}
 		if !modelNameFound {
-			return fmt.Errorf("file %s not found at %s", p.OnnxFilename, p.ModelPath)
+			return nil, nil, nil, fmt.Errorf("file %s not found at %s", onnxFilename, p.ModelPath)
 		}
 	} else {
 		modelOnnxFile = util.PathJoinSafe(onnxFiles[0]...)
@@ -138,26 +552,17 @@ func (p *BasePipeline) loadModel() error {
 
 	onnxBytes, err := util.ReadFileBytes(modelOnnxFile)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	inputs, outputs, err := ort.GetInputOutputInfoWithONNXData(onnxBytes)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	p.InputsMeta = inputs
-	p.OutputsMeta = outputs
-
 	inputNames := make([]string, len(inputs))
 	for i, meta := range inputs {
 		inputNames[i] = meta.Name
-		switch meta.Name {
-		case "token_type_ids":
-			p.hasTokenTypeIds = true
-		case "attention_mask":
-			p.hasAttentionMask = true
-		}
 	}
 	outputNames := make([]string, len(outputs))
 	for i, meta := range outputs {
@@ -170,19 +575,48 @@ func (p *BasePipeline) loadModel() error {
 		p.OrtOptions,
 	)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
+	return session, inputs, outputs, nil
+}
 
-	p.OrtSession = session
-	p.Tokenizer = tk
-	return nil
+// addTokens adds the pipeline AddedTokens to the tokenizer, checking that the model can embed them.
+func (p *BasePipeline) addTokens(tokenizerBytes []byte) ([]byte, error) {
+	modifiedBytes, ids, err := addTokens(tokenizerBytes, p.AddedTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var modelConfig struct {
+		VocabSize uint32 `json:"vocab_size"`
+	}
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(p.ModelPath, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("config.json is required to check the vocabulary size of the model when adding tokens: %w", err)
+	}
+	if err = jsoniter.Unmarshal(configBytes, &modelConfig); err != nil {
+		return nil, err
+	}
+	var uncovered []string
+	for token, id := range ids {
+		if modelConfig.VocabSize > 0 && id >= modelConfig.VocabSize {
+			uncovered = append(uncovered, token)
+		}
+	}
+	if len(uncovered) > 0 {
+		slices.Sort(uncovered)
+		return nil, fmt.Errorf("added tokens %v are not covered by the model embedding matrix (vocab_size %d): the model must be fine-tuned with the extended tokenizer", uncovered, modelConfig.VocabSize)
+	}
+	return modifiedBytes, nil
 }
 
 func (p *BasePipeline) Destroy() error {
 	var finalErr error
-	errTokenizer := p.Tokenizer.Close()
-	if errTokenizer != nil {
-		finalErr = errTokenizer
+	if p.Tokenizer != nil {
+		errTokenizer := p.Tokenizer.Close()
+		if errTokenizer != nil {
+			finalErr = errTokenizer
+		}
 	}
 	ortError := p.OrtSession.Destroy()
 	if ortError != nil {
@@ -197,13 +631,44 @@ func (p *BasePipeline) Preprocess(inputs []string) PipelineBatch {
 
 	outputs := make([]TokenizedInput, len(inputs))
 	maxSequence := 0
+	var warnings []Warning
+	var truncations []Truncation
+
+	// the untruncated tokenizer cannot drop tokens, the pipeline splits long inputs itself. Otherwise the offsets
+	// and special tokens mask are requested to count the tokens dropped by the truncation of the tokenizer.
+	reportTruncation := !p.untruncated && p.pairTemplate != nil && p.pairTemplate.maxLength > 0
+	encodeOptions := p.TokenizerOptions
+	if reportTruncation {
+		encodeOptions = append(encodeOptions[:len(encodeOptions):len(encodeOptions)],
+			tokenizers.WithReturnOffsets(),
+			tokenizers.WithReturnSpecialTokensMask(),
+		)
+	}
+
 	for i, input := range inputs {
 
 		output := p.Tokenizer.EncodeWithOptions(input,
 			true,
-			p.TokenizerOptions...,
+			encodeOptions...,
 		)
 
+		truncatedTokens := 0
+		if reportTruncation && len(output.IDs) >= p.pairTemplate.maxLength {
+			truncatedTokens = p.droppedTokens(input, output)
+		}
+		if p.MaxInputTokens > 0 && len(output.IDs) > p.MaxInputTokens {
+			truncatedTokens += len(output.IDs) - p.MaxInputTokens
+			output = p.truncateEncoding(output, p.MaxInputTokens)
+		}
+		if truncatedTokens > 0 {
+			truncations = append(truncations, Truncation{Input: i, Tokens: len(output.IDs), TruncatedTokens: truncatedTokens})
+			warnings = append(warnings, Warning{
+				Input:   i,
+				Type:    WarningTruncated,
+				Message: fmt.Sprintf("input was truncated to %d tokens, %d tokens were dropped", len(output.IDs), truncatedTokens),
+			})
+		}
+
 		maxAttentionIndex := 0
 		for j, attentionMaskValue := range output.AttentionMask {
 			if attentionMaskValue != 0 {
@@ -221,6 +686,13 @@ func (p *BasePipeline) Preprocess(inputs []string) PipelineBatch {
 			SpecialTokensMask: output.SpecialTokensMask,
 			Offsets:           output.Offsets, // we need the offsets here for postprocessing later
 		}
+		if len(output.Tokens) == len(output.IDs) && len(output.Offsets) == len(output.IDs) && len(output.SpecialTokensMask) == len(output.IDs) {
+			prefix := ""
+			if p.Vocabulary != nil {
+				prefix = p.Vocabulary.ContinuingSubwordPrefix
+			}
+			outputs[i].WordIds = wordIds(outputs[i], prefix)
+		}
 		if maxAttentionIndex > maxSequence {
 			maxSequence = maxAttentionIndex
 		}
@@ -229,15 +701,186 @@ func (p *BasePipeline) Preprocess(inputs []string) PipelineBatch {
 	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
 	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
 	batch := p.convertInputToTensors(outputs, maxSequence+1)
+	batch.Warnings = warnings
+	batch.Truncations = truncations
 	return batch
 }
 
+// PreprocessTokenized builds the batch of inputs already tokenized with the tokenizer of the pipeline: the token ids
+// of each text, special tokens included. The attention masks cover all the ids and the special tokens are those of
+// the vocabulary. Inputs longer than the maximum length of the model are rejected, as they were not truncated by the
+// tokenizer, unless allowLong is set.
+func (p *BasePipeline) PreprocessTokenized(inputs [][]uint32, allowLong bool) (PipelineBatch, error) {
+	specialIds := map[uint32]bool{}
+	if p.Vocabulary != nil {
+		for _, id := range p.Vocabulary.SpecialTokens() {
+			specialIds[id] = true
+		}
+	}
+	outputs := make([]TokenizedInput, len(inputs))
+	maxSequence := 0
+	for i, ids := range inputs {
+		if len(ids) == 0 {
+			return PipelineBatch{}, fmt.Errorf("input %d has no token ids", i)
+		}
+		if !allowLong && len(ids) > p.modelLength() {
+			return PipelineBatch{}, fmt.Errorf("input %d has %d tokens, more than the maximum length %d of the model", i, len(ids), p.modelLength())
+		}
+		output := TokenizedInput{
+			TokenIds:          ids,
+			TypeIds:           make([]uint32, len(ids)),
+			AttentionMask:     make([]uint32, len(ids)),
+			SpecialTokensMask: make([]uint32, len(ids)),
+			MaxAttentionIndex: len(ids) - 1,
+		}
+		for j, id := range ids {
+			output.AttentionMask[j] = 1
+			if specialIds[id] {
+				output.SpecialTokensMask[j] = 1
+			}
+		}
+		outputs[i] = output
+		if len(ids) > maxSequence {
+			maxSequence = len(ids)
+		}
+	}
+	return p.convertInputToTensors(outputs, maxSequence), nil
+}
+
+// droppedTokens counts the tokens of the text dropped by the truncation of the tokenizer, zero if the input fits the
+// maximum length exactly. Only the text after the offsets of the truncated encoding is encoded again.
+func (p *BasePipeline) droppedTokens(input string, encoding tokenizers.Encoding) int {
+	if len(encoding.Offsets) != len(encoding.IDs) || len(encoding.SpecialTokensMask) != len(encoding.IDs) {
+		return 0
+	}
+	end := uint(0)
+	for j, offset := range encoding.Offsets {
+		if encoding.SpecialTokensMask[j] == 0 && offset[1] > end {
+			end = offset[1]
+		}
+	}
+	if int(end) >= len(input) {
+		return 0
+	}
+	return len(p.Tokenizer.EncodeWithOptions(input[end:], false).IDs)
+}
+
+// modelLength is the maximum length of the model in tokens, special tokens included.
+func (p *BasePipeline) modelLength() int {
+	if p.pairTemplate != nil && p.pairTemplate.maxLength > 0 {
+		return p.pairTemplate.maxLength
+	}
+	return 512
+}
+
+// windowLength is the length in tokens of the windows of the inputs split by the pipeline, special tokens included:
+// the maximum length of the model, or the chunk size of the pipeline if lower.
+func (p *BasePipeline) windowLength() int {
+	if p.ChunkSize > 0 && p.ChunkSize < p.modelLength() {
+		return p.ChunkSize
+	}
+	return p.modelLength()
+}
+
+// splitWindows splits an input into windows of at most the maximum length of the model, each with the special
+// tokens of the input, consecutive windows sharing stride tokens. It also returns the position of the first token of
+// each window in the input, less the leading special tokens.
+func (p *BasePipeline) splitWindows(input TokenizedInput, stride int) ([]TokenizedInput, []int) {
+	if len(input.TokenIds) <= p.windowLength() {
+		return []TokenizedInput{input}, []int{0}
+	}
+	prefix := 0
+	for prefix < len(input.SpecialTokensMask) && input.SpecialTokensMask[prefix] > 0 {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(input.SpecialTokensMask)-prefix && input.SpecialTokensMask[len(input.SpecialTokensMask)-1-suffix] > 0 {
+		suffix++
+	}
+	content := len(input.TokenIds) - prefix - suffix
+	size := p.windowLength() - prefix - suffix
+
+	var windows []TokenizedInput
+	var starts []int
+	for start := 0; ; start += size - stride {
+		end := start + size
+		if end > content {
+			end = content
+		}
+		window := TokenizedInput{
+			Raw:               input.Raw,
+			Tokens:            windowOf(input.Tokens, prefix, suffix, start, end),
+			TokenIds:          windowOf(input.TokenIds, prefix, suffix, start, end),
+			TypeIds:           windowOf(input.TypeIds, prefix, suffix, start, end),
+			AttentionMask:     windowOf(input.AttentionMask, prefix, suffix, start, end),
+			SpecialTokensMask: windowOf(input.SpecialTokensMask, prefix, suffix, start, end),
+			Offsets:           windowOf(input.Offsets, prefix, suffix, start, end),
+			WordIds:           windowOf(input.WordIds, prefix, suffix, start, end),
+		}
+		window.MaxAttentionIndex = len(window.TokenIds) - 1
+		windows = append(windows, window)
+		starts = append(starts, start)
+		if end == content {
+			return windows, starts
+		}
+	}
+}
+
+// windowOf returns the leading prefix and trailing suffix values of a token attribute around the values of the
+// content tokens from start to end, or nil if the attribute was not returned by the tokenizer.
+func windowOf[T any](values []T, prefix, suffix, start, end int) []T {
+	if len(values) == 0 {
+		return nil
+	}
+	window := make([]T, 0, prefix+end-start+suffix)
+	window = append(window, values[:prefix]...)
+	window = append(window, values[prefix+start:prefix+end]...)
+	return append(window, values[len(values)-suffix:]...)
+}
+
+// truncateEncoding cuts an encoding to maxTokens tokens, keeping the special tokens the tokenizer appends to a
+// sequence (e.g. [SEP]).
+func (p *BasePipeline) truncateEncoding(encoding tokenizers.Encoding, maxTokens int) tokenizers.Encoding {
+	suffix := p.specialSuffix
+	if suffix >= maxTokens {
+		suffix = 0
+	}
+	keep := maxTokens - suffix
+	length := len(encoding.IDs)
+	cut := func(n int) (int, int) {
+		if n != length {
+			// attribute not returned by the tokenizer
+			return 0, 0
+		}
+		return keep, length - suffix
+	}
+	if head, tail := cut(len(encoding.IDs)); head > 0 {
+		encoding.IDs = append(encoding.IDs[:head:head], encoding.IDs[tail:]...)
+	}
+	if head, tail := cut(len(encoding.TypeIDs)); head > 0 {
+		encoding.TypeIDs = append(encoding.TypeIDs[:head:head], encoding.TypeIDs[tail:]...)
+	}
+	if head, tail := cut(len(encoding.AttentionMask)); head > 0 {
+		encoding.AttentionMask = append(encoding.AttentionMask[:head:head], encoding.AttentionMask[tail:]...)
+	}
+	if head, tail := cut(len(encoding.SpecialTokensMask)); head > 0 {
+		encoding.SpecialTokensMask = append(encoding.SpecialTokensMask[:head:head], encoding.SpecialTokensMask[tail:]...)
+	}
+	if head, tail := cut(len(encoding.Tokens)); head > 0 {
+		encoding.Tokens = append(encoding.Tokens[:head:head], encoding.Tokens[tail:]...)
+	}
+	if head, tail := cut(len(encoding.Offsets)); head > 0 {
+		encoding.Offsets = append(encoding.Offsets[:head:head], encoding.Offsets[tail:]...)
+	}
+	return encoding
+}
+
 func (p *BasePipeline) getInputTensors(batch PipelineBatch, actualBatchSize int64, maxSequence int64) ([]ort.ArbitraryTensor, error) {
 	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
-	var err error
 
 	for i, input := range p.InputsMeta {
-		var inputTensor *ort.Tensor[int64]
+		var inputTensor ort.ArbitraryTensor
+		var err error
 
 		// create the tensor for the input name
 		switch input.Name {
@@ -247,15 +890,43 @@ func (p *BasePipeline) getInputTensors(batch PipelineBatch, actualBatchSize int6
 			inputTensor, err = ort.NewTensor(ort.NewShape(actualBatchSize, maxSequence), batch.TypeIdsTensor)
 		case "attention_mask":
 			inputTensor, err = ort.NewTensor(ort.NewShape(actualBatchSize, maxSequence), batch.AttentionMasksTensor)
+		case "bbox":
+			inputTensor, err = ort.NewTensor(ort.NewShape(actualBatchSize, maxSequence, 4), batch.BboxTensor)
+		case "pixel_values":
+			if len(batch.PixelValues) == 0 {
+				err = errors.New("the model requires an image for each input")
+				break
+			}
+			inputTensor, err = ort.NewTensor(ort.NewShape(actualBatchSize, 3, int64(batch.ImageHeight), int64(batch.ImageWidth)), batch.PixelValues)
+		default:
+			if _, isState := p.stateOutput(input.Name); isState {
+				state := batch.State
+				if state == nil {
+					state = NewStateHandle()
+				}
+				inputTensor, err = state.stateTensor(input, actualBatchSize)
+				break
+			}
+			err = fmt.Errorf("unsupported model input %s", input.Name)
+		}
+		if err != nil {
+			for _, tensor := range inputTensors[:i] {
+				err = errors.Join(err, tensor.Destroy())
+			}
+			return nil, err
 		}
 
 		inputTensors[i] = inputTensor
 	}
-	return inputTensors, err
+	return inputTensors, nil
 }
 
 // Forward pass of the neural network on the tokenized input
 func (p *BasePipeline) Forward(batch PipelineBatch) (PipelineBatch, error) {
+	return p.forwardWithinBudget(batch, p.forward)
+}
+
+func (p *BasePipeline) forward(batch PipelineBatch) (PipelineBatch, error) {
 	start := time.Now()
 
 	actualBatchSize := int64(len(batch.Input))
@@ -277,7 +948,7 @@ func (p *BasePipeline) Forward(batch PipelineBatch) (PipelineBatch, error) {
 	}(inputTensors)
 
 	// Run Onnx model
-	errOnnx := p.OrtSession.Run(inputTensors, []ort.ArbitraryTensor{outputTensor})
+	errOnnx := p.runStateful(batch.State, inputTensors, outputTensor)
 	if errOnnx != nil {
 		return batch, errOnnx
 	}
@@ -291,6 +962,20 @@ func (p *BasePipeline) Forward(batch PipelineBatch) (PipelineBatch, error) {
 	return batch, err
 }
 
+// runSession runs an onnxruntime session of the pipeline, throttled if the pipeline has a Throttle, and records the
+// batch size of the run.
+func (p *BasePipeline) runSession(session *ort.DynamicAdvancedSession, inputs []ort.ArbitraryTensor, outputs []ort.ArbitraryTensor) error {
+	p.recordBatchSize(inputs)
+	if p.Throttle == nil {
+		return session.Run(inputs, outputs)
+	}
+	p.Throttle.wait()
+	start := time.Now()
+	err := session.Run(inputs, outputs)
+	p.Throttle.ran(time.Since(start))
+	return err
+}
+
 // convert tokenized input to the format required by the onnxruntime library
 func (p *BasePipeline) convertInputToTensors(inputs []TokenizedInput, maxSequence int) PipelineBatch {
 	tensorSize := len(inputs) * maxSequence
@@ -299,6 +984,10 @@ func (p *BasePipeline) convertInputToTensors(inputs []TokenizedInput, maxSequenc
 	idsTensor := make([]int64, tensorSize)
 	typeIdsTensor := make([]int64, tensorSize)
 	attentionMasksTensor := make([]int64, tensorSize)
+	var bboxTensor []int64
+	if p.hasBbox {
+		bboxTensor = make([]int64, tensorSize*4)
+	}
 
 	for _, input := range inputs {
 		length := len(input.TokenIds)
@@ -311,6 +1000,9 @@ func (p *BasePipeline) convertInputToTensors(inputs []TokenizedInput, maxSequenc
 				if p.hasAttentionMask {
 					attentionMasksTensor[counter] = int64(input.AttentionMask[j])
 				}
+				if p.hasBbox && j < len(input.Bboxes) {
+					copy(bboxTensor[counter*4:counter*4+4], input.Bboxes[j][:])
+				}
 			} else {
 				// padding all vectors to max sequence length
 				idsTensor[counter] = 0
@@ -325,14 +1017,23 @@ func (p *BasePipeline) convertInputToTensors(inputs []TokenizedInput, maxSequenc
 		IdsTensor:            idsTensor,
 		TypeIdsTensor:        typeIdsTensor,
 		AttentionMasksTensor: attentionMasksTensor,
+		BboxTensor:           bboxTensor,
 		MaxSequence:          maxSequence,
 	}
 }
 
 func (p *BasePipeline) GetStats() []string {
-	return []string{
+	stats := []string{
 		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
 		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s", time.Duration(p.TokenizerTimings.TotalNS), p.TokenizerTimings.NumCalls, time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
 		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s", time.Duration(p.PipelineTimings.TotalNS), p.PipelineTimings.NumCalls, time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		fmt.Sprintf("Tokens: Input=%d, Generated=%d", p.GetTotalUsage().InputTokens, p.GetTotalUsage().GeneratedTokens),
+	}
+	if p.Throttle != nil {
+		stats = append(stats, fmt.Sprintf("Throttle: Target utilization=%.2f, Throttled time=%s", p.Throttle.TargetUtilization, time.Duration(atomic.LoadUint64(&p.Throttle.ThrottledNS))))
+	}
+	if p.MemoryBudget != nil {
+		stats = append(stats, fmt.Sprintf("Memory budget: Bytes=%d, Split batches=%d", p.MemoryBudget.Bytes, atomic.LoadUint64(&p.MemoryBudget.SplitBatches)))
 	}
+	return stats
 }
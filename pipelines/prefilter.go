@@ -0,0 +1,189 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// PrefilterPipeline runs cheap heuristics before a pipeline and short-circuits inference for the inputs they
+// reject, which get a default output instead. On noisy streams (empty messages, URLs, boilerplate) this saves the
+// cost of running the model on obviously irrelevant inputs.
+type PrefilterPipeline struct {
+	PipelineName string
+	Pipeline     Pipeline
+	Filters      []Prefilter
+	// DefaultOutput is the output of the skipped inputs, nil by default.
+	DefaultOutput any
+	NumInputs     uint64
+	NumSkipped    uint64
+}
+
+// Prefilter reports whether an input should be skipped.
+type Prefilter func(input string) bool
+
+// SkipShorterThan skips the inputs with fewer than n characters, ignoring leading and trailing whitespace.
+func SkipShorterThan(n int) Prefilter {
+	return func(input string) bool {
+		return utf8.RuneCountInString(strings.TrimSpace(input)) < n
+	}
+}
+
+// SkipLongerThan skips the inputs with more than n characters.
+func SkipLongerThan(n int) Prefilter {
+	return func(input string) bool {
+		return utf8.RuneCountInString(input) > n
+	}
+}
+
+// SkipMatching skips the inputs matching a regular expression.
+func SkipMatching(pattern *regexp.Regexp) Prefilter {
+	return func(input string) bool {
+		return pattern.MatchString(input)
+	}
+}
+
+// SkipWithoutKeywords skips the inputs containing none of the keywords, ignoring case.
+func SkipWithoutKeywords(keywords ...string) Prefilter {
+	lowered := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		lowered[i] = strings.ToLower(keyword)
+	}
+	return func(input string) bool {
+		input = strings.ToLower(input)
+		for _, keyword := range lowered {
+			if strings.Contains(input, keyword) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// PrefilterOutput holds the outputs of all inputs, in input order. Skipped marks the inputs that were not run
+// through the pipeline and hold the default output.
+type PrefilterOutput struct {
+	Usage
+	Diagnostics
+	Outputs []any
+	Skipped []bool
+}
+
+func (t *PrefilterOutput) GetOutput() []any {
+	return t.Outputs
+}
+
+// options
+
+// WithDefaultOutput sets the output of the skipped inputs, e.g. a "neutral" classification.
+func WithDefaultOutput(output any) PipelineOption[*PrefilterPipeline] {
+	return func(p *PrefilterPipeline) {
+		p.DefaultOutput = output
+	}
+}
+
+// NewPrefilterPipeline creates a pipeline running pipeline on the inputs not skipped by any of the filters. The
+// wrapped pipeline is not owned by the prefilter pipeline and must be destroyed separately, e.g. by the session
+// that created it.
+func NewPrefilterPipeline(name string, pipeline Pipeline, filters []Prefilter, opts ...PipelineOption[*PrefilterPipeline]) (*PrefilterPipeline, error) {
+	prefilterPipeline := &PrefilterPipeline{
+		PipelineName: name,
+		Pipeline:     pipeline,
+		Filters:      filters,
+	}
+	for _, o := range opts {
+		o(prefilterPipeline)
+	}
+	if err := prefilterPipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return prefilterPipeline, nil
+}
+
+func (p *PrefilterPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.Pipeline == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a pipeline to filter is required"))
+	}
+	if len(p.Filters) == 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least one filter is required"))
+	}
+	for i, filter := range p.Filters {
+		if filter == nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: filter %d is nil", i))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy is a no-op: the filtered pipeline is not owned by the prefilter pipeline.
+func (p *PrefilterPipeline) Destroy() error {
+	return nil
+}
+
+func (p *PrefilterPipeline) GetOutputDim() int {
+	return p.Pipeline.GetOutputDim()
+}
+
+func (p *PrefilterPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Prefilter: Inputs=%d, Skipped inputs=%d", atomic.LoadUint64(&p.NumInputs), atomic.LoadUint64(&p.NumSkipped)),
+	}
+}
+
+// skip reports whether any of the filters rejects an input.
+func (p *PrefilterPipeline) skip(input string) bool {
+	for _, filter := range p.Filters {
+		if filter(input) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the pipeline on a string batch.
+func (p *PrefilterPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline runs the filtered pipeline once on the inputs not skipped by the filters.
+func (p *PrefilterPipeline) RunPipeline(inputs []string) (*PrefilterOutput, error) {
+	output := &PrefilterOutput{Outputs: make([]any, len(inputs)), Skipped: make([]bool, len(inputs))}
+	var kept []string
+	var positions []int
+	for i, input := range inputs {
+		if p.skip(input) {
+			output.Skipped[i] = true
+			output.Outputs[i] = p.DefaultOutput
+			continue
+		}
+		kept = append(kept, input)
+		positions = append(positions, i)
+	}
+	atomic.AddUint64(&p.NumInputs, uint64(len(inputs)))
+	atomic.AddUint64(&p.NumSkipped, uint64(len(inputs)-len(kept)))
+	if len(kept) == 0 {
+		return output, nil
+	}
+
+	pipelineOutput, err := p.Pipeline.Run(kept)
+	if err != nil {
+		return nil, err
+	}
+	output.Usage = usageOf(pipelineOutput)
+	output.Warnings = warningsOf(pipelineOutput, positions)
+	output.Truncations = truncationsOf(pipelineOutput, positions)
+	results := pipelineOutput.GetOutput()
+	if len(results) != len(kept) {
+		return nil, fmt.Errorf("the pipeline returned %d outputs for %d inputs", len(results), len(kept))
+	}
+	for j, result := range results {
+		output.Outputs[positions[j]] = result
+	}
+	return output, nil
+}
@@ -0,0 +1,163 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/exp/slices"
+)
+
+// PromptInjectionPipeline is a text classification pipeline preset for prompt injection and jailbreak detection
+// models such as protectai/deberta-v3-base-prompt-injection-v2 or meta-llama/Prompt-Guard-86M. The scores of all
+// the injection labels are summed, and inputs scoring at or above the threshold are flagged.
+
+// types
+
+type PromptInjectionPipeline struct {
+	TextClassificationPipeline
+	InjectionLabels []string
+	Threshold       float32
+}
+
+type PromptInjectionResult struct {
+	IsInjection bool
+	Score       float32
+	Label       string
+}
+
+type PromptInjectionOutput struct {
+	Usage
+	Results []PromptInjectionResult
+}
+
+func (t *PromptInjectionOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// options
+
+// WithInjectionLabels sets the labels of the model that indicate a prompt injection or jailbreak attempt.
+// Labels are matched ignoring case. Default is INJECTION and JAILBREAK.
+func WithInjectionLabels(labels []string) PipelineOption[*PromptInjectionPipeline] {
+	return func(pipeline *PromptInjectionPipeline) {
+		pipeline.InjectionLabels = labels
+	}
+}
+
+// WithInjectionThreshold sets the minimum injection score for an input to be flagged. Default is 0.5.
+func WithInjectionThreshold(threshold float32) PipelineOption[*PromptInjectionPipeline] {
+	return func(pipeline *PromptInjectionPipeline) {
+		pipeline.Threshold = threshold
+	}
+}
+
+// NewPromptInjectionPipeline initializes a new prompt injection detection pipeline
+func NewPromptInjectionPipeline(config PipelineConfig[*PromptInjectionPipeline], ortOptions *ort.SessionOptions) (*PromptInjectionPipeline, error) {
+	pipeline := &PromptInjectionPipeline{}
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// defaults
+	if len(pipeline.InjectionLabels) == 0 {
+		pipeline.InjectionLabels = []string{"INJECTION", "JAILBREAK"}
+	}
+	if pipeline.Threshold == 0 {
+		pipeline.Threshold = 0.5
+	}
+
+	// the underlying classifier returns the softmax scores of all labels
+	classificationConfig := PipelineConfig[*TextClassificationPipeline]{
+		ModelPath:    config.ModelPath,
+		Name:         config.Name,
+		OnnxFilename: config.OnnxFilename,
+		Options:      []PipelineOption[*TextClassificationPipeline]{WithSoftmax(), WithMultiLabel()},
+	}
+	classificationPipeline, err := NewTextClassificationPipeline(classificationConfig, ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.TextClassificationPipeline = *classificationPipeline
+
+	if err = pipeline.Validate(); err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *PromptInjectionPipeline) isInjectionLabel(label string) bool {
+	return slices.ContainsFunc(p.InjectionLabels, func(l string) bool {
+		return strings.EqualFold(l, label)
+	})
+}
+
+func (p *PromptInjectionPipeline) Validate() error {
+	var validationErrors []error
+
+	if err := p.TextClassificationPipeline.Validate(); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+	found := false
+	for _, label := range p.IdLabelMap {
+		if p.isInjectionLabel(label) {
+			found = true
+		}
+	}
+	if !found {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: none of the injection labels %v are in the model id2label map", p.InjectionLabels))
+	}
+	if p.Threshold < 0 || p.Threshold > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: injection threshold must be between 0 and 1, got %f", p.Threshold))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Run the pipeline on a string batch
+func (p *PromptInjectionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+func (p *PromptInjectionPipeline) RunPipeline(inputs []string) (*PromptInjectionOutput, error) {
+	classification, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	output := &PromptInjectionOutput{
+		Results: make([]PromptInjectionResult, len(classification.ClassificationOutputs)),
+		Usage:   classification.Usage,
+	}
+	for i, scores := range classification.ClassificationOutputs {
+		var injectionScore, topScore float32
+		var topLabel string
+		for _, score := range scores {
+			if p.isInjectionLabel(score.Label) {
+				injectionScore += score.Score
+			}
+			if score.Score > topScore {
+				topScore = score.Score
+				topLabel = score.Label
+			}
+		}
+		output.Results[i] = PromptInjectionResult{
+			IsInjection: injectionScore >= p.Threshold,
+			Score:       injectionScore,
+			Label:       topLabel,
+		}
+	}
+	return output, nil
+}
+
+// Detect screens a single input, returning whether it is a prompt injection and the injection score.
+func (p *PromptInjectionPipeline) Detect(input string) (PromptInjectionResult, error) {
+	output, err := p.RunPipeline([]string{input})
+	if err != nil {
+		return PromptInjectionResult{}, err
+	}
+	return output.Results[0], nil
+}
@@ -0,0 +1,263 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// RelationExtractionPipeline extracts (head, relation, tail) triples from text. Entities are first detected with a
+// token classification pipeline; then every ordered pair of entities in an input is marked up in the text and
+// classified with a text classification (relation classifier) model.
+
+// types
+
+type RelationExtractionPipeline struct {
+	PipelineName     string
+	NER              *TokenClassificationPipeline
+	Classifier       *TextClassificationPipeline
+	HeadMarkers      [2]string
+	TailMarkers      [2]string
+	IgnoreRelations  []string
+	MinScore         float32
+	MaxEntityPairs   int
+	RestrictEntities map[string][]string
+}
+
+type Relation struct {
+	Head     Entity
+	Relation string
+	Tail     Entity
+	Score    float32
+}
+
+type RelationExtractionOutput struct {
+	Usage
+	Relations [][]Relation
+}
+
+func (t *RelationExtractionOutput) GetOutput() []any {
+	out := make([]any, len(t.Relations))
+	for i, relations := range t.Relations {
+		out[i] = any(relations)
+	}
+	return out
+}
+
+// options
+
+// WithEntityMarkers sets the strings inserted around the head and tail entities before classification. These must
+// match the markers used when training the relation classifier. Default is [E1] [/E1] and [E2] [/E2].
+func WithEntityMarkers(headStart, headEnd, tailStart, tailEnd string) PipelineOption[*RelationExtractionPipeline] {
+	return func(pipeline *RelationExtractionPipeline) {
+		pipeline.HeadMarkers = [2]string{headStart, headEnd}
+		pipeline.TailMarkers = [2]string{tailStart, tailEnd}
+	}
+}
+
+// WithIgnoreRelations sets the relation labels that mean "no relation" and are dropped from the output.
+// Default is no_relation.
+func WithIgnoreRelations(labels []string) PipelineOption[*RelationExtractionPipeline] {
+	return func(pipeline *RelationExtractionPipeline) {
+		pipeline.IgnoreRelations = labels
+	}
+}
+
+// WithMinRelationScore drops relations predicted with a score lower than minScore.
+func WithMinRelationScore(minScore float32) PipelineOption[*RelationExtractionPipeline] {
+	return func(pipeline *RelationExtractionPipeline) {
+		pipeline.MinScore = minScore
+	}
+}
+
+// WithMaxEntityPairs bounds the number of entity pairs classified per input, since the number of pairs grows
+// quadratically with the number of entities. Default is 100.
+func WithMaxEntityPairs(maxPairs int) PipelineOption[*RelationExtractionPipeline] {
+	return func(pipeline *RelationExtractionPipeline) {
+		pipeline.MaxEntityPairs = maxPairs
+	}
+}
+
+// WithEntityTypePairs restricts the candidate pairs to the given head entity type -> allowed tail entity types,
+// e.g. {"PER": {"ORG", "LOC"}}. By default all pairs are classified.
+func WithEntityTypePairs(pairs map[string][]string) PipelineOption[*RelationExtractionPipeline] {
+	return func(pipeline *RelationExtractionPipeline) {
+		pipeline.RestrictEntities = pairs
+	}
+}
+
+// NewRelationExtractionPipeline initializes a relation extraction pipeline on top of a token classification
+// pipeline and a relation classifier. The wrapped pipelines are not owned by the relation extraction pipeline
+// and must be destroyed separately, e.g. by the session that created them.
+func NewRelationExtractionPipeline(name string, ner *TokenClassificationPipeline, classifier *TextClassificationPipeline, opts ...PipelineOption[*RelationExtractionPipeline]) (*RelationExtractionPipeline, error) {
+	pipeline := &RelationExtractionPipeline{
+		PipelineName: name,
+		NER:          ner,
+		Classifier:   classifier,
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+
+	// defaults
+	if pipeline.HeadMarkers == [2]string{} {
+		pipeline.HeadMarkers = [2]string{"[E1]", "[/E1]"}
+	}
+	if pipeline.TailMarkers == [2]string{} {
+		pipeline.TailMarkers = [2]string{"[E2]", "[/E2]"}
+	}
+	if pipeline.IgnoreRelations == nil {
+		pipeline.IgnoreRelations = []string{"no_relation"}
+	}
+	if pipeline.MaxEntityPairs == 0 {
+		pipeline.MaxEntityPairs = 100
+	}
+
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *RelationExtractionPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.NER == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a token classification pipeline is required"))
+	}
+	if p.Classifier == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a relation classification pipeline is required"))
+	}
+	if p.MaxEntityPairs < 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: maximum number of entity pairs must be positive"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy is a no-op: the wrapped pipelines are not owned by the relation extraction pipeline.
+func (p *RelationExtractionPipeline) Destroy() error {
+	return nil
+}
+
+// GetOutputDim returns the number of relation labels of the classifier.
+func (p *RelationExtractionPipeline) GetOutputDim() int {
+	return p.Classifier.GetOutputDim()
+}
+
+func (p *RelationExtractionPipeline) GetStats() []string {
+	return append(p.NER.GetStats(), p.Classifier.GetStats()...)
+}
+
+// MarkPair inserts the head and tail markers around the two entities in the text, as the inputs of the relation
+// classifier, e.g. to prepare its training data with the markers of the pipeline.
+func (p *RelationExtractionPipeline) MarkPair(text string, head Entity, tail Entity) string {
+	type insertion struct {
+		position uint
+		marker   string
+	}
+	insertions := []insertion{
+		{head.Start, p.HeadMarkers[0] + " "},
+		{head.End, " " + p.HeadMarkers[1]},
+		{tail.Start, p.TailMarkers[0] + " "},
+		{tail.End, " " + p.TailMarkers[1]},
+	}
+	slices.SortStableFunc(insertions, func(a, b insertion) int {
+		return int(a.position) - int(b.position)
+	})
+	var builder strings.Builder
+	last := uint(0)
+	for _, ins := range insertions {
+		builder.WriteString(text[last:ins.position])
+		builder.WriteString(ins.marker)
+		last = ins.position
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+func (p *RelationExtractionPipeline) allowedPair(head Entity, tail Entity) bool {
+	if p.RestrictEntities == nil {
+		return true
+	}
+	return slices.Contains(p.RestrictEntities[head.Entity], tail.Entity)
+}
+
+// EntityPairs returns the ordered (head, tail) pairs of the entities of an input classified by the pipeline: the pairs
+// of types allowed by WithEntityTypePairs, without overlapping entities, which cannot be marked up, and at most
+// MaxEntityPairs of them.
+func (p *RelationExtractionPipeline) EntityPairs(entities []Entity) [][2]Entity {
+	var pairs [][2]Entity
+	for h, head := range entities {
+		for t, tail := range entities {
+			if h == t || !p.allowedPair(head, tail) {
+				continue
+			}
+			if head.Start < tail.End && tail.Start < head.End {
+				continue
+			}
+			if len(pairs) >= p.MaxEntityPairs {
+				return pairs
+			}
+			pairs = append(pairs, [2]Entity{head, tail})
+		}
+	}
+	return pairs
+}
+
+// Run the pipeline on a string batch
+func (p *RelationExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+func (p *RelationExtractionPipeline) RunPipeline(inputs []string) (*RelationExtractionOutput, error) {
+	nerOutput, err := p.NER.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		input int
+		head  Entity
+		tail  Entity
+	}
+	var candidates []candidate
+	var markedInputs []string
+
+	for i, entities := range nerOutput.Entities {
+		for _, pair := range p.EntityPairs(entities) {
+			candidates = append(candidates, candidate{input: i, head: pair[0], tail: pair[1]})
+			markedInputs = append(markedInputs, p.MarkPair(inputs[i], pair[0], pair[1]))
+		}
+	}
+
+	output := &RelationExtractionOutput{Relations: make([][]Relation, len(inputs)), Usage: nerOutput.Usage}
+	if len(candidates) == 0 {
+		return output, nil
+	}
+
+	classification, err := p.Classifier.RunPipeline(markedInputs)
+	if err != nil {
+		return nil, err
+	}
+	output.Usage = output.Usage.Add(classification.Usage)
+	if len(classification.ClassificationOutputs) != len(candidates) {
+		return nil, fmt.Errorf("relation classifier returned %d outputs for %d entity pairs", len(classification.ClassificationOutputs), len(candidates))
+	}
+
+	for i, c := range candidates {
+		for _, result := range classification.ClassificationOutputs[i] {
+			if slices.Contains(p.IgnoreRelations, result.Label) || result.Score < p.MinScore {
+				continue
+			}
+			output.Relations[c.input] = append(output.Relations[c.input], Relation{
+				Head:     c.head,
+				Relation: result.Label,
+				Tail:     c.tail,
+				Score:    result.Score,
+			})
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,244 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// RerankingPipeline scores the relevance of documents to a query with a cross-encoder model (e.g.
+// cross-encoder/ms-marco-MiniLM-L-6-v2), which reads the query and each document as a sequence pair, and returns
+// the documents sorted by relevance.
+
+// types
+
+type RerankingPipeline struct {
+	BasePipeline
+	// PairBatchSize is the maximum number of (query, document) pairs run through the model at once. The documents
+	// are batched by length, so that the pairs of a batch are padded to similar lengths.
+	PairBatchSize int
+}
+
+// RerankingResult is the relevance score of a document. Index is the position of the document in the input.
+type RerankingResult struct {
+	Index    int
+	Document string
+	Score    float32
+}
+
+type RerankingOutput struct {
+	Usage
+	// Results are sorted by decreasing score.
+	Results []RerankingResult
+}
+
+func (t *RerankingOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// options
+
+// WithPairBatchSize sets the maximum number of (query, document) pairs run through the model at once, to bound the
+// memory of reranking hundreds of candidates. Default is 32.
+func WithPairBatchSize(size int) PipelineOption[*RerankingPipeline] {
+	return func(pipeline *RerankingPipeline) {
+		pipeline.PairBatchSize = size
+	}
+}
+
+// NewRerankingPipeline initializes a reranking pipeline.
+func NewRerankingPipeline(config PipelineConfig[*RerankingPipeline], ortOptions *ort.SessionOptions) (*RerankingPipeline, error) {
+	pipeline := &RerankingPipeline{PairBatchSize: 32}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx model
+	err := pipeline.loadModel()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pipeline.OutputsMeta) > 0 && len(pipeline.OutputsMeta[0].Dimensions) == 2 {
+		pipeline.OutputDim = int(pipeline.OutputsMeta[0].Dimensions[1])
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *RerankingPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.OutputDim != 1 && p.OutputDim != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: cross-encoder models must output one relevance logit, or two for binary classifiers, got %d", p.OutputDim))
+	}
+	if p.PairBatchSize < 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: pair batch size must be positive, got %d", p.PairBatchSize))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes the (query, document) pairs.
+func (p *RerankingPipeline) Preprocess(query string, documents []string) (PipelineBatch, error) {
+	inputs, err := p.encodeDocuments(query, documents)
+	if err != nil {
+		return PipelineBatch{}, err
+	}
+	return p.convertInputToTensors(inputs, maxLength(inputs)), nil
+}
+
+// encodeDocuments tokenizes the (query, document) pairs, the query once for all the documents.
+func (p *RerankingPipeline) encodeDocuments(query string, documents []string) ([]TokenizedInput, error) {
+	start := time.Now()
+	inputs, err := p.encodePairs(query, documents)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return inputs, nil
+}
+
+// maxLength is the length in tokens of the longest input.
+func maxLength(inputs []TokenizedInput) int {
+	length := 0
+	for _, input := range inputs {
+		if len(input.TokenIds) > length {
+			length = len(input.TokenIds)
+		}
+	}
+	return length
+}
+
+func (p *RerankingPipeline) Forward(batch PipelineBatch) (PipelineBatch, error) {
+	return p.forwardWithinBudget(batch, p.forward)
+}
+
+func (p *RerankingPipeline) forward(batch PipelineBatch) (PipelineBatch, error) {
+	start := time.Now()
+
+	actualBatchSize := int64(len(batch.Input))
+	maxSequence := int64(batch.MaxSequence)
+	inputTensors, err := p.getInputTensors(batch, actualBatchSize, maxSequence)
+	if err != nil {
+		return batch, err
+	}
+
+	defer func(inputTensors []ort.ArbitraryTensor) {
+		for _, tensor := range inputTensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}(inputTensors)
+
+	outputTensor, errTensor := ort.NewEmptyTensor[float32](ort.NewShape(actualBatchSize, int64(p.OutputDim)))
+	if errTensor != nil {
+		return batch, errTensor
+	}
+
+	defer func(outputTensor *ort.Tensor[float32]) {
+		err = errors.Join(err, outputTensor.Destroy())
+	}(outputTensor)
+
+	// Run Onnx model
+	errOnnx := p.runSession(p.OrtSession, inputTensors, []ort.ArbitraryTensor{outputTensor})
+	if errOnnx != nil {
+		return batch, errOnnx
+	}
+	batch.OutputTensor = outputTensor.GetData()
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return batch, err
+}
+
+// Postprocess converts the logits into relevance scores between 0 and 1 and sorts the documents by score. Single
+// logit models are scored with a sigmoid, binary classifiers with the softmax probability of the relevant class.
+func (p *RerankingPipeline) Postprocess(batch PipelineBatch, documents []string) (*RerankingOutput, error) {
+	output := &RerankingOutput{
+		Usage:   p.recordUsage(batchUsage(batch)),
+		Results: make([]RerankingResult, len(documents)),
+	}
+	for i, document := range documents {
+		logits := batch.OutputTensor[i*p.OutputDim : (i+1)*p.OutputDim]
+		var score float32
+		if p.OutputDim == 1 {
+			score = util.Sigmoid(logits)[0]
+		} else {
+			score = util.SoftMax(logits)[1]
+		}
+		output.Results[i] = RerankingResult{Index: i, Document: document, Score: score}
+	}
+	sort.SliceStable(output.Results, func(i, j int) bool {
+		return output.Results[i].Score > output.Results[j].Score
+	})
+	return output, nil
+}
+
+// Run the pipeline on a string batch. The first input is the query and the following ones the documents to rerank.
+func (p *RerankingPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("reranking requires a query followed by the documents to rerank")
+	}
+	return p.RunPipeline(inputs[0], inputs[1:])
+}
+
+// RunPipeline scores each document against the query and returns the documents sorted by relevance. The pairs are
+// run in batches of at most PairBatchSize pairs of similar lengths.
+func (p *RerankingPipeline) RunPipeline(query string, documents []string) (*RerankingOutput, error) {
+	if len(documents) == 0 {
+		return &RerankingOutput{}, nil
+	}
+	inputs, err := p.encodeDocuments(query, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(inputs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(inputs[order[i]].TokenIds) < len(inputs[order[j]].TokenIds)
+	})
+	logits := make([]float32, len(inputs)*p.OutputDim)
+	for start := 0; start < len(order); start += p.PairBatchSize {
+		end := start + p.PairBatchSize
+		if end > len(order) {
+			end = len(order)
+		}
+		batchInputs := make([]TokenizedInput, 0, end-start)
+		for _, i := range order[start:end] {
+			batchInputs = append(batchInputs, inputs[i])
+		}
+		batch, err := p.Forward(p.convertInputToTensors(batchInputs, maxLength(batchInputs)))
+		if err != nil {
+			return nil, err
+		}
+		for k, i := range order[start:end] {
+			copy(logits[i*p.OutputDim:(i+1)*p.OutputDim], batch.OutputTensor[k*p.OutputDim:(k+1)*p.OutputDim])
+		}
+	}
+	return p.Postprocess(PipelineBatch{Input: inputs, OutputTensor: logits}, documents)
+}
@@ -0,0 +1,205 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+// RouterPipeline splits traffic between two or more pipelines (typically different versions of a model) for
+// A/B experiments. Each input is assigned to one route, either at random according to the route weights, or
+// deterministically by hashing a routing key so that the same key is always served by the same version.
+type RouterPipeline struct {
+	PipelineName    string
+	Routes          []Route
+	RoutingStrategy string
+	routeCounts     []uint64
+}
+
+// Route is a pipeline that can be selected by a RouterPipeline, with the version tag applied to its outputs and
+// the relative share of the traffic it should receive.
+type Route struct {
+	Version  string
+	Pipeline Pipeline
+	Weight   float64
+}
+
+// RoutedOutput is the output for a single input, tagged with the version of the route that produced it.
+type RoutedOutput struct {
+	Version string
+	Output  any
+}
+
+type RouterOutput struct {
+	Usage
+	Diagnostics
+	Outputs []RoutedOutput
+}
+
+func (t *RouterOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, routedOutput := range t.Outputs {
+		out[i] = any(routedOutput)
+	}
+	return out
+}
+
+// options
+
+// WithWeightedRouting assigns each input to a route at random, proportionally to the route weights. This is the default.
+func WithWeightedRouting() PipelineOption[*RouterPipeline] {
+	return func(p *RouterPipeline) {
+		p.RoutingStrategy = "WEIGHTED"
+	}
+}
+
+// WithKeyHashRouting assigns each input to a route by hashing its routing key, so that assignments are sticky.
+// When the pipeline is called with Run, the input string itself is used as the key; use RunWithKeys to route on
+// e.g. a user id or a request header instead.
+func WithKeyHashRouting() PipelineOption[*RouterPipeline] {
+	return func(p *RouterPipeline) {
+		p.RoutingStrategy = "KEYHASH"
+	}
+}
+
+// NewRouterPipeline creates a pipeline routing inputs between the given routes. The wrapped pipelines are not
+// owned by the router and must be destroyed separately, e.g. by the session that created them.
+func NewRouterPipeline(name string, routes []Route, opts ...PipelineOption[*RouterPipeline]) (*RouterPipeline, error) {
+	pipeline := &RouterPipeline{
+		PipelineName: name,
+		Routes:       routes,
+		routeCounts:  make([]uint64, len(routes)),
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+	if pipeline.RoutingStrategy == "" {
+		pipeline.RoutingStrategy = "WEIGHTED"
+	}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (p *RouterPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.Routes) < 2 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least two routes are required"))
+	}
+	totalWeight := 0.0
+	versions := map[string]bool{}
+	for _, route := range p.Routes {
+		if route.Pipeline == nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: route %s has no pipeline", route.Version))
+		}
+		if route.Weight < 0 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: route %s has a negative weight", route.Version))
+		}
+		if versions[route.Version] {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: route version %s is not unique", route.Version))
+		}
+		versions[route.Version] = true
+		totalWeight += route.Weight
+	}
+	if totalWeight <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the sum of the route weights must be greater than zero"))
+	}
+	if p.RoutingStrategy != "WEIGHTED" && p.RoutingStrategy != "KEYHASH" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: routing strategy %s is not supported", p.RoutingStrategy))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy is a no-op: the routed pipelines are not owned by the router.
+func (p *RouterPipeline) Destroy() error {
+	return nil
+}
+
+// GetOutputDim returns the output dimension of the first route.
+func (p *RouterPipeline) GetOutputDim() int {
+	return p.Routes[0].Pipeline.GetOutputDim()
+}
+
+func (p *RouterPipeline) GetStats() []string {
+	stats := []string{fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName)}
+	for i, route := range p.Routes {
+		stats = append(stats, fmt.Sprintf("Route: Version=%s, Inputs served=%d", route.Version, atomic.LoadUint64(&p.routeCounts[i])))
+	}
+	return stats
+}
+
+// pickRoute maps a value in [0, 1) onto the routes according to their cumulative weights.
+func (p *RouterPipeline) pickRoute(u float64) int {
+	totalWeight := 0.0
+	for _, route := range p.Routes {
+		totalWeight += route.Weight
+	}
+	cumulative := 0.0
+	for i, route := range p.Routes {
+		cumulative += route.Weight / totalWeight
+		if u < cumulative {
+			return i
+		}
+	}
+	return len(p.Routes) - 1
+}
+
+func (p *RouterPipeline) routeFor(key string) int {
+	if p.RoutingStrategy == "KEYHASH" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		return p.pickRoute(float64(h.Sum64()%1_000_000) / 1_000_000)
+	}
+	return p.pickRoute(rand.Float64()) //nolint:gosec // traffic splitting does not need a secure source
+}
+
+// Run the pipeline on a string batch, using the inputs themselves as routing keys.
+func (p *RouterPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunWithKeys(inputs, inputs)
+}
+
+// RunWithKeys runs the pipeline on a string batch, routing each input according to the corresponding key.
+// Keys are only used with key hash routing.
+func (p *RouterPipeline) RunWithKeys(inputs []string, keys []string) (*RouterOutput, error) {
+	if len(keys) != len(inputs) {
+		return nil, fmt.Errorf("number of routing keys (%d) does not match number of inputs (%d)", len(keys), len(inputs))
+	}
+
+	// split the batch into one sub-batch per route, remembering the original positions
+	routeInputs := make([][]string, len(p.Routes))
+	routePositions := make([][]int, len(p.Routes))
+	for i, input := range inputs {
+		r := p.routeFor(keys[i])
+		routeInputs[r] = append(routeInputs[r], input)
+		routePositions[r] = append(routePositions[r], i)
+	}
+
+	outputs := make([]RoutedOutput, len(inputs))
+	var usage Usage
+	var diagnostics Diagnostics
+	for r, route := range p.Routes {
+		if len(routeInputs[r]) == 0 {
+			continue
+		}
+		routeOutput, err := route.Pipeline.Run(routeInputs[r])
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Version, err)
+		}
+		usage = usage.Add(usageOf(routeOutput))
+		diagnostics.Warnings = append(diagnostics.Warnings, warningsOf(routeOutput, routePositions[r])...)
+		diagnostics.Truncations = append(diagnostics.Truncations, truncationsOf(routeOutput, routePositions[r])...)
+		results := routeOutput.GetOutput()
+		if len(results) != len(routeInputs[r]) {
+			return nil, fmt.Errorf("route %s returned %d outputs for %d inputs", route.Version, len(results), len(routeInputs[r]))
+		}
+		for j, result := range results {
+			outputs[routePositions[r][j]] = RoutedOutput{Version: route.Version, Output: result}
+		}
+		atomic.AddUint64(&p.routeCounts[r], uint64(len(results)))
+	}
+	return &RouterOutput{Outputs: outputs, Usage: usage, Diagnostics: diagnostics}, nil
+}
@@ -0,0 +1,326 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// BaseSeq2SeqPipeline is used for struct composition in the encoder-decoder generation pipelines (translation,
+// speech recognition, image captioning, ...). Encoder-decoder models are exported to onnx as two files: the encoder,
+// loaded as the pipeline model, and the decoder, which is run once per generated token.
+type BaseSeq2SeqPipeline struct {
+	BasePipeline
+	DecoderOnnxFilename string
+	DecoderSession      *ort.DynamicAdvancedSession
+	DecoderInputsMeta   []ort.InputOutputInfo
+	DecoderOutputsMeta  []ort.InputOutputInfo
+	GenerationConfig    GenerationConfig
+	// cache is nil if the decoder does not take past key/values, in which case the whole decoded sequence is
+	// run through the decoder at each step.
+	cache *kvCache
+}
+
+const (
+	defaultEncoderOnnxFilename       = "encoder_model.onnx"
+	defaultMergedDecoderOnnxFilename = "decoder_model_merged.onnx"
+	defaultDecoderOnnxFilename       = "decoder_model.onnx"
+)
+
+// seq2seqPipeline is implemented by the pipelines embedding BaseSeq2SeqPipeline.
+type seq2seqPipeline interface {
+	getSeq2Seq() *BaseSeq2SeqPipeline
+}
+
+func (p *BaseSeq2SeqPipeline) getSeq2Seq() *BaseSeq2SeqPipeline {
+	return p
+}
+
+func (p *BaseSeq2SeqPipeline) getGenerationConfig() *GenerationConfig {
+	return &p.GenerationConfig
+}
+
+// WithDecoderOnnxFilename sets the onnx file of the decoder of an encoder-decoder pipeline. By default
+// decoder_model_merged.onnx is used if present, and decoder_model.onnx otherwise. The encoder file is set with the
+// OnnxFilename of the pipeline config and defaults to encoder_model.onnx.
+// Example: pipelines.WithDecoderOnnxFilename[*pipelines.TranslationPipeline]("decoder_model.onnx").
+func WithDecoderOnnxFilename[T Pipeline](filename string) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(seq2seqPipeline); ok {
+			p.getSeq2Seq().DecoderOnnxFilename = filename
+		}
+	}
+}
+
+// loadSeq2SeqModel loads the tokenizer, the encoder and the decoder.
+func (p *BaseSeq2SeqPipeline) loadSeq2SeqModel() error {
+	if p.OnnxFilename == "" {
+		p.OnnxFilename = defaultEncoderOnnxFilename
+	}
+	if err := p.loadModel(); err != nil {
+		return err
+	}
+
+	if p.DecoderOnnxFilename == "" {
+		onnxFiles, err := getOnnxFiles(p.ModelPath)
+		if err != nil {
+			return errors.Join(err, p.BasePipeline.Destroy())
+		}
+		p.DecoderOnnxFilename = defaultDecoderOnnxFilename
+		for _, file := range onnxFiles {
+			if file[1] == defaultMergedDecoderOnnxFilename {
+				p.DecoderOnnxFilename = defaultMergedDecoderOnnxFilename
+			}
+		}
+	}
+	session, inputs, outputs, err := p.loadSession(p.DecoderOnnxFilename)
+	if err != nil {
+		return errors.Join(err, p.BasePipeline.Destroy())
+	}
+	p.DecoderSession = session
+	p.DecoderInputsMeta = inputs
+	p.DecoderOutputsMeta = outputs
+
+	hasPast := false
+	hasUseCacheBranch := false
+	for _, input := range inputs {
+		hasPast = hasPast || strings.HasPrefix(input.Name, pastKeyValuesPrefix)
+		hasUseCacheBranch = hasUseCacheBranch || input.Name == "use_cache_branch"
+	}
+	if hasPast {
+		if !hasUseCacheBranch {
+			// the first step cannot be run without past key/values
+			return errors.Join(fmt.Errorf("decoder %s requires past key/values at every step, use %s or %s instead", p.DecoderOnnxFilename, defaultMergedDecoderOnnxFilename, defaultDecoderOnnxFilename), p.Destroy())
+		}
+		modelConfig, configErr := loadModelConfig(p.ModelPath)
+		if configErr != nil {
+			return errors.Join(configErr, p.Destroy())
+		}
+		if decoderConfig, ok := modelConfig["decoder"].(map[string]any); ok {
+			// composite models (e.g. vision-encoder-decoder) describe their decoder in a sub config
+			modelConfig = decoderConfig
+		}
+		if p.cache, err = newKVCache(inputs, modelConfig); err != nil {
+			return errors.Join(err, p.Destroy())
+		}
+	}
+
+	// the output dimension is the vocabulary size of the logits
+	for _, output := range outputs {
+		if output.Name == "logits" && len(output.Dimensions) == 3 {
+			p.OutputDim = int(output.Dimensions[2])
+		}
+	}
+	return nil
+}
+
+// validateSeq2Seq checks the configuration common to the encoder-decoder pipelines.
+func (p *BaseSeq2SeqPipeline) validateSeq2Seq() []error {
+	var validationErrors []error
+	if p.OutputDim <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the decoder must have a logits output of shape [batch, sequence, vocabulary]"))
+	}
+	if p.GenerationConfig.MaxNewTokens <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: max new tokens must be greater than zero"))
+	}
+	if p.GenerationConfig.DecoderStartTokenId < 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: decoder_start_token_id is not set in the model config"))
+	}
+	for _, input := range p.DecoderInputsMeta {
+		switch input.Name {
+		case "input_ids", "encoder_hidden_states", "encoder_attention_mask", "use_cache_branch":
+		default:
+			if p.cache == nil || p.cache.shapes[input.Name] == nil {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported decoder input %s", input.Name))
+			}
+		}
+	}
+	return validationErrors
+}
+
+// Destroy frees the encoder and decoder sessions and the tokenizer.
+func (p *BaseSeq2SeqPipeline) Destroy() error {
+	err := p.BasePipeline.Destroy()
+	if p.DecoderSession != nil {
+		err = errors.Join(err, p.DecoderSession.Destroy())
+	}
+	return err
+}
+
+// encode runs the encoder on a tokenized batch and returns its last hidden state.
+func (p *BaseSeq2SeqPipeline) encode(batch PipelineBatch) (ort.ArbitraryTensor, error) {
+	inputTensors, err := p.getInputTensors(batch, int64(len(batch.Input)), int64(batch.MaxSequence))
+	if err != nil {
+		return nil, err
+	}
+	return p.runEncoder(inputTensors)
+}
+
+// runEncoder runs the encoder on the given inputs, which it destroys, and returns its last hidden state.
+func (p *BaseSeq2SeqPipeline) runEncoder(inputTensors []ort.ArbitraryTensor) (hiddenStates ort.ArbitraryTensor, err error) {
+	defer func() {
+		for _, tensor := range inputTensors {
+			if tensor != nil {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+	hiddenStatesIndex := 0
+	for i, output := range p.OutputsMeta {
+		if output.Name == "last_hidden_state" {
+			hiddenStatesIndex = i
+		}
+	}
+	for i, tensor := range outputTensors {
+		if i != hiddenStatesIndex {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}
+	return outputTensors[hiddenStatesIndex], err
+}
+
+// generate decodes greedily from the encoder hidden states. encoderAttentionMask is the [batch, sequence] mask of
+// the encoder inputs, or nil if all the positions are attended. Decoding starts from the prefix tokens (e.g. the
+// decoder start token and a target language token) for all the sequences of the batch.
+func (p *BaseSeq2SeqPipeline) generate(encoderHiddenStates ort.ArbitraryTensor, encoderAttentionMask []int64, prefix []int64) (generated [][]int64, err error) {
+	start := time.Now()
+
+	shape := encoderHiddenStates.GetShape()
+	batchSize := int(shape[0])
+	if encoderAttentionMask == nil {
+		encoderAttentionMask = make([]int64, batchSize*int(shape[1]))
+		for i := range encoderAttentionMask {
+			encoderAttentionMask[i] = 1
+		}
+	}
+	maskTensor, err := ort.NewTensor(ort.NewShape(shape[0], shape[1]), encoderAttentionMask)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, maskTensor.Destroy())
+	}()
+
+	var cache *kvCache
+	if p.cache != nil {
+		if cache, err = p.cache.allocate(batchSize); err != nil {
+			return nil, err
+		}
+		defer func() {
+			err = errors.Join(err, cache.destroy())
+		}()
+	}
+
+	sequences := make([][]int64, batchSize)
+	for i := range sequences {
+		sequences[i] = append([]int64(nil), prefix...)
+	}
+	firstStep := true
+	step := func(nextTokens []int64) ([][]float32, error) {
+		for i, token := range nextTokens {
+			sequences[i] = append(sequences[i], token)
+		}
+		useCache := cache != nil && !firstStep
+		firstStep = false
+		if useCache {
+			return p.decoderStep(cache, useCache, nextTokens, 1, encoderHiddenStates, maskTensor)
+		}
+		// the whole sequence is decoded, at the first step or when the decoder has no past key/values
+		inputIds := make([]int64, 0, batchSize*len(sequences[0]))
+		for _, sequence := range sequences {
+			inputIds = append(inputIds, sequence...)
+		}
+		return p.decoderStep(cache, useCache, inputIds, len(sequences[0]), encoderHiddenStates, maskTensor)
+	}
+	generated, err = greedySearch(p.GenerationConfig, batchSize, step)
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return generated, err
+}
+
+// decoderStep runs the decoder on the input ids of one decoding step and returns the logits of the next token.
+func (p *BaseSeq2SeqPipeline) decoderStep(cache *kvCache, useCache bool, inputIds []int64, sequenceLength int, encoderHiddenStates ort.ArbitraryTensor, encoderAttentionMask ort.ArbitraryTensor) (logits [][]float32, err error) {
+	batchSize := encoderHiddenStates.GetShape()[0]
+
+	inputTensors := make([]ort.ArbitraryTensor, len(p.DecoderInputsMeta))
+	var ownedTensors []ort.ArbitraryTensor
+	defer func() {
+		for _, tensor := range ownedTensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}()
+	for i, input := range p.DecoderInputsMeta {
+		var tensor ort.ArbitraryTensor
+		var tensorErr error
+		switch input.Name {
+		case "input_ids":
+			tensor, tensorErr = ort.NewTensor(ort.NewShape(batchSize, int64(sequenceLength)), inputIds)
+			ownedTensors = append(ownedTensors, tensor)
+		case "encoder_hidden_states":
+			tensor = encoderHiddenStates
+		case "encoder_attention_mask":
+			tensor = encoderAttentionMask
+		case "use_cache_branch":
+			tensor, tensorErr = newUseCacheBranchTensor(useCache)
+			ownedTensors = append(ownedTensors, tensor)
+		default:
+			tensor = cache.tensors[input.Name]
+		}
+		if tensorErr != nil {
+			return nil, tensorErr
+		}
+		inputTensors[i] = tensor
+	}
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.DecoderOutputsMeta))
+	if err = p.runSession(p.DecoderSession, inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+	for i, output := range p.DecoderOutputsMeta {
+		tensor := outputTensors[i]
+		if cache != nil {
+			if inputName, ok := cache.isPresent(output.Name); ok {
+				// the cross-attention key/values only depend on the encoder output and are kept from the first step
+				if !useCache || !cache.isCrossAttention(inputName) {
+					err = errors.Join(err, cache.update(inputName, tensor))
+					continue
+				}
+			}
+		}
+		if output.Name == "logits" {
+			logitsTensor, ok := tensor.(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, errors.New("logits output must be float32"))
+			} else {
+				var logitsErr error
+				logits, logitsErr = lastTokenLogits(logitsTensor)
+				err = errors.Join(err, logitsErr)
+			}
+		}
+		err = errors.Join(err, tensor.Destroy())
+	}
+	return logits, err
+}
+
+// decodeGenerated converts the generated token ids to text.
+func (p *BaseSeq2SeqPipeline) decodeGenerated(generated [][]int64) []string {
+	texts := make([]string, len(generated))
+	for i, tokens := range generated {
+		ids := make([]uint32, len(tokens))
+		for j, id := range tokens {
+			ids[j] = uint32(id)
+		}
+		texts[i] = strings.TrimSpace(p.Tokenizer.Decode(ids, true))
+	}
+	return texts
+}
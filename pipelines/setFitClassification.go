@@ -0,0 +1,215 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// SetFitPipeline runs SetFit (https://github.com/huggingface/setfit) few-shot classifiers: a sentence-transformers
+// body exported to onnx, whose mean pooled embeddings are classified by a logistic regression head. SetFit saves the
+// head as a pickle, which must be exported to json with its coefficients, intercepts and classes:
+//
+//	{"coef": [[...]], "intercept": [...], "classes": [...], "multi_class": "multinomial"}
+//
+// i.e. the coef_, intercept_ and classes_ attributes of the scikit-learn LogisticRegression. If the model folder
+// has a config_setfit.json, its normalize_embeddings and labels settings are applied.
+
+// types
+
+type SetFitPipeline struct {
+	FeatureExtractionPipeline
+	HeadFilename string
+	Head         SetFitHead
+	// Labels maps the classes of the head to label names, from the labels of config_setfit.json.
+	Labels []string
+}
+
+// SetFitHead is a logistic regression classification head. Binary heads have a single row of coefficients, the
+// probability of the second class being the sigmoid of the logit. Multi-class heads have a row per class and are
+// normalized with a softmax, or, if MultiClass is "ovr" (one-vs-rest), by dividing the sigmoids by their sum.
+type SetFitHead struct {
+	Coef       [][]float32 `json:"coef"`
+	Intercept  []float32   `json:"intercept"`
+	Classes    []any       `json:"classes"`
+	MultiClass string      `json:"multi_class"`
+}
+
+// options
+
+// WithHeadFilename sets the json file of the classification head, model_head.json by default. Relative paths are
+// resolved against the model folder.
+func WithHeadFilename(filename string) PipelineOption[*SetFitPipeline] {
+	return func(pipeline *SetFitPipeline) {
+		pipeline.HeadFilename = filename
+	}
+}
+
+// NewSetFitPipeline initializes a SetFit classification pipeline.
+func NewSetFitPipeline(config PipelineConfig[*SetFitPipeline], ortOptions *ort.SessionOptions) (*SetFitPipeline, error) {
+	pipeline := &SetFitPipeline{HeadFilename: "model_head.json"}
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	headPath := pipeline.HeadFilename
+	if !filepath.IsAbs(headPath) && util.GetPathType(headPath) != "S3" {
+		headPath = util.PathJoinSafe(config.ModelPath, headPath)
+	}
+	headBytes, err := util.ReadFileBytes(headPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = jsoniter.Unmarshal(headBytes, &pipeline.Head); err != nil {
+		return nil, fmt.Errorf("could not read classification head %s: %w", pipeline.HeadFilename, err)
+	}
+
+	var setFitConfig struct {
+		NormalizeEmbeddings bool     `json:"normalize_embeddings"`
+		Labels              []string `json:"labels"`
+	}
+	setFitConfigPath := util.PathJoinSafe(config.ModelPath, "config_setfit.json")
+	exists, err := util.FileSystem.Exists(context.Background(), setFitConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		configBytes, readErr := util.ReadFileBytes(setFitConfigPath)
+		if readErr != nil {
+			return nil, readErr
+		}
+		if err = jsoniter.Unmarshal(configBytes, &setFitConfig); err != nil {
+			return nil, fmt.Errorf("could not read config_setfit.json: %w", err)
+		}
+		pipeline.Labels = setFitConfig.Labels
+	}
+
+	// the body is a feature extraction pipeline returning the mean pooled embeddings
+	bodyConfig := PipelineConfig[*FeatureExtractionPipeline]{
+		ModelPath:    config.ModelPath,
+		Name:         config.Name,
+		OnnxFilename: config.OnnxFilename,
+	}
+	if setFitConfig.NormalizeEmbeddings {
+		bodyConfig.Options = append(bodyConfig.Options, WithNormalization())
+	}
+	body, err := NewFeatureExtractionPipeline(bodyConfig, ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.FeatureExtractionPipeline = *body
+
+	if err = pipeline.Validate(); err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *SetFitPipeline) Validate() error {
+	var validationErrors []error
+
+	if err := p.FeatureExtractionPipeline.Validate(); err != nil {
+		validationErrors = append(validationErrors, err)
+	}
+	classes := len(p.Head.Classes)
+	switch {
+	case classes < 2:
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the classification head must have at least two classes"))
+	case classes == 2 && len(p.Head.Coef) != 1 && len(p.Head.Coef) != 2:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: a binary classification head must have one or two rows of coefficients, got %d", len(p.Head.Coef)))
+	case classes > 2 && len(p.Head.Coef) != classes:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the classification head has %d classes but %d rows of coefficients", classes, len(p.Head.Coef)))
+	}
+	if len(p.Head.Intercept) != len(p.Head.Coef) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the classification head has %d intercepts for %d rows of coefficients", len(p.Head.Intercept), len(p.Head.Coef)))
+	}
+	for i, row := range p.Head.Coef {
+		if len(row) != p.FeatureExtractionPipeline.GetOutputDim() {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: coefficients row %d has dimension %d, the embeddings have dimension %d", i, len(row), p.FeatureExtractionPipeline.GetOutputDim()))
+			break
+		}
+	}
+	if p.Head.MultiClass != "" && p.Head.MultiClass != "multinomial" && p.Head.MultiClass != "ovr" && p.Head.MultiClass != "auto" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported multi_class setting %s", p.Head.MultiClass))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// GetOutputDim returns the number of classes of the head.
+func (p *SetFitPipeline) GetOutputDim() int {
+	return len(p.Head.Classes)
+}
+
+// label returns the name of a class of the head. Integer classes index the labels of config_setfit.json, if any.
+func (p *SetFitPipeline) label(class int) string {
+	value := p.Head.Classes[class]
+	if index, ok := value.(float64); ok && index == math.Trunc(index) && index >= 0 && int(index) < len(p.Labels) {
+		return p.Labels[int(index)]
+	}
+	if index, ok := value.(float64); ok && index == math.Trunc(index) {
+		return fmt.Sprintf("%d", int64(index))
+	}
+	return fmt.Sprint(value)
+}
+
+// probabilities applies the head to an embedding.
+func (p *SetFitPipeline) probabilities(embedding []float32) []float32 {
+	logits := make([]float32, len(p.Head.Coef))
+	for i, row := range p.Head.Coef {
+		logits[i] = util.Dot(row, embedding) + p.Head.Intercept[i]
+	}
+	if len(logits) == 1 {
+		positive := util.Sigmoid(logits)[0]
+		return []float32{1 - positive, positive}
+	}
+	if p.Head.MultiClass != "ovr" {
+		return util.SoftMax(logits)
+	}
+	scores := util.Sigmoid(logits)
+	var sum float32
+	for _, score := range scores {
+		sum += score
+	}
+	for i := range scores {
+		scores[i] /= sum
+	}
+	return scores
+}
+
+// Run the pipeline on a string batch.
+func (p *SetFitPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline classifies the inputs, returning the probability of every class sorted by decreasing score.
+func (p *SetFitPipeline) RunPipeline(inputs []string) (*TextClassificationOutput, error) {
+	embeddings, err := p.FeatureExtractionPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	output := &TextClassificationOutput{
+		Usage:                 embeddings.Usage,
+		Diagnostics:           embeddings.Diagnostics,
+		ClassificationOutputs: make([][]ClassificationOutput, len(embeddings.Embeddings)),
+	}
+	for i, embedding := range embeddings.Embeddings {
+		scores := p.probabilities(embedding)
+		classifications := make([]ClassificationOutput, len(scores))
+		for class, score := range scores {
+			classifications[class] = ClassificationOutput{Label: p.label(class), Score: score}
+		}
+		sort.SliceStable(classifications, func(a, b int) bool {
+			return classifications[a].Score > classifications[b].Score
+		})
+		output.ClassificationOutputs[i] = classifications
+	}
+	return output, nil
+}
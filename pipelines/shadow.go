@@ -0,0 +1,216 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ShadowPipeline runs a primary pipeline and mirrors a fraction of the batches to a shadow pipeline (e.g. a new
+// model version). Only the primary results are ever returned: the shadow run happens in the background and is
+// only used to record how often the two pipelines agree, so that a model rollout can be evaluated on live traffic.
+type ShadowPipeline struct {
+	PipelineName string
+	Primary      Pipeline
+	Shadow       Pipeline
+	Fraction     float64
+	// EmbeddingAgreementThreshold is the minimum cosine similarity for two embeddings to be considered in agreement.
+	EmbeddingAgreementThreshold float32
+	// MaxShadowRuns is the maximum number of shadow runs in flight. Sampled batches are skipped while it is reached.
+	MaxShadowRuns int
+	ShadowStats   *ShadowStats
+	slots         chan struct{}
+	mutex         sync.Mutex
+	destroyed     bool
+	wg            sync.WaitGroup
+}
+
+// ShadowStats holds the agreement metrics collected by a ShadowPipeline.
+type ShadowStats struct {
+	NumBatches    uint64
+	NumShadowed   uint64
+	NumCompared   uint64
+	NumAgreements uint64
+	NumErrors     uint64
+	NumSkipped    uint64
+}
+
+// WithMaxShadowRuns bounds the number of shadow runs in flight, so that a slow shadow pipeline cannot pile up
+// goroutines under load. Sampled batches are skipped and counted while the limit is reached. Default is 4.
+func WithMaxShadowRuns(maxRuns int) PipelineOption[*ShadowPipeline] {
+	return func(pipeline *ShadowPipeline) {
+		pipeline.MaxShadowRuns = maxRuns
+	}
+}
+
+// NewShadowPipeline creates a pipeline that returns the outputs of primary while mirroring the given fraction
+// (between 0 and 1) of the batches to shadow. The wrapped pipelines are not owned by the shadow pipeline and
+// must be destroyed separately, e.g. by the session that created them.
+func NewShadowPipeline(name string, primary Pipeline, shadow Pipeline, fraction float64, opts ...PipelineOption[*ShadowPipeline]) (*ShadowPipeline, error) {
+	pipeline := &ShadowPipeline{
+		PipelineName:                name,
+		Primary:                     primary,
+		Shadow:                      shadow,
+		Fraction:                    fraction,
+		EmbeddingAgreementThreshold: 0.99,
+		ShadowStats:                 &ShadowStats{},
+	}
+	for _, o := range opts {
+		o(pipeline)
+	}
+
+	// defaults
+	if pipeline.MaxShadowRuns == 0 {
+		pipeline.MaxShadowRuns = 4
+	}
+
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	pipeline.slots = make(chan struct{}, pipeline.MaxShadowRuns)
+	return pipeline, nil
+}
+
+func (p *ShadowPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.Primary == nil || p.Shadow == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: both a primary and a shadow pipeline are required"))
+	}
+	if p.Fraction < 0 || p.Fraction > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: shadow fraction must be between 0 and 1, got %f", p.Fraction))
+	}
+	if p.MaxShadowRuns <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: max shadow runs must be greater than 0, got %d", p.MaxShadowRuns))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy stops mirroring new batches and waits for any in-flight shadow runs to complete. The wrapped pipelines
+// are not destroyed.
+func (p *ShadowPipeline) Destroy() error {
+	p.mutex.Lock()
+	p.destroyed = true
+	p.mutex.Unlock()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *ShadowPipeline) GetOutputDim() int {
+	return p.Primary.GetOutputDim()
+}
+
+func (p *ShadowPipeline) GetStats() []string {
+	compared := atomic.LoadUint64(&p.ShadowStats.NumCompared)
+	agreements := atomic.LoadUint64(&p.ShadowStats.NumAgreements)
+	agreementRate := 0.0
+	if compared > 0 {
+		agreementRate = float64(agreements) / float64(compared)
+	}
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Shadow: Batches=%d, Shadowed batches=%d, Compared inputs=%d, Agreement rate=%.4f, Shadow errors=%d, Skipped batches=%d",
+			atomic.LoadUint64(&p.ShadowStats.NumBatches),
+			atomic.LoadUint64(&p.ShadowStats.NumShadowed),
+			compared,
+			agreementRate,
+			atomic.LoadUint64(&p.ShadowStats.NumErrors),
+			atomic.LoadUint64(&p.ShadowStats.NumSkipped)),
+	}
+}
+
+// Run the primary pipeline on a string batch, mirroring it to the shadow pipeline if sampled. A sampled batch is
+// skipped if MaxShadowRuns shadow runs are already in flight or the pipeline has been destroyed.
+func (p *ShadowPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	atomic.AddUint64(&p.ShadowStats.NumBatches, 1)
+	output, err := p.Primary.Run(inputs)
+	if err != nil {
+		return output, err
+	}
+	if p.Fraction > 0 && rand.Float64() < p.Fraction { //nolint:gosec // sampling does not need a secure source
+		p.startShadow(inputs, output)
+	}
+	return output, nil
+}
+
+// startShadow starts a shadow run if a slot is free. The wait group is only added to under the mutex, so that it
+// cannot race with the wait in Destroy.
+func (p *ShadowPipeline) startShadow(inputs []string, output PipelineBatchOutput) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.destroyed {
+		atomic.AddUint64(&p.ShadowStats.NumSkipped, 1)
+		return
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		atomic.AddUint64(&p.ShadowStats.NumSkipped, 1)
+		return
+	}
+	atomic.AddUint64(&p.ShadowStats.NumShadowed, 1)
+	p.wg.Add(1)
+	go p.runShadow(inputs, output)
+}
+
+func (p *ShadowPipeline) runShadow(inputs []string, primaryOutput PipelineBatchOutput) {
+	defer func() {
+		<-p.slots
+		p.wg.Done()
+	}()
+	shadowOutput, err := p.Shadow.Run(inputs)
+	if err != nil {
+		atomic.AddUint64(&p.ShadowStats.NumErrors, 1)
+		return
+	}
+	primaryResults := primaryOutput.GetOutput()
+	shadowResults := shadowOutput.GetOutput()
+	for i := 0; i < len(primaryResults) && i < len(shadowResults); i++ {
+		atomic.AddUint64(&p.ShadowStats.NumCompared, 1)
+		if p.outputsAgree(primaryResults[i], shadowResults[i]) {
+			atomic.AddUint64(&p.ShadowStats.NumAgreements, 1)
+		}
+	}
+}
+
+// outputsAgree compares the outputs of the two pipelines for a single input. Classifications agree if they
+// predict the same labels, entities agree if they have the same types and spans, and embeddings agree if their
+// cosine similarity is above the configured threshold.
+func (p *ShadowPipeline) outputsAgree(a any, b any) bool {
+	switch primary := a.(type) {
+	case []ClassificationOutput:
+		shadow, ok := b.([]ClassificationOutput)
+		if !ok || len(primary) != len(shadow) {
+			return false
+		}
+		for i := range primary {
+			if primary[i].Label != shadow[i].Label {
+				return false
+			}
+		}
+		return true
+	case []Entity:
+		shadow, ok := b.([]Entity)
+		if !ok || len(primary) != len(shadow) {
+			return false
+		}
+		for i := range primary {
+			if primary[i].Entity != shadow[i].Entity || primary[i].Start != shadow[i].Start || primary[i].End != shadow[i].End {
+				return false
+			}
+		}
+		return true
+	case []float32:
+		shadow, ok := b.([]float32)
+		if !ok || len(primary) != len(shadow) {
+			return false
+		}
+		return util.CosineSimilarity(primary, shadow) >= p.EmbeddingAgreementThreshold
+	default:
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// StateHandle carries the state tensors of a stateful model between the calls of a stream, e.g. the hidden state of
+// a streaming audio classifier or the past of a text classifier reading a document chunk by chunk. A model input is
+// a state if it is fed back from an output of the previous call: past_X from present_X, or X_in from X_out, unless
+// WithStateTensors declares the pairs. The state is zero on the first call and after Reset.
+//
+// A handle belongs to one stream: the batch size must not change between its calls. It is safe for concurrent use,
+// but the calls of a stream must be ordered by the caller for the state to be meaningful.
+type StateHandle struct {
+	mutex  sync.Mutex
+	states map[string]stateTensor
+}
+
+// stateTensor is the data of a state input, kept as a go slice so that the handle holds no onnxruntime memory.
+type stateTensor struct {
+	shape ort.Shape
+	data  []float32
+}
+
+// NewStateHandle returns an empty state handle. See also Session.GetStateHandle.
+func NewStateHandle() *StateHandle {
+	return &StateHandle{states: map[string]stateTensor{}}
+}
+
+// Reset clears the state, e.g. at the start of a new stream.
+func (h *StateHandle) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.states = map[string]stateTensor{}
+}
+
+// WithStateTensors declares the state tensors of a stateful model as a map of model input names to the names of the
+// outputs they are fed back from, for models not following the past_X/present_X or X_in/X_out naming.
+// Example: pipelines.WithStateTensors[*pipelines.TextClassificationPipeline](map[string]string{"h": "hn"}).
+func WithStateTensors[T Pipeline](states map[string]string) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().StateTensors = states
+		}
+	}
+}
+
+// stateOutput returns the name of the output a state input is fed back from, and false if the input is not a state.
+func (p *BasePipeline) stateOutput(input string) (string, bool) {
+	if p.StateTensors != nil {
+		output, ok := p.StateTensors[input]
+		return output, ok
+	}
+	var output string
+	switch {
+	case strings.HasPrefix(input, "past_"):
+		output = "present_" + strings.TrimPrefix(input, "past_")
+	case strings.HasSuffix(input, "_in"):
+		output = strings.TrimSuffix(input, "_in") + "_out"
+	default:
+		return "", false
+	}
+	for _, meta := range p.OutputsMeta {
+		if meta.Name == output {
+			return output, true
+		}
+	}
+	return "", false
+}
+
+// isStateful returns whether the model has state inputs.
+func (p *BasePipeline) isStateful() bool {
+	for _, input := range p.InputsMeta {
+		if _, ok := p.stateOutput(input.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stateTensor returns the tensor of a state input, zero if the handle has no state for it yet. The batch dimension
+// (the first dynamic one) of a zero state is the batch size, and its other dynamic dimensions are 1, as tensors
+// cannot have a zero dimension: models with a growing past must accept, or mask, this initial zero step.
+func (h *StateHandle) stateTensor(input ort.InputOutputInfo, batchSize int64) (ort.ArbitraryTensor, error) {
+	if input.DataType != ort.TensorElementDataTypeFloat {
+		return nil, fmt.Errorf("state input %s must be float32", input.Name)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	state, ok := h.states[input.Name]
+	if !ok {
+		shape := make(ort.Shape, len(input.Dimensions))
+		batchDimension := true
+		for i, dimension := range input.Dimensions {
+			switch {
+			case dimension > 0:
+				shape[i] = dimension
+			case batchDimension:
+				shape[i] = batchSize
+				batchDimension = false
+			default:
+				shape[i] = 1
+			}
+		}
+		state = stateTensor{shape: shape, data: make([]float32, shape.FlattenedSize())}
+	}
+	return ort.NewTensor(state.shape.Clone(), append([]float32(nil), state.data...))
+}
+
+// update stores an output of the model as the state of its input.
+func (h *StateHandle) update(input string, output ort.ArbitraryTensor) error {
+	tensor, ok := output.(*ort.Tensor[float32])
+	if !ok {
+		return fmt.Errorf("state output of input %s must be float32", input)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.states[input] = stateTensor{shape: tensor.GetShape().Clone(), data: append([]float32(nil), tensor.GetData()...)}
+	return nil
+}
+
+// runStateful runs the model of the pipeline with output bound to its first output which is not a state. The other
+// outputs of a stateful model are allocated by onnxruntime, and its state outputs update the state handle if any.
+func (p *BasePipeline) runStateful(state *StateHandle, inputs []ort.ArbitraryTensor, output ort.ArbitraryTensor) (err error) {
+	if !p.isStateful() {
+		return p.runSession(p.OrtSession, inputs, []ort.ArbitraryTensor{output})
+	}
+	outputs := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	outputs[p.firstOutput()] = output
+	if err = p.runSession(p.OrtSession, inputs, outputs); err != nil {
+		return err
+	}
+	return p.updateState(state, outputs, output)
+}
+
+// firstOutput returns the index of the first output of the model which is not a state.
+func (p *BasePipeline) firstOutput() int {
+	stateInputs := p.stateInputs()
+	for i, meta := range p.OutputsMeta {
+		if _, isState := stateInputs[meta.Name]; !isState {
+			return i
+		}
+	}
+	return 0
+}
+
+// stateInputs maps the state outputs of the model to the inputs they are fed back to.
+func (p *BasePipeline) stateInputs() map[string]string {
+	stateInputs := map[string]string{}
+	for _, input := range p.InputsMeta {
+		if output, ok := p.stateOutput(input.Name); ok {
+			stateInputs[output] = input.Name
+		}
+	}
+	return stateInputs
+}
+
+// updateState stores the state outputs of a run in the state handle, if not nil, and destroys the outputs allocated
+// by onnxruntime, i.e. all but bound.
+func (p *BasePipeline) updateState(state *StateHandle, outputs []ort.ArbitraryTensor, bound ort.ArbitraryTensor) error {
+	var err error
+	stateInputs := p.stateInputs()
+	for i, meta := range p.OutputsMeta {
+		if outputs[i] == nil || outputs[i] == bound {
+			continue
+		}
+		if input, isState := stateInputs[meta.Name]; isState && state != nil {
+			err = errors.Join(err, state.update(input, outputs[i]))
+		}
+		err = errors.Join(err, outputs[i].Destroy())
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package pipelines
+
+import (
+	"sync/atomic"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// batchSizeBuckets is the number of buckets of the batch size histogram: batches of up to 1, 2, 4, ... 512 inputs,
+// and larger batches.
+const batchSizeBuckets = 11
+
+// PipelineStatistics is a snapshot of the statistics of a pipeline, the structured counterpart of GetStats, e.g. to
+// track the performance of a pipeline across runs.
+type PipelineStatistics struct {
+	Name string
+	// TokenizerTimings are the timings of the tokenization of the batches.
+	TokenizerTimings Timings
+	// PipelineTimings are the timings of the runs of the model on the batches.
+	PipelineTimings Timings
+	// Usage is the number of tokens processed.
+	Usage Usage
+	// BatchSizes is the histogram of the batch sizes of the model runs, without the empty buckets.
+	BatchSizes []BatchSizeBucket
+}
+
+// BatchSizeBucket counts the model runs on batches of more than the MaxSize of the previous bucket and up to
+// MaxSize inputs. The MaxSize of the last bucket is -1, for the batches larger than the other buckets.
+type BatchSizeBucket struct {
+	MaxSize int
+	Count   uint64
+}
+
+// GetStatistics returns a snapshot of the statistics of the pipeline.
+func (p *BasePipeline) GetStatistics() PipelineStatistics {
+	statistics := PipelineStatistics{
+		Name:  p.PipelineName,
+		Usage: p.GetTotalUsage(),
+	}
+	if p.TokenizerTimings != nil {
+		statistics.TokenizerTimings = Timings{
+			NumCalls: atomic.LoadUint64(&p.TokenizerTimings.NumCalls),
+			TotalNS:  atomic.LoadUint64(&p.TokenizerTimings.TotalNS),
+		}
+	}
+	if p.PipelineTimings != nil {
+		statistics.PipelineTimings = Timings{
+			NumCalls: atomic.LoadUint64(&p.PipelineTimings.NumCalls),
+			TotalNS:  atomic.LoadUint64(&p.PipelineTimings.TotalNS),
+		}
+	}
+	for i := range p.batchSizes {
+		count := atomic.LoadUint64(&p.batchSizes[i])
+		if count == 0 {
+			continue
+		}
+		maxSize := 1 << i
+		if i == batchSizeBuckets-1 {
+			maxSize = -1
+		}
+		statistics.BatchSizes = append(statistics.BatchSizes, BatchSizeBucket{MaxSize: maxSize, Count: count})
+	}
+	return statistics
+}
+
+// recordBatchSize adds a model run to the batch size histogram. The batch size is the first dimension of the first
+// input of the model.
+func (p *BasePipeline) recordBatchSize(inputs []ort.ArbitraryTensor) {
+	if len(inputs) == 0 || len(inputs[0].GetShape()) == 0 {
+		return
+	}
+	size := inputs[0].GetShape()[0]
+	bucket := 0
+	for bucket < batchSizeBuckets-1 && int64(1)<<bucket < size {
+		bucket++
+	}
+	atomic.AddUint64(&p.batchSizes[bucket], 1)
+}
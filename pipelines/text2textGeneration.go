@@ -0,0 +1,146 @@
+package pipelines
+
+import (
+	"errors"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/tokenizers"
+)
+
+// Text2TextGenerationPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/text2text_generation.py
+// for encoder-decoder models such as T5 and FLAN-T5 exported to onnx as an encoder and a decoder. Any prompted
+// sequence to sequence task can be run, e.g. "summarize: ..." or "Answer the question: ...". The length of the
+// outputs is set with WithMaxNewTokens.
+
+// types
+
+type Text2TextGenerationPipeline struct {
+	BaseSeq2SeqPipeline
+	// Prefix is prepended to every input, e.g. "summarize: " for T5 models.
+	Prefix string
+}
+
+type Text2TextGenerationOutput struct {
+	Usage
+	Diagnostics
+	GeneratedTexts []string
+}
+
+func (t *Text2TextGenerationOutput) GetOutput() []any {
+	out := make([]any, len(t.GeneratedTexts))
+	for i, text := range t.GeneratedTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+// options
+
+// WithTaskPrefix prepends a task prefix to every input, e.g. "translate English to German: " for T5 models.
+func WithTaskPrefix(prefix string) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.Prefix = prefix
+	}
+}
+
+// NewText2TextGenerationPipeline initializes a text2text generation pipeline.
+func NewText2TextGenerationPipeline(config PipelineConfig[*Text2TextGenerationPipeline], ortOptions *ort.SessionOptions) (*Text2TextGenerationPipeline, error) {
+	pipeline := &Text2TextGenerationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	generationConfig, err := loadGenerationConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.GenerationConfig = generationConfig
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// tokenizer
+	pipeline.TokenizerOptions = []tokenizers.EncodeOption{tokenizers.WithReturnAttentionMask()}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx models
+	err = pipeline.loadSeq2SeqModel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *Text2TextGenerationPipeline) Validate() error {
+	return errors.Join(p.validateSeq2Seq()...)
+}
+
+// Preprocess tokenizes the inputs with the task prefix.
+func (p *Text2TextGenerationPipeline) Preprocess(inputs []string) PipelineBatch {
+	if p.Prefix == "" {
+		return p.BasePipeline.Preprocess(inputs)
+	}
+	prefixed := make([]string, len(inputs))
+	for i, input := range inputs {
+		prefixed[i] = p.Prefix + input
+	}
+	return p.BasePipeline.Preprocess(prefixed)
+}
+
+// Forward encodes the inputs and decodes the outputs, returning the generated token ids.
+func (p *Text2TextGenerationPipeline) Forward(batch PipelineBatch) (generated [][]int64, err error) {
+	hiddenStates, err := p.encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, hiddenStates.Destroy())
+	}()
+	var encoderAttentionMask []int64
+	if p.hasAttentionMask {
+		encoderAttentionMask = batch.AttentionMasksTensor
+	}
+	return p.generate(hiddenStates, encoderAttentionMask, []int64{p.GenerationConfig.DecoderStartTokenId})
+}
+
+// Postprocess decodes the generated tokens.
+func (p *Text2TextGenerationPipeline) Postprocess(batch PipelineBatch, generated [][]int64) (*Text2TextGenerationOutput, error) {
+	usage := batchUsage(batch)
+	for _, tokens := range generated {
+		usage.GeneratedTokens += uint64(len(tokens))
+	}
+	return &Text2TextGenerationOutput{
+		Usage:          p.recordUsage(usage),
+		Diagnostics:    batchDiagnostics(batch),
+		GeneratedTexts: p.decodeGenerated(generated),
+	}, nil
+}
+
+// Run the pipeline on a string batch
+func (p *Text2TextGenerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline generates an output text for each input.
+func (p *Text2TextGenerationPipeline) RunPipeline(inputs []string) (*Text2TextGenerationOutput, error) {
+	if len(inputs) == 0 {
+		return &Text2TextGenerationOutput{}, nil
+	}
+	batch := p.Preprocess(inputs)
+	generated, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, generated)
+}
@@ -3,6 +3,7 @@ package pipelines
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/knights-analytics/tokenizers"
 	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/exp/slices"
 )
 
 // types
@@ -20,10 +22,40 @@ type TextClassificationPipeline struct {
 	IdLabelMap              map[int]string
 	AggregationFunctionName string
 	ProblemType             string
+	Explain                 bool
+	// AbstentionThreshold is the minimum top score for a prediction, below which the AbstainLabel is returned.
+	AbstentionThreshold float32
+	LabelMapping        map[string]string
+	// TopK is the maximum number of labels returned per input, ranked by score. If zero, single label pipelines
+	// return the top label and multi label pipelines all the labels in model order, unless AllScores is set.
+	TopK int
+	// AllScores returns the scores of all the labels per input, ranked by score.
+	AllScores bool
+	// CalibrationFilename is the calibration file applied to the logits, if set.
+	CalibrationFilename string
+	Calibration         *Calibration
+	// LabelThresholds are the minimum scores of the labels to be returned.
+	LabelThresholds map[string]float32
+	// SuppressedLabels are never returned.
+	SuppressedLabels []string
+	// Chunking splits the inputs longer than the maximum length of the model into chunks sharing ChunkStride tokens,
+	// whose scores are merged with ChunkMerge: MAX, MEAN or TOKENS.
+	Chunking    bool
+	ChunkStride int
+	ChunkMerge  string
 }
 
 type TextClassificationPipelineConfig struct {
-	IdLabelMap map[int]string `json:"id2label"`
+	IdLabelMap  map[int]string `json:"id2label"`
+	NumLabels   int            `json:"num_labels"`
+	ProblemType string         `json:"problem_type"`
+}
+
+// TextPair is an input of two texts classified together, e.g. a premise and a hypothesis for natural language
+// inference models, or two questions for duplicate question models.
+type TextPair struct {
+	Text     string
+	TextPair string
 }
 
 type ClassificationOutput struct {
@@ -31,8 +63,35 @@ type ClassificationOutput struct {
 	Score float32
 }
 
+// TokenContribution is the contribution of a token to the score of the top label of an input: the drop in the
+// score when the token is occluded. Negative contributions are tokens that lower the score. Start and End are the
+// offsets of the token in the input.
+type TokenContribution struct {
+	Token        string
+	Start        uint
+	End          uint
+	Contribution float32
+}
+
 type TextClassificationOutput struct {
+	Usage
+	Diagnostics
 	ClassificationOutputs [][]ClassificationOutput
+	// Explanations holds the token contributions of each input, if the pipeline was created with
+	// WithOcclusionExplanations.
+	Explanations [][]TokenContribution
+	// Chunks holds the classification of each chunk of each input, if the pipeline was created with
+	// WithChunkedClassification.
+	Chunks [][]ChunkClassification `json:",omitempty"`
+}
+
+// ChunkClassification is the classification of a chunk of a long input. Start and End are the offsets of the chunk
+// in the input.
+type ChunkClassification struct {
+	Start                 uint
+	End                   uint
+	Tokens                int
+	ClassificationOutputs []ClassificationOutput
 }
 
 func (t *TextClassificationOutput) GetOutput() []any {
@@ -43,6 +102,10 @@ func (t *TextClassificationOutput) GetOutput() []any {
 	return out
 }
 
+// AbstainLabel is the label returned instead of a prediction when the top score of an input is below the
+// abstention threshold of the pipeline, see WithAbstention.
+const AbstainLabel = "abstain"
+
 // options
 
 type TextClassificationOption func(eo *TextClassificationPipeline)
@@ -71,6 +134,99 @@ func WithMultiLabel() PipelineOption[*TextClassificationPipeline] {
 	}
 }
 
+// WithRegression returns the raw outputs of the model for all the labels, without aggregation function, for
+// regression models (e.g. a sentiment intensity score).
+func WithRegression() PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.ProblemType = "regression"
+		pipeline.AggregationFunctionName = "NONE"
+	}
+}
+
+// WithOcclusionExplanations adds the contribution of each token to the top label score to the outputs, so that
+// predictions can be explained. Contributions are computed by occlusion: each token is replaced in turn by the mask
+// token (or the unknown token if the tokenizer has none) and the input is scored again, which multiplies the cost of
+// a run by the number of tokens.
+func WithOcclusionExplanations() PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.Explain = true
+	}
+}
+
+// WithAbstention makes the pipeline abstain on inputs whose top score, after the softmax or sigmoid, is below the
+// threshold: a single output with the AbstainLabel and the top score is returned instead of the prediction, so that
+// uncertain inputs can be routed to human review.
+func WithAbstention(threshold float32) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.AbstentionThreshold = threshold
+	}
+}
+
+// WithTopK returns the k labels with the highest scores per input, ranked by score, as the top_k parameter of the
+// python pipeline. This applies to both single and multi label pipelines.
+func WithTopK(k int) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.TopK = k
+	}
+}
+
+// WithAllScores returns the scores of all the labels per input, ranked by score, as top_k=None in the python
+// pipeline, rather than only the top label. Combined with WithTopK, at most k labels are returned.
+func WithAllScores() PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.AllScores = true
+	}
+}
+
+// WithCalibrationFile calibrates the scores of the model with a json calibration file of temperature and Platt
+// scaling parameters, and optionally per label thresholds, see Calibration. Relative paths are resolved against the
+// model folder. The thresholds of WithLabelThresholds take precedence over those of the file.
+func WithCalibrationFile(filename string) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.CalibrationFilename = filename
+	}
+}
+
+// WithLabelThresholds sets the minimum score of labels to be returned, so that the precision and recall of each
+// label can be tuned: labels scoring below their threshold are removed from the outputs, which can leave an input
+// without labels. Thresholds apply to the labels after WithLabelMapping, labels without threshold are always kept.
+func WithLabelThresholds(thresholds map[string]float32) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.LabelThresholds = thresholds
+	}
+}
+
+// WithSuppressedLabels removes labels from the outputs, e.g. a NEUTRAL label consumers are not interested in, so that
+// they are filtered once by the pipeline rather than by each consumer. Suppression applies to the labels after
+// WithLabelMapping, and can leave an input without labels, like WithLabelThresholds.
+func WithSuppressedLabels(labels []string) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.SuppressedLabels = labels
+	}
+}
+
+// WithChunkedClassification classifies the inputs longer than the maximum length of the model, e.g. long documents,
+// by splitting them into overlapping chunks rather than truncating them, consecutive chunks sharing stride tokens.
+// Each chunk is classified and the scores of the chunks of an input are merged into the scores of the input, see
+// WithChunkMerge; the classification of each chunk is also returned in the Chunks of the output. Chunking is not
+// supported with occlusion explanations, text pairs or a state.
+func WithChunkedClassification(stride int) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.Chunking = true
+		pipeline.ChunkStride = stride
+	}
+}
+
+// WithChunkMerge sets how the scores of the chunks of an input are merged with WithChunkedClassification: MEAN (the
+// default) averages them, TOKENS weights them by their number of tokens, so that a short last chunk counts less, and
+// MAX keeps the highest score of each label, so that a label found in any chunk is found in the input, e.g. to flag
+// documents with a toxic passage.
+func WithChunkMerge(merge string) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.ChunkMerge = merge
+	}
+}
+
 // NewTextClassificationPipeline initializes a new text classification pipeline
 func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipeline], ortOptions *ort.SessionOptions) (*TextClassificationPipeline, error) {
 	pipeline := &TextClassificationPipeline{}
@@ -83,20 +239,27 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 		o(pipeline)
 	}
 
-	if pipeline.ProblemType == "" {
-		pipeline.ProblemType = "singleLabel"
-	}
-	if pipeline.AggregationFunctionName == "" {
-		if pipeline.PipelineName == "singleLabel" {
-			pipeline.AggregationFunctionName = "SOFTMAX"
-		} else {
-			pipeline.AggregationFunctionName = "SIGMOID"
-		}
-	}
-
 	pipeline.TokenizerOptions = []tokenizers.EncodeOption{
 		tokenizers.WithReturnAttentionMask(),
 	}
+	if pipeline.Explain {
+		pipeline.TokenizerOptions = append(pipeline.TokenizerOptions,
+			tokenizers.WithReturnTokens(),
+			tokenizers.WithReturnSpecialTokensMask(),
+			tokenizers.WithReturnOffsets(),
+		)
+	} else if pipeline.Chunking {
+		// the chunks keep the special tokens of their input, and their offsets are returned
+		pipeline.TokenizerOptions = append(pipeline.TokenizerOptions,
+			tokenizers.WithReturnSpecialTokensMask(),
+			tokenizers.WithReturnOffsets(),
+		)
+	}
+	if pipeline.Chunking && pipeline.ChunkMerge == "" {
+		pipeline.ChunkMerge = "MEAN"
+	}
+	// long inputs are split into chunks rather than truncated by the tokenizer
+	pipeline.untruncated = pipeline.Chunking
 
 	configPath := util.PathJoinSafe(pipeline.ModelPath, "config.json")
 	pipelineInputConfig := TextClassificationPipelineConfig{}
@@ -110,6 +273,32 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 	}
 
 	pipeline.IdLabelMap = pipelineInputConfig.IdLabelMap
+	if len(pipeline.IdLabelMap) == 0 && pipelineInputConfig.NumLabels > 0 {
+		// the default labels of transformers configs
+		pipeline.IdLabelMap = map[int]string{}
+		for i := 0; i < pipelineInputConfig.NumLabels; i++ {
+			pipeline.IdLabelMap[i] = fmt.Sprintf("LABEL_%d", i)
+		}
+	}
+	pipeline.configureProblemType(pipelineInputConfig.ProblemType)
+
+	if pipeline.CalibrationFilename != "" {
+		calibration, calibrationErr := loadCalibration(pipeline.ModelPath, pipeline.CalibrationFilename)
+		if calibrationErr != nil {
+			return nil, calibrationErr
+		}
+		pipeline.Calibration = calibration
+		if len(calibration.Thresholds) > 0 {
+			thresholds := map[string]float32{}
+			for label, threshold := range calibration.Thresholds {
+				thresholds[label] = threshold
+			}
+			for label, threshold := range pipeline.LabelThresholds {
+				thresholds[label] = threshold
+			}
+			pipeline.LabelThresholds = thresholds
+		}
+	}
 	pipeline.PipelineTimings = &Timings{}
 	pipeline.TokenizerTimings = &Timings{}
 
@@ -119,7 +308,7 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 		return nil, loadErr
 	}
 
-	pipeline.OutputDim = int(pipeline.OutputsMeta[0].Dimensions[1])
+	pipeline.OutputDim = int(pipeline.OutputsMeta[pipeline.firstOutput()].Dimensions[1])
 
 	// validate
 	validationErrors := pipeline.Validate()
@@ -130,6 +319,32 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 	return pipeline, nil
 }
 
+// configureProblemType sets the problem type and aggregation function not set by options from the problem_type and
+// the labels of the model config, as the python pipeline does: regression models return their raw outputs, multi
+// label models and models with a single label the sigmoid of their outputs, and other models their softmax.
+func (p *TextClassificationPipeline) configureProblemType(configProblemType string) {
+	if p.ProblemType == "" {
+		switch configProblemType {
+		case "multi_label_classification":
+			p.ProblemType = "multiLabel"
+		case "regression":
+			p.ProblemType = "regression"
+		default:
+			p.ProblemType = "singleLabel"
+		}
+	}
+	if p.AggregationFunctionName == "" {
+		switch {
+		case p.ProblemType == "regression":
+			p.AggregationFunctionName = "NONE"
+		case p.ProblemType == "multiLabel" || len(p.IdLabelMap) == 1:
+			p.AggregationFunctionName = "SIGMOID"
+		default:
+			p.AggregationFunctionName = "SOFTMAX"
+		}
+	}
+}
+
 func (p *TextClassificationPipeline) Validate() error {
 	var validationErrors []error
 
@@ -145,10 +360,43 @@ func (p *TextClassificationPipeline) Validate() error {
 	if len(p.IdLabelMap) != p.OutputDim {
 		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: length of id2label map does not match model output dimension"))
 	}
+	if p.AbstentionThreshold < 0 || p.AbstentionThreshold > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: abstention threshold must be between 0 and 1, got %f", p.AbstentionThreshold))
+	}
+	if p.Calibration != nil {
+		if err := p.Calibration.validate(p.IdLabelMap); err != nil {
+			validationErrors = append(validationErrors, err)
+		}
+	}
+	for label, threshold := range p.LabelThresholds {
+		if threshold < 0 || threshold > 1 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: threshold of label %s must be between 0 and 1, got %f", label, threshold))
+		}
+	}
+	if p.TopK < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: top k must not be negative, got %d", p.TopK))
+	}
+	if p.Chunking {
+		if p.ChunkStride < 0 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk stride must not be negative, got %d", p.ChunkStride))
+		} else if p.ChunkStride >= p.windowLength()-p.pairTemplate.specialLength() {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk stride %d must be smaller than the chunk of %d tokens", p.ChunkStride, p.windowLength()-p.pairTemplate.specialLength()))
+		}
+		if p.ChunkMerge != "MAX" && p.ChunkMerge != "MEAN" && p.ChunkMerge != "TOKENS" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: chunk merge must be MAX, MEAN or TOKENS, got %s", p.ChunkMerge))
+		}
+		if p.Explain {
+			validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: occlusion explanations are not supported with chunking"))
+		}
+	}
 	return errors.Join(validationErrors...)
 }
 
 func (p *TextClassificationPipeline) Forward(batch PipelineBatch) (PipelineBatch, error) {
+	return p.forwardWithinBudget(batch, p.forward)
+}
+
+func (p *TextClassificationPipeline) forward(batch PipelineBatch) (PipelineBatch, error) {
 	start := time.Now()
 
 	actualBatchSize := int64(len(batch.Input))
@@ -174,7 +422,7 @@ func (p *TextClassificationPipeline) Forward(batch PipelineBatch) (PipelineBatch
 	}(outputTensor)
 
 	// Run Onnx model
-	errOnnx := p.OrtSession.Run(inputTensors, []ort.ArbitraryTensor{outputTensor})
+	errOnnx := p.runStateful(batch.State, inputTensors, outputTensor)
 	if errOnnx != nil {
 		return batch, errOnnx
 	}
@@ -185,9 +433,71 @@ func (p *TextClassificationPipeline) Forward(batch PipelineBatch) (PipelineBatch
 	return batch, err
 }
 
-func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClassificationOutput, error) {
-	outputTensor := batch.OutputTensor
-	output := make([][]float32, len(batch.Input))
+func (p *TextClassificationPipeline) setLabelMapping(mapping map[string]string) {
+	p.LabelMapping = mapping
+}
+
+// mapLabels returns the scores of the mapped labels, in the order of their first model label. The scores of the
+// model labels mapped to the same label are summed for softmax scores and their maximum is kept for sigmoid scores.
+func (p *TextClassificationPipeline) mapLabels(scores []float32) ([]ClassificationOutput, error) {
+	var mapped []ClassificationOutput
+	positions := map[string]int{}
+	for j, score := range scores {
+		label, ok := p.IdLabelMap[j]
+		if !ok {
+			return nil, fmt.Errorf("class with index number %d not found in id label map", j)
+		}
+		if mappedLabel, ok := p.LabelMapping[label]; ok {
+			label = mappedLabel
+		}
+		position, seen := positions[label]
+		if !seen {
+			positions[label] = len(mapped)
+			mapped = append(mapped, ClassificationOutput{Label: label, Score: score})
+			continue
+		}
+		if p.AggregationFunctionName == "SOFTMAX" {
+			mapped[position].Score += score
+		} else if score > mapped[position].Score {
+			mapped[position].Score = score
+		}
+	}
+	return mapped, nil
+}
+
+// rankLabels returns the (mapped) labels with their scores, from the highest score to the lowest, at most TopK.
+func (p *TextClassificationPipeline) rankLabels(scores []float32) ([]ClassificationOutput, error) {
+	ranked, err := p.mapLabels(scores)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	if p.TopK > 0 && p.TopK < len(ranked) {
+		ranked = ranked[:p.TopK]
+	}
+	return ranked, nil
+}
+
+// applyThresholds removes the outputs of the suppressed labels, and those scoring below the threshold of their label.
+func (p *TextClassificationPipeline) applyThresholds(outputs []ClassificationOutput) []ClassificationOutput {
+	kept := make([]ClassificationOutput, 0, len(outputs))
+	for _, output := range outputs {
+		if slices.Contains(p.SuppressedLabels, output.Label) {
+			continue
+		}
+		if threshold, ok := p.LabelThresholds[output.Label]; ok && output.Score < threshold {
+			continue
+		}
+		kept = append(kept, output)
+	}
+	return kept
+}
+
+// scores applies the aggregation function to the logits of each input of a batch.
+func (p *TextClassificationPipeline) scores(outputTensor []float32, batchSize int) ([][]float32, error) {
+	output := make([][]float32, batchSize)
 	inputCounter := 0
 	vectorCounter := 0
 	inputVector := make([]float32, p.OutputDim)
@@ -197,6 +507,10 @@ func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClas
 		aggregationFunction = util.Sigmoid
 	case "SOFTMAX":
 		aggregationFunction = util.SoftMax
+	case "NONE":
+		aggregationFunction = func(logits []float32) []float32 {
+			return logits
+		}
 	default:
 		return nil, fmt.Errorf("aggregation function %s is not supported", p.AggregationFunctionName)
 	}
@@ -204,7 +518,9 @@ func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClas
 	for _, result := range outputTensor {
 		inputVector[vectorCounter] = result
 		if vectorCounter == p.OutputDim-1 {
-
+			if p.Calibration != nil {
+				p.Calibration.apply(inputVector, p.IdLabelMap)
+			}
 			output[inputCounter] = aggregationFunction(inputVector)
 			vectorCounter = 0
 			inputVector = make([]float32, p.OutputDim)
@@ -213,14 +529,28 @@ func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClas
 			vectorCounter++
 		}
 	}
+	return output, nil
+}
 
-	batchClassificationOutputs := TextClassificationOutput{
-		ClassificationOutputs: make([][]ClassificationOutput, len(batch.Input)),
+func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClassificationOutput, error) {
+	output, err := p.scores(batch.OutputTensor, len(batch.Input))
+	if err != nil {
+		return nil, err
 	}
+	classificationOutputs, err := p.classify(output)
+	return &TextClassificationOutput{
+		ClassificationOutputs: classificationOutputs,
+		Usage:                 p.recordUsage(batchUsage(batch)),
+		Diagnostics:           batchDiagnostics(batch),
+	}, err
+}
 
+// classify returns the labels of each input from its scores.
+func (p *TextClassificationPipeline) classify(output [][]float32) ([][]ClassificationOutput, error) {
 	var err error
+	classificationOutputs := make([][]ClassificationOutput, len(output))
 
-	for i := 0; i < len(batch.Input); i++ {
+	for i := 0; i < len(output); i++ {
 		switch p.ProblemType {
 		case "singleLabel":
 			inputClassificationOutputs := make([]ClassificationOutput, 1)
@@ -237,8 +567,8 @@ func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClas
 				Label: class,
 				Score: value,
 			}
-			batchClassificationOutputs.ClassificationOutputs[i] = inputClassificationOutputs
-		case "multiLabel":
+			classificationOutputs[i] = inputClassificationOutputs
+		case "multiLabel", "regression":
 			inputClassificationOutputs := make([]ClassificationOutput, len(p.IdLabelMap))
 			for j := range output[i] {
 				class, ok := p.IdLabelMap[j]
@@ -250,12 +580,51 @@ func (p *TextClassificationPipeline) Postprocess(batch PipelineBatch) (*TextClas
 					Score: output[i][j],
 				}
 			}
-			batchClassificationOutputs.ClassificationOutputs[i] = inputClassificationOutputs
+			classificationOutputs[i] = inputClassificationOutputs
 		default:
 			err = fmt.Errorf("problem type %s not recognized", p.ProblemType)
 		}
+		if len(p.LabelMapping) > 0 {
+			mapped, errMap := p.mapLabels(output[i])
+			if errMap != nil {
+				err = errMap
+				continue
+			}
+			if p.ProblemType == "singleLabel" {
+				top := 0
+				for j := range mapped {
+					if mapped[j].Score > mapped[top].Score {
+						top = j
+					}
+				}
+				mapped = mapped[top : top+1]
+			}
+			classificationOutputs[i] = mapped
+		}
+		if p.TopK > 0 || p.AllScores {
+			ranked, errRank := p.rankLabels(output[i])
+			if errRank != nil {
+				err = errRank
+				continue
+			}
+			classificationOutputs[i] = ranked
+		}
+		if len(p.LabelThresholds) > 0 || len(p.SuppressedLabels) > 0 {
+			classificationOutputs[i] = p.applyThresholds(classificationOutputs[i])
+		}
+		if p.AbstentionThreshold > 0 {
+			var topScore float32
+			for _, classification := range classificationOutputs[i] {
+				if classification.Score > topScore {
+					topScore = classification.Score
+				}
+			}
+			if topScore < p.AbstentionThreshold {
+				classificationOutputs[i] = []ClassificationOutput{{Label: AbstainLabel, Score: topScore}}
+			}
+		}
 	}
-	return &batchClassificationOutputs, err
+	return classificationOutputs, err
 }
 
 // Run the pipeline on a string batch
@@ -265,9 +634,238 @@ func (p *TextClassificationPipeline) Run(inputs []string) (PipelineBatchOutput,
 
 func (p *TextClassificationPipeline) RunPipeline(inputs []string) (*TextClassificationOutput, error) {
 	batch := p.Preprocess(inputs)
+	if p.Chunking {
+		return p.runChunks(batch)
+	}
+	batch, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	output, err := p.Postprocess(batch)
+	if err != nil || !p.Explain {
+		return output, err
+	}
+	output.Explanations, err = p.explain(batch)
+	return output, err
+}
+
+// runChunks splits the inputs of a batch longer than the maximum length of the model into overlapping chunks, runs
+// the model on all the chunks at once and merges the scores of the chunks of each input.
+func (p *TextClassificationPipeline) runChunks(batch PipelineBatch) (*TextClassificationOutput, error) {
+	var chunks []TokenizedInput
+	var owners []int
+	maxSequence := 0
+	for i, input := range batch.Input {
+		inputChunks, _ := p.splitWindows(input, p.ChunkStride)
+		for _, chunk := range inputChunks {
+			chunks = append(chunks, chunk)
+			owners = append(owners, i)
+			if len(chunk.TokenIds) > maxSequence {
+				maxSequence = len(chunk.TokenIds)
+			}
+		}
+	}
+	chunkBatch := p.convertInputToTensors(chunks, maxSequence)
+	chunkBatch, err := p.Forward(chunkBatch)
+	if err != nil {
+		return nil, err
+	}
+	chunkScores, err := p.scores(chunkBatch.OutputTensor, len(chunks))
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([][]float32, len(batch.Input))
+	weights := make([]float32, len(batch.Input))
+	for c, chunkScore := range chunkScores {
+		weight := float32(1)
+		if p.ChunkMerge == "TOKENS" {
+			weight = float32(len(chunks[c].TokenIds))
+		}
+		owner := owners[c]
+		if scores[owner] == nil {
+			scores[owner] = make([]float32, len(chunkScore))
+			if p.ChunkMerge == "MAX" {
+				copy(scores[owner], chunkScore)
+			}
+		}
+		for k, value := range chunkScore {
+			if p.ChunkMerge == "MAX" {
+				if value > scores[owner][k] {
+					scores[owner][k] = value
+				}
+			} else {
+				scores[owner][k] += weight * value
+			}
+		}
+		weights[owner] += weight
+	}
+	if p.ChunkMerge != "MAX" {
+		for i, score := range scores {
+			for k := range score {
+				score[k] /= weights[i]
+			}
+		}
+	}
+
+	output := &TextClassificationOutput{
+		Chunks:      make([][]ChunkClassification, len(batch.Input)),
+		Usage:       p.recordUsage(batchUsage(chunkBatch)),
+		Diagnostics: batchDiagnostics(batch),
+	}
+	output.ClassificationOutputs, err = p.classify(scores)
+	if err != nil {
+		return nil, err
+	}
+	chunkOutputs, err := p.classify(chunkScores)
+	if err != nil {
+		return nil, err
+	}
+	for c, chunk := range chunks {
+		start, end := chunkSpan(chunk)
+		output.Chunks[owners[c]] = append(output.Chunks[owners[c]], ChunkClassification{
+			Start:                 start,
+			End:                   end,
+			Tokens:                len(chunk.TokenIds),
+			ClassificationOutputs: chunkOutputs[c],
+		})
+	}
+	return output, nil
+}
+
+// chunkSpan returns the offsets in the input of the first and last non special tokens of a chunk.
+func chunkSpan(chunk TokenizedInput) (uint, uint) {
+	var start, end uint
+	first := true
+	for j, offset := range chunk.Offsets {
+		if chunk.SpecialTokensMask[j] > 0 {
+			continue
+		}
+		if first {
+			start = offset[0]
+			first = false
+		}
+		end = offset[1]
+	}
+	return start, end
+}
+
+// RunWithState runs the pipeline on the next batch of a stream with a stateful model, e.g. the next chunks of
+// documents read in parallel: the states output by the model are fed back to it on the next call with the same
+// handle. The inputs of a batch are the ith streams of the handle, so their number must not change between calls.
+// Occlusion explanations are not supported with a state.
+func (p *TextClassificationPipeline) RunWithState(inputs []string, state *StateHandle) (*TextClassificationOutput, error) {
+	if p.Explain {
+		return nil, errors.New("occlusion explanations are not supported with a state")
+	}
+	if p.Chunking {
+		return nil, errors.New("chunking is not supported with a state")
+	}
+	batch := p.Preprocess(inputs)
+	batch.State = state
 	batch, err := p.Forward(batch)
 	if err != nil {
 		return nil, err
 	}
 	return p.Postprocess(batch)
 }
+
+// RunPairs runs the pipeline on a batch of text pairs. The two texts of a pair are encoded as one input with the pair
+// template of the tokenizer (e.g. [CLS] text [SEP] text pair [SEP]), with the token type ids of the second text set,
+// as sentence pair classification models expect. Occlusion explanations are not supported for pairs.
+func (p *TextClassificationPipeline) RunPairs(pairs []TextPair) (*TextClassificationOutput, error) {
+	if p.Explain {
+		return nil, errors.New("occlusion explanations are not supported for text pairs")
+	}
+	if p.Chunking {
+		return nil, errors.New("chunking is not supported for text pairs")
+	}
+	batch, err := p.PreprocessPairs(pairs)
+	if err != nil {
+		return nil, err
+	}
+	batch, err = p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch)
+}
+
+// PreprocessPairs tokenizes the text pairs. If the tokenizer truncates its inputs, the longest text of a pair is
+// truncated first.
+func (p *TextClassificationPipeline) PreprocessPairs(pairs []TextPair) (PipelineBatch, error) {
+	start := time.Now()
+
+	inputs := make([]TokenizedInput, len(pairs))
+	maxSequence := 0
+	for i, pair := range pairs {
+		input, err := p.encodePair(pair.Text, pair.TextPair)
+		if err != nil {
+			return PipelineBatch{}, err
+		}
+		inputs[i] = input
+		if len(input.TokenIds) > maxSequence {
+			maxSequence = len(input.TokenIds)
+		}
+	}
+
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return p.convertInputToTensors(inputs, maxSequence), nil
+}
+
+// explain computes the contribution of each token of the inputs to their top label score, by scoring a batch of
+// copies of each input with one token occluded.
+func (p *TextClassificationPipeline) explain(batch PipelineBatch) ([][]TokenContribution, error) {
+	occlusionId, err := p.Vocabulary.SpecialTokenId("mask_token")
+	if err != nil {
+		if occlusionId, err = p.Vocabulary.SpecialTokenId("unk_token"); err != nil {
+			return nil, errors.New("occlusion explanations require a tokenizer with a mask or unknown token")
+		}
+	}
+	scores, err := p.scores(batch.OutputTensor, len(batch.Input))
+	if err != nil {
+		return nil, err
+	}
+
+	explanations := make([][]TokenContribution, len(batch.Input))
+	for i, input := range batch.Input {
+		label, score, err := util.ArgMax(scores[i])
+		if err != nil {
+			return nil, err
+		}
+		var occluded []TokenizedInput
+		var positions []int
+		for j := range input.TokenIds {
+			if input.SpecialTokensMask[j] > 0 || input.AttentionMask[j] == 0 {
+				continue
+			}
+			occludedInput := input
+			occludedInput.TokenIds = append([]uint32(nil), input.TokenIds...)
+			occludedInput.TokenIds[j] = occlusionId
+			occluded = append(occluded, occludedInput)
+			positions = append(positions, j)
+		}
+		explanations[i] = make([]TokenContribution, len(positions))
+		if len(occluded) == 0 {
+			continue
+		}
+		occludedBatch, err := p.Forward(p.convertInputToTensors(occluded, batch.MaxSequence))
+		if err != nil {
+			return nil, err
+		}
+		occludedScores, err := p.scores(occludedBatch.OutputTensor, len(occluded))
+		if err != nil {
+			return nil, err
+		}
+		for k, j := range positions {
+			explanations[i][k] = TokenContribution{
+				Token:        input.Tokens[j],
+				Start:        input.Offsets[j][0],
+				End:          input.Offsets[j][1],
+				Contribution: score - occludedScores[k][label],
+			}
+		}
+	}
+	return explanations, nil
+}
@@ -0,0 +1,297 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/tokenizers"
+)
+
+// TextGenerationPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/text_generation.py
+// for decoder-only models (gpt2, llama, ...) exported to onnx with past key/values. Text is generated greedily.
+
+// types
+
+type TextGenerationPipeline struct {
+	BasePipeline
+	GenerationConfig GenerationConfig
+	cache            *kvCache
+}
+
+type TextGenerationOutput struct {
+	Usage
+	GeneratedTexts    []string
+	GeneratedTokenIds [][]uint32
+}
+
+func (t *TextGenerationOutput) GetOutput() []any {
+	out := make([]any, len(t.GeneratedTexts))
+	for i, text := range t.GeneratedTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+func (p *TextGenerationPipeline) getGenerationConfig() *GenerationConfig {
+	return &p.GenerationConfig
+}
+
+// NewTextGenerationPipeline initializes a text generation pipeline.
+func NewTextGenerationPipeline(config PipelineConfig[*TextGenerationPipeline], ortOptions *ort.SessionOptions) (*TextGenerationPipeline, error) {
+	pipeline := &TextGenerationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	generationConfig, err := loadGenerationConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.GenerationConfig = generationConfig
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// tokenizer
+	pipeline.TokenizerOptions = []tokenizers.EncodeOption{tokenizers.WithReturnAttentionMask()}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	// load onnx model
+	err = pipeline.loadModel()
+	if err != nil {
+		return nil, err
+	}
+
+	modelConfig, err := loadModelConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.cache, err = newKVCache(pipeline.InputsMeta, modelConfig)
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+
+	// the output dimension is the vocabulary size of the logits
+	for _, output := range pipeline.OutputsMeta {
+		if output.Name == "logits" && len(output.Dimensions) == 3 {
+			pipeline.OutputDim = int(output.Dimensions[2])
+		}
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *TextGenerationPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.OutputDim <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model must have a logits output of shape [batch, sequence, vocabulary]"))
+	}
+	if p.GenerationConfig.MaxNewTokens <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: max new tokens must be greater than zero"))
+	}
+	for _, input := range p.InputsMeta {
+		switch input.Name {
+		case "input_ids", "attention_mask", "position_ids", "use_cache_branch":
+		default:
+			if _, ok := p.cache.shapes[input.Name]; !ok {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unsupported model input %s", input.Name))
+			}
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Generate runs greedy decoding over the tokenized prompts and returns the generated token ids of each prompt.
+// Prompts are left padded so that the new tokens of all the sequences are generated at the same position.
+func (p *TextGenerationPipeline) Generate(batch PipelineBatch) ([][]int64, error) {
+	start := time.Now()
+
+	batchSize := len(batch.Input)
+	prompts := make([][]int64, batchSize)
+	maxPromptLength := 0
+	for i, input := range batch.Input {
+		for j, id := range input.TokenIds {
+			if input.AttentionMask[j] != 0 {
+				prompts[i] = append(prompts[i], int64(id))
+			}
+		}
+		if len(prompts[i]) == 0 {
+			return nil, fmt.Errorf("input %d is empty after tokenization", i)
+		}
+		if len(prompts[i]) > maxPromptLength {
+			maxPromptLength = len(prompts[i])
+		}
+	}
+
+	// the attention masks start with the dummy past position of the cache, which is masked out
+	attentionMasks := make([][]int64, batchSize)
+	for i, prompt := range prompts {
+		attentionMasks[i] = make([]int64, 1+maxPromptLength)
+		for j := 1 + maxPromptLength - len(prompt); j < len(attentionMasks[i]); j++ {
+			attentionMasks[i][j] = 1
+		}
+	}
+	cache, err := p.cache.allocate(batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	step := func(nextTokens []int64) ([][]float32, error) {
+		var inputIds []int64
+		sequenceLength := 1
+		if nextTokens == nil {
+			sequenceLength = maxPromptLength
+			inputIds = make([]int64, 0, batchSize*maxPromptLength)
+			for _, prompt := range prompts {
+				for j := len(prompt); j < maxPromptLength; j++ {
+					inputIds = append(inputIds, p.GenerationConfig.PadTokenId)
+				}
+				inputIds = append(inputIds, prompt...)
+			}
+		} else {
+			inputIds = nextTokens
+			for i := range attentionMasks {
+				attentionMasks[i] = append(attentionMasks[i], 1)
+			}
+		}
+		return p.forwardStep(cache, inputIds, attentionMasks, sequenceLength)
+	}
+
+	generated, err := greedySearch(p.GenerationConfig, batchSize, step)
+	err = errors.Join(err, cache.destroy())
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return generated, err
+}
+
+// forwardStep runs the model on the input ids of one decoding step and returns the logits of the next token.
+func (p *TextGenerationPipeline) forwardStep(cache *kvCache, inputIds []int64, attentionMasks [][]int64, sequenceLength int) (logits [][]float32, err error) {
+	batchSize := int64(len(attentionMasks))
+	totalLength := int64(len(attentionMasks[0]))
+
+	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
+	defer func() {
+		for _, tensor := range inputTensors {
+			// past key/values are owned by the cache
+			if _, isPast := tensor.(*ort.Tensor[float32]); tensor != nil && !isPast {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+	for i, input := range p.InputsMeta {
+		var tensorErr error
+		switch input.Name {
+		case "input_ids":
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(batchSize, int64(sequenceLength)), inputIds)
+		case "attention_mask":
+			mask := make([]int64, 0, batchSize*totalLength)
+			for _, m := range attentionMasks {
+				mask = append(mask, m...)
+			}
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(batchSize, totalLength), mask)
+		case "position_ids":
+			// positions count the attended tokens only, so that left padding does not shift them
+			positions := make([]int64, 0, int(batchSize)*sequenceLength)
+			for _, m := range attentionMasks {
+				position := int64(-1)
+				var sequencePositions []int64
+				for _, v := range m {
+					position += v
+					sequencePositions = append(sequencePositions, max64(position, 0))
+				}
+				positions = append(positions, sequencePositions[len(sequencePositions)-sequenceLength:]...)
+			}
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(batchSize, int64(sequenceLength)), positions)
+		case "use_cache_branch":
+			inputTensors[i], tensorErr = newUseCacheBranchTensor(true)
+		default:
+			inputTensors[i] = cache.tensors[input.Name]
+		}
+		if tensorErr != nil {
+			return nil, tensorErr
+		}
+	}
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+	for i, output := range p.OutputsMeta {
+		tensor := outputTensors[i]
+		if inputName, ok := cache.isPresent(output.Name); ok {
+			err = errors.Join(err, cache.update(inputName, tensor))
+			continue
+		}
+		if output.Name == "logits" {
+			logitsTensor, ok := tensor.(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, errors.New("logits output must be float32"))
+			} else {
+				var logitsErr error
+				logits, logitsErr = lastTokenLogits(logitsTensor)
+				err = errors.Join(err, logitsErr)
+			}
+		}
+		err = errors.Join(err, tensor.Destroy())
+	}
+	return logits, err
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Postprocess decodes the generated tokens.
+func (p *TextGenerationPipeline) Postprocess(batch PipelineBatch, generated [][]int64) (*TextGenerationOutput, error) {
+	usage := batchUsage(batch)
+	for _, tokens := range generated {
+		usage.GeneratedTokens += uint64(len(tokens))
+	}
+	output := &TextGenerationOutput{
+		Usage:             p.recordUsage(usage),
+		GeneratedTexts:    make([]string, len(generated)),
+		GeneratedTokenIds: make([][]uint32, len(generated)),
+	}
+	for i, tokens := range generated {
+		ids := make([]uint32, len(tokens))
+		for j, id := range tokens {
+			ids[j] = uint32(id)
+		}
+		output.GeneratedTokenIds[i] = ids
+		output.GeneratedTexts[i] = p.Tokenizer.Decode(ids, true)
+	}
+	return output, nil
+}
+
+// Run the pipeline on a string batch
+func (p *TextGenerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline generates a continuation of each input.
+func (p *TextGenerationPipeline) RunPipeline(inputs []string) (*TextGenerationOutput, error) {
+	batch := p.Preprocess(inputs)
+	generated, err := p.Generate(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, generated)
+}
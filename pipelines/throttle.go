@@ -0,0 +1,51 @@
+package pipelines
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Throttle limits the share of the time a pipeline spends running its model, so that background jobs (e.g. an
+// embedding backfill) can run on a host without starving the workloads it serves. After each run of the model, the
+// next run is delayed long enough for the model to have run TargetUtilization of the time: at 0.25, a run of 100ms is
+// followed by at least 300ms during which the model is idle. Time spent between runs by the caller, e.g. writing the
+// results, counts as idle time.
+type Throttle struct {
+	TargetUtilization float64
+	// ThrottledNS is the total time runs of the model were delayed by the throttle.
+	ThrottledNS uint64
+	mutex       sync.Mutex
+	idleUntil   time.Time
+}
+
+// WithCPUThrottle throttles the runs of the model of the pipeline to a target utilization between 0 and 1, see
+// Throttle. The utilization is that of the threads of the onnxruntime session, so that the throttle is best combined
+// with hugot.WithIntraOpNumThreads to bound the number of cores used while the model runs.
+// Example: pipelines.WithCPUThrottle[*pipelines.FeatureExtractionPipeline](0.25).
+func WithCPUThrottle[T Pipeline](targetUtilization float64) PipelineOption[T] {
+	return func(pipeline T) {
+		if p, ok := any(pipeline).(basePipeline); ok {
+			p.getBase().Throttle = &Throttle{TargetUtilization: targetUtilization}
+		}
+	}
+}
+
+// wait sleeps until the model can run again.
+func (t *Throttle) wait() {
+	t.mutex.Lock()
+	delay := time.Until(t.idleUntil)
+	t.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+		atomic.AddUint64(&t.ThrottledNS, uint64(delay))
+	}
+}
+
+// ran records a run of the model that took busy, delaying the next run accordingly.
+func (t *Throttle) ran(busy time.Duration) {
+	idle := time.Duration(float64(busy) * (1 - t.TargetUtilization) / t.TargetUtilization)
+	t.mutex.Lock()
+	t.idleUntil = time.Now().Add(idle)
+	t.mutex.Unlock()
+}
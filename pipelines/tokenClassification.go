@@ -3,7 +3,10 @@ package pipelines
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	// according to https://freshman.tech/snippets/go/check-if-slice-contains-element
 	"golang.org/x/exp/slices"
@@ -22,7 +25,36 @@ type TokenClassificationPipeline struct {
 	BasePipeline
 	IdLabelMap          map[int]string
 	AggregationStrategy string
+	// TaggingScheme is the scheme of the entity labels of the model: IOB2 (B-, I-), BILOU (B-, I-, L-, U-) or BIOES
+	// (B-, I-, E-, S-).
+	TaggingScheme       string
 	IgnoreLabels        []string
+	CoreferenceGrouping bool
+	LabelMapping        map[string]string
+	// MaxEntityTokens is the maximum number of tokens grouped into one entity, unlimited if zero.
+	MaxEntityTokens int
+	// MergeAdjacentEntities merges consecutive entities of the same type separated only by whitespace and punctuation.
+	MergeAdjacentEntities bool
+	// Stride is the number of tokens shared by consecutive windows of the inputs longer than the maximum length of the
+	// model. Long inputs are truncated if zero.
+	Stride int
+	// ScoreThreshold is the minimum score of the entities returned, unless the entity type has its own threshold in
+	// LabelScoreThresholds.
+	ScoreThreshold       float32
+	LabelScoreThresholds map[string]float32
+	// TokenProbabilities adds the probability of every label for every token to the output.
+	TokenProbabilities bool
+	// ReturnLogits adds the logits of every token to the output.
+	ReturnLogits bool
+	// TokenDistributions adds the label probability distribution of every token to the output, see
+	// WriteTokenDistributions.
+	TokenDistributions bool
+	// OverlappingEntities decodes the spans of each entity type independently, the tokens whose probability of
+	// being in an entity of the type reaches the threshold of the type forming its spans, rather than keeping the
+	// most likely label of each token. Entities of different types can then overlap or nest.
+	OverlappingEntities    bool
+	OverlapThreshold       float32
+	OverlapLabelThresholds map[string]float32
 }
 
 type TokenClassificationPipelineConfig struct {
@@ -39,10 +71,41 @@ type Entity struct {
 	Start     uint
 	End       uint
 	IsSubword bool
+	Mentions  []Mention `json:",omitempty"`
+	// tokenIds are the tokens of a word aggregated by the FIRST, MAX and AVERAGE strategies.
+	tokenIds []uint32
+}
+
+// Mention is the span of one occurrence of an entity in the input.
+type Mention struct {
+	Start uint
+	End   uint
+}
+
+// TokenProbabilities are the label probabilities of a token, as predicted by the model.
+type TokenProbabilities struct {
+	Index         int
+	Word          string
+	Start         uint
+	End           uint
+	Probabilities map[string]float32
 }
 
 type TokenClassificationOutput struct {
+	Usage
+	Diagnostics
 	Entities [][]Entity
+	// TokenProbabilities holds the label probabilities of the tokens of each input, special tokens excluded, if the
+	// pipeline was created with WithTokenProbabilities.
+	TokenProbabilities [][]TokenProbabilities `json:",omitempty"`
+	// Logits holds the logits predicted by the model for each token of each input, special tokens included and
+	// padding excluded, in the order of the token ids and of the model labels, if the pipeline was created with
+	// WithReturnLogits.
+	Logits [][][]float32 `json:",omitempty"`
+	// Distributions holds the label probabilities of each token of each input, special tokens included and padding
+	// excluded, in the order of the token ids and of the model labels, if the pipeline was created with
+	// WithTokenDistributions.
+	Distributions [][][]float32 `json:",omitempty"`
 }
 
 func (t *TokenClassificationOutput) GetOutput() []any {
@@ -61,6 +124,30 @@ func WithSimpleAggregation() PipelineOption[*TokenClassificationPipeline] {
 	}
 }
 
+// WithFirstAggregation labels each word with the label of its first token, then groups the words as the simple
+// aggregation does. Words are never split between entities.
+func WithFirstAggregation() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.AggregationStrategy = "FIRST"
+	}
+}
+
+// WithMaxAggregation labels each word with the label of its token with the highest score, then groups the words as
+// the simple aggregation does. Words are never split between entities.
+func WithMaxAggregation() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.AggregationStrategy = "MAX"
+	}
+}
+
+// WithAverageAggregation labels each word with the label of the average of the scores of its tokens, then groups the
+// words as the simple aggregation does. Words are never split between entities.
+func WithAverageAggregation() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.AggregationStrategy = "AVERAGE"
+	}
+}
+
 func WithoutAggregation() PipelineOption[*TokenClassificationPipeline] {
 	return func(pipeline *TokenClassificationPipeline) {
 		pipeline.AggregationStrategy = "NONE"
@@ -73,6 +160,109 @@ func WithIgnoreLabels(ignoreLabels []string) PipelineOption[*TokenClassification
 	}
 }
 
+// WithTaggingScheme declares the tagging scheme of the model labels, so that the tokens are grouped into entities
+// correctly: IOB2 (the default, B- and I- tags), BILOU (with L- tags ending and U- tags forming single token
+// entities) or BIOES (E- and S- tags, the same as L- and U-).
+func WithTaggingScheme(scheme string) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.TaggingScheme = scheme
+	}
+}
+
+// WithCoreferenceGrouping merges repeated mentions of the same entity (same type and surface form, ignoring case)
+// within an input into a single entity. The merged entity keeps the position of the first mention, averages the
+// scores, and lists the spans of all mentions in Mentions.
+func WithCoreferenceGrouping() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.CoreferenceGrouping = true
+	}
+}
+
+// WithMaxEntityTokens limits the number of tokens grouped into one entity, starting a new entity when the limit is
+// reached, to split the run-on entities of models that rarely predict B- tags.
+func WithMaxEntityTokens(maxTokens int) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.MaxEntityTokens = maxTokens
+	}
+}
+
+// WithAdjacentEntityMerging merges consecutive entities of the same type separated only by whitespace and
+// punctuation (e.g. "Jean" and "Pierre" in "Jean-Pierre"), to repair the fragmented entities of models that predict
+// B- tags too often or label punctuation as O. The merged entity spans both entities and averages their scores.
+// It does not apply without aggregation.
+func WithAdjacentEntityMerging() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.MergeAdjacentEntities = true
+	}
+}
+
+// WithStride splits the inputs longer than the maximum length of the model into overlapping windows rather than
+// truncating them. Consecutive windows share stride tokens, and the entities of the windows are merged back with
+// their offsets in the input: an entity found by two windows is returned once, spanning the tokens both windows found
+// it in, and the longest (then highest scoring) entity is kept where windows disagree on its type.
+func WithStride(stride int) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.Stride = stride
+	}
+}
+
+// WithScoreThreshold drops the entities scoring below threshold during postprocessing.
+func WithScoreThreshold(threshold float32) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.ScoreThreshold = threshold
+	}
+}
+
+// WithLabelScoreThresholds drops the entities scoring below the threshold of their type during postprocessing, e.g.
+// {"MISC": 0.8}. Thresholds apply to the types after WithLabelMapping, like the ignore labels. The types missing from
+// thresholds use the threshold of WithScoreThreshold.
+func WithLabelScoreThresholds(thresholds map[string]float32) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.LabelScoreThresholds = thresholds
+	}
+}
+
+// WithTokenProbabilities adds the probability of every label for every token of the inputs to the output, e.g. to
+// apply a custom decoding.
+func WithTokenProbabilities() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.TokenProbabilities = true
+	}
+}
+
+// WithReturnLogits adds the raw logits of every token to the output, e.g. for calibration or ensembling, without
+// running the model again.
+func WithReturnLogits() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.ReturnLogits = true
+	}
+}
+
+// WithTokenDistributions adds the label probability distribution of every token to the output, for active learning:
+// the distributions can be exported with WriteTokenDistributions, and the inputs to annotate selected with
+// SelectForAnnotation.
+func WithTokenDistributions() PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.TokenDistributions = true
+	}
+}
+
+// WithOverlappingEntities decodes the entities of nested NER models, where a token can be part of entities of
+// several types (e.g. "Bank of England" as an organisation containing a location). Rather than keeping the most
+// likely label of each token, the spans of each entity type are decoded independently: a token is in an entity of a
+// type if the sum of the probabilities of the labels of the type (B-, I-, and the end and single token tags of the
+// tagging scheme) reaches the threshold of the type, given in labelThresholds (e.g. {"LOC": 0.3}) or threshold
+// otherwise. A new entity starts where the beginning and single token tags are more likely than the others. Subword
+// tokens always follow the first token of their word. The score of an entity is the mean probability of its tokens.
+// Entities are sorted by start, longest first.
+func WithOverlappingEntities(threshold float32, labelThresholds map[string]float32) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.OverlappingEntities = true
+		pipeline.OverlapThreshold = threshold
+		pipeline.OverlapLabelThresholds = labelThresholds
+	}
+}
+
 // NewTokenClassificationPipeline Initializes a feature extraction pipeline
 func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPipeline], ortOptions *ort.SessionOptions) (*TokenClassificationPipeline, error) {
 	pipeline := &TokenClassificationPipeline{}
@@ -115,10 +305,16 @@ func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPi
 	if pipeline.AggregationStrategy == "" {
 		pipeline.AggregationStrategy = "SIMPLE"
 	}
+	if pipeline.TaggingScheme == "" {
+		pipeline.TaggingScheme = "IOB2"
+	}
 	if len(pipeline.IgnoreLabels) == 0 {
 		pipeline.IgnoreLabels = []string{"O"}
 	}
 
+	// long inputs are split into windows rather than truncated by the tokenizer
+	pipeline.untruncated = pipeline.Stride > 0
+
 	// load onnx model
 	errModel := pipeline.loadModel()
 	if errModel != nil {
@@ -147,12 +343,99 @@ func (p *TokenClassificationPipeline) Validate() error {
 	if len(p.IdLabelMap) != p.OutputDim {
 		validationErrors = append(validationErrors, fmt.Errorf("p configuration invalid: length of id2label map does not match model output dimension"))
 	}
+	switch p.AggregationStrategy {
+	case "SIMPLE", "NONE", "FIRST", "MAX", "AVERAGE":
+	default:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unknown aggregation strategy %s", p.AggregationStrategy))
+	}
+	switch p.TaggingScheme {
+	case "IOB2", "BILOU", "BIOES":
+	default:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: unknown tagging scheme %s", p.TaggingScheme))
+	}
+	if p.Stride < 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: stride cannot be negative"))
+	} else if p.Stride > 0 && p.Stride >= p.windowLength()-p.pairTemplate.specialLength() {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: stride %d must be smaller than the window of %d tokens", p.Stride, p.windowLength()-p.pairTemplate.specialLength()))
+	}
+	if p.MaxEntityTokens < 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: max entity tokens cannot be negative"))
+	}
+	if p.ScoreThreshold < 0 || p.ScoreThreshold > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: score threshold %f must be between 0 and 1", p.ScoreThreshold))
+	}
+	for label, threshold := range p.LabelScoreThresholds {
+		if threshold < 0 || threshold > 1 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: score threshold %f of label %s must be between 0 and 1", threshold, label))
+		}
+	}
+	if p.OverlappingEntities {
+		if p.OverlapThreshold <= 0 || p.OverlapThreshold > 1 {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: overlap threshold %f must be greater than 0 and at most 1", p.OverlapThreshold))
+		}
+		for label, threshold := range p.OverlapLabelThresholds {
+			if threshold <= 0 || threshold > 1 {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: overlap threshold %f of label %s must be greater than 0 and at most 1", threshold, label))
+			}
+		}
+	}
+	if p.Stride > 0 && (p.OverlappingEntities || p.TokenProbabilities || p.ReturnLogits || p.TokenDistributions) {
+		// the windows are merged keeping one entity per span, and their tokens overlap
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: overlapping entities, token probabilities, logits and distributions are not supported with a stride"))
+	}
 	return errors.Join(validationErrors...)
 }
 
 // Postprocess function for a token classification pipeline
 func (p *TokenClassificationPipeline) Postprocess(batch PipelineBatch) (*TokenClassificationOutput, error) {
+	logits := p.tokenLogits(batch)
+	outputs := tokenScores(logits)
 
+	// now convert the logits to the predictions of actual entities
+	classificationOutput := TokenClassificationOutput{
+		Entities:    make([][]Entity, len(batch.Input)),
+		Usage:       p.recordUsage(batchUsage(batch)),
+		Diagnostics: batchDiagnostics(batch),
+	}
+	if p.ReturnLogits {
+		classificationOutput.Logits = logits
+	}
+	if p.TokenDistributions {
+		classificationOutput.Distributions = outputs
+	}
+	if p.TokenProbabilities {
+		classificationOutput.TokenProbabilities = make([][]TokenProbabilities, len(batch.Input))
+	}
+	for i, input := range batch.Input {
+		if p.TokenProbabilities {
+			classificationOutput.TokenProbabilities[i] = p.tokenProbabilities(input, outputs[i])
+		}
+		entities, err := p.inputEntities(input, outputs[i])
+		if err != nil {
+			return nil, err
+		}
+		if p.CoreferenceGrouping {
+			entities = p.GroupMentions(input, entities)
+		}
+		classificationOutput.Entities[i] = entities
+	}
+	return &classificationOutput, nil
+}
+
+// tokenScores returns the label probabilities of each token of each input from their logits.
+func tokenScores(logits [][][]float32) [][][]float32 {
+	scores := make([][][]float32, len(logits))
+	for i, inputLogits := range logits {
+		scores[i] = make([][]float32, len(inputLogits))
+		for j, tokenLogits := range inputLogits {
+			scores[i][j] = util.SoftMax(tokenLogits)
+		}
+	}
+	return scores
+}
+
+// tokenLogits returns the logits of each token of each input of a batch.
+func (p *TokenClassificationPipeline) tokenLogits(batch PipelineBatch) [][][]float32 {
 	outputs := make([][][]float32, len(batch.Input))        // holds the final output
 	inputVectors := make([][]float32, 0, batch.MaxSequence) // holds the embeddings of each original token (no padding) for an input
 	tokenVector := make([]float32, p.OutputDim)             // holds the vector embedding for a token
@@ -171,7 +454,7 @@ func (p *TokenClassificationPipeline) Postprocess(batch PipelineBatch) (*TokenCl
 			// raw result vector for token is now complete
 			if tokenCounter < len(inputTokens) {
 				// it is an original token (not resulting from padding), keep it
-				inputVectors = append(inputVectors, util.SoftMax(tokenVector))
+				inputVectors = append(inputVectors, tokenVector)
 			}
 			tokenVectorCounter = 0
 			tokenVector = make([]float32, p.OutputDim)
@@ -191,28 +474,178 @@ func (p *TokenClassificationPipeline) Postprocess(batch PipelineBatch) (*TokenCl
 			tokenVectorCounter++
 		}
 	}
+	return outputs
+}
 
-	// now convert the logits to the predictions of actual entities
-	classificationOutput := TokenClassificationOutput{
-		Entities: make([][]Entity, len(batch.Input)),
-	}
-
-	for i, input := range batch.Input {
-		preEntities := p.GatherPreEntities(input, outputs[i])
-		entities, errAggregate := p.Aggregate(input, preEntities)
+// inputEntities returns the entities of an input from the scores of its tokens, without coreference grouping.
+func (p *TokenClassificationPipeline) inputEntities(input TokenizedInput, output [][]float32) ([]Entity, error) {
+	preEntities := p.GatherPreEntities(input, output)
+	var entities []Entity
+	if p.OverlappingEntities {
+		entities = p.overlappingEntities(input, preEntities)
+	} else {
+		var errAggregate error
+		entities, errAggregate = p.Aggregate(input, preEntities)
 		if errAggregate != nil {
 			return nil, errAggregate
 		}
-		// Filter anything that is in ignore_labels
-		var filteredEntities []Entity
-		for _, e := range entities {
-			if !slices.Contains(p.IgnoreLabels, e.Entity) && e.Entity != "" {
-				filteredEntities = append(filteredEntities, e)
+	}
+	// map the labels first, so that the ignore labels and thresholds apply to the mapped labels as in text classification
+	for j, e := range entities {
+		if label, ok := p.LabelMapping[e.Entity]; ok {
+			entities[j].Entity = label
+		}
+	}
+	// Filter anything that is in ignore_labels or below the score threshold
+	var filteredEntities []Entity
+	for _, e := range entities {
+		if !slices.Contains(p.IgnoreLabels, e.Entity) && e.Entity != "" && e.Score >= p.scoreThreshold(e.Entity) {
+			filteredEntities = append(filteredEntities, e)
+		}
+	}
+	if p.MergeAdjacentEntities && p.AggregationStrategy != "NONE" {
+		filteredEntities = mergeAdjacentEntities(input.Raw, filteredEntities)
+	}
+	return filteredEntities, nil
+}
+
+// tokenProbabilities returns the label probabilities of the tokens of an input, special tokens excluded.
+func (p *TokenClassificationPipeline) tokenProbabilities(input TokenizedInput, output [][]float32) []TokenProbabilities {
+	preEntities := p.GatherPreEntities(input, output)
+	tokens := make([]TokenProbabilities, len(preEntities))
+	for i, preEntity := range preEntities {
+		probabilities := make(map[string]float32, len(preEntity.Scores))
+		for k, score := range preEntity.Scores {
+			probabilities[p.IdLabelMap[k]] = score
+		}
+		tokens[i] = TokenProbabilities{
+			Index:         preEntity.Index,
+			Word:          preEntity.Word,
+			Start:         preEntity.Start,
+			End:           preEntity.End,
+			Probabilities: probabilities,
+		}
+	}
+	return tokens
+}
+
+// overlappingEntities decodes the spans of each entity type of the model independently, see WithOverlappingEntities.
+func (p *TokenClassificationPipeline) overlappingEntities(input TokenizedInput, preEntities []Entity) []Entity {
+	// the label indices of each entity type, by B/I prefix
+	type typeLabels struct {
+		begin, inside []int
+	}
+	labelsByType := map[string]*typeLabels{}
+	var entityTypes []string
+	for k := 0; k < len(p.IdLabelMap); k++ {
+		label := p.IdLabelMap[k]
+		if slices.Contains(p.IgnoreLabels, label) {
+			continue
+		}
+		bi, tag := p.getTag(label)
+		if _, ok := labelsByType[tag]; !ok {
+			labelsByType[tag] = &typeLabels{}
+			entityTypes = append(entityTypes, tag)
+		}
+		if bi == "B" || bi == "S" {
+			labelsByType[tag].begin = append(labelsByType[tag].begin, k)
+		} else {
+			labelsByType[tag].inside = append(labelsByType[tag].inside, k)
+		}
+	}
+
+	var entities []Entity
+	for _, entityType := range entityTypes {
+		threshold := p.OverlapThreshold
+		if labelThreshold, ok := p.OverlapLabelThresholds[entityType]; ok {
+			threshold = labelThreshold
+		}
+		var span []Entity
+		var spanScores []float32
+		closeSpan := func() {
+			if len(span) > 0 {
+				e := p.groupSubEntities(input.Raw, span)
+				e.Entity = entityType
+				e.Score = util.Mean(spanScores)
+				e.Index = span[0].Index
+				entities = append(entities, e)
+			}
+			span, spanScores = nil, nil
+		}
+		for _, token := range preEntities {
+			var begin, inside float32
+			for _, k := range labelsByType[entityType].begin {
+				begin += token.Scores[k]
 			}
+			for _, k := range labelsByType[entityType].inside {
+				inside += token.Scores[k]
+			}
+			switch {
+			case token.IsSubword:
+				// subwords follow the first token of their word
+				if len(span) == 0 {
+					continue
+				}
+			case begin+inside < threshold:
+				closeSpan()
+				continue
+			case begin > inside:
+				closeSpan()
+			}
+			span = append(span, token)
+			spanScores = append(spanScores, begin+inside)
 		}
-		classificationOutput.Entities[i] = filteredEntities
+		closeSpan()
 	}
-	return &classificationOutput, nil
+	sort.SliceStable(entities, func(a, b int) bool {
+		if entities[a].Start != entities[b].Start {
+			return entities[a].Start < entities[b].Start
+		}
+		return entities[a].End > entities[b].End
+	})
+	return entities
+}
+
+// scoreThreshold returns the minimum score of the entities of a type.
+func (p *TokenClassificationPipeline) scoreThreshold(label string) float32 {
+	if threshold, ok := p.LabelScoreThresholds[label]; ok {
+		return threshold
+	}
+	return p.ScoreThreshold
+}
+
+func (p *TokenClassificationPipeline) setLabelMapping(mapping map[string]string) {
+	p.LabelMapping = mapping
+}
+
+// GroupMentions merges entities that have the same type and the same surface form in the input into one
+// entity with multiple mentions.
+func (p *TokenClassificationPipeline) GroupMentions(input TokenizedInput, entities []Entity) []Entity {
+	var grouped []Entity
+	var mentionScores [][]float32
+	groupIndex := map[string]int{}
+
+	for _, e := range entities {
+		surfaceForm := e.Word
+		if e.End > e.Start && int(e.End) <= len(input.Raw) {
+			surfaceForm = input.Raw[e.Start:e.End]
+		}
+		key := e.Entity + "\x00" + strings.ToLower(strings.TrimSpace(surfaceForm))
+		mention := Mention{Start: e.Start, End: e.End}
+		if idx, ok := groupIndex[key]; ok {
+			grouped[idx].Mentions = append(grouped[idx].Mentions, mention)
+			mentionScores[idx] = append(mentionScores[idx], e.Score)
+			continue
+		}
+		e.Mentions = []Mention{mention}
+		groupIndex[key] = len(grouped)
+		grouped = append(grouped, e)
+		mentionScores = append(mentionScores, []float32{e.Score})
+	}
+	for i := range grouped {
+		grouped[i].Score = util.Mean(mentionScores[i])
+	}
+	return grouped
 }
 
 // GatherPreEntities from batch of logits to list of pre-aggregated outputs
@@ -230,13 +663,19 @@ func (p *TokenClassificationPipeline) GatherPreEntities(input TokenizedInput, ou
 		// TODO: the python code uses id_to_token to get the token here which is a method on the rust tokenizer, check if it's better
 		word := input.Tokens[j]
 		tokenId := input.TokenIds[j]
-		// TODO: the determination of subword can probably be better done by exporting the words field from the tokenizer directly
 		startInd := input.Offsets[j][0]
 		endInd := input.Offsets[j][1]
 		wordRef := sentence[startInd:endInd]
-		isSubword := len(word) != len(wordRef)
-		// TODO: check for unknown token here, it's in the config and can be loaded and compared with the token
-		// in that case set the subword as in the python code
+		var isSubword bool
+		if len(input.WordIds) == len(input.TokenIds) {
+			// a token is a subword if it continues the word of the previous token
+			isSubword = j > 0 && input.WordIds[j] >= 0 && input.WordIds[j] == input.WordIds[j-1]
+		} else {
+			isSubword = len(word) != len(wordRef)
+		}
+		if p.Vocabulary != nil && word == p.Vocabulary.SpecialTokenRoles["unk_token"] {
+			word = wordRef
+		}
 		preEntities = append(preEntities, Entity{
 			Word:      word,
 			TokenId:   tokenId,
@@ -252,7 +691,8 @@ func (p *TokenClassificationPipeline) GatherPreEntities(input TokenizedInput, ou
 
 func (p *TokenClassificationPipeline) Aggregate(input TokenizedInput, preEntities []Entity) ([]Entity, error) {
 	entities := make([]Entity, len(preEntities))
-	if p.AggregationStrategy == "SIMPLE" || p.AggregationStrategy == "NONE" {
+	switch p.AggregationStrategy {
+	case "SIMPLE", "NONE":
 		for i, preEntity := range preEntities {
 			entityIdx, score, argMaxErr := util.ArgMax(preEntity.Scores)
 			if argMaxErr != nil {
@@ -272,33 +712,121 @@ func (p *TokenClassificationPipeline) Aggregate(input TokenizedInput, preEntitie
 				End:     preEntity.End,
 			}
 		}
-	} else {
-		return nil, errors.New("aggregation strategies other than SIMPLE and NONE are not implemented")
+	case "FIRST", "MAX", "AVERAGE":
+		var err error
+		entities, err = p.aggregateWords(input, preEntities)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("aggregation strategy %s is not implemented", p.AggregationStrategy)
 	}
 	if p.AggregationStrategy == "NONE" {
 		return entities, nil
 	}
-	return p.GroupEntities(entities)
+	return p.groupEntities(input.Raw, entities)
 }
 
+// aggregateWords groups the tokens of each word and labels the word from the scores of its tokens according to the
+// FIRST, MAX or AVERAGE strategy.
+func (p *TokenClassificationPipeline) aggregateWords(input TokenizedInput, preEntities []Entity) ([]Entity, error) {
+	var words []Entity
+	var wordGroup []Entity
+	for _, preEntity := range preEntities {
+		if len(wordGroup) > 0 && !preEntity.IsSubword {
+			word, err := p.aggregateWord(input, wordGroup)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, word)
+			wordGroup = nil
+		}
+		wordGroup = append(wordGroup, preEntity)
+	}
+	if len(wordGroup) > 0 {
+		word, err := p.aggregateWord(input, wordGroup)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+// aggregateWord labels the tokens of a word as one entity.
+func (p *TokenClassificationPipeline) aggregateWord(input TokenizedInput, tokens []Entity) (Entity, error) {
+	var scores []float32
+	switch p.AggregationStrategy {
+	case "FIRST":
+		scores = tokens[0].Scores
+	case "MAX":
+		var best float32
+		for i, token := range tokens {
+			_, score, err := util.ArgMax(token.Scores)
+			if err != nil {
+				return Entity{}, err
+			}
+			if i == 0 || score > best {
+				scores, best = token.Scores, score
+			}
+		}
+	case "AVERAGE":
+		scores = make([]float32, len(tokens[0].Scores))
+		for _, token := range tokens {
+			for k, score := range token.Scores {
+				scores[k] += score / float32(len(tokens))
+			}
+		}
+	}
+	entityIdx, score, err := util.ArgMax(scores)
+	if err != nil {
+		return Entity{}, err
+	}
+	label, ok := p.IdLabelMap[entityIdx]
+	if !ok {
+		return Entity{}, fmt.Errorf("could not determine entity type for input %s, predicted entity index %d", input.Raw, entityIdx)
+	}
+	tokenIds := make([]uint32, len(tokens))
+	for i, token := range tokens {
+		tokenIds[i] = token.TokenId
+	}
+	start, end := tokens[0].Start, tokens[len(tokens)-1].End
+	word := p.Tokenizer.Decode(tokenIds, false)
+	if !validWord(word) && end <= uint(len(input.Raw)) && start <= end && utf8.ValidString(input.Raw[start:end]) {
+		word = input.Raw[start:end]
+	}
+	return Entity{
+		Entity:   label,
+		Score:    score,
+		Scores:   scores,
+		Index:    tokens[0].Index,
+		Word:     word,
+		TokenId:  tokens[0].TokenId,
+		Start:    start,
+		End:      end,
+		tokenIds: tokenIds,
+	}, nil
+}
+
+// getTag splits an entity label into its position in the entity and its type. The position is normalised to B
+// (beginning), I (inside), E (end, the L- and E- tags) or S (single token entity, the U- and S- tags), according to
+// the tagging scheme of the pipeline. Labels without a prefix of the scheme are inside their type.
 func (p *TokenClassificationPipeline) getTag(entityName string) (string, string) {
-	var bi string
-	var tag string
-	if strings.HasPrefix(entityName, "B-") {
-		bi = "B"
-		tag = entityName[2:]
-	} else if strings.HasPrefix(entityName, "I-") {
-		bi = "I"
-		tag = entityName[2:]
-	} else {
-		// defaulting to "I" if string is not in B- I- format
-		bi = "I"
-		tag = entityName
+	if len(entityName) > 2 && entityName[1] == '-' {
+		switch prefix := entityName[:1]; {
+		case prefix == "B" || prefix == "I":
+			return prefix, entityName[2:]
+		case p.TaggingScheme == "BILOU" && prefix == "L", p.TaggingScheme == "BIOES" && prefix == "E":
+			return "E", entityName[2:]
+		case p.TaggingScheme == "BILOU" && prefix == "U", p.TaggingScheme == "BIOES" && prefix == "S":
+			return "S", entityName[2:]
+		}
 	}
-	return bi, tag
+	// defaulting to "I" if string is not in the format of the scheme
+	return "I", entityName
 }
 
-func (p *TokenClassificationPipeline) groupSubEntities(entities []Entity) Entity {
+func (p *TokenClassificationPipeline) groupSubEntities(raw string, entities []Entity) Entity {
 	splits := strings.Split(entities[0].Entity, "-")
 	var entityType string
 	if len(splits) == 1 {
@@ -307,27 +835,77 @@ func (p *TokenClassificationPipeline) groupSubEntities(entities []Entity) Entity
 		entityType = strings.Join(splits[1:], "-")
 	}
 	scores := make([]float32, len(entities))
-	tokens := make([]uint32, len(entities))
+	tokens := make([]uint32, 0, len(entities))
 	for i, s := range entities {
 		scores[i] = s.Score
-		tokens[i] = s.TokenId
+		if len(s.tokenIds) > 0 {
+			tokens = append(tokens, s.tokenIds...)
+		} else {
+			tokens = append(tokens, s.TokenId)
+		}
 	}
 	score := util.Mean(scores)
 	// note: here we directly appeal to the tokenizer decoder with the tokenIds
 	// in the python code they pass the words to a token_to_string_method
 	word := p.Tokenizer.Decode(tokens, false)
+	start := entities[0].Start
+	end := entities[len(entities)-1].End
+	if !validWord(word) && end <= uint(len(raw)) && start <= end && utf8.ValidString(raw[start:end]) {
+		// byte-level BPE tokenizers split multibyte characters (emoji, CJK, ...) over several tokens, so decoding
+		// a group that starts or ends within a character yields replacement characters. Use the source span instead.
+		word = raw[start:end]
+	}
 
 	return Entity{
 		Entity: entityType,
 		Score:  score,
 		Word:   word,
-		Start:  entities[0].Start,
-		End:    entities[len(entities)-1].End,
+		Start:  start,
+		End:    end,
 	}
 }
 
+// mergeAdjacentEntities merges consecutive entities of the same type whose gap in the input contains only whitespace
+// and punctuation.
+func mergeAdjacentEntities(raw string, entities []Entity) []Entity {
+	var merged []Entity
+	for _, e := range entities {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.Entity == e.Entity && last.End <= e.Start && int(e.End) <= len(raw) && separatorsOnly(raw[last.End:e.Start]) {
+				last.Score = (last.Score + e.Score) / 2
+				last.End = e.End
+				last.Word = raw[last.Start:last.End]
+				continue
+			}
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// separatorsOnly reports whether a string contains only whitespace and punctuation.
+func separatorsOnly(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) && !unicode.IsPunct(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validWord reports whether a decoded word is valid UTF-8 without replacement characters.
+func validWord(word string) bool {
+	return utf8.ValidString(word) && !strings.ContainsRune(word, utf8.RuneError)
+}
+
 // GroupEntities group together adjacent tokens with the same entity predicted
 func (p *TokenClassificationPipeline) GroupEntities(entities []Entity) ([]Entity, error) {
+	return p.groupEntities("", entities)
+}
+
+// groupEntities groups entities, using the raw input to recover the words that cannot be decoded from their tokens.
+func (p *TokenClassificationPipeline) groupEntities(raw string, entities []Entity) ([]Entity, error) {
 	var entityGroups []Entity
 	var currentGroupDisagg []Entity
 
@@ -338,19 +916,21 @@ func (p *TokenClassificationPipeline) GroupEntities(entities []Entity) ([]Entity
 		}
 
 		bi, tag := p.getTag(e.Entity)
-		_, lastTag := p.getTag(currentGroupDisagg[len(currentGroupDisagg)-1].Entity)
-		if tag == lastTag && bi != "B" {
+		lastBi, lastTag := p.getTag(currentGroupDisagg[len(currentGroupDisagg)-1].Entity)
+		// entities start at B and S tags, and end at E and S tags
+		continues := bi != "B" && bi != "S" && lastBi != "E" && lastBi != "S"
+		if tag == lastTag && continues && (p.MaxEntityTokens <= 0 || len(currentGroupDisagg) < p.MaxEntityTokens) {
 			currentGroupDisagg = append(currentGroupDisagg, e)
 		} else {
 			// create the grouped entity
-			entityGroups = append(entityGroups, p.groupSubEntities(currentGroupDisagg))
+			entityGroups = append(entityGroups, p.groupSubEntities(raw, currentGroupDisagg))
 			currentGroupDisagg = []Entity{e}
 		}
 	}
 
 	if len(currentGroupDisagg) > 0 {
 		// last entity remaining
-		entityGroups = append(entityGroups, p.groupSubEntities(currentGroupDisagg))
+		entityGroups = append(entityGroups, p.groupSubEntities(raw, currentGroupDisagg))
 	}
 	return entityGroups, nil
 }
@@ -362,9 +942,102 @@ func (p *TokenClassificationPipeline) Run(inputs []string) (PipelineBatchOutput,
 
 func (p *TokenClassificationPipeline) RunPipeline(inputs []string) (*TokenClassificationOutput, error) {
 	batch := p.Preprocess(inputs)
+	if p.Stride > 0 {
+		return p.runWindows(batch)
+	}
 	batch, errForward := p.Forward(batch)
 	if errForward != nil {
 		return nil, errForward
 	}
 	return p.Postprocess(batch)
 }
+
+// runWindows splits the inputs of a batch longer than the maximum length of the model into overlapping windows,
+// runs the model on all the windows at once and merges the entities of the windows of each input.
+func (p *TokenClassificationPipeline) runWindows(batch PipelineBatch) (*TokenClassificationOutput, error) {
+	var windows []TokenizedInput
+	var owners, starts []int
+	maxSequence := 0
+	for i, input := range batch.Input {
+		inputWindows, inputStarts := p.splitWindows(input, p.Stride)
+		for j, window := range inputWindows {
+			windows = append(windows, window)
+			owners = append(owners, i)
+			starts = append(starts, inputStarts[j])
+			if len(window.TokenIds) > maxSequence {
+				maxSequence = len(window.TokenIds)
+			}
+		}
+	}
+	windowBatch := p.convertInputToTensors(windows, maxSequence)
+	windowBatch, err := p.Forward(windowBatch)
+	if err != nil {
+		return nil, err
+	}
+	outputs := tokenScores(p.tokenLogits(windowBatch))
+
+	windowEntities := make([][]Entity, len(batch.Input))
+	for w, window := range windows {
+		entities, err := p.inputEntities(window, outputs[w])
+		if err != nil {
+			return nil, err
+		}
+		for j := range entities {
+			entities[j].Index += starts[w]
+		}
+		windowEntities[owners[w]] = append(windowEntities[owners[w]], entities...)
+	}
+
+	classificationOutput := TokenClassificationOutput{
+		Entities:    make([][]Entity, len(batch.Input)),
+		Usage:       p.recordUsage(batchUsage(windowBatch)),
+		Diagnostics: batchDiagnostics(batch),
+	}
+	for i, input := range batch.Input {
+		entities := aggregateOverlappingEntities(input.Raw, windowEntities[i])
+		if p.MergeAdjacentEntities && p.AggregationStrategy != "NONE" {
+			// entities of different windows are only merged once the windows are aggregated
+			entities = mergeAdjacentEntities(input.Raw, entities)
+		}
+		if p.CoreferenceGrouping {
+			entities = p.GroupMentions(input, entities)
+		}
+		classificationOutput.Entities[i] = entities
+	}
+	return &classificationOutput, nil
+}
+
+// aggregateOverlappingEntities resolves the entities found in the shared tokens of consecutive windows. Overlapping
+// entities of the same type are the same entity seen by both windows, possibly cut at the edge of one of them, and
+// are merged into their union. Of overlapping entities of different types the longest is kept, then the highest
+// scoring, as the python pipeline.
+func aggregateOverlappingEntities(raw string, entities []Entity) []Entity {
+	if len(entities) == 0 {
+		return entities
+	}
+	sort.SliceStable(entities, func(a, b int) bool {
+		return entities[a].Start < entities[b].Start
+	})
+	var aggregated []Entity
+	previous := entities[0]
+	for _, e := range entities[1:] {
+		if previous.Start <= e.Start && e.Start < previous.End {
+			length, previousLength := e.End-e.Start, previous.End-previous.Start
+			if e.Entity == previous.Entity && e.End > previous.End {
+				if length > previousLength {
+					previous.Score = e.Score
+				}
+				previous.End = e.End
+				if int(previous.End) <= len(raw) {
+					previous.Word = raw[previous.Start:previous.End]
+				}
+			} else if e.Entity != previous.Entity && (length > previousLength || (length == previousLength && e.Score > previous.Score)) {
+				previous = e
+			}
+			continue
+		}
+		aggregated = append(aggregated, previous)
+		previous = e
+	}
+	return append(aggregated, previous)
+}
@@ -0,0 +1,260 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/tokenizers"
+)
+
+// TranslationPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/text2text_generation.py
+// (TranslationPipeline) for MarianMT, NLLB, M2M100 and mBART models exported to onnx as an encoder and a decoder.
+// MarianMT models translate between a fixed language pair, or to the target language selected with a >>lang<< token
+// for multilingual ones; NLLB, M2M100 and mBART models take the source and target languages as language tokens
+// (e.g. eng_Latn and fra_Latn for NLLB, en and fr for M2M100, en_XX and fr_XX for mBART).
+
+// types
+
+type TranslationPipeline struct {
+	BaseSeq2SeqPipeline
+	SourceLanguage string
+	TargetLanguage string
+	ModelType      string
+}
+
+type TranslationOutput struct {
+	Usage
+	TranslationTexts []string
+}
+
+func (t *TranslationOutput) GetOutput() []any {
+	out := make([]any, len(t.TranslationTexts))
+	for i, text := range t.TranslationTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+// options
+
+// WithSourceLanguage sets the language of the inputs, for models with language tokens.
+func WithSourceLanguage(language string) PipelineOption[*TranslationPipeline] {
+	return func(pipeline *TranslationPipeline) {
+		pipeline.SourceLanguage = language
+	}
+}
+
+// WithTargetLanguage sets the language to translate to, for multilingual models.
+func WithTargetLanguage(language string) PipelineOption[*TranslationPipeline] {
+	return func(pipeline *TranslationPipeline) {
+		pipeline.TargetLanguage = language
+	}
+}
+
+// NewTranslationPipeline initializes a translation pipeline.
+func NewTranslationPipeline(config PipelineConfig[*TranslationPipeline], ortOptions *ort.SessionOptions) (*TranslationPipeline, error) {
+	pipeline := &TranslationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	generationConfig, err := loadGenerationConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.GenerationConfig = generationConfig
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// tokenizer
+	pipeline.TokenizerOptions = []tokenizers.EncodeOption{tokenizers.WithReturnAttentionMask()}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	modelConfig, err := loadModelConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ModelType, _ = modelConfig["model_type"].(string)
+
+	// load onnx models
+	err = pipeline.loadSeq2SeqModel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+// usesLanguageTokens reports whether the model marks the source and target languages with language tokens
+// (NLLB, M2M100, mBART) rather than being trained on a language pair (MarianMT).
+func (p *TranslationPipeline) usesLanguageTokens() bool {
+	switch p.ModelType {
+	case "m2m_100", "nllb-moe", "mbart":
+		return true
+	default:
+		return false
+	}
+}
+
+// languageTokenId returns the id of the token of a language, e.g. fra_Latn (NLLB), __fr__ (M2M100) or
+// >>fra<< (multilingual MarianMT).
+func (p *TranslationPipeline) languageTokenId(language string) (uint32, error) {
+	candidates := []string{language, "__" + language + "__"}
+	if !p.usesLanguageTokens() {
+		candidates = []string{">>" + language + "<<"}
+	}
+	for _, candidate := range candidates {
+		if id, ok := p.Vocabulary.TokenToId(candidate); ok {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("language %s has no token in the model vocabulary", language)
+}
+
+func (p *TranslationPipeline) Validate() error {
+	validationErrors := p.validateSeq2Seq()
+
+	if p.usesLanguageTokens() {
+		if p.SourceLanguage == "" || p.TargetLanguage == "" {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: %s models require a source and a target language", p.ModelType))
+		}
+		if len(p.GenerationConfig.EosTokenIds) == 0 {
+			validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: eos_token_id is not set in the model config"))
+		}
+	}
+	for _, language := range []string{p.SourceLanguage, p.TargetLanguage} {
+		if language == "" || (!p.usesLanguageTokens() && language == p.SourceLanguage) {
+			// marian models are not told the source language
+			continue
+		}
+		if _, err := p.languageTokenId(language); err != nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: %w", err))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes the inputs, adding the language tokens expected by the model.
+func (p *TranslationPipeline) Preprocess(inputs []string) (PipelineBatch, error) {
+	start := time.Now()
+
+	var targetLanguageToken uint32
+	var sourceLanguageToken uint32
+	var err error
+	if p.TargetLanguage != "" {
+		if targetLanguageToken, err = p.languageTokenId(p.TargetLanguage); err != nil {
+			return PipelineBatch{}, err
+		}
+	}
+	if p.usesLanguageTokens() {
+		if sourceLanguageToken, err = p.languageTokenId(p.SourceLanguage); err != nil {
+			return PipelineBatch{}, err
+		}
+	}
+
+	tokenizedInputs := make([]TokenizedInput, len(inputs))
+	maxSequence := 0
+	for i, input := range inputs {
+		var ids []uint32
+		if p.usesLanguageTokens() {
+			// [source language] tokens [eos]
+			output := p.Tokenizer.EncodeWithOptions(input, false, p.TokenizerOptions...)
+			ids = append([]uint32{sourceLanguageToken}, output.IDs...)
+			ids = append(ids, uint32(p.GenerationConfig.EosTokenIds[0]))
+		} else {
+			// tokens [eos], with the >>target language<< token first for multilingual marian models
+			output := p.Tokenizer.EncodeWithOptions(input, true, p.TokenizerOptions...)
+			ids = output.IDs
+			if p.TargetLanguage != "" {
+				ids = append([]uint32{targetLanguageToken}, ids...)
+			}
+		}
+		attentionMask := make([]uint32, len(ids))
+		for j := range attentionMask {
+			attentionMask[j] = 1
+		}
+		tokenizedInputs[i] = TokenizedInput{
+			Raw:               input,
+			TokenIds:          ids,
+			AttentionMask:     attentionMask,
+			MaxAttentionIndex: len(ids) - 1,
+		}
+		if len(ids) > maxSequence {
+			maxSequence = len(ids)
+		}
+	}
+
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return p.convertInputToTensors(tokenizedInputs, maxSequence), nil
+}
+
+// Forward encodes the inputs and decodes the translations, returning the generated token ids.
+func (p *TranslationPipeline) Forward(batch PipelineBatch) (generated [][]int64, err error) {
+	hiddenStates, err := p.encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, hiddenStates.Destroy())
+	}()
+
+	prefix := []int64{p.GenerationConfig.DecoderStartTokenId}
+	if p.usesLanguageTokens() {
+		// the translation is forced to start with the target language token
+		targetLanguageToken, tokenErr := p.languageTokenId(p.TargetLanguage)
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+		prefix = append(prefix, int64(targetLanguageToken))
+	}
+	var encoderAttentionMask []int64
+	if p.hasAttentionMask {
+		encoderAttentionMask = batch.AttentionMasksTensor
+	}
+	return p.generate(hiddenStates, encoderAttentionMask, prefix)
+}
+
+// Postprocess decodes the generated tokens.
+func (p *TranslationPipeline) Postprocess(batch PipelineBatch, generated [][]int64) (*TranslationOutput, error) {
+	usage := batchUsage(batch)
+	for _, tokens := range generated {
+		usage.GeneratedTokens += uint64(len(tokens))
+	}
+	return &TranslationOutput{
+		Usage:            p.recordUsage(usage),
+		TranslationTexts: p.decodeGenerated(generated),
+	}, nil
+}
+
+// Run the pipeline on a string batch
+func (p *TranslationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline translates each input.
+func (p *TranslationPipeline) RunPipeline(inputs []string) (*TranslationOutput, error) {
+	batch, err := p.Preprocess(inputs)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := p.Forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(batch, generated)
+}
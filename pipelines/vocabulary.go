@@ -0,0 +1,221 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// Vocabulary holds the token <-> id mappings and the special tokens of a pipeline tokenizer. The rust tokenizer
+// bindings do not expose the vocabulary, so it is read from the tokenizer.json (and tokenizer_config.json, if
+// present) files of the model.
+type Vocabulary struct {
+	tokenToId     map[string]uint32
+	idToToken     map[uint32]string
+	specialTokens map[string]uint32
+	// ContinuingSubwordPrefix is the prefix marking tokens that continue a word (## for WordPiece tokenizers), if any.
+	ContinuingSubwordPrefix string
+	// SpecialTokenRoles maps the role of a special token (cls_token, sep_token, pad_token, unk_token, mask_token,
+	// bos_token, eos_token) to the token string, as declared in tokenizer_config.json.
+	SpecialTokenRoles map[string]string
+}
+
+type tokenizerJSON struct {
+	AddedTokens []struct {
+		Id      uint32 `json:"id"`
+		Content string `json:"content"`
+		Special bool   `json:"special"`
+	} `json:"added_tokens"`
+	Model struct {
+		Type                    string              `json:"type"`
+		Vocab                   jsoniter.RawMessage `json:"vocab"`
+		ContinuingSubwordPrefix string              `json:"continuing_subword_prefix"`
+	} `json:"model"`
+}
+
+// newVocabulary parses the vocabulary from the contents of tokenizer.json and, optionally, tokenizer_config.json.
+func newVocabulary(tokenizerBytes []byte, tokenizerConfigBytes []byte) (*Vocabulary, error) {
+	var tokenizerData tokenizerJSON
+	if err := jsoniter.Unmarshal(tokenizerBytes, &tokenizerData); err != nil {
+		return nil, err
+	}
+
+	v := &Vocabulary{
+		tokenToId:         map[string]uint32{},
+		idToToken:         map[uint32]string{},
+		specialTokens:     map[string]uint32{},
+		SpecialTokenRoles: map[string]string{},
+	}
+	if tokenizerData.Model.Type == "WordPiece" {
+		v.ContinuingSubwordPrefix = tokenizerData.Model.ContinuingSubwordPrefix
+	}
+
+	if len(tokenizerData.Model.Vocab) > 0 {
+		switch tokenizerData.Model.Type {
+		case "Unigram":
+			// unigram vocabularies are a list of [token, score] pairs, the id being the position in the list
+			var vocab [][]any
+			if err := jsoniter.Unmarshal(tokenizerData.Model.Vocab, &vocab); err != nil {
+				return nil, err
+			}
+			for i, entry := range vocab {
+				if token, ok := entry[0].(string); ok {
+					v.tokenToId[token] = uint32(i)
+					v.idToToken[uint32(i)] = token
+				}
+			}
+		default:
+			// WordPiece, BPE and WordLevel vocabularies are token -> id maps
+			var vocab map[string]uint32
+			if err := jsoniter.Unmarshal(tokenizerData.Model.Vocab, &vocab); err != nil {
+				return nil, fmt.Errorf("could not read vocabulary of %s tokenizer model: %w", tokenizerData.Model.Type, err)
+			}
+			for token, id := range vocab {
+				v.tokenToId[token] = id
+				v.idToToken[id] = token
+			}
+		}
+	}
+
+	for _, added := range tokenizerData.AddedTokens {
+		v.tokenToId[added.Content] = added.Id
+		v.idToToken[added.Id] = added.Content
+		if added.Special {
+			v.specialTokens[added.Content] = added.Id
+		}
+	}
+
+	if len(tokenizerConfigBytes) > 0 {
+		var tokenizerConfig map[string]any
+		if err := jsoniter.Unmarshal(tokenizerConfigBytes, &tokenizerConfig); err != nil {
+			return nil, err
+		}
+		for _, role := range []string{"cls_token", "sep_token", "pad_token", "unk_token", "mask_token", "bos_token", "eos_token"} {
+			switch token := tokenizerConfig[role].(type) {
+			case string:
+				v.SpecialTokenRoles[role] = token
+			case map[string]any:
+				// added token objects of the form {"content": "[CLS]", ...}
+				if content, ok := token["content"].(string); ok {
+					v.SpecialTokenRoles[role] = content
+				}
+			}
+		}
+	}
+	return v, nil
+}
+
+// loadVocabulary reads the vocabulary from the model folder. tokenizer_config.json is optional.
+func loadVocabulary(modelPath string, tokenizerBytes []byte) (*Vocabulary, error) {
+	configPath := util.PathJoinSafe(modelPath, "tokenizer_config.json")
+	configExists, err := util.FileSystem.Exists(context.Background(), configPath)
+	if err != nil {
+		return nil, err
+	}
+	var configBytes []byte
+	if configExists {
+		if configBytes, err = util.ReadFileBytes(configPath); err != nil {
+			return nil, err
+		}
+	}
+	return newVocabulary(tokenizerBytes, configBytes)
+}
+
+// Size is the number of tokens in the vocabulary, including added tokens.
+func (v *Vocabulary) Size() int {
+	return len(v.idToToken)
+}
+
+// TokenToId returns the id of a token, and false if the token is not in the vocabulary.
+func (v *Vocabulary) TokenToId(token string) (uint32, bool) {
+	id, ok := v.tokenToId[token]
+	return id, ok
+}
+
+// IdToToken returns the token with the given id, and false if the id is not in the vocabulary.
+func (v *Vocabulary) IdToToken(id uint32) (string, bool) {
+	token, ok := v.idToToken[id]
+	return token, ok
+}
+
+// SpecialTokens returns the special tokens of the tokenizer (e.g. [CLS], [SEP], [PAD]) with their ids.
+func (v *Vocabulary) SpecialTokens() map[string]uint32 {
+	specialTokens := make(map[string]uint32, len(v.specialTokens))
+	for token, id := range v.specialTokens {
+		specialTokens[token] = id
+	}
+	return specialTokens
+}
+
+// SpecialTokenId returns the id of the special token with the given role (e.g. cls_token, pad_token).
+func (v *Vocabulary) SpecialTokenId(role string) (uint32, error) {
+	token, ok := v.SpecialTokenRoles[role]
+	if !ok {
+		return 0, fmt.Errorf("tokenizer has no %s", role)
+	}
+	id, ok := v.tokenToId[token]
+	if !ok {
+		return 0, errors.New("special token " + token + " is not in the vocabulary")
+	}
+	return id, nil
+}
+
+// addedToken is the tokenizer.json representation of a token added to the vocabulary.
+type addedToken struct {
+	Id         uint32 `json:"id"`
+	Content    string `json:"content"`
+	SingleWord bool   `json:"single_word"`
+	Lstrip     bool   `json:"lstrip"`
+	Rstrip     bool   `json:"rstrip"`
+	Normalized bool   `json:"normalized"`
+	Special    bool   `json:"special"`
+}
+
+// addTokens adds the tokens that are not already in the vocabulary to the added_tokens of tokenizer.json, with
+// ids following the largest id of the vocabulary. It returns the modified tokenizer.json and the ids of the tokens.
+func addTokens(tokenizerBytes []byte, tokens []string) ([]byte, map[string]uint32, error) {
+	vocabulary, err := newVocabulary(tokenizerBytes, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tokenizerData map[string]jsoniter.RawMessage
+	if err = jsoniter.Unmarshal(tokenizerBytes, &tokenizerData); err != nil {
+		return nil, nil, err
+	}
+	var addedTokens []addedToken
+	if raw, ok := tokenizerData["added_tokens"]; ok {
+		if err = jsoniter.Unmarshal(raw, &addedTokens); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	nextId := uint32(0)
+	for id := range vocabulary.idToToken {
+		if id >= nextId {
+			nextId = id + 1
+		}
+	}
+	ids := map[string]uint32{}
+	for _, token := range tokens {
+		if id, ok := vocabulary.TokenToId(token); ok {
+			ids[token] = id
+			continue
+		}
+		if _, ok := ids[token]; ok {
+			continue
+		}
+		addedTokens = append(addedTokens, addedToken{Id: nextId, Content: token, Normalized: true})
+		ids[token] = nextId
+		nextId++
+	}
+
+	if tokenizerData["added_tokens"], err = jsoniter.Marshal(addedTokens); err != nil {
+		return nil, nil, err
+	}
+	modifiedBytes, err := jsoniter.Marshal(tokenizerData)
+	return modifiedBytes, ids, err
+}
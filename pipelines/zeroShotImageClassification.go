@@ -0,0 +1,233 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/tokenizers"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ZeroShotImageClassificationPipeline is a go version of
+// https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/zero_shot_image_classification.py
+// for CLIP-style dual encoders exported to onnx as a single model, taking input_ids and pixel_values and returning
+// logits_per_image. The candidate labels are inserted in the hypothesis template, and each image is classified by the
+// softmax of its similarities to the label texts.
+
+// types
+
+type ZeroShotImageClassificationPipeline struct {
+	BasePipeline
+	Labels             []string
+	HypothesisTemplate string
+	ImageConfig        ImageProcessorConfig
+}
+
+type ZeroShotImageClassificationOutput struct {
+	Usage
+	// ClassificationOutputs holds the labels of each image, sorted by decreasing score.
+	ClassificationOutputs [][]ClassificationOutput
+}
+
+func (t *ZeroShotImageClassificationOutput) GetOutput() []any {
+	out := make([]any, len(t.ClassificationOutputs))
+	for i, classificationOutput := range t.ClassificationOutputs {
+		out[i] = any(classificationOutput)
+	}
+	return out
+}
+
+const defaultImageHypothesisTemplate = "This is a photo of {}."
+
+// options
+
+// WithCandidateLabels sets the labels the images are classified against.
+func WithCandidateLabels(labels []string) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.Labels = labels
+	}
+}
+
+// WithImageHypothesisTemplate sets the text the labels are inserted in, at the {} placeholder.
+// The default is "This is a photo of {}.".
+func WithImageHypothesisTemplate(template string) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.HypothesisTemplate = template
+	}
+}
+
+// NewZeroShotImageClassificationPipeline initializes a zero-shot image classification pipeline.
+func NewZeroShotImageClassificationPipeline(config PipelineConfig[*ZeroShotImageClassificationPipeline], ortOptions *ort.SessionOptions) (*ZeroShotImageClassificationPipeline, error) {
+	pipeline := &ZeroShotImageClassificationPipeline{HypothesisTemplate: defaultImageHypothesisTemplate}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// tokenizer
+	pipeline.TokenizerOptions = []tokenizers.EncodeOption{tokenizers.WithReturnAttentionMask()}
+
+	pipeline.PipelineTimings = &Timings{}
+	pipeline.TokenizerTimings = &Timings{}
+
+	imageConfig, err := loadImageProcessorConfig(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.ImageConfig = imageConfig
+
+	// load onnx model
+	err = pipeline.loadModel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pipeline.Validate()
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	return pipeline, nil
+}
+
+func (p *ZeroShotImageClassificationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.Labels) == 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least one candidate label is required"))
+	}
+	if !strings.Contains(p.HypothesisTemplate, "{}") {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: hypothesis template %q has no {} placeholder", p.HypothesisTemplate))
+	}
+	for _, name := range []string{"input_ids", "pixel_values"} {
+		if !hasInputOutput(p.InputsMeta, name) {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model has no %s input, a text and vision model exported together is required", name))
+		}
+	}
+	if !hasInputOutput(p.OutputsMeta, "logits_per_image") {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the model has no logits_per_image output"))
+	}
+	if height, width := p.ImageConfig.outputSize(); height <= 0 || width <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the image processor config must define a fixed output size"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Forward runs the model on the tokenized labels and the images and returns the logits_per_image,
+// of shape [images, labels].
+func (p *ZeroShotImageClassificationPipeline) Forward(labelsBatch PipelineBatch, images []image.Image) (logits []float32, err error) {
+	start := time.Now()
+
+	pixelValues, height, width, err := p.ImageConfig.preprocessImages(images)
+	if err != nil {
+		return nil, err
+	}
+
+	labelsCount := int64(len(labelsBatch.Input))
+	maxSequence := int64(labelsBatch.MaxSequence)
+	inputTensors := make([]ort.ArbitraryTensor, len(p.InputsMeta))
+	defer func() {
+		for _, tensor := range inputTensors {
+			if tensor != nil {
+				err = errors.Join(err, tensor.Destroy())
+			}
+		}
+	}()
+	for i, input := range p.InputsMeta {
+		var tensorErr error
+		switch input.Name {
+		case "input_ids":
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(labelsCount, maxSequence), labelsBatch.IdsTensor)
+		case "attention_mask":
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(labelsCount, maxSequence), labelsBatch.AttentionMasksTensor)
+		case "pixel_values":
+			inputTensors[i], tensorErr = ort.NewTensor(ort.NewShape(int64(len(images)), 3, int64(height), int64(width)), pixelValues)
+		default:
+			tensorErr = fmt.Errorf("unsupported model input %s", input.Name)
+		}
+		if tensorErr != nil {
+			return nil, tensorErr
+		}
+	}
+
+	outputTensors := make([]ort.ArbitraryTensor, len(p.OutputsMeta))
+	if err = p.runSession(p.OrtSession, inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+	for i, output := range p.OutputsMeta {
+		if output.Name == "logits_per_image" {
+			logitsTensor, ok := outputTensors[i].(*ort.Tensor[float32])
+			if !ok {
+				err = errors.Join(err, errors.New("logits_per_image output must be float32"))
+			} else {
+				logits = append([]float32(nil), logitsTensor.GetData()...)
+			}
+		}
+		err = errors.Join(err, outputTensors[i].Destroy())
+	}
+
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, err
+}
+
+// Postprocess applies the softmax over the labels of each image and sorts the labels by score.
+func (p *ZeroShotImageClassificationPipeline) Postprocess(labelsBatch PipelineBatch, logits []float32, imagesCount int) (*ZeroShotImageClassificationOutput, error) {
+	labelsCount := len(p.Labels)
+	if len(logits) != imagesCount*labelsCount {
+		return nil, fmt.Errorf("expected %d logits for %d images and %d labels, got %d", imagesCount*labelsCount, imagesCount, labelsCount, len(logits))
+	}
+	output := &ZeroShotImageClassificationOutput{
+		Usage:                 p.recordUsage(batchUsage(labelsBatch)),
+		ClassificationOutputs: make([][]ClassificationOutput, imagesCount),
+	}
+	for i := 0; i < imagesCount; i++ {
+		scores := util.SoftMax(logits[i*labelsCount : (i+1)*labelsCount])
+		classifications := make([]ClassificationOutput, labelsCount)
+		for j, label := range p.Labels {
+			classifications[j] = ClassificationOutput{Label: label, Score: scores[j]}
+		}
+		sort.SliceStable(classifications, func(a, b int) bool {
+			return classifications[a].Score > classifications[b].Score
+		})
+		output.ClassificationOutputs[i] = classifications
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of paths to image files (jpeg, png or gif).
+func (p *ZeroShotImageClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	images, err := readImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunPipeline(images)
+}
+
+// RunPipeline classifies each image against the candidate labels.
+func (p *ZeroShotImageClassificationPipeline) RunPipeline(images []image.Image) (*ZeroShotImageClassificationOutput, error) {
+	if len(images) == 0 {
+		return &ZeroShotImageClassificationOutput{}, nil
+	}
+	hypotheses := make([]string, len(p.Labels))
+	for i, label := range p.Labels {
+		hypotheses[i] = strings.ReplaceAll(p.HypothesisTemplate, "{}", label)
+	}
+	labelsBatch := p.Preprocess(hypotheses)
+	logits, err := p.Forward(labelsBatch, images)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(labelsBatch, logits, len(images))
+}
@@ -0,0 +1,151 @@
+package hugot
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// OutputSchemaVersion is the version of the json schemas of the pipeline outputs. It is incremented on incompatible
+// changes of the outputs, i.e. fields removed, renamed or changing type; fields can be added within a version.
+const OutputSchemaVersion = 1
+
+// outputTypes are the output types of the pipeline types of Capabilities.
+var outputTypes = map[string]reflect.Type{
+	"featureExtraction":           reflect.TypeOf(pipelines.FeatureExtractionOutput{}),
+	"textClassification":          reflect.TypeOf(pipelines.TextClassificationOutput{}),
+	"tokenClassification":         reflect.TypeOf(pipelines.TokenClassificationOutput{}),
+	"promptInjection":             reflect.TypeOf(pipelines.PromptInjectionOutput{}),
+	"intentSlotFilling":           reflect.TypeOf(pipelines.IntentSlotFillingOutput{}),
+	"textGeneration":              reflect.TypeOf(pipelines.TextGenerationOutput{}),
+	"translation":                 reflect.TypeOf(pipelines.TranslationOutput{}),
+	"text2textGeneration":         reflect.TypeOf(pipelines.Text2TextGenerationOutput{}),
+	"reranking":                   reflect.TypeOf(pipelines.RerankingOutput{}),
+	"gliner":                      reflect.TypeOf(pipelines.GLiNEROutput{}),
+	"setFit":                      reflect.TypeOf(pipelines.TextClassificationOutput{}),
+	"zeroShotImageClassification": reflect.TypeOf(pipelines.ZeroShotImageClassificationOutput{}),
+	"imageToText":                 reflect.TypeOf(pipelines.ImageToTextOutput{}),
+	"imageSegmentation":           reflect.TypeOf(pipelines.ImageSegmentationOutput{}),
+	"maskGeneration":              reflect.TypeOf(pipelines.MaskGenerationOutput{}),
+	"automaticSpeechRecognition":  reflect.TypeOf(pipelines.AutomaticSpeechRecognitionOutput{}),
+	"audioClassification":         reflect.TypeOf(pipelines.AudioClassificationOutput{}),
+	"documentQuestionAnswering":   reflect.TypeOf(pipelines.DocumentQuestionAnsweringOutput{}),
+}
+
+// OutputSchema returns the json schema (draft 2020-12) of the json encoding of the output of a pipeline type, named
+// as in Capabilities, e.g. textClassification, so that the consumers of the outputs can validate them or generate
+// code. The output of each input in the cli results is an item of the main array of the pipeline output, e.g.
+// ClassificationOutputs. The schemas of the current version are published in the schemas folder of the repository.
+func OutputSchema(pipelineType string) ([]byte, error) {
+	outputType, ok := outputTypes[pipelineType]
+	if !ok {
+		return nil, fmt.Errorf("pipeline type %s has no output schema", pipelineType)
+	}
+	generator := &schemaGenerator{definitions: map[string]map[string]any{}}
+	schema := generator.object(outputType)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = fmt.Sprintf("https://%s/schemas/v%d/%s.json", modulePath, OutputSchemaVersion, pipelineType)
+	schema["title"] = outputType.Name()
+	if len(generator.definitions) > 0 {
+		schema["$defs"] = generator.definitions
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaGenerator generates the json schema of go types as encoding/json encodes them. Named struct types are
+// defined once in definitions and referenced.
+type schemaGenerator struct {
+	definitions map[string]map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(g.schema(t.Elem()))
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// byte slices are encoded in base64
+			return nullable(map[string]any{"type": "string"})
+		}
+		return nullable(map[string]any{"type": "array", "items": g.schema(t.Elem())})
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return nullable(map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())})
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.definitions[t.Name()]; !ok {
+			// defined before generating the fields, for recursive types
+			g.definitions[t.Name()] = map[string]any{}
+			g.definitions[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	default:
+		// interfaces can hold any value
+		return map[string]any{}
+	}
+}
+
+// object returns the schema of a struct. The fields of embedded structs are promoted, as in encoding/json, and the
+// fields without omitempty are required.
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			fieldType := field.Type
+			if field.Anonymous && name == "" {
+				if fieldType.Kind() == reflect.Pointer {
+					fieldType = fieldType.Elem()
+				}
+				if fieldType.Kind() == reflect.Struct {
+					addFields(fieldType)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = g.schema(fieldType)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+// nullable allows null in a schema, e.g. for the nil slices, maps and pointers.
+func nullable(schema map[string]any) map[string]any {
+	if schemaType, ok := schema["type"].(string); ok {
+		schema["type"] = []string{schemaType, "null"}
+		return schema
+	}
+	return map[string]any{"anyOf": []any{schema, map[string]any{"type": "null"}}}
+}
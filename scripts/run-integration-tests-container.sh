@@ -0,0 +1,9 @@
+#!/bin/bash
+
+set -e
+
+cd /build && \
+mkdir -p /test/integration && \
+gotestsum --junitfile=/test/integration/integration.xml --jsonfile=/test/integration/integration.json -- -tags INTEGRATION -count=1 ./integration/...
+
+echo Done.
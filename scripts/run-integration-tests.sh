@@ -0,0 +1,22 @@
+#!/bin/bash
+
+set -e
+
+# Directory of *this* script
+this_dir="$( cd "$( dirname "$0" )" && pwd )"
+export src_dir="$(realpath "${this_dir}/..")"
+
+export commit_hash=$(git rev-parse --short HEAD)
+export test_folder="$src_dir/testTarget"
+# the models are kept between runs, so that they are only downloaded once
+export models_folder="${HUGOT_INTEGRATION_MODELS:-$src_dir/testTarget/integrationModels}"
+export integration_eps="${HUGOT_INTEGRATION_EPS:-cpu}"
+mkdir -p $test_folder $models_folder
+export host_uid=$(id -u "$USER")
+
+# build with compose
+docker compose -f $src_dir/compose-integration.yaml build
+echo "Running integration tests for commit hash: $commit_hash on execution providers: $integration_eps"
+docker compose -f $src_dir/compose-integration.yaml up --exit-code-from hugot && \
+docker compose -f $src_dir/compose-integration.yaml logs --no-color >& $test_folder/integration-logs.txt
+docker compose -f $src_dir/compose-integration.yaml rm -fsv
@@ -0,0 +1,188 @@
+package hugot
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// GoldenFixture pins inputs of a pipeline and the outputs expected for them, as json. Fixtures are recorded with
+// RecordGoldenFixture from a model known to be good, and can be stored as json to be checked by later runs.
+type GoldenFixture struct {
+	Name     string          `json:"name"`
+	Inputs   []string        `json:"inputs"`
+	Expected json.RawMessage `json:"expected"`
+}
+
+// RecordGoldenFixture runs the pipeline on the inputs and returns a fixture expecting its current outputs.
+func RecordGoldenFixture(pipeline pipelines.Pipeline, name string, inputs []string) (GoldenFixture, error) {
+	output, err := pipeline.Run(inputs)
+	if err != nil {
+		return GoldenFixture{}, err
+	}
+	expected, err := json.Marshal(output.GetOutput())
+	if err != nil {
+		return GoldenFixture{}, err
+	}
+	return GoldenFixture{Name: name, Inputs: inputs, Expected: expected}, nil
+}
+
+// CheckGoldenFixture runs the pipeline on the inputs of a fixture and returns an error describing the first output
+// value deviating from the expected one: numbers by more than tolerance, other values at all.
+func CheckGoldenFixture(pipeline pipelines.Pipeline, fixture GoldenFixture, tolerance float64) error {
+	output, err := pipeline.Run(fixture.Inputs)
+	if err != nil {
+		return err
+	}
+	actualBytes, err := json.Marshal(output.GetOutput())
+	if err != nil {
+		return err
+	}
+	var expected, actual any
+	if err = json.Unmarshal(fixture.Expected, &expected); err != nil {
+		return fmt.Errorf("could not read the expected outputs of fixture %s: %w", fixture.Name, err)
+	}
+	if err = json.Unmarshal(actualBytes, &actual); err != nil {
+		return err
+	}
+	return compareOutputs(expected, actual, tolerance, "output")
+}
+
+// compareOutputs compares decoded json values recursively.
+func compareOutputs(expected any, actual any, tolerance float64, path string) error {
+	switch e := expected.(type) {
+	case float64:
+		a, ok := actual.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected the number %v, got %v", path, e, actual)
+		}
+		if math.Abs(e-a) > tolerance {
+			return fmt.Errorf("%s: expected %v, got %v, beyond the tolerance of %v", path, e, a, tolerance)
+		}
+	case []any:
+		a, ok := actual.([]any)
+		if !ok || len(a) != len(e) {
+			return fmt.Errorf("%s: expected %d values, got %v", path, len(e), actual)
+		}
+		for i := range e {
+			if err := compareOutputs(e[i], a[i], tolerance, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		a, ok := actual.(map[string]any)
+		if !ok || len(a) != len(e) {
+			return fmt.Errorf("%s: expected %v, got %v", path, e, actual)
+		}
+		for key, value := range e {
+			if err := compareOutputs(value, a[key], tolerance, path+"."+key); err != nil {
+				return err
+			}
+		}
+	default:
+		if expected != actual {
+			return fmt.Errorf("%s: expected %v, got %v", path, expected, actual)
+		}
+	}
+	return nil
+}
+
+// SelfTest periodically checks golden fixtures against the pipelines of a long-running service, to catch silent
+// output corruption in production, e.g. a bad model reload or numerical issues of an execution provider. Failures are
+// counted in Failures and passed to OnFailure if set, e.g. to log them or raise an alert.
+type SelfTest struct {
+	Interval  time.Duration
+	Tolerance float64
+	// OnFailure is called with the name of each failing fixture and the deviation found.
+	OnFailure func(fixture string, err error)
+	// Runs is the number of fixture checks run, and Failures the number of failed ones.
+	Runs     uint64
+	Failures uint64
+	checks   []selfTestCheck
+	mutex    sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type selfTestCheck struct {
+	pipeline pipelines.Pipeline
+	fixture  GoldenFixture
+}
+
+// NewSelfTest returns a self-test checking its fixtures every interval, within tolerance, once started.
+func NewSelfTest(interval time.Duration, tolerance float64) *SelfTest {
+	return &SelfTest{Interval: interval, Tolerance: tolerance}
+}
+
+// Add adds a fixture checked against a pipeline.
+func (t *SelfTest) Add(pipeline pipelines.Pipeline, fixture GoldenFixture) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.checks = append(t.checks, selfTestCheck{pipeline: pipeline, fixture: fixture})
+}
+
+// Run checks all the fixtures once and returns the number of failures.
+func (t *SelfTest) Run() int {
+	t.mutex.Lock()
+	checks := append([]selfTestCheck(nil), t.checks...)
+	t.mutex.Unlock()
+
+	failures := 0
+	for _, check := range checks {
+		atomic.AddUint64(&t.Runs, 1)
+		if err := CheckGoldenFixture(check.pipeline, check.fixture, t.Tolerance); err != nil {
+			failures++
+			atomic.AddUint64(&t.Failures, 1)
+			if t.OnFailure != nil {
+				t.OnFailure(check.fixture.Name, err)
+			}
+		}
+	}
+	return failures
+}
+
+// Start checks the fixtures every interval in the background, until Stop. An error is returned if the interval is
+// not positive, rather than failing in the background.
+func (t *SelfTest) Start() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.Interval <= 0 {
+		return fmt.Errorf("self-test interval must be positive, got %s", t.Interval)
+	}
+	if t.stop != nil {
+		return nil
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.Run()
+			}
+		}
+	}(t.stop, t.done)
+	return nil
+}
+
+// Stop stops the background checks started with Start, waiting for a running check to finish.
+func (t *SelfTest) Stop() {
+	t.mutex.Lock()
+	stop, done := t.stop, t.done
+	t.stop, t.done = nil, nil
+	t.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,125 @@
+package hugot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// Result is the output of a pipeline for a record read from a Source.
+type Result struct {
+	Record
+	// Output is the output of the pipeline for the input of the record, one of the elements of the GetOutput method
+	// of the pipeline batch output.
+	Output any
+}
+
+// NewResults pairs the records of a batch with the output of the pipeline run on their inputs.
+func NewResults(batch RecordBatch, output pipelines.PipelineBatchOutput) ([]Result, error) {
+	outputs := output.GetOutput()
+	if len(outputs) != len(batch) {
+		return nil, fmt.Errorf("the pipeline returned %d outputs for %d records", len(outputs), len(batch))
+	}
+	results := make([]Result, len(batch))
+	for i, record := range batch {
+		results[i] = Result{Record: record, Output: outputs[i]}
+	}
+	return results, nil
+}
+
+// Sink writes the results of pipelines as they are produced, the counterpart of Source:
+//
+//	results, err := hugot.NewResults(batch, output)
+//	...
+//	err = sink.Write(results)
+//
+// Sinks are not safe for concurrent use, and Close must be called once all results are written.
+type Sink interface {
+	// Write writes a batch of results.
+	Write(results []Result) error
+	// Close flushes the results written. The underlying writer, if any, is not closed.
+	Close() error
+}
+
+// jsonlSink writes the results as json lines.
+type jsonlSink struct {
+	encoder *json.Encoder
+}
+
+// NewJSONLSink returns a sink writing one json object per result, with the "input" and "output" of the result and
+// the fields of its record, e.g. an id read from a jsonl source. This is the output format of the cli.
+func NewJSONLSink(w io.Writer) Sink {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &jsonlSink{encoder: encoder}
+}
+
+func (s *jsonlSink) Write(results []Result) error {
+	for _, result := range results {
+		object := make(map[string]any, len(result.Fields)+2)
+		for field, value := range result.Fields {
+			object[field] = value
+		}
+		object["input"] = result.Input
+		object["output"] = result.Output
+		if err := s.encoder.Encode(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonlSink) Close() error {
+	return nil
+}
+
+// channelSink sends the results to a channel.
+type channelSink struct {
+	channel chan<- []Result
+}
+
+// NewChannelSink returns a sink sending each batch of results to the channel, e.g. to process them in another
+// goroutine. Close closes the channel.
+func NewChannelSink(channel chan<- []Result) Sink {
+	return &channelSink{channel: channel}
+}
+
+func (s *channelSink) Write(results []Result) error {
+	s.channel <- results
+	return nil
+}
+
+func (s *channelSink) Close() error {
+	close(s.channel)
+	return nil
+}
+
+// multiSink writes the results to several sinks.
+type multiSink struct {
+	sinks []Sink
+}
+
+// NewMultiSink returns a sink writing the results to all the sinks in order, e.g. to both write them to a file and
+// send them to a channel. The errors of all the sinks are returned, joined.
+func NewMultiSink(sinks ...Sink) Sink {
+	return &multiSink{sinks: sinks}
+}
+
+func (s *multiSink) Write(results []Result) error {
+	var errs []error
+	for _, sink := range s.sinks {
+		errs = append(errs, sink.Write(results))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *multiSink) Close() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,208 @@
+package hugot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Record is an input read from a Source.
+type Record struct {
+	// Input is the text passed to the pipelines.
+	Input string
+	// Fields are all the fields of the record (the json fields, or the csv columns by header), e.g. to pass an id
+	// through to the output. Text sources have no fields.
+	Fields map[string]any
+	// Line is the line of the record in the source, starting at 1.
+	Line int
+}
+
+// RecordBatch is a batch of records read from a Source.
+type RecordBatch []Record
+
+// Inputs returns the inputs of the records, to be passed to the Run or RunPipeline method of a pipeline.
+func (b RecordBatch) Inputs() []string {
+	inputs := make([]string, len(b))
+	for i, record := range b {
+		inputs[i] = record.Input
+	}
+	return inputs
+}
+
+// Source iterates over the records of a stream in batches, reading the stream as it goes, so that files of any size
+// can be run through pipelines in constant memory:
+//
+//	for {
+//		batch, err := source.Next()
+//		if errors.Is(err, io.EOF) {
+//			break
+//		}
+//		...
+//		output, err := pipeline.RunPipeline(batch.Inputs())
+//	}
+type Source interface {
+	// Next returns the next batch of records, of at most the batch size of the source, and io.EOF once all records
+	// have been read. Empty lines are skipped. If a record cannot be read, the records of the batch read before it
+	// are returned with the error.
+	Next() (RecordBatch, error)
+}
+
+type sourceOptions struct {
+	inputField string
+}
+
+// SourceOption is an option of the sources.
+type SourceOption func(o *sourceOptions)
+
+// WithInputField sets the json field or csv column holding the input of the records, "input" by default.
+func WithInputField(field string) SourceOption {
+	return func(o *sourceOptions) {
+		o.inputField = field
+	}
+}
+
+func newSourceOptions(options []SourceOption) sourceOptions {
+	o := sourceOptions{inputField: "input"}
+	for _, option := range options {
+		option(&o)
+	}
+	return o
+}
+
+// lineSource reads batches of non-empty lines, parsed into records.
+type lineSource struct {
+	reader    *bufio.Reader
+	batchSize int
+	line      int
+	parse     func(line []byte, lineNumber int) (Record, error)
+}
+
+func (s *lineSource) Next() (RecordBatch, error) {
+	var batch RecordBatch
+	for len(batch) < s.batchSize {
+		line, err := s.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			s.line++
+			if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+				record, parseErr := s.parse(trimmed, s.line)
+				if parseErr != nil {
+					return batch, fmt.Errorf("line %d: %w", s.line, parseErr)
+				}
+				batch = append(batch, record)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return batch, err
+		}
+	}
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	return batch, nil
+}
+
+// NewJSONLSource returns a source reading .jsonl records, one json object per line, the input of each record being
+// the string of its "input" field (see WithInputField). This is the input format of the cli.
+func NewJSONLSource(r io.Reader, batchSize int, options ...SourceOption) (Source, error) {
+	if batchSize <= 0 {
+		return nil, errors.New("the batch size must be greater than zero")
+	}
+	o := newSourceOptions(options)
+	return &lineSource{
+		reader:    bufio.NewReader(r),
+		batchSize: batchSize,
+		parse: func(line []byte, lineNumber int) (Record, error) {
+			var fields map[string]any
+			if err := json.Unmarshal(line, &fields); err != nil {
+				return Record{}, err
+			}
+			input, ok := fields[o.inputField].(string)
+			if !ok {
+				return Record{}, fmt.Errorf("the record has no string field %s", o.inputField)
+			}
+			return Record{Input: input, Fields: fields, Line: lineNumber}, nil
+		},
+	}, nil
+}
+
+// NewTextSource returns a source reading one input per line, without surrounding whitespace.
+func NewTextSource(r io.Reader, batchSize int) (Source, error) {
+	if batchSize <= 0 {
+		return nil, errors.New("the batch size must be greater than zero")
+	}
+	return &lineSource{
+		reader:    bufio.NewReader(r),
+		batchSize: batchSize,
+		parse: func(line []byte, lineNumber int) (Record, error) {
+			return Record{Input: string(line), Line: lineNumber}, nil
+		},
+	}, nil
+}
+
+// csvSource reads the records of a csv file with a header row.
+type csvSource struct {
+	reader     *csv.Reader
+	batchSize  int
+	inputField string
+	header     []string
+	inputIndex int
+}
+
+// NewCSVSource returns a source reading csv records. The first row is the header naming the columns, the input of
+// each record being its "input" column (see WithInputField). Quoted fields can span several lines.
+func NewCSVSource(r io.Reader, batchSize int, options ...SourceOption) (Source, error) {
+	if batchSize <= 0 {
+		return nil, errors.New("the batch size must be greater than zero")
+	}
+	o := newSourceOptions(options)
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	return &csvSource{reader: reader, batchSize: batchSize, inputField: o.inputField, inputIndex: -1}, nil
+}
+
+func (s *csvSource) Next() (RecordBatch, error) {
+	if s.header == nil {
+		header, err := s.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		s.header = append([]string(nil), header...)
+		for i, column := range s.header {
+			if strings.TrimSpace(column) == s.inputField {
+				s.inputIndex = i
+			}
+		}
+		if s.inputIndex < 0 {
+			return nil, fmt.Errorf("the csv header has no %s column", s.inputField)
+		}
+	}
+
+	var batch RecordBatch
+	for len(batch) < s.batchSize {
+		row, err := s.reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return batch, err
+		}
+		line, _ := s.reader.FieldPos(0)
+		fields := make(map[string]any, len(row))
+		for i, value := range row {
+			fields[s.header[i]] = value
+		}
+		batch = append(batch, Record{Input: row[s.inputIndex], Fields: fields, Line: line})
+	}
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	return batch, nil
+}
@@ -0,0 +1,24 @@
+// Command generate writes the tiny test models of all tasks to the output folder, e.g.
+//
+//	go run ./testData/tinymodels/generate -output ./models/tiny
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/knights-analytics/hugot/testData/tinymodels"
+)
+
+func main() {
+	output := flag.String("output", "./models/tiny", "folder the models are written to, one sub folder per task")
+	flag.Parse()
+
+	paths, err := tinymodels.WriteAll(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, task := range tinymodels.Tasks {
+		log.Printf("%s: %s", task, paths[task])
+	}
+}
@@ -0,0 +1,133 @@
+package tinymodels
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The onnx model files are protobuf messages. There is no protobuf dependency in the module, so the few messages of
+// onnx.proto needed for the tiny models are encoded by hand. The field numbers are those of onnx.proto.
+
+const (
+	tensorFloat = 1
+	tensorInt64 = 7
+
+	attributeInt = 2
+)
+
+// message is a protobuf message being encoded.
+type message []byte
+
+func (m message) varint(field int, value uint64) message {
+	m = binary.AppendUvarint(m, uint64(field)<<3)
+	return binary.AppendUvarint(m, value)
+}
+
+func (m message) bytes(field int, value []byte) message {
+	m = binary.AppendUvarint(m, uint64(field)<<3|2)
+	m = binary.AppendUvarint(m, uint64(len(value)))
+	return append(m, value...)
+}
+
+func (m message) string(field int, value string) message {
+	return m.bytes(field, []byte(value))
+}
+
+func (m message) message(field int, value message) message {
+	return m.bytes(field, value)
+}
+
+// dimension is a fixed dimension of a tensor shape, or a named dynamic one if name is set.
+type dimension struct {
+	name  string
+	value int64
+}
+
+// valueInfo encodes a ValueInfoProto, the name and type of a graph input or output.
+func valueInfo(name string, elementType int, dims ...dimension) message {
+	var shape message
+	for _, d := range dims {
+		if d.name != "" {
+			shape = shape.message(1, message{}.string(2, d.name))
+		} else {
+			shape = shape.message(1, message{}.varint(1, uint64(d.value)))
+		}
+	}
+	tensorType := message{}.varint(1, uint64(elementType)).message(2, shape)
+	return message{}.string(1, name).message(2, message{}.message(1, tensorType))
+}
+
+// floatTensor encodes a TensorProto of float32 values.
+func floatTensor(name string, dims []int64, values []float32) message {
+	raw := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(v))
+	}
+	return tensor(name, tensorFloat, dims, raw)
+}
+
+// int64Tensor encodes a TensorProto of int64 values.
+func int64Tensor(name string, dims []int64, values []int64) message {
+	raw := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(raw[8*i:], uint64(v))
+	}
+	return tensor(name, tensorInt64, dims, raw)
+}
+
+func tensor(name string, dataType int, dims []int64, raw []byte) message {
+	var m message
+	for _, d := range dims {
+		m = m.varint(1, uint64(d))
+	}
+	return m.varint(2, uint64(dataType)).string(8, name).bytes(9, raw)
+}
+
+// node encodes a NodeProto of the default domain.
+func node(opType string, inputs []string, outputs []string, attributes ...message) message {
+	var m message
+	for _, input := range inputs {
+		m = m.string(1, input)
+	}
+	for _, output := range outputs {
+		m = m.string(2, output)
+	}
+	m = m.string(3, outputs[0]).string(4, opType)
+	for _, attribute := range attributes {
+		m = m.message(5, attribute)
+	}
+	return m
+}
+
+// intAttribute encodes an AttributeProto holding an integer.
+func intAttribute(name string, value int64) message {
+	return message{}.string(1, name).varint(3, uint64(value)).varint(20, attributeInt)
+}
+
+// graph is an onnx graph being built.
+type graph struct {
+	nodes        []message
+	initializers []message
+	inputs       []message
+	outputs      []message
+}
+
+// model encodes the ModelProto of the graph, with ir version 7 and opset 13.
+func (g *graph) model(name string) []byte {
+	graphMessage := message{}
+	for _, n := range g.nodes {
+		graphMessage = graphMessage.message(1, n)
+	}
+	graphMessage = graphMessage.string(2, name)
+	for _, initializer := range g.initializers {
+		graphMessage = graphMessage.message(5, initializer)
+	}
+	for _, input := range g.inputs {
+		graphMessage = graphMessage.message(11, input)
+	}
+	for _, output := range g.outputs {
+		graphMessage = graphMessage.message(12, output)
+	}
+	opset := message{}.string(1, "").varint(2, 13)
+	return message{}.varint(1, 7).string(2, "hugot-tinymodels").message(7, graphMessage).message(8, opset)
+}
@@ -0,0 +1,392 @@
+// Package tinymodels generates tiny onnx models with fixed weights, and the matching tokenizer and config files, for
+// the encoder pipelines of hugot. The models are a word embedding followed by a linear head, small enough to be
+// generated in a few milliseconds, so that tests can run the pipelines hermetically, without downloading models.
+// Their outputs are deterministic but meaningless: tests should check the pipeline mechanics, not the predictions.
+//
+// The models use a lowercasing WordPiece tokenizer whose vocabulary holds a few common words and every letter and
+// digit, alone and as a ## subword, so that any input is tokenized without unknown tokens.
+package tinymodels
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The tasks a model can be generated for.
+const (
+	FeatureExtraction   = "featureExtraction"
+	TextClassification  = "textClassification"
+	TokenClassification = "tokenClassification"
+	Reranking           = "reranking"
+	// StatefulTextClassification is a text classification model with a state_in input and a state_out output, the
+	// sum of the [CLS] embeddings of the inputs seen so far, which it classifies.
+	StatefulTextClassification = "statefulTextClassification"
+	// IntentSlotFilling is a joint model with an intent_logits output classifying the [CLS] embedding and a
+	// slot_logits output classifying each token, whose labels are IntentLabels and Labels.
+	IntentSlotFilling = "intentSlotFilling"
+)
+
+// Tasks are all the tasks a model can be generated for.
+var Tasks = []string{FeatureExtraction, TextClassification, TokenClassification, Reranking, StatefulTextClassification, IntentSlotFilling}
+
+// HiddenSize is the dimension of the embeddings of the models.
+const HiddenSize = 16
+
+// MaxLength is the maximum number of tokens of the model inputs, beyond which the tokenizer truncates.
+const MaxLength = 128
+
+var specialTokens = []string{"[PAD]", "[UNK]", "[CLS]", "[SEP]", "[MASK]"}
+
+var words = []string{
+	"the", "an", "is", "are", "was", "in", "of", "and", "to", "for", "on", "with", "at", "by", "this", "that",
+	"it", "he", "she", "they", "we", "you", "not", "movie", "great", "terrible", "good", "bad", "capital",
+	"city", "country", "met", "lives", "visited", "paris", "berlin", "london", "germany", "france", "angela",
+	"merkel", "emmanuel", "macron", "what", "where", "who",
+	".", ",", "!", "?", "-", "'", ":", ";", "(", ")", "\"",
+}
+
+// labels are the labels of the classification heads of each task.
+var labels = map[string][]string{
+	TextClassification:         {"NEGATIVE", "POSITIVE"},
+	TokenClassification:        {"O", "B-PER", "I-PER", "B-LOC", "I-LOC", "B-ORG", "I-ORG", "B-MISC", "I-MISC"},
+	Reranking:                  {"LABEL_0"},
+	StatefulTextClassification: {"NEGATIVE", "POSITIVE"},
+	IntentSlotFilling:          {"O", "B-city", "I-city"},
+}
+
+// intentLabels are the intent labels of the intent slot filling model.
+var intentLabels = []string{"greeting", "travel", "weather"}
+
+// Labels returns the labels of the model of a task, in the order of the model outputs. Feature extraction models
+// have no labels.
+func Labels(task string) []string {
+	return append([]string(nil), labels[task]...)
+}
+
+// IntentLabels returns the intent labels of the intent slot filling model, in the order of its intent output.
+func IntentLabels() []string {
+	return append([]string(nil), intentLabels...)
+}
+
+// Vocabulary returns the tokens of the tokenizer of the models, the id of a token being its position.
+func Vocabulary() []string {
+	vocabulary := append([]string(nil), specialTokens...)
+	vocabulary = append(vocabulary, words...)
+	for _, c := range "abcdefghijklmnopqrstuvwxyz0123456789" {
+		vocabulary = append(vocabulary, string(c))
+	}
+	for _, c := range "abcdefghijklmnopqrstuvwxyz0123456789" {
+		vocabulary = append(vocabulary, "##"+string(c))
+	}
+	return vocabulary
+}
+
+// TokenId returns the id of a token of the vocabulary, and false if the token is not in the vocabulary.
+func TokenId(token string) (uint32, bool) {
+	for i, t := range Vocabulary() {
+		if t == token {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// WriteAll writes the models of all tasks to sub folders of dir named after the tasks, e.g. dir/tokenClassification,
+// and returns the path of each model by task.
+func WriteAll(dir string) (map[string]string, error) {
+	paths := map[string]string{}
+	for _, task := range Tasks {
+		modelDir := filepath.Join(dir, task)
+		if err := Write(modelDir, task); err != nil {
+			return nil, err
+		}
+		paths[task] = modelDir
+	}
+	return paths, nil
+}
+
+// Write writes the model of a task to dir, created if needed: model.onnx, config.json, tokenizer.json,
+// tokenizer_config.json and special_tokens_map.json. The files are identical on every call.
+func Write(dir string, task string) error {
+	var model []byte
+	switch task {
+	case FeatureExtraction:
+		model = featureExtractionModel()
+	case TextClassification, Reranking:
+		model = sequenceClassificationModel(task)
+	case TokenClassification:
+		model = tokenClassificationModel()
+	case StatefulTextClassification:
+		model = statefulClassificationModel()
+	case IntentSlotFilling:
+		model = intentSlotFillingModel()
+	default:
+		return fmt.Errorf("unknown task %s", task)
+	}
+
+	config, err := modelConfig(task)
+	if err != nil {
+		return err
+	}
+	tokenizer, err := tokenizerJSON()
+	if err != nil {
+		return err
+	}
+	tokenizerConfig, err := json.MarshalIndent(map[string]any{
+		"cls_token":        "[CLS]",
+		"sep_token":        "[SEP]",
+		"pad_token":        "[PAD]",
+		"unk_token":        "[UNK]",
+		"mask_token":       "[MASK]",
+		"do_lower_case":    true,
+		"model_max_length": MaxLength,
+		"tokenizer_class":  "BertTokenizer",
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	specialTokensMap, err := json.MarshalIndent(map[string]string{
+		"cls_token":  "[CLS]",
+		"sep_token":  "[SEP]",
+		"pad_token":  "[PAD]",
+		"unk_token":  "[UNK]",
+		"mask_token": "[MASK]",
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for name, contents := range map[string][]byte{
+		"model.onnx":              model,
+		"config.json":             config,
+		"tokenizer.json":          tokenizer,
+		"tokenizer_config.json":   tokenizerConfig,
+		"special_tokens_map.json": specialTokensMap,
+	} {
+		if err = os.WriteFile(filepath.Join(dir, name), contents, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weights returns n fixed pseudo random values in [-scale, scale], different for each name.
+func weights(name string, n int, scale float32) []float32 {
+	// FNV-1a hash of the name as the seed of a splitmix64 generator
+	state := uint64(14695981039346656037)
+	for _, c := range []byte(name) {
+		state ^= uint64(c)
+		state *= 1099511628211
+	}
+	values := make([]float32, n)
+	for i := range values {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		values[i] = scale * float32(2*float64(z>>11)/float64(uint64(1)<<53)-1)
+	}
+	return values
+}
+
+var (
+	batchDim    = dimension{name: "batch_size"}
+	sequenceDim = dimension{name: "sequence_length"}
+)
+
+// encoder adds to g the inputs and the layers computing the token embeddings, tanh(word + token type embedding)
+// zeroed at the padding positions, and returns the name of the [batch, sequence, HiddenSize] output.
+func encoder(g *graph) string {
+	vocabularySize := int64(len(Vocabulary()))
+	g.inputs = append(g.inputs,
+		valueInfo("input_ids", tensorInt64, batchDim, sequenceDim),
+		valueInfo("attention_mask", tensorInt64, batchDim, sequenceDim),
+		valueInfo("token_type_ids", tensorInt64, batchDim, sequenceDim),
+	)
+	g.initializers = append(g.initializers,
+		floatTensor("word_embeddings", []int64{vocabularySize, HiddenSize}, weights("word_embeddings", int(vocabularySize)*HiddenSize, 1)),
+		floatTensor("token_type_embeddings", []int64{2, HiddenSize}, weights("token_type_embeddings", 2*HiddenSize, 0.5)),
+		int64Tensor("mask_axes", []int64{1}, []int64{2}),
+	)
+	g.nodes = append(g.nodes,
+		node("Gather", []string{"word_embeddings", "input_ids"}, []string{"words"}),
+		node("Gather", []string{"token_type_embeddings", "token_type_ids"}, []string{"token_types"}),
+		node("Add", []string{"words", "token_types"}, []string{"embeddings"}),
+		node("Cast", []string{"attention_mask"}, []string{"mask"}, intAttribute("to", tensorFloat)),
+		node("Unsqueeze", []string{"mask", "mask_axes"}, []string{"expanded_mask"}),
+		node("Mul", []string{"embeddings", "expanded_mask"}, []string{"masked_embeddings"}),
+		node("Tanh", []string{"masked_embeddings"}, []string{"last_hidden_state"}),
+	)
+	return "last_hidden_state"
+}
+
+// linear adds to g a linear layer of outputDim outputs applied to input, and returns the name of its output.
+func linear(g *graph, input string, outputDim int, output string) string {
+	return namedLinear(g, "classifier", input, outputDim, output)
+}
+
+// namedLinear adds to g a linear layer whose weights are named after name, for graphs with several layers.
+func namedLinear(g *graph, name string, input string, outputDim int, output string) string {
+	g.initializers = append(g.initializers,
+		floatTensor(name+"_weight", []int64{HiddenSize, int64(outputDim)}, weights(name+"_weight", HiddenSize*outputDim, 2)),
+		floatTensor(name+"_bias", []int64{int64(outputDim)}, weights(name+"_bias", outputDim, 0.1)),
+	)
+	g.nodes = append(g.nodes,
+		node("MatMul", []string{input, name + "_weight"}, []string{name + "_product"}),
+		node("Add", []string{name + "_product", name + "_bias"}, []string{output}),
+	)
+	return output
+}
+
+func featureExtractionModel() []byte {
+	g := &graph{}
+	output := encoder(g)
+	g.outputs = append(g.outputs, valueInfo(output, tensorFloat, batchDim, sequenceDim, dimension{value: HiddenSize}))
+	return g.model("tinyFeatureExtraction")
+}
+
+// sequenceClassificationModel classifies the embedding of the first ([CLS]) token of the inputs.
+func sequenceClassificationModel(task string) []byte {
+	g := &graph{}
+	hidden := encoder(g)
+	g.initializers = append(g.initializers, int64Tensor("cls_index", nil, []int64{0}))
+	g.nodes = append(g.nodes, node("Gather", []string{hidden, "cls_index"}, []string{"pooled"}, intAttribute("axis", 1)))
+	outputDim := len(labels[task])
+	output := linear(g, "pooled", outputDim, "logits")
+	g.outputs = append(g.outputs, valueInfo(output, tensorFloat, batchDim, dimension{value: int64(outputDim)}))
+	return g.model("tiny" + task)
+}
+
+// statefulClassificationModel classifies the running sum of the embeddings of the first ([CLS]) token of the inputs.
+func statefulClassificationModel() []byte {
+	g := &graph{}
+	hidden := encoder(g)
+	g.inputs = append(g.inputs, valueInfo("state_in", tensorFloat, batchDim, dimension{value: HiddenSize}))
+	g.initializers = append(g.initializers, int64Tensor("cls_index", nil, []int64{0}))
+	g.nodes = append(g.nodes,
+		node("Gather", []string{hidden, "cls_index"}, []string{"pooled"}, intAttribute("axis", 1)),
+		node("Add", []string{"pooled", "state_in"}, []string{"state_out"}),
+	)
+	outputDim := len(labels[StatefulTextClassification])
+	output := linear(g, "state_out", outputDim, "logits")
+	g.outputs = append(g.outputs,
+		valueInfo(output, tensorFloat, batchDim, dimension{value: int64(outputDim)}),
+		valueInfo("state_out", tensorFloat, batchDim, dimension{value: HiddenSize}),
+	)
+	return g.model("tiny" + StatefulTextClassification)
+}
+
+func tokenClassificationModel() []byte {
+	g := &graph{}
+	hidden := encoder(g)
+	outputDim := len(labels[TokenClassification])
+	output := linear(g, hidden, outputDim, "logits")
+	g.outputs = append(g.outputs, valueInfo(output, tensorFloat, batchDim, sequenceDim, dimension{value: int64(outputDim)}))
+	return g.model("tinyTokenClassification")
+}
+
+// intentSlotFillingModel classifies the embedding of the first ([CLS]) token of the inputs into intents, and each
+// token into slots.
+func intentSlotFillingModel() []byte {
+	g := &graph{}
+	hidden := encoder(g)
+	g.initializers = append(g.initializers, int64Tensor("cls_index", nil, []int64{0}))
+	g.nodes = append(g.nodes, node("Gather", []string{hidden, "cls_index"}, []string{"pooled"}, intAttribute("axis", 1)))
+	intentDim, slotDim := len(intentLabels), len(labels[IntentSlotFilling])
+	intents := namedLinear(g, "intent_classifier", "pooled", intentDim, "intent_logits")
+	slots := namedLinear(g, "slot_classifier", hidden, slotDim, "slot_logits")
+	g.outputs = append(g.outputs,
+		valueInfo(intents, tensorFloat, batchDim, dimension{value: int64(intentDim)}),
+		valueInfo(slots, tensorFloat, batchDim, sequenceDim, dimension{value: int64(slotDim)}),
+	)
+	return g.model("tiny" + IntentSlotFilling)
+}
+
+func modelConfig(task string) ([]byte, error) {
+	config := map[string]any{
+		"model_type":              "bert",
+		"hidden_size":             HiddenSize,
+		"vocab_size":              len(Vocabulary()),
+		"max_position_embeddings": MaxLength,
+	}
+	if task == IntentSlotFilling {
+		intentId2label := map[string]string{}
+		for i, label := range intentLabels {
+			intentId2label[strconv.Itoa(i)] = label
+		}
+		slotId2label := map[string]string{}
+		for i, label := range labels[task] {
+			slotId2label[strconv.Itoa(i)] = label
+		}
+		config["intent_id2label"] = intentId2label
+		config["slot_id2label"] = slotId2label
+	} else if taskLabels, ok := labels[task]; ok {
+		id2label := map[string]string{}
+		label2id := map[string]int{}
+		for i, label := range taskLabels {
+			id2label[strconv.Itoa(i)] = label
+			label2id[label] = i
+		}
+		config["id2label"] = id2label
+		config["label2id"] = label2id
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// tokenizerJSON returns the tokenizer.json of a BERT WordPiece tokenizer with the vocabulary of the models.
+func tokenizerJSON() ([]byte, error) {
+	vocabulary := Vocabulary()
+	vocab := make(map[string]int, len(vocabulary))
+	for i, token := range vocabulary {
+		vocab[token] = i
+	}
+	var addedTokens []map[string]any
+	specialTokenIds := map[string]any{}
+	for i, token := range specialTokens {
+		addedTokens = append(addedTokens, map[string]any{
+			"id": i, "content": token, "single_word": false, "lstrip": false, "rstrip": false, "normalized": false, "special": true,
+		})
+		specialTokenIds[token] = map[string]any{"id": token, "ids": []int{i}, "tokens": []string{token}}
+	}
+	special := func(token string, typeId int) map[string]any {
+		return map[string]any{"SpecialToken": map[string]any{"id": token, "type_id": typeId}}
+	}
+	sequence := func(id string, typeId int) map[string]any {
+		return map[string]any{"Sequence": map[string]any{"id": id, "type_id": typeId}}
+	}
+
+	tokenizer := map[string]any{
+		"version": "1.0",
+		"truncation": map[string]any{
+			"direction": "Right", "max_length": MaxLength, "strategy": "LongestFirst", "stride": 0,
+		},
+		"padding":      nil,
+		"added_tokens": addedTokens,
+		"normalizer": map[string]any{
+			"type": "BertNormalizer", "clean_text": true, "handle_chinese_chars": true, "strip_accents": nil, "lowercase": true,
+		},
+		"pre_tokenizer": map[string]any{"type": "BertPreTokenizer"},
+		"post_processor": map[string]any{
+			"type":           "TemplateProcessing",
+			"single":         []any{special("[CLS]", 0), sequence("A", 0), special("[SEP]", 0)},
+			"pair":           []any{special("[CLS]", 0), sequence("A", 0), special("[SEP]", 0), sequence("B", 1), special("[SEP]", 1)},
+			"special_tokens": specialTokenIds,
+		},
+		"decoder": map[string]any{"type": "WordPiece", "prefix": "##", "cleanup": true},
+		"model": map[string]any{
+			"type":                      "WordPiece",
+			"unk_token":                 "[UNK]",
+			"continuing_subword_prefix": "##",
+			"max_input_chars_per_word":  100,
+			"vocab":                     vocab,
+		},
+	}
+	return json.MarshalIndent(tokenizer, "", "  ")
+}
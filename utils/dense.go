@@ -0,0 +1,191 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Dense holds a fully connected layer applied to embeddings, as the Dense module of sentence-transformers models,
+// which is not part of the exported onnx graph. The weights are [output, input] as in torch.nn.Linear.
+type Dense struct {
+	Weight [][]float32
+	Bias   []float32
+	// Activation is the activation function applied to the output: Identity, Tanh, ReLU, Sigmoid or GELU, or the
+	// torch class name of one of them, e.g. torch.nn.modules.activation.Tanh.
+	Activation string
+}
+
+// InputDim is the dimension of the vectors the layer applies to.
+func (d *Dense) InputDim() int {
+	if len(d.Weight) == 0 {
+		return 0
+	}
+	return len(d.Weight[0])
+}
+
+// OutputDim is the dimension of the output vectors.
+func (d *Dense) OutputDim() int {
+	return len(d.Weight)
+}
+
+// Validate checks that the dimensions of the layer are consistent and its activation function is supported.
+func (d *Dense) Validate() error {
+	if len(d.Weight) == 0 {
+		return errors.New("dense layer has no weights")
+	}
+	for i, row := range d.Weight {
+		if len(row) != d.InputDim() {
+			return fmt.Errorf("dense weight row %d has dimension %d, expected %d", i, len(row), d.InputDim())
+		}
+	}
+	if d.Bias != nil && len(d.Bias) != d.OutputDim() {
+		return fmt.Errorf("dense bias has dimension %d, expected %d", len(d.Bias), d.OutputDim())
+	}
+	switch d.activation() {
+	case "", "Identity", "Tanh", "ReLU", "Sigmoid", "GELU":
+		return nil
+	default:
+		return fmt.Errorf("dense activation function %s is not supported", d.Activation)
+	}
+}
+
+// activation returns the activation function name without its torch package.
+func (d *Dense) activation() string {
+	return d.Activation[strings.LastIndex(d.Activation, ".")+1:]
+}
+
+// Transform applies the layer to a single vector.
+func (d *Dense) Transform(vector []float32) []float32 {
+	output := make([]float32, len(d.Weight))
+	activation := d.activation()
+	for i, row := range d.Weight {
+		var sum float32
+		for j, v := range vector {
+			sum += v * row[j]
+		}
+		if d.Bias != nil {
+			sum += d.Bias[i]
+		}
+		switch activation {
+		case "Tanh":
+			sum = float32(math.Tanh(float64(sum)))
+		case "ReLU":
+			sum = float32(math.Max(0, float64(sum)))
+		case "Sigmoid":
+			sum = float32(1 / (1 + math.Exp(-float64(sum))))
+		case "GELU":
+			sum = float32(0.5 * float64(sum) * (1 + math.Erf(float64(sum)/math.Sqrt2)))
+		}
+		output[i] = sum
+	}
+	return output
+}
+
+// Tensor is a float tensor read from a safetensors file, with its values in row-major order.
+type Tensor struct {
+	Shape  []int
+	Values []float32
+}
+
+// ReadSafetensors parses the tensors of a safetensors file: a little endian uint64 header length, a json header with
+// the dtype, shape and data offsets of each tensor, then the tensor data. F32, F16 and BF16 tensors are read as float32.
+func ReadSafetensors(data []byte) (map[string]Tensor, error) {
+	if len(data) < 8 {
+		return nil, errors.New("safetensors file is too short")
+	}
+	headerLength := binary.LittleEndian.Uint64(data[:8])
+	if headerLength > uint64(len(data)-8) {
+		return nil, fmt.Errorf("safetensors header length %d is greater than the file", headerLength)
+	}
+	var header map[string]jsoniter.RawMessage
+	if err := jsoniter.Unmarshal(data[8:8+headerLength], &header); err != nil {
+		return nil, fmt.Errorf("could not read the safetensors header: %w", err)
+	}
+	body := data[8+headerLength:]
+
+	tensors := map[string]Tensor{}
+	for name, raw := range header {
+		if name == "__metadata__" {
+			continue
+		}
+		var info struct {
+			Dtype       string `json:"dtype"`
+			Shape       []int  `json:"shape"`
+			DataOffsets [2]int `json:"data_offsets"`
+		}
+		if err := jsoniter.Unmarshal(raw, &info); err != nil {
+			return nil, fmt.Errorf("could not read the safetensors header of tensor %s: %w", name, err)
+		}
+		start, end := info.DataOffsets[0], info.DataOffsets[1]
+		if start < 0 || end < start || end > len(body) {
+			return nil, fmt.Errorf("safetensors tensor %s has invalid data offsets %v", name, info.DataOffsets)
+		}
+		values, err := decodeFloats(info.Dtype, body[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("safetensors tensor %s: %w", name, err)
+		}
+		size := 1
+		for _, dim := range info.Shape {
+			size *= dim
+		}
+		if size != len(values) {
+			return nil, fmt.Errorf("safetensors tensor %s has %d values, expected %d from its shape %v", name, len(values), size, info.Shape)
+		}
+		tensors[name] = Tensor{Shape: info.Shape, Values: values}
+	}
+	return tensors, nil
+}
+
+// decodeFloats decodes little endian float values of a safetensors dtype.
+func decodeFloats(dtype string, data []byte) ([]float32, error) {
+	switch dtype {
+	case "F32":
+		values := make([]float32, len(data)/4)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		}
+		return values, nil
+	case "F16":
+		values := make([]float32, len(data)/2)
+		for i := range values {
+			values[i] = float16ToFloat32(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+		return values, nil
+	case "BF16":
+		values := make([]float32, len(data)/2)
+		for i := range values {
+			values[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(data[2*i:])) << 16)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("dtype %s is not supported", dtype)
+	}
+}
+
+// float16ToFloat32 converts IEEE 754 half precision bits to a float32.
+func float16ToFloat32(bits uint16) float32 {
+	sign := uint32(bits>>15) << 31
+	exponent := uint32(bits>>10) & 0x1f
+	mantissa := uint32(bits) & 0x3ff
+	switch {
+	case exponent == 0x1f:
+		// infinity or NaN
+		return math.Float32frombits(sign | 0xff<<23 | mantissa<<13)
+	case exponent == 0 && mantissa == 0:
+		return math.Float32frombits(sign)
+	case exponent == 0:
+		// subnormal half precision values are normal float32 values
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			return -value
+		}
+		return value
+	default:
+		return math.Float32frombits(sign | (exponent+127-15)<<23 | mantissa<<13)
+	}
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// RankedResult is a document identifier with its retrieval score.
+type RankedResult struct {
+	ID    string
+	Score float32
+}
+
+// sortResults sorts results by descending score, breaking ties by id so that fusion is deterministic.
+func sortResults(results []RankedResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].ID < results[j].ID
+		}
+		return results[i].Score > results[j].Score
+	})
+}
+
+// DenseRanking ranks documents by cosine similarity to the query embedding and returns the topK results
+// (all results if topK <= 0).
+func DenseRanking(query []float32, ids []string, embeddings [][]float32, topK int) ([]RankedResult, error) {
+	if len(ids) != len(embeddings) {
+		return nil, fmt.Errorf("number of ids (%d) does not match number of embeddings (%d)", len(ids), len(embeddings))
+	}
+	results := make([]RankedResult, len(ids))
+	for i, embedding := range embeddings {
+		if len(embedding) != len(query) {
+			return nil, fmt.Errorf("embedding %s has dimension %d, expected %d", ids[i], len(embedding), len(query))
+		}
+		results[i] = RankedResult{ID: ids[i], Score: CosineSimilarity(query, embedding)}
+	}
+	sortResults(results)
+	if topK > 0 && topK < len(results) {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+// ReciprocalRankFusion merges several rankings (each sorted by descending relevance) with reciprocal rank fusion:
+// each document scores the sum over rankings of 1 / (k + rank). Only ranks are used, so rankings with scores on
+// different scales (e.g. BM25 and cosine similarity) can be fused directly. k is typically 60.
+func ReciprocalRankFusion(rankings [][]RankedResult, k float64) []RankedResult {
+	fused := map[string]float64{}
+	for _, ranking := range rankings {
+		for rank, result := range ranking {
+			fused[result.ID] += 1 / (k + float64(rank+1))
+		}
+	}
+	results := make([]RankedResult, 0, len(fused))
+	for id, score := range fused {
+		results = append(results, RankedResult{ID: id, Score: float32(score)})
+	}
+	sortResults(results)
+	return results
+}
+
+// WeightedScoreFusion merges several rankings by a weighted sum of their scores. The scores of each ranking are
+// first min-max normalised to [0, 1] so that they are comparable; documents missing from a ranking get 0 for it.
+func WeightedScoreFusion(rankings [][]RankedResult, weights []float32) ([]RankedResult, error) {
+	if len(rankings) != len(weights) {
+		return nil, errors.New("the number of weights must match the number of rankings")
+	}
+	fused := map[string]float32{}
+	for i, ranking := range rankings {
+		if len(ranking) == 0 {
+			continue
+		}
+		minScore, maxScore := ranking[0].Score, ranking[0].Score
+		for _, result := range ranking {
+			if result.Score < minScore {
+				minScore = result.Score
+			}
+			if result.Score > maxScore {
+				maxScore = result.Score
+			}
+		}
+		for _, result := range ranking {
+			normalised := float32(1)
+			if maxScore > minScore {
+				normalised = (result.Score - minScore) / (maxScore - minScore)
+			}
+			fused[result.ID] += weights[i] * normalised
+		}
+	}
+	results := make([]RankedResult, 0, len(fused))
+	for id, score := range fused {
+		results = append(results, RankedResult{ID: id, Score: score})
+	}
+	sortResults(results)
+	return results, nil
+}
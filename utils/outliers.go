@@ -0,0 +1,173 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// OutlierDetector scores embeddings by how far they are from a reference set, e.g. to let an intent router reject
+// out-of-domain queries. Three methods are supported:
+//   - CENTROID: cosine distance to the centroid of the reference set
+//   - MAHALANOBIS: Mahalanobis distance to the centroid, using a diagonal covariance
+//   - KNN: mean cosine distance to the K nearest reference embeddings
+type OutlierDetector struct {
+	Method    string
+	Centroid  []float32
+	Variance  []float32
+	Reference [][]float32
+	K         int
+	Threshold float32
+}
+
+// FitOutlierDetector fits the statistics of the given method on a reference set of embeddings. k is only used by
+// the KNN method. The threshold is initialised to the 95th percentile of the reference scores, see
+// CalibrateThreshold to change it. The reference embeddings are copied.
+func FitOutlierDetector(reference [][]float32, method string, k int) (*OutlierDetector, error) {
+	if len(reference) < 2 {
+		return nil, errors.New("at least two reference embeddings are required to fit an outlier detector")
+	}
+	dim := len(reference[0])
+	for _, v := range reference {
+		if len(v) != dim {
+			return nil, errors.New("all reference embeddings must have the same dimension")
+		}
+	}
+
+	detector := &OutlierDetector{Method: method}
+	switch method {
+	case "CENTROID", "MAHALANOBIS":
+		centroid := make([]float64, dim)
+		for _, v := range reference {
+			for j, x := range v {
+				centroid[j] += float64(x)
+			}
+		}
+		detector.Centroid = make([]float32, dim)
+		for j := range centroid {
+			centroid[j] /= float64(len(reference))
+			detector.Centroid[j] = float32(centroid[j])
+		}
+		if method == "MAHALANOBIS" {
+			detector.Variance = make([]float32, dim)
+			for j := 0; j < dim; j++ {
+				sum := 0.0
+				for _, v := range reference {
+					d := float64(v[j]) - centroid[j]
+					sum += d * d
+				}
+				// small floor to avoid dividing by zero on constant dimensions
+				detector.Variance[j] = float32(math.Max(sum/float64(len(reference)-1), 1e-12))
+			}
+		}
+	case "KNN":
+		if k <= 0 || k >= len(reference) {
+			return nil, fmt.Errorf("k must be between 1 and %d, got %d", len(reference)-1, k)
+		}
+		detector.K = k
+		detector.Reference = make([][]float32, len(reference))
+		for i, v := range reference {
+			detector.Reference[i] = append([]float32(nil), v...)
+		}
+	default:
+		return nil, fmt.Errorf("outlier detection method %s is not supported", method)
+	}
+
+	if err := detector.CalibrateThreshold(reference, 0.95, true); err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+// Score returns the outlier score of an embedding: the higher, the further from the reference set. The embedding
+// must have the dimension of the reference set.
+func (d *OutlierDetector) Score(v []float32) (float32, error) {
+	if err := d.checkDimension(v); err != nil {
+		return 0, err
+	}
+	return d.score(v, -1), nil
+}
+
+// dimension returns the dimension of the reference embeddings.
+func (d *OutlierDetector) dimension() int {
+	if len(d.Reference) > 0 {
+		return len(d.Reference[0])
+	}
+	return len(d.Centroid)
+}
+
+// checkDimension checks that an embedding has the dimension of the reference set.
+func (d *OutlierDetector) checkDimension(v []float32) error {
+	if len(v) != d.dimension() {
+		return fmt.Errorf("embedding has dimension %d, expected %d", len(v), d.dimension())
+	}
+	return nil
+}
+
+// score computes the outlier score, skipping the reference embedding at index skip for leave-one-out scoring.
+func (d *OutlierDetector) score(v []float32, skip int) float32 {
+	switch d.Method {
+	case "CENTROID":
+		return 1 - CosineSimilarity(v, d.Centroid)
+	case "MAHALANOBIS":
+		sum := 0.0
+		for j, x := range v {
+			diff := float64(x - d.Centroid[j])
+			sum += diff * diff / float64(d.Variance[j])
+		}
+		return float32(math.Sqrt(sum))
+	case "KNN":
+		distances := make([]float32, 0, len(d.Reference))
+		for i, r := range d.Reference {
+			if i == skip {
+				continue
+			}
+			distances = append(distances, 1-CosineSimilarity(v, r))
+		}
+		sort.Slice(distances, func(i, j int) bool { return distances[i] < distances[j] })
+		var sum float32
+		for _, distance := range distances[:d.K] {
+			sum += distance
+		}
+		return sum / float32(d.K)
+	default:
+		return 0
+	}
+}
+
+// IsOutlier reports whether the score of an embedding is above the threshold.
+func (d *OutlierDetector) IsOutlier(v []float32) (bool, error) {
+	score, err := d.Score(v)
+	return score > d.Threshold, err
+}
+
+// CalibrateThreshold sets the threshold to the given quantile (between 0 and 1) of the scores of a set of
+// in-domain embeddings. To calibrate on the reference set itself, set leaveOneOut: with the KNN method, each reference
+// embedding is then scored against the others so that it is not its own nearest neighbour.
+func (d *OutlierDetector) CalibrateThreshold(inDomain [][]float32, quantile float64, leaveOneOut bool) error {
+	if quantile < 0 || quantile > 1 {
+		return fmt.Errorf("quantile must be between 0 and 1, got %f", quantile)
+	}
+	if len(inDomain) == 0 {
+		return errors.New("at least one embedding is required to calibrate the threshold")
+	}
+	skipOwn := leaveOneOut && d.Method == "KNN"
+	if skipOwn && len(inDomain) != len(d.Reference) {
+		return fmt.Errorf("leave-one-out calibration expects the %d reference embeddings, got %d embeddings", len(d.Reference), len(inDomain))
+	}
+	scores := make([]float32, len(inDomain))
+	for i, v := range inDomain {
+		if err := d.checkDimension(v); err != nil {
+			return fmt.Errorf("embedding %d: %w", i, err)
+		}
+		skip := -1
+		if skipOwn {
+			skip = i
+		}
+		scores[i] = d.score(v, skip)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i] < scores[j] })
+	d.Threshold = scores[int(math.Round(quantile*float64(len(scores)-1)))]
+	return nil
+}
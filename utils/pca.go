@@ -0,0 +1,181 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// PCA holds a linear projection (principal components, optionally whitened) that reduces the dimensionality
+// of embeddings. It can be fitted with FitPCA, or loaded from a json file exported from e.g. scikit-learn.
+type PCA struct {
+	Mean              []float32   `json:"mean"`
+	Components        [][]float32 `json:"components"`
+	ExplainedVariance []float32   `json:"explained_variance"`
+	Whiten            bool        `json:"whiten"`
+}
+
+// InputDim is the dimension of the vectors the projection applies to.
+func (p *PCA) InputDim() int {
+	return len(p.Mean)
+}
+
+// OutputDim is the dimension of the projected vectors.
+func (p *PCA) OutputDim() int {
+	return len(p.Components)
+}
+
+// Validate checks that the dimensions of the projection are consistent.
+func (p *PCA) Validate() error {
+	if len(p.Components) == 0 {
+		return errors.New("pca projection has no components")
+	}
+	for i, component := range p.Components {
+		if len(component) != len(p.Mean) {
+			return fmt.Errorf("pca component %d has dimension %d, expected %d", i, len(component), len(p.Mean))
+		}
+	}
+	if p.Whiten && len(p.ExplainedVariance) != len(p.Components) {
+		return errors.New("pca whitening requires one explained variance value per component")
+	}
+	return nil
+}
+
+// Transform projects a single vector onto the principal components.
+func (p *PCA) Transform(vector []float32) []float32 {
+	projected := make([]float32, len(p.Components))
+	for i, component := range p.Components {
+		var sum float32
+		for j, v := range vector {
+			sum += (v - p.Mean[j]) * component[j]
+		}
+		if p.Whiten && p.ExplainedVariance[i] > 0 {
+			sum /= float32(math.Sqrt(float64(p.ExplainedVariance[i])))
+		}
+		projected[i] = sum
+	}
+	return projected
+}
+
+// FitPCA fits a PCA projection with nComponents components on a sample of vectors. The components are
+// computed with power iteration and deflation on the covariance matrix, which is accurate enough for the
+// leading components of embedding spaces. If whiten is true, the projected vectors have unit variance. An error
+// is returned if the sample has fewer dimensions of variance than nComponents, e.g. with fewer vectors than
+// components, since the remaining components would be arbitrary.
+func FitPCA(vectors [][]float32, nComponents int, whiten bool) (*PCA, error) {
+	if len(vectors) < 2 {
+		return nil, errors.New("at least two vectors are required to fit a pca projection")
+	}
+	dim := len(vectors[0])
+	if nComponents <= 0 || nComponents > dim {
+		return nil, fmt.Errorf("number of components must be between 1 and %d, got %d", dim, nComponents)
+	}
+
+	mean := make([]float64, dim)
+	for _, vector := range vectors {
+		if len(vector) != dim {
+			return nil, errors.New("all vectors must have the same dimension to fit a pca projection")
+		}
+		for j, v := range vector {
+			mean[j] += float64(v)
+		}
+	}
+	for j := range mean {
+		mean[j] /= float64(len(vectors))
+	}
+
+	covariance := make([][]float64, dim)
+	for i := range covariance {
+		covariance[i] = make([]float64, dim)
+	}
+	centered := make([]float64, dim)
+	for _, vector := range vectors {
+		for j, v := range vector {
+			centered[j] = float64(v) - mean[j]
+		}
+		for i := 0; i < dim; i++ {
+			for j := i; j < dim; j++ {
+				covariance[i][j] += centered[i] * centered[j]
+			}
+		}
+	}
+	totalVariance := 0.0
+	for i := 0; i < dim; i++ {
+		for j := i; j < dim; j++ {
+			covariance[i][j] /= float64(len(vectors) - 1)
+			covariance[j][i] = covariance[i][j]
+		}
+		totalVariance += covariance[i][i]
+	}
+
+	pca := &PCA{
+		Mean:              make([]float32, dim),
+		Components:        make([][]float32, nComponents),
+		ExplainedVariance: make([]float32, nComponents),
+		Whiten:            whiten,
+	}
+	for j, m := range mean {
+		pca.Mean[j] = float32(m)
+	}
+
+	for c := 0; c < nComponents; c++ {
+		component, eigenvalue := powerIteration(covariance)
+		// once the variance is exhausted, what is left of the deflated covariance is rounding noise
+		if eigenvalue <= 1e-9*totalVariance {
+			return nil, fmt.Errorf("cannot fit %d pca components: the vectors only vary along %d dimensions", nComponents, c)
+		}
+		pca.Components[c] = make([]float32, dim)
+		for j, v := range component {
+			pca.Components[c][j] = float32(v)
+		}
+		pca.ExplainedVariance[c] = float32(eigenvalue)
+		// deflate so that the next iteration finds the next component
+		for i := 0; i < dim; i++ {
+			for j := 0; j < dim; j++ {
+				covariance[i][j] -= eigenvalue * component[i] * component[j]
+			}
+		}
+	}
+	return pca, nil
+}
+
+// powerIteration finds the dominant eigenvector and eigenvalue of a symmetric matrix. The eigenvector is nil if
+// the matrix is zero.
+func powerIteration(matrix [][]float64) ([]float64, float64) {
+	dim := len(matrix)
+	vector := make([]float64, dim)
+	for i := range vector {
+		// deterministic, non-degenerate starting point
+		vector[i] = 1 / math.Sqrt(float64(dim)) * (1 + float64(i%7)/10)
+	}
+	next := make([]float64, dim)
+	eigenvalue := 0.0
+	for iteration := 0; iteration < 1000; iteration++ {
+		for i := 0; i < dim; i++ {
+			sum := 0.0
+			for j := 0; j < dim; j++ {
+				sum += matrix[i][j] * vector[j]
+			}
+			next[i] = sum
+		}
+		norm := 0.0
+		for _, v := range next {
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		if norm == 0 {
+			return nil, 0
+		}
+		delta := 0.0
+		for i := range next {
+			next[i] /= norm
+			delta += math.Abs(next[i] - vector[i])
+		}
+		vector, next = next, vector
+		eigenvalue = norm
+		if delta < 1e-9 {
+			break
+		}
+	}
+	return vector, eigenvalue
+}
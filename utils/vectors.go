@@ -89,3 +89,96 @@ func Normalize(embedding []float32, p int) []float32 {
 	}
 	return embedding
 }
+
+// Dot product of two vectors of the same length.
+func Dot(a []float32, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// CosineSimilarity of two vectors of the same length. Returns 0 if either vector is all zeros.
+func CosineSimilarity(a []float32, b []float32) float32 {
+	normA := Norm(a, 2)
+	normB := Norm(b, 2)
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(float64(Dot(a, b)) / (normA * normB))
+}
+
+// MaxSim is the late interaction score of ColBERT: the sum, over the query token embeddings, of their maximum
+// similarity (dot product) with the document token embeddings. Embeddings are expected to be normalized.
+func MaxSim(query [][]float32, document [][]float32) float32 {
+	var score float32
+	for _, q := range query {
+		best := float32(math.Inf(-1))
+		for _, d := range document {
+			if similarity := Dot(q, d); similarity > best {
+				best = similarity
+			}
+		}
+		if len(document) > 0 {
+			score += best
+		}
+	}
+	return score
+}
+
+// QuantizeInt8 quantizes a vector to int8 values with a symmetric scale, the maximum absolute value of the vector
+// divided by 127: the vector is approximately the quantized vector times the scale. The scale of a zero vector is 0.
+func QuantizeInt8(vector []float32) ([]int8, float32) {
+	var maxAbs float64
+	for _, v := range vector {
+		maxAbs = math.Max(maxAbs, math.Abs(float64(v)))
+	}
+	quantized := make([]int8, len(vector))
+	if maxAbs == 0 {
+		return quantized, 0
+	}
+	scale := maxAbs / 127
+	for i, v := range vector {
+		quantized[i] = int8(math.Max(-127, math.Min(127, math.Round(float64(v)/scale))))
+	}
+	return quantized, float32(scale)
+}
+
+// QuantizeBinary quantizes a vector to its sign bits, 1 for the positive values, packed in bytes with the first
+// value as the most significant bit, as the ubinary precision of sentence-transformers. The last byte is padded
+// with zeros.
+func QuantizeBinary(vector []float32) []byte {
+	packed := make([]byte, (len(vector)+7)/8)
+	for i, v := range vector {
+		if v > 0 {
+			packed[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return packed
+}
+
+// Entropy returns the Shannon entropy in nats of a probability distribution, 0 when the distribution is certain.
+func Entropy(distribution []float32) float64 {
+	var entropy float64
+	for _, p := range distribution {
+		if p > 0 {
+			entropy -= float64(p) * math.Log(float64(p))
+		}
+	}
+	return entropy
+}
+
+// Margin returns the difference between the two highest probabilities of a distribution, small when the model
+// hesitates between two labels. The margin of a distribution with a single value is that value.
+func Margin(distribution []float32) float32 {
+	var first, second float32
+	for _, p := range distribution {
+		if p > first {
+			first, second = p, first
+		} else if p > second {
+			second = p
+		}
+	}
+	return first - second
+}